@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// apiBook is the JSON form of a book served by the API. Contributors, tags
+// and genres are only set where the database loads them.
+type apiBook struct {
+	ID            int64             `json:"id"`
+	Title         string            `json:"title"`
+	Author        string            `json:"author"`
+	ImageURL      string            `json:"imageUrl,omitempty"`
+	Description   string            `json:"description,omitempty"`
+	PublishedDate string            `json:"publishedDate,omitempty"`
+	ISBN10        string            `json:"isbn10,omitempty"`
+	ISBN13        string            `json:"isbn13,omitempty"`
+	Contributors  []*apiContributor `json:"contributors,omitempty"`
+	Tags          []string          `json:"tags,omitempty"`
+	Genres        []string          `json:"genres,omitempty"`
+	RatingCount   int               `json:"ratingCount"`
+	Rating        float64           `json:"rating,omitempty"`
+	CreatedAt     *time.Time        `json:"createdAt,omitempty"`
+	UpdatedAt     *time.Time        `json:"updatedAt,omitempty"`
+	DeletedAt     *time.Time        `json:"deletedAt,omitempty"`
+	DeletedBy     string            `json:"deletedBy,omitempty"`
+}
+
+func toAPIBook(b *bookshelf.Book) *apiBook {
+	a := &apiBook{
+		ID:       b.ID,
+		Title:    b.Title,
+		Author:   b.Author,
+		ImageURL: b.ImageURL,
+		ISBN10:   b.ISBN10,
+		ISBN13:   b.ISBN13,
+		Tags:     b.Tags,
+		Genres:   b.Genres,
+
+		Description:   b.Description,
+		PublishedDate: b.PublishedDate,
+		RatingCount:   b.RatingCount,
+		Rating:        b.AverageRating(),
+	}
+	for _, c := range b.Contributors {
+		a.Contributors = append(a.Contributors, &apiContributor{AuthorID: c.AuthorID, Name: c.Name, Role: c.Role})
+	}
+	if !b.CreatedAt.IsZero() {
+		a.CreatedAt = &b.CreatedAt
+	}
+	if !b.UpdatedAt.IsZero() {
+		a.UpdatedAt = &b.UpdatedAt
+	}
+	if !b.DeletedAt.IsZero() {
+		a.DeletedAt = &b.DeletedAt
+		a.DeletedBy = b.DeletedBy
+	}
+	return a
+}
+
+// apiContributor is the JSON form of a book's contributor.
+type apiContributor struct {
+	AuthorID int64  `json:"authorId"`
+	Name     string `json:"name"`
+	Role     string `json:"role"`
+}
+
+func toAPIBooks(books []*bookshelf.Book) []*apiBook {
+	a := make([]*apiBook, len(books))
+	for i, b := range books {
+		a[i] = toAPIBook(b)
+	}
+	return a
+}
+
+// apiChange is the JSON form of an entry in a book's history.
+type apiChange struct {
+	ID      int64                   `json:"id"`
+	BookID  int64                   `json:"bookId"`
+	Action  string                  `json:"action"`
+	ActorID string                  `json:"actorId,omitempty"`
+	Actor   string                  `json:"actor"`
+	Source  string                  `json:"source"`
+	Time    time.Time               `json:"time"`
+	Diff    []bookshelf.FieldChange `json:"diff,omitempty"`
+}
+
+func toAPIChanges(changes []*bookshelf.BookChange) []*apiChange {
+	a := make([]*apiChange, len(changes))
+	for i, c := range changes {
+		a[i] = &apiChange{
+			ID:      c.ID,
+			BookID:  c.BookID,
+			Action:  c.Action,
+			ActorID: c.Actor.ID,
+			Actor:   c.Actor.Name,
+			Source:  c.Actor.Source,
+			Time:    c.Time,
+			Diff:    c.Diff,
+		}
+	}
+	return a
+}
+
+// writeJSON replies with v encoded as JSON.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("could not encode response: %v", err)
+	}
+}
+
+// apiError logs err and replies with a JSON error and the status
+// errorStatus maps it to.
+func apiError(w http.ResponseWriter, err error) {
+	status := errorStatus(err)
+	log.Printf("database error (%d): %v", status, err)
+	writeJSON(w, status, map[string]string{"error": http.StatusText(status)})
+}
+
+// apiID parses the id route variable, replying with 400 if it is not a
+// number.
+func apiID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid book id"})
+		return 0, false
+	}
+	return id, true
+}
+
+// apiTrashHandler lists the books in the trash.
+func apiTrashHandler(w http.ResponseWriter, r *http.Request) {
+	books, err := database(r).ListDeletedBooks()
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIBooks(books))
+}
+
+// apiRestoreHandler takes a book out of the trash.
+func apiRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r)
+	if !ok {
+		return
+	}
+	if err := restoreBook(id, actorFromRequest(r, bookshelf.SourceAPI)); err != nil {
+		apiError(w, err)
+		return
+	}
+	markWrite(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiPurgeHandler permanently removes a book from the trash. Like the trash
+// page, it needs a logged in user.
+func apiPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r)
+	if !ok {
+		return
+	}
+	if profileFromSession(r) == nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "log in to purge books"})
+		return
+	}
+	if err := purgeBook(r.Context(), id, actorFromRequest(r, bookshelf.SourceAPI)); err != nil {
+		apiError(w, err)
+		return
+	}
+	markWrite(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiHistoryHandler lists the changes made to a book, newest first.
+func apiHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r)
+	if !ok {
+		return
+	}
+	changes, err := database(r).BookHistory(id)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIChanges(changes))
+}
+
+// apiRollbackHandler restores a book to the version left by the change
+// given in the change parameter, and replies with the restored book.
+func apiRollbackHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r)
+	if !ok {
+		return
+	}
+	changeID, err := strconv.ParseInt(r.FormValue("change"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid change id"})
+		return
+	}
+	book, err := bookshelf.RollbackBook(bookshelf.DB, id, changeID, actorFromRequest(r, bookshelf.SourceAPI))
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	go publishEvent(bookshelf.BookUpdated, id)
+	markWrite(w, r)
+	writeJSON(w, http.StatusOK, toAPIBook(book))
+}
+
+// apiAuditHandler serves the audit log to admins, filtered like the audit
+// page.
+func apiAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": http.StatusText(http.StatusForbidden)})
+		return
+	}
+	q, err := auditQuery(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	changes, err := bookshelf.DB.AuditLog(q)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIChanges(changes))
+}
+
+func registerAPIHandlers(r *mux.Router) {
+	r.HandleFunc("/trash", apiTrashHandler).Methods("GET")
+	r.HandleFunc("/trash/{id:[0-9]+}/restore", apiRestoreHandler).Methods("POST")
+	r.HandleFunc("/trash/{id:[0-9]+}", apiPurgeHandler).Methods("DELETE")
+	r.HandleFunc("/books/{id:[0-9]+}/history", apiHistoryHandler).Methods("GET")
+	r.HandleFunc("/books/{id:[0-9]+}/rollback", apiRollbackHandler).Methods("POST")
+	r.HandleFunc("/audit", apiAuditHandler).Methods("GET")
+	r.HandleFunc("/duplicates", apiDuplicatesHandler).Methods("GET")
+	r.HandleFunc("/books/{id:[0-9]+}/merge", apiMergeHandler).Methods("POST")
+	r.HandleFunc("/import", apiImportHandler).Methods("POST")
+	r.HandleFunc("/import/shelves", apiShelfImportHandler).Methods("POST")
+	r.HandleFunc("/import/{id:[0-9a-f-]+}", apiImportStatusHandler).Methods("GET")
+	r.HandleFunc("/authors", apiAuthorsHandler).Methods("GET")
+	r.HandleFunc("/suggest", apiSuggestHandler).Methods("GET")
+	r.HandleFunc("/books", apiBooksHandler).Methods("GET")
+	r.HandleFunc("/books/isbn", apiAddByISBNHandler).Methods("POST")
+	r.HandleFunc("/metadata/{isbn}", apiMetadataHandler).Methods("GET")
+	r.HandleFunc("/search", apiSearchHandler).Methods("GET")
+	r.HandleFunc("/tags", apiTagsHandler).Methods("GET")
+	r.HandleFunc("/shelves", apiShelvesHandler).Methods("GET")
+	r.HandleFunc("/readings", apiReadingsHandler).Methods("GET")
+	r.HandleFunc("/books/{id:[0-9]+}/reading", apiGetReadingHandler).Methods("GET")
+	r.HandleFunc("/books/{id:[0-9]+}/reading", apiPutReadingHandler).Methods("PUT")
+	r.HandleFunc("/books/{id:[0-9]+}/reading", apiDeleteReadingHandler).Methods("DELETE")
+	r.HandleFunc("/books/{id:[0-9]+}/copies", apiCopiesHandler).Methods("GET")
+	r.HandleFunc("/books/{id:[0-9]+}/copies", apiAddCopyHandler).Methods("POST")
+	r.HandleFunc("/books/{id:[0-9]+}/copies/{copyId:[0-9]+}", apiRemoveCopyHandler).Methods("DELETE")
+	r.HandleFunc("/books/{id:[0-9]+}/checkout", apiCheckOutHandler).Methods("POST")
+	r.HandleFunc("/books/{id:[0-9]+}/loans/{loanId:[0-9]+}/return", apiReturnHandler).Methods("POST")
+	r.HandleFunc("/books/{id:[0-9]+}/hold", apiPlaceHoldHandler).Methods("POST")
+	r.HandleFunc("/books/{id:[0-9]+}/hold", apiCancelHoldHandler).Methods("DELETE")
+	r.HandleFunc("/loans", apiLoansHandler).Methods("GET")
+	r.HandleFunc("/reviews", apiReviewsHandler).Methods("GET")
+	r.HandleFunc("/books/{id:[0-9]+}/review", apiGetReviewHandler).Methods("GET")
+	r.HandleFunc("/books/{id:[0-9]+}/review", apiPutReviewHandler).Methods("PUT")
+	r.HandleFunc("/books/{id:[0-9]+}/review", apiDeleteReviewHandler).Methods("DELETE")
+	r.HandleFunc("/books/{id:[0-9]+}/reviews/{userId}", apiDeleteReviewHandler).Methods("DELETE")
+	r.HandleFunc("/webhooks", apiWebhooksHandler).Methods("GET")
+	r.HandleFunc("/webhooks", apiAddWebhookHandler).Methods("POST")
+	r.HandleFunc("/webhooks/{id:[0-9]+}", apiWebhookHandler).Methods("GET")
+	r.HandleFunc("/webhooks/{id:[0-9]+}", apiUpdateWebhookHandler).Methods("PUT")
+	r.HandleFunc("/webhooks/{id:[0-9]+}", apiDeleteWebhookHandler).Methods("DELETE")
+	r.HandleFunc("/webhooks/{id:[0-9]+}/deliveries", apiDeliveriesHandler).Methods("GET")
+	r.HandleFunc("/webhooks/{id:[0-9]+}/test", apiTestWebhookHandler).Methods("POST")
+}
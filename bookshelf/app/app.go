@@ -2,20 +2,18 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
+	"html"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"strconv"
+	"strings"
+	"time"
 
-	"cloud.google.com/go/pubsub"
-	"cloud.google.com/go/storage"
-
-	uuid "github.com/gofrs/uuid"
 	"github.com/gorilla/mux"
 	"github.com/tony-yang/google-cloud-stack/bookshelf"
 )
@@ -24,13 +22,78 @@ var (
 	UserProfile *Profile
 )
 
+const (
+	pinSessionID        = "pin"
+	lastWriteSessionKey = "last_write"
+)
+
+// markWrite records that the user just changed a book, so database sends
+// their reads to the primary until the replicas have caught up.
+func markWrite(w http.ResponseWriter, r *http.Request) {
+	session, err := bookshelf.SessionStore.Get(r, pinSessionID)
+	if err != nil {
+		log.Printf("markWrite: replacing pin session: %v", err)
+	}
+	session.Values[lastWriteSessionKey] = time.Now().Unix()
+	session.Options.MaxAge = int(bookshelf.ReadYourWritesWindow / time.Second)
+	if err := session.Save(r, w); err != nil {
+		log.Printf("markWrite: could not save pin session: %v", err)
+	}
+}
+
+// database returns the BookDatabase to read from for r: the primary for a
+// user who wrote within bookshelf.ReadYourWritesWindow, so they see their
+// own change, and otherwise bookshelf.DB with its replicas and cache.
+func database(r *http.Request) bookshelf.BookDatabase {
+	session, err := bookshelf.SessionStore.Get(r, pinSessionID)
+	if err != nil {
+		return bookshelf.DB
+	}
+	if t, ok := session.Values[lastWriteSessionKey].(int64); ok && time.Since(time.Unix(t, 0)) < bookshelf.ReadYourWritesWindow {
+		return bookshelf.ReadPrimary(bookshelf.DB)
+	}
+	return bookshelf.DB
+}
+
+// errForbidden is returned for changes the logged in user may not make.
+var errForbidden = errors.New("not allowed for this user")
+
+// errorStatus maps an error from bookshelf.DB to the HTTP status to report.
+// Anything that is not a known bookshelf error is treated as the database
+// being unavailable.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, bookshelf.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, bookshelf.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, bookshelf.ErrInvalid):
+		return http.StatusBadRequest
+	}
+	return http.StatusServiceUnavailable
+}
+
+// dbError logs err and replies with the status errorStatus maps it to.
+func dbError(w http.ResponseWriter, err error) {
+	status := errorStatus(err)
+	log.Printf("database error (%d): %v", status, err)
+	http.Error(w, http.StatusText(status), status)
+}
+
 // listHandler displays a list with summaries of books in the database.
 func listHandler(w http.ResponseWriter, r *http.Request) {
 	UserProfile = profileFromSession(r)
 
-	books, err := bookshelf.DB.ListBooks()
+	f := bookFilter(r)
+	books, err := filterBooks(database(r), f)
+	var avail map[int64]bookshelf.Availability
+	if err == nil {
+		avail, err = database(r).Availability()
+	}
 	if err != nil {
-		fmt.Fprintf(w, err.Error())
+		dbError(w, err)
 	} else {
 		bookResult := "<div><a href='login?redirect=books'>Login</a></div><div><a href='logout?redirect=books'>Logout</a></div>"
 
@@ -38,14 +101,58 @@ func listHandler(w http.ResponseWriter, r *http.Request) {
 			fmt.Println("User profile has something =", UserProfile)
 			bookResult += fmt.Sprintf("name = %s", UserProfile.DisplayName)
 		}
-
-		for _, book := range books {
-			deleteForm := fmt.Sprintf("<form method='post' action='/books/%d/delete'><input type='submit' value='Delete'></form>", book.ID)
-			bookResult = bookResult + "<br>" + book.String() + deleteForm
+		bookResult += searchForm(f)
+		bookResult += "<div><a href='/books/trash'>Trash</a> <a href='/tags'>Tags</a> <a href='/shelves'>My shelves</a> <a href='/loans'>My loans</a> <a href='/webhooks'>Webhooks</a></div>"
+		bookResult += "<div><a href='/books/import'>Import CSV</a> <a href='/books/export.csv'>Export CSV</a></div>"
+		feedParams := url.Values{}
+		if tag := bookshelf.NormalizeTag(f.Tag); tag != "" {
+			feedParams.Set("tag", tag)
 		}
+		bookResult += feedLinks(feedParams)
+
+		bookResult += bookList(books, avail)
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		fmt.Fprintf(w, string(bookResult))
+		fmt.Fprint(w, bookResult)
+	}
+}
+
+// searchForm renders the search box, filled in with f.
+func searchForm(f bookshelf.BookFilter) string {
+	return fmt.Sprintf(`<form method="get" action="/books/search">
+		<input name="q" value="%s"> <input name="tag" value="%s" placeholder="Tag">
+		<select name="genre">%s</select><select name="sort">%s</select><input type="submit" value="Search">
+		<a href="/search">Full-text search</a>
+	</form>`, html.EscapeString(f.Query), html.EscapeString(f.Tag), genreOptions(f.Genre), sortOptions(f.Sort))
+}
+
+// bookList renders books, with their ratings and how many copies of each
+// are available, and a delete button for each. Deleting asks for
+// confirmation, and the book can be restored from the trash.
+func bookList(books []*bookshelf.Book, avail map[int64]bookshelf.Availability) string {
+	result := ""
+	for _, book := range books {
+		deleteForm := fmt.Sprintf("<form method='post' action='/books/%d/delete' onsubmit='return confirm(\"Move this book to the trash?\")'><input type='submit' value='Delete'></form>", book.ID)
+		result = result + "<br>" + html.EscapeString(book.String()+ratingNote(book)+availabilityNote(avail[book.ID])) + deleteForm
+	}
+	return result
+}
+
+// searchHandler displays the books whose title or author match a query,
+// narrowed to a tag or genre if one is given.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	f := bookFilter(r)
+	books, err := filterBooks(database(r), f)
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	avail, err := database(r).Availability()
+	if err != nil {
+		dbError(w, err)
+		return
 	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, searchForm(f)+bookList(books, avail))
 }
 
 // detailHandler displays the details of a given book.
@@ -53,13 +160,80 @@ func detailHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
 		http.Redirect(w, r, fmt.Sprintf("/books"), http.StatusFound)
+		return
 	}
-	book, err := bookshelf.DB.GetBook(id)
+	db := database(r)
+	book, err := db.GetBook(id)
 	if err != nil {
-		http.Redirect(w, r, fmt.Sprintf("/books"), http.StatusFound)
+		dbError(w, err)
+		return
+	}
+	history, err := db.BookHistory(id)
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	lending, err := lendingSection(r, id)
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	reviews, err := reviewsSection(r, book)
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	result := html.EscapeString(book.String()) + contributorLinks(book) + tagLinks(book)
+	if book.PublishedDate != "" {
+		result += "<p>Published " + html.EscapeString(book.PublishedDate) + "</p>"
 	}
+	if book.Description != "" {
+		result += "<p>" + strings.Replace(html.EscapeString(book.Description), "\n", "<br>", -1) + "</p>"
+	}
+	result += lending
+	if profileFromSession(r) != nil {
+		reading, err := userReading(r, id)
+		if err != nil {
+			dbError(w, err)
+			return
+		}
+		result += readingForm(id, reading)
+	}
+	result += reviews
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, result+historyList(id, history))
+}
 
-	fmt.Fprintf(w, book.String())
+// historyList renders the history of a book, newest first, with a button
+// to roll back to each earlier version.
+func historyList(id int64, history []*bookshelf.BookChange) string {
+	result := "<h3>History</h3><ul>"
+	for i, c := range history {
+		line := fmt.Sprintf("%s: %s by %s (%s)", c.Time.Format("2006-01-02 15:04 MST"), c.Action, c.Actor.Name, c.Actor.Source)
+		for _, d := range c.Diff {
+			line += fmt.Sprintf("; %s: %q to %q", d.Field, d.Old, d.New)
+		}
+		result += "<li>" + html.EscapeString(line)
+		if i > 0 && len(c.Diff) > 0 {
+			result += fmt.Sprintf(`<form method="post" action="/books/%d/rollback" onsubmit="return confirm('Roll back to this version?')">
+				<input type="hidden" name="change" value="%d"><input type="submit" value="Roll back to this version">
+			</form>`, id, c.ID)
+		}
+		result += "</li>"
+	}
+	return result + "</ul>"
+}
+
+// isbnHandler redirects to the book with the ISBN-10 or ISBN-13 in the
+// path.
+func isbnHandler(w http.ResponseWriter, r *http.Request) {
+	book, err := database(r).GetBookByISBN(mux.Vars(r)["isbn"])
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/books/%d", book.ID), http.StatusFound)
 }
 
 // addBookHandler displays a form that captures details of a new book to add.
@@ -73,6 +247,19 @@ func addBookHandler(w http.ResponseWriter, r *http.Request) {
 			<label for="author">Author</label>
 			<input class="form-control" name="author" id="author">
 		</div>
+		<div class="form-group">
+			<label for="isbn">ISBN</label>
+			<input class="form-control" name="isbn" id="isbn">
+		</div>
+		<div class="form-group">
+			<label for="publishedDate">Published</label>
+			<input class="form-control" name="publishedDate" id="publishedDate" placeholder="YYYY-MM-DD">
+		</div>
+		<div class="form-group">
+			<label for="description">Description</label>
+			<textarea class="form-control" name="description" id="description"></textarea>
+		</div>
+		` + tagFormGroups(&bookshelf.Book{}) + `
 		<div class="form-group">
 			<label for="image">Cover Image</label>
 			<input class="form-control" name="image" id="image" type="file">
@@ -81,7 +268,7 @@ func addBookHandler(w http.ResponseWriter, r *http.Request) {
 	</form>
 	`
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	fmt.Fprintf(w, FORM)
+	fmt.Fprint(w, "<div><a href='/books/add/isbn'>Add by ISBN</a></div>"+FORM+bookAutocomplete)
 }
 
 func uploadCover(r *http.Request) (url string, err error) {
@@ -94,39 +281,27 @@ func uploadCover(r *http.Request) (url string, err error) {
 		return "", err
 	}
 
-	if bookshelf.StorageBucket == nil {
-		fmt.Println("app.go: uploadCover storage bucket is missing")
-		return "", errors.New("storage bucket is missing - check config.go")
-	}
-
-	name := uuid.Must(uuid.NewV4()).String() + path.Ext(fileHeader.Filename)
-	ctx := context.Background()
-	w := bookshelf.StorageBucket.Object(name).NewWriter(ctx)
-
-	w.ACL = []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}}
-	w.ContentType = fileHeader.Header.Get("Content-Type")
-
-	w.CacheControl = "public, max-age=86400"
-
-	if _, err := io.Copy(w, f); err != nil {
-		fmt.Printf("app.go: uploadCover: io copy failed %v\n", err)
-		return "", err
-	}
-	if err := w.Close(); err != nil {
-		fmt.Printf("app.go: uploadCover: close failed %v\n", err)
+	url, err = bookshelf.StoreCover(context.Background(), f, fileHeader.Header.Get("Content-Type"), path.Ext(fileHeader.Filename))
+	if err != nil {
+		fmt.Printf("app.go: uploadCover: %v\n", err)
 		return "", err
 	}
-
-	const publicURL = "https://storage.googleapis.com/%s/%s"
-	return fmt.Sprintf(publicURL, bookshelf.StorageBucketName, name), nil
+	return url, nil
 }
 
 // createHandler adds a book to the database
 func createHandler(w http.ResponseWriter, r *http.Request) {
 	book := &bookshelf.Book{
-		Title:  r.FormValue("title"),
-		Author: r.FormValue("author"),
+		Title:         r.FormValue("title"),
+		Author:        r.FormValue("author"),
+		Description:   r.FormValue("description"),
+		PublishedDate: r.FormValue("publishedDate"),
 	}
+	if err := book.SetISBN(r.FormValue("isbn")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	setTags(r, book)
 
 	imageURL, err := uploadCover(r)
 	if err != nil {
@@ -136,12 +311,15 @@ func createHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("createHandler: image URL =", imageURL)
 	book.ImageURL = imageURL
 
-	id, err := bookshelf.DB.AddBook(book)
+	id, err := bookshelf.DB.AddBook(book, actorFromRequest(r, bookshelf.SourceHTML))
 	if err != nil {
 		fmt.Printf("createHandler failed to add book: %v\n", err)
-		http.Redirect(w, r, fmt.Sprintf("/books"), http.StatusFound)
+		dbError(w, err)
+		return
 	}
 	go publishUpdate(id)
+	go publishEvent(bookshelf.BookCreated, id)
+	markWrite(w, r)
 	http.Redirect(w, r, fmt.Sprintf("/books/%d", id), http.StatusFound)
 }
 
@@ -149,11 +327,13 @@ func editHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
 		http.Redirect(w, r, fmt.Sprintf("/books"), http.StatusFound)
+		return
 	}
 
-	book, err := bookshelf.DB.GetBook(id)
+	book, err := database(r).GetBook(id)
 	if err != nil {
-		http.Redirect(w, r, fmt.Sprintf("/books"), http.StatusFound)
+		dbError(w, err)
+		return
 	}
 
 	FORM := fmt.Sprintf(`<form method="post" enctype="multipart/form-data" action="/books/%d">	
@@ -169,80 +349,393 @@ func editHandler(w http.ResponseWriter, r *http.Request) {
 			<label for="author">Author</label>
 			<input class="form-control" name="author" id="author" value="%s">
 		</div>
+		<div class="form-group">
+			<label for="isbn">ISBN</label>
+			<input class="form-control" name="isbn" id="isbn" value="%s">
+		</div>
+		<div class="form-group">
+			<label for="publishedDate">Published</label>
+			<input class="form-control" name="publishedDate" id="publishedDate" value="%s" placeholder="YYYY-MM-DD">
+		</div>
+		<div class="form-group">
+			<label for="description">Description</label>
+			<textarea class="form-control" name="description" id="description">%s</textarea>
+		</div>
+		%s
 		<div class="form-group">
 			<label for="image">Cover Image</label>
 			<input class="form-control" name="image" id="image" type="file">
 		</div>
 		<input type="submit" name="submit" id="submit" value="Submit">
-	</form>`, book.ID, book.ID, book.Title, book.Author)
+	</form>`, book.ID, book.ID, html.EscapeString(book.Title), html.EscapeString(book.Author),
+		html.EscapeString(book.ISBN13), html.EscapeString(book.PublishedDate), html.EscapeString(book.Description),
+		tagFormGroups(book))
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	fmt.Fprintf(w, FORM)
+	fmt.Fprint(w, FORM+bookAutocomplete)
 }
 
 // updateHandler updates a given book with id
 func updateHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
-		fmt.Println("update handler parse id error: %v", err)
+		fmt.Printf("update handler parse id error: %v\n", err)
 		http.Redirect(w, r, fmt.Sprintf("/books"), http.StatusFound)
+		return
 	}
-	book := &bookshelf.Book{
-		ID:     id,
-		Title:  r.FormValue("title"),
-		Author: r.FormValue("author"),
+	// Start from the stored book so fields the form leaves out, such as
+	// the cover when no new one is uploaded, are kept.
+	book, err := bookshelf.ReadPrimary(bookshelf.DB).GetBook(id)
+	if err != nil {
+		dbError(w, err)
+		return
 	}
-	err = bookshelf.DB.UpdateBook(book)
+	book.Title = r.FormValue("title")
+	book.Author = r.FormValue("author")
+	book.Description = r.FormValue("description")
+	book.PublishedDate = r.FormValue("publishedDate")
+	if err := book.SetISBN(r.FormValue("isbn")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	setTags(r, book)
+	imageURL, err := uploadCover(r)
 	if err != nil {
-		http.Redirect(w, r, fmt.Sprintf("/books"), http.StatusFound)
+		fmt.Printf("updateHandler failed to upload cover: %v\n", err)
+	} else if imageURL != "" {
+		book.ImageURL = imageURL
+	}
+	err = bookshelf.DB.UpdateBook(book, actorFromRequest(r, bookshelf.SourceHTML))
+	if err != nil {
+		dbError(w, err)
+		return
 	}
 	go publishUpdate(id)
+	go publishEvent(bookshelf.BookUpdated, id)
+	markWrite(w, r)
 	http.Redirect(w, r, fmt.Sprintf("/books/%d", id), http.StatusFound)
 }
 
-// deletHandler deletes a given book
+// deletHandler moves a given book to the trash
 func deleteHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
-		fmt.Println("delete handler parse id error: %v", err)
+		fmt.Printf("delete handler parse id error: %v\n", err)
 		http.Redirect(w, r, fmt.Sprintf("/books"), http.StatusFound)
+		return
+	}
+	if err := bookshelf.DB.DeleteBook(id, actorFromRequest(r, bookshelf.SourceHTML)); err != nil {
+		dbError(w, err)
+		return
 	}
-	bookshelf.DB.DeleteBook(id)
+	go publishEvent(bookshelf.BookDeleted, id)
+	markWrite(w, r)
 	http.Redirect(w, r, fmt.Sprintf("/books"), http.StatusFound)
 }
 
-func publishUpdate(bookID int64) {
-	if bookshelf.PubsubClient == nil {
+// trashHandler lists the deleted books, with buttons to restore or purge
+// each of them.
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	books, err := database(r).ListDeletedBooks()
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	result := "<div><a href='/books'>Back to books</a></div>"
+	if len(books) == 0 {
+		result += "<p>The trash is empty.</p>"
+	}
+	for _, book := range books {
+		restoreForm := fmt.Sprintf("<form method='post' action='/books/%d/restore'><input type='submit' value='Restore'></form>", book.ID)
+		purgeForm := fmt.Sprintf("<form method='post' action='/books/%d/purge' onsubmit='return confirm(\"Delete this book forever?\")'><input type='submit' value='Delete forever'></form>", book.ID)
+		deleted := fmt.Sprintf("deleted by %s on %s", book.DeletedBy, book.DeletedAt.Format("2006-01-02 15:04 MST"))
+		result += "<br>" + html.EscapeString(book.String()+" "+deleted) + restoreForm + purgeForm
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, result)
+}
+
+// restoreBook takes a book out of the trash and announces it.
+func restoreBook(id int64, by bookshelf.Actor) error {
+	if err := bookshelf.DB.RestoreBook(id, by); err != nil {
+		return err
+	}
+	go publishEvent(bookshelf.BookRestored, id)
+	return nil
+}
+
+// purgeBook permanently removes a book from the trash, along with its
+// cover, and announces it.
+func purgeBook(ctx context.Context, id int64, by bookshelf.Actor) error {
+	book, err := bookshelf.DB.PurgeBook(id, by)
+	if err != nil {
+		return err
+	}
+	if err := bookshelf.DeleteCover(ctx, book.ImageURL); err != nil {
+		log.Printf("[ID %d] could not delete cover %s: %v", id, book.ImageURL, err)
+	}
+	go publishEvent(bookshelf.BookPurged, id)
+	return nil
+}
+
+// restoreHandler takes a given book out of the trash
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Redirect(w, r, fmt.Sprintf("/books/trash"), http.StatusFound)
+		return
+	}
+	if err := restoreBook(id, actorFromRequest(r, bookshelf.SourceHTML)); err != nil {
+		dbError(w, err)
+		return
+	}
+	markWrite(w, r)
+	http.Redirect(w, r, fmt.Sprintf("/books/%d", id), http.StatusFound)
+}
+
+// purgeHandler permanently removes a given book from the trash. It cannot
+// be undone, so only logged in users may do it.
+func purgeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Redirect(w, r, fmt.Sprintf("/books/trash"), http.StatusFound)
+		return
+	}
+	if profileFromSession(r) == nil {
+		http.Redirect(w, r, "/login?redirect=/books/trash", http.StatusFound)
+		return
+	}
+	if err := purgeBook(r.Context(), id, actorFromRequest(r, bookshelf.SourceHTML)); err != nil {
+		dbError(w, err)
 		return
 	}
-	ctx := context.Background()
-	b, err := json.Marshal(bookID)
+	markWrite(w, r)
+	http.Redirect(w, r, fmt.Sprintf("/books/trash"), http.StatusFound)
+}
+
+// rollbackHandler restores a given book to the version left by one of its
+// earlier changes
+func rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
+		http.Redirect(w, r, fmt.Sprintf("/books"), http.StatusFound)
 		return
 	}
-	topic := bookshelf.PubsubClient.Topic(bookshelf.PubsubTopicID)
-	_, err = topic.Publish(ctx, &pubsub.Message{Data: b}).Get(ctx)
+	changeID, err := strconv.ParseInt(r.FormValue("change"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid change", http.StatusBadRequest)
+		return
+	}
+	if _, err := bookshelf.RollbackBook(bookshelf.DB, id, changeID, actorFromRequest(r, bookshelf.SourceHTML)); err != nil {
+		dbError(w, err)
+		return
+	}
+	go publishEvent(bookshelf.BookUpdated, id)
+	markWrite(w, r)
+	http.Redirect(w, r, fmt.Sprintf("/books/%d", id), http.StatusFound)
+}
+
+// auditQuery reads the audit log filters from the query string. Times are
+// RFC 3339 or dates.
+func auditQuery(r *http.Request) (bookshelf.AuditQuery, error) {
+	q := bookshelf.AuditQuery{
+		ActorID: r.FormValue("actor"),
+		Source:  r.FormValue("source"),
+		Action:  r.FormValue("action"),
+	}
+	for _, f := range []struct {
+		name string
+		dst  *int64
+	}{{"book", &q.BookID}, {"before", &q.BeforeID}} {
+		if v := r.FormValue(f.name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return q, fmt.Errorf("invalid %s %q", f.name, v)
+			}
+			*f.dst = n
+		}
+	}
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid limit %q", v)
+		}
+		q.Limit = n
+	}
+	for _, f := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		v := r.FormValue(f.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			if t, err = time.Parse("2006-01-02", v); err != nil {
+				return q, fmt.Errorf("invalid %s %q", f.name, v)
+			}
+		}
+		*f.dst = t
+	}
+	return q, nil
+}
+
+// auditHandler displays the audit log of changes to every book, filtered
+// by the query string, to admins.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	q, err := auditQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	changes, err := bookshelf.DB.AuditLog(q)
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+
+	e := html.EscapeString
+	result := fmt.Sprintf(`<h3>Audit log</h3><form method="get" action="/admin/audit">
+		Book <input name="book" value="%s"> Actor ID <input name="actor" value="%s">
+		Source <input name="source" value="%s"> Action <input name="action" value="%s">
+		Since <input name="since" value="%s"> Until <input name="until" value="%s">
+		<input type="submit" value="Filter">
+	</form><table><tr><th>ID</th><th>Time</th><th>Book</th><th>Action</th><th>Actor</th><th>Source</th><th>Changes</th></tr>`,
+		e(r.FormValue("book")), e(r.FormValue("actor")), e(r.FormValue("source")), e(r.FormValue("action")),
+		e(r.FormValue("since")), e(r.FormValue("until")))
+	for _, c := range changes {
+		diff := ""
+		for _, d := range c.Diff {
+			diff += fmt.Sprintf("%s: %q to %q; ", d.Field, d.Old, d.New)
+		}
+		result += fmt.Sprintf("<tr><td>%d</td><td>%s</td><td><a href='/books/%d'>%d</a></td><td>%s</td><td>%s (%s)</td><td>%s</td><td>%s</td></tr>",
+			c.ID, c.Time.Format(time.RFC3339), c.BookID, c.BookID, e(c.Action), e(c.Actor.Name), e(c.Actor.ID), e(c.Actor.Source), e(diff))
+	}
+	result += "</table>"
+	if len(changes) > 0 {
+		next := r.URL.Query()
+		next.Set("before", strconv.FormatInt(changes[len(changes)-1].ID, 10))
+		result += fmt.Sprintf("<a href='/admin/audit?%s'>Older</a>", e(next.Encode()))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, result)
+}
+
+func publishUpdate(bookID int64) {
+	err := bookshelf.RequestEnrichment(context.Background(), bookID)
 	log.Printf("Published update to Pub/Sub for Book ID %d: %v", bookID, err)
 }
 
+// publishEvent announces a change to a book to every subscriber, such as
+// the caches of the other replicas. This replica's suggestions are
+// refreshed here too, so they keep up without Pub/Sub.
+func publishEvent(eventType string, bookID int64) {
+	if err := refreshSuggestions(bookshelf.BookEvent{Type: eventType, BookID: bookID}); err != nil {
+		log.Printf("[ID %d] could not refresh suggestions: %v", bookID, err)
+	}
+	err := bookshelf.PublishBookEvent(context.Background(), eventType, bookID)
+	log.Printf("Published %s to Pub/Sub for Book ID %d: %v", eventType, bookID, err)
+}
+
+// followBookEvents drops books from this replica's cache, and refreshes
+// their suggestions, as other replicas and the worker change them. Each
+// replica needs its own subscription to see every event; it expires a day
+// after the replica goes away.
+func followBookEvents() {
+	host, err := os.Hostname()
+	if err != nil {
+		log.Printf("could not subscribe to book events: %v", err)
+		return
+	}
+	subID := "book-events-app-" + host
+	err = bookshelf.SubscribeBookEvents(context.Background(), subID, 24*time.Hour,
+		func(ctx context.Context, e bookshelf.BookEvent) error {
+			if bookshelf.BookCache != nil {
+				bookshelf.BookCache.Invalidate(e.BookID)
+			}
+			return refreshSuggestions(e)
+		})
+	log.Printf("book event subscription %s stopped: %v", subID, err)
+}
+
 func registerHandlers() {
 	fmt.Println("Register handlers")
+	http.Handle("/", newRouter())
+}
+
+// newRouter routes every page and API endpoint of the app.
+func newRouter() *mux.Router {
 	r := mux.NewRouter()
 	r.HandleFunc("/", listHandler).Methods("GET")
 	r.HandleFunc("/books", listHandler).Methods("GET")
 	r.HandleFunc("/books/{id:[0-9]+}", detailHandler).Methods("GET")
 	r.HandleFunc("/books/add", addBookHandler).Methods("GET")
+	r.HandleFunc("/books/add/isbn", addByISBNHandler).Methods("GET")
+	r.HandleFunc("/books/search", searchHandler).Methods("GET")
+	r.HandleFunc("/search", fullTextHandler).Methods("GET")
+	r.HandleFunc("/books/isbn/{isbn}", isbnHandler).Methods("GET")
+	r.HandleFunc("/books/trash", trashHandler).Methods("GET")
+	r.HandleFunc("/books/import", importFormHandler).Methods("GET")
+	r.HandleFunc("/books/import/shelves", shelfImportFormHandler).Methods("GET")
+	r.HandleFunc("/books/import/{id:[0-9a-f-]+}", importStatusHandler).Methods("GET")
+	r.HandleFunc("/books/export.csv", exportHandler).Methods("GET")
 	r.HandleFunc("/books/{id:[0-9]+}/edit", editHandler).Methods("GET")
+	r.HandleFunc("/authors/{id:[0-9]+}", authorHandler).Methods("GET")
+	r.HandleFunc("/tags", tagsHandler).Methods("GET")
+	r.HandleFunc("/shelves", shelvesHandler).Methods("GET")
+	r.HandleFunc("/loans", loansHandler).Methods("GET")
+	r.HandleFunc("/webhooks", webhooksHandler).Methods("GET")
+	r.HandleFunc("/webhooks/{id:[0-9]+}", webhookHandler).Methods("GET")
+	r.HandleFunc("/opds", opdsRootHandler).Methods("GET")
+	r.HandleFunc("/opds/books", opdsBooksHandler).Methods("GET")
+	r.HandleFunc("/opds/new", opdsNewHandler).Methods("GET")
+	r.HandleFunc("/opds/authors", opdsAuthorsHandler).Methods("GET")
+	r.HandleFunc("/opds/authors/{id:[0-9]+}", opdsAuthorHandler).Methods("GET")
+	r.HandleFunc("/opds/tags", opdsTagsHandler).Methods("GET")
+	r.HandleFunc("/opds/search.xml", opdsSearchHandler).Methods("GET")
+	r.HandleFunc("/feeds/{sort:new|updated}.{format:atom|rss}", feedHandler).Methods("GET")
 
 	r.HandleFunc("/books", createHandler).Methods("POST")
+	r.HandleFunc("/books/add/isbn", createByISBNHandler).Methods("POST")
 	r.HandleFunc("/books/{id:[0-9]+}", updateHandler).Methods("POST")
 	r.HandleFunc("/books/{id:[0-9]+}/delete", deleteHandler).Methods("POST")
+	r.HandleFunc("/books/{id:[0-9]+}/restore", restoreHandler).Methods("POST")
+	r.HandleFunc("/books/{id:[0-9]+}/purge", purgeHandler).Methods("POST")
+	r.HandleFunc("/books/{id:[0-9]+}/rollback", rollbackHandler).Methods("POST")
+	r.HandleFunc("/books/{id:[0-9]+}/reading", saveReadingHandler).Methods("POST")
+	r.HandleFunc("/books/{id:[0-9]+}/reading/delete", deleteReadingHandler).Methods("POST")
+	r.HandleFunc("/books/{id:[0-9]+}/checkout", checkOutHandler).Methods("POST")
+	r.HandleFunc("/books/{id:[0-9]+}/loans/{loanId:[0-9]+}/return", returnHandler).Methods("POST")
+	r.HandleFunc("/books/{id:[0-9]+}/hold", placeHoldHandler).Methods("POST")
+	r.HandleFunc("/books/{id:[0-9]+}/hold/cancel", cancelHoldHandler).Methods("POST")
+	r.HandleFunc("/books/{id:[0-9]+}/copies", addCopyHandler).Methods("POST")
+	r.HandleFunc("/books/{id:[0-9]+}/copies/{copyId:[0-9]+}/delete", removeCopyHandler).Methods("POST")
+	r.HandleFunc("/books/{id:[0-9]+}/review", saveReviewHandler).Methods("POST")
+	r.HandleFunc("/books/{id:[0-9]+}/review/delete", deleteReviewHandler).Methods("POST")
+	r.HandleFunc("/books/import", uploadImportHandler).Methods("POST")
+	r.HandleFunc("/books/import/shelves", shelfImportHandler).Methods("POST")
+	r.HandleFunc("/books/import/{id:[0-9a-f-]+}", importHandler).Methods("POST")
+	r.HandleFunc("/webhooks", createWebhookHandler).Methods("POST")
+	r.HandleFunc("/webhooks/{id:[0-9]+}", updateWebhookHandler).Methods("POST")
+	r.HandleFunc("/webhooks/{id:[0-9]+}/delete", deleteWebhookHandler).Methods("POST")
+	r.HandleFunc("/webhooks/{id:[0-9]+}/test", testWebhookHandler).Methods("POST")
+	r.HandleFunc("/admin/audit", auditHandler).Methods("GET")
+	r.HandleFunc("/admin/duplicates", duplicatesHandler).Methods("GET")
+	r.HandleFunc("/admin/duplicates/merge", mergeHandler).Methods("POST")
+	r.HandleFunc("/admin/loans", adminLoansHandler).Methods("GET")
+	r.HandleFunc("/admin/reviews", adminReviewsHandler).Methods("GET")
+
+	registerAPIHandlers(r.PathPrefix("/api").Subrouter())
 
 	// For OAuth2
 	r.HandleFunc("/login", loginHandler).Methods("GET")
 	r.HandleFunc("/logout", logoutHandler).Methods("GET")
 	r.HandleFunc("/oauth2callback", oauthCallbackHandler).Methods("GET")
-
-	http.Handle("/", r)
+	return r
 }
 
 func main() {
@@ -251,6 +744,18 @@ func main() {
 		port = "80"
 	}
 	fmt.Println("Starting the server on port:", port)
+	if err := bookshelf.Configure(); err != nil {
+		log.Fatal(err)
+	}
+	period, err := bookshelf.LoanPeriodDuration()
+	if err != nil {
+		log.Fatal(err)
+	}
+	loanPeriod = period
 	registerHandlers()
+	loadSuggestions()
+	if bookshelf.PubsubClient != nil {
+		go followBookEvents()
+	}
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
 }
@@ -182,3 +182,19 @@ func profileFromSession(r *http.Request) *Profile {
 	}
 	return profile
 }
+
+// actorFromRequest identifies who is making a change through source, for
+// the book history. Users who are not logged in are recorded as anonymous.
+func actorFromRequest(r *http.Request, source string) bookshelf.Actor {
+	profile := profileFromSession(r)
+	if profile == nil {
+		return bookshelf.Actor{Name: "anonymous", Source: source}
+	}
+	return bookshelf.Actor{ID: profile.ID, Name: profile.DisplayName, Source: source}
+}
+
+// isAdmin reports whether the logged in user is one of bookshelf.Admins.
+func isAdmin(r *http.Request) bool {
+	profile := profileFromSession(r)
+	return profile != nil && bookshelf.IsAdmin(profile.ID)
+}
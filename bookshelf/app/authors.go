@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// contributorLinks links each contributor of a book to their author page.
+func contributorLinks(book *bookshelf.Book) string {
+	if len(book.Contributors) == 0 {
+		return ""
+	}
+	result := "<p>"
+	for i, c := range book.Contributors {
+		if i > 0 {
+			result += "; "
+		}
+		result += fmt.Sprintf("<a href='/authors/%d'>%s</a>", c.AuthorID, html.EscapeString(c.Name))
+		if c.Role != bookshelf.RoleAuthor {
+			result += " (" + c.Role + ")"
+		}
+	}
+	return result + "</p>"
+}
+
+// authorHandler lists the books an author contributed to, with their role
+// in each.
+func authorHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Redirect(w, r, "/books", http.StatusFound)
+		return
+	}
+	db := database(r)
+	author, err := db.GetAuthor(id)
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	books, err := db.ListAuthorBooks(id)
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+
+	result := "<h3>" + html.EscapeString(author.Name) + "</h3>"
+	result += feedLinks(url.Values{"author": {strconv.FormatInt(id, 10)}})
+	if len(books) == 0 {
+		result += "<p>No books.</p>"
+	}
+	for _, b := range books {
+		var roles []string
+		for _, c := range b.Contributors {
+			if c.AuthorID == id {
+				roles = append(roles, c.Role)
+			}
+		}
+		result += fmt.Sprintf("<br><a href='/books/%d'>%s</a> %v", b.ID, html.EscapeString(b.Title), roles)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, result)
+}
+
+// apiAuthor is the JSON form of an author.
+type apiAuthor struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// apiAuthorsHandler suggests the authors with a word of their name starting
+// with the q parameter, for autocompletion.
+func apiAuthorsHandler(w http.ResponseWriter, r *http.Request) {
+	limit, ok := apiLimit(w, r, bookshelf.DefaultAuthorSearchLimit)
+	if !ok {
+		return
+	}
+	authors, err := database(r).SearchAuthors(r.FormValue("q"), limit)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	a := make([]*apiAuthor, len(authors))
+	for i, author := range authors {
+		a[i] = &apiAuthor{ID: author.ID, Name: author.Name}
+	}
+	writeJSON(w, http.StatusOK, a)
+}
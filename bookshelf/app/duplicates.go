@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// duplicateThreshold reads the threshold parameter, defaulting to
+// bookshelf.DefaultDuplicateThreshold.
+func duplicateThreshold(r *http.Request) (float64, error) {
+	v := r.FormValue("threshold")
+	if v == "" {
+		return bookshelf.DefaultDuplicateThreshold, nil
+	}
+	t, err := strconv.ParseFloat(v, 64)
+	if err != nil || t <= 0 || t > 1 {
+		return 0, fmt.Errorf("invalid threshold %q: want a number above 0 and up to 1", v)
+	}
+	return t, nil
+}
+
+// findDuplicates lists the likely duplicates among all books.
+func findDuplicates(threshold float64) ([]bookshelf.Duplicate, error) {
+	books, err := bookshelf.ReadPrimary(bookshelf.DB).ListBooks()
+	if err != nil {
+		return nil, err
+	}
+	return bookshelf.FindDuplicates(books, threshold), nil
+}
+
+// mergeBooks merges the book with dupID into the book with keepID, removes
+// the duplicate's cover unless the merged book kept it, and announces both
+// changes.
+func mergeBooks(ctx context.Context, keepID, dupID int64, by bookshelf.Actor) (*bookshelf.Book, error) {
+	merged, dup, err := bookshelf.MergeBooks(bookshelf.DB, keepID, dupID, by)
+	if err != nil {
+		return nil, err
+	}
+	if dup.ImageURL != "" && dup.ImageURL != merged.ImageURL {
+		if err := bookshelf.DeleteCover(ctx, dup.ImageURL); err != nil {
+			log.Printf("[ID %d] could not delete cover %s: %v", dupID, dup.ImageURL, err)
+		}
+	}
+	go publishEvent(bookshelf.BookUpdated, keepID)
+	go publishEvent(bookshelf.BookPurged, dupID)
+	return merged, nil
+}
+
+// duplicatesHandler shows admins the pairs of books that are likely the same
+// book, with buttons to merge either into the other.
+func duplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	threshold, err := duplicateThreshold(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dups, err := findDuplicates(threshold)
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+
+	e := html.EscapeString
+	result := fmt.Sprintf(`<h3>Likely duplicates</h3><form method="get" action="/admin/duplicates">
+		Threshold <input name="threshold" value="%.2f"> <input type="submit" value="Show">
+	</form>`, threshold)
+	if len(dups) == 0 {
+		result += "<p>No likely duplicates.</p>"
+	}
+	result += "<table><tr><th>Score</th><th>Book</th><th>Book</th><th>Why</th><th></th></tr>"
+	mergeForm := func(keep, dup *bookshelf.Book) string {
+		return fmt.Sprintf(`<form method="post" action="/admin/duplicates/merge" onsubmit="return confirm('Merge book %d into book %d?')">
+			<input type="hidden" name="keep" value="%d"><input type="hidden" name="dup" value="%d">
+			<input type="submit" value="Keep %d"></form>`, dup.ID, keep.ID, keep.ID, dup.ID, keep.ID)
+	}
+	for _, d := range dups {
+		result += fmt.Sprintf("<tr><td>%.2f</td><td><a href='/books/%d'>%s</a></td><td><a href='/books/%d'>%s</a></td><td>%s</td><td>%s%s</td></tr>",
+			d.Score, d.A.ID, e(d.A.String()), d.B.ID, e(d.B.String()), e(d.Reason), mergeForm(d.A, d.B), mergeForm(d.B, d.A))
+	}
+	result += "</table>"
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, result)
+}
+
+// mergeHandler merges the book with ID dup into the book with ID keep.
+func mergeHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	keep, err := strconv.ParseInt(r.FormValue("keep"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid book id", http.StatusBadRequest)
+		return
+	}
+	dup, err := strconv.ParseInt(r.FormValue("dup"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid book id", http.StatusBadRequest)
+		return
+	}
+	if _, err := mergeBooks(r.Context(), keep, dup, actorFromRequest(r, bookshelf.SourceHTML)); err != nil {
+		dbError(w, err)
+		return
+	}
+	markWrite(w, r)
+	http.Redirect(w, r, fmt.Sprintf("/books/%d", keep), http.StatusFound)
+}
+
+// apiDuplicate is the JSON form of a pair of likely duplicates.
+type apiDuplicate struct {
+	A      *apiBook `json:"a"`
+	B      *apiBook `json:"b"`
+	Score  float64  `json:"score"`
+	Reason string   `json:"reason"`
+}
+
+// apiDuplicatesHandler serves the likely duplicates to admins.
+func apiDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": http.StatusText(http.StatusForbidden)})
+		return
+	}
+	threshold, err := duplicateThreshold(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	dups, err := findDuplicates(threshold)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	a := make([]apiDuplicate, len(dups))
+	for i, d := range dups {
+		a[i] = apiDuplicate{A: toAPIBook(d.A), B: toAPIBook(d.B), Score: d.Score, Reason: d.Reason}
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+// apiMergeHandler merges the book whose ID is the from parameter into the
+// book in the path, for admins, and returns the merged book.
+func apiMergeHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": http.StatusText(http.StatusForbidden)})
+		return
+	}
+	id, ok := apiID(w, r)
+	if !ok {
+		return
+	}
+	from, err := strconv.ParseInt(r.FormValue("from"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid from book id"})
+		return
+	}
+	book, err := mergeBooks(r.Context(), id, from, actorFromRequest(r, bookshelf.SourceAPI))
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	markWrite(w, r)
+	writeJSON(w, http.StatusOK, toAPIBook(book))
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// The feeds at /feeds/new and /feeds/updated follow the books added and
+// updated most recently, as Atom or RSS, for feed readers. They can be
+// narrowed to the books of an author or with a tag. Readers poll them, so
+// they answer conditional requests, and are built only from the books they
+// list, dated by when those were saved, so they change only when one does.
+
+// feedSize is how many books a feed lists.
+const feedSize = 50
+
+// feedSorts maps the sort route variable of a feed to its order.
+var feedSorts = map[string]string{
+	"new":     bookshelf.SortNewest,
+	"updated": bookshelf.SortUpdated,
+}
+
+// feedTime returns the time b is listed by in a feed sorted by order.
+func feedTime(b *bookshelf.Book, order string) time.Time {
+	if order == bookshelf.SortNewest {
+		return b.CreatedAt
+	}
+	return b.UpdatedAt
+}
+
+// feedBooks returns the books of the author with the author parameter, if
+// any, with the tag parameter, if any, most recent first by order, along
+// with the title of the feed of them.
+func feedBooks(r *http.Request, order string) ([]*bookshelf.Book, string, error) {
+	title := "New books"
+	if order == bookshelf.SortUpdated {
+		title = "Recently updated books"
+	}
+	db := database(r)
+	tag := bookshelf.NormalizeTag(r.FormValue("tag"))
+	var books []*bookshelf.Book
+	if v := r.FormValue("author"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: invalid author %q", bookshelf.ErrInvalid, v)
+		}
+		author, err := db.GetAuthor(id)
+		if err != nil {
+			return nil, "", err
+		}
+		all, err := db.ListAuthorBooks(id)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, b := range all {
+			if tag == "" || hasTag(b, tag) {
+				books = append(books, b)
+			}
+		}
+		bookshelf.SortRecent(books, order)
+		title += " by " + author.Name
+	} else {
+		var err error
+		if books, err = db.FilterBooks(bookshelf.BookFilter{Tag: tag, Sort: order}); err != nil {
+			return nil, "", err
+		}
+	}
+	if tag != "" {
+		title += " tagged " + tag
+	}
+	// Books saved before their times were kept sort last, and are left out.
+	for i, b := range books {
+		if i == feedSize || feedTime(b, order).IsZero() {
+			books = books[:i]
+			break
+		}
+	}
+	return books, title, nil
+}
+
+// hasTag reports whether b is tagged tag.
+func hasTag(b *bookshelf.Book, tag string) bool {
+	for _, t := range b.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// lastModified returns when the most recently updated of books was.
+func lastModified(books []*bookshelf.Book) time.Time {
+	var last time.Time
+	for _, b := range books {
+		for _, t := range []time.Time{b.CreatedAt, b.UpdatedAt} {
+			if t.After(last) {
+				last = t
+			}
+		}
+	}
+	return last
+}
+
+// feedHandler serves the feed of the books added or updated most recently,
+// by the sort route variable, in the format route variable, atom or rss.
+// Its ETag is a digest of the feed, and its Last-Modified when the most
+// recently updated of its books was, so readers polling it are answered
+// 304 until it changes.
+func feedHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	order := feedSorts[vars["sort"]]
+	books, title, err := feedBooks(r, order)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	modified := lastModified(books)
+	base := baseURL(r)
+	self := base + r.URL.Path
+	if params := feedParams(r); len(params) > 0 {
+		self += "?" + params.Encode()
+	}
+
+	var doc interface{}
+	contentType := "application/atom+xml"
+	if vars["format"] == "rss" {
+		contentType = "application/rss+xml"
+		doc = rssFeed(books, order, title, base, self, modified)
+	} else {
+		doc = atomBooksFeed(books, title, base, self, modified)
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(doc); err != nil {
+		log.Printf("feedHandler: could not encode feed %s: %v", self, err)
+		http.Error(w, "could not encode feed", http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Cache-Control", "no-cache")
+	// ServeContent answers If-None-Match and If-Modified-Since.
+	http.ServeContent(w, r, "", modified, bytes.NewReader(buf.Bytes()))
+}
+
+// feedParams returns the author and tag parameters a feed was asked for,
+// so its self link names them.
+func feedParams(r *http.Request) url.Values {
+	params := url.Values{}
+	for _, name := range []string{"author", "tag"} {
+		if v := r.FormValue(name); v != "" {
+			params.Set(name, v)
+		}
+	}
+	return params
+}
+
+// atomBooksFeed builds the Atom feed of books. Feed readers do not resolve
+// relative links reliably, so every link is made absolute against base.
+func atomBooksFeed(books []*bookshelf.Book, title, base, self string, modified time.Time) *atomFeed {
+	f := &atomFeed{
+		Xmlns:   "http://www.w3.org/2005/Atom",
+		XmlnsDC: "http://purl.org/dc/terms/",
+		ID:      self,
+		Title:   "Bookshelf: " + title,
+		Updated: opdsTime(modified),
+		Author:  atomPerson{Name: "Bookshelf"},
+		Links: []atomLink{
+			{Rel: "self", Href: self, Type: "application/atom+xml"},
+			{Rel: "alternate", Href: base + "/books", Type: "text/html"},
+		},
+	}
+	for _, b := range books {
+		f.book(b)
+		e := &f.Entries[len(f.Entries)-1]
+		// The links to the book's page are all a reader needs; borrowing
+		// is for e-readers.
+		e.Links = []atomLink{{Rel: "alternate", Href: fmt.Sprintf("%s/books/%d", base, b.ID), Type: "text/html"}}
+		for i := range e.Authors {
+			if e.Authors[i].URI != "" {
+				e.Authors[i].URI = base + strings.Replace(e.Authors[i].URI, "/opds/authors/", "/authors/", 1)
+			}
+		}
+	}
+	return f
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	ID          string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Description string   `xml:"description,omitempty"`
+	Author      string   `xml:"dc:creator,omitempty"`
+	Categories  []string `xml:"category"`
+	GUID        rssGUID  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	Self          atomLink  `xml:"atom:link"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssDocument struct {
+	XMLName   xml.Name   `xml:"rss"`
+	Version   string     `xml:"version,attr"`
+	XmlnsAtom string     `xml:"xmlns:atom,attr"`
+	XmlnsDC   string     `xml:"xmlns:dc,attr"`
+	Channel   rssChannel `xml:"channel"`
+}
+
+// rssFeed builds the RSS 2.0 feed of books, each dated by when it was
+// added or updated, by order.
+func rssFeed(books []*bookshelf.Book, order, title, base, self string, modified time.Time) *rssDocument {
+	d := &rssDocument{
+		Version:   "2.0",
+		XmlnsAtom: "http://www.w3.org/2005/Atom",
+		XmlnsDC:   "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:       "Bookshelf: " + title,
+			Link:        base + "/books",
+			Description: title + " in the library.",
+			Self:        atomLink{Rel: "self", Href: self, Type: "application/rss+xml"},
+		},
+	}
+	if !modified.IsZero() {
+		d.Channel.LastBuildDate = modified.UTC().Format(time.RFC1123Z)
+	}
+	for _, b := range books {
+		link := fmt.Sprintf("%s/books/%d", base, b.ID)
+		d.Channel.Items = append(d.Channel.Items, rssItem{
+			Title:       b.Title,
+			Link:        link,
+			Description: b.Description,
+			Author:      b.Author,
+			Categories:  append(append([]string(nil), b.Genres...), b.Tags...),
+			GUID:        rssGUID{IsPermaLink: true, ID: link},
+			PubDate:     feedTime(b, order).UTC().Format(time.RFC1123Z),
+		})
+	}
+	return d
+}
+
+// feedLinks renders links to the Atom and RSS feeds of the books added and
+// updated most recently, narrowed by params.
+func feedLinks(params url.Values) string {
+	q := ""
+	if len(params) > 0 {
+		q = "?" + params.Encode()
+	}
+	return fmt.Sprintf(`<div>Feeds: new books <a href="/feeds/new.atom%[1]s">Atom</a> <a href="/feeds/new.rss%[1]s">RSS</a>,
+		updated books <a href="/feeds/updated.atom%[1]s">Atom</a> <a href="/feeds/updated.rss%[1]s">RSS</a></div>`,
+		strings.Replace(q, "&", "&amp;", -1))
+}
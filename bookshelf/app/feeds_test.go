@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// getFeed fetches target with the given request headers.
+func getFeed(t *testing.T, target string, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("GET", target, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, req)
+	return w
+}
+
+func TestFeedConditionalGet(t *testing.T) {
+	by := bookshelf.Actor{ID: "alice", Name: "Alice", Source: bookshelf.SourceHTML}
+	b := &bookshelf.Book{Title: "Middlemarch", Author: "George Eliot", Tags: []string{"feedtest"}}
+	id, err := bookshelf.DB.AddBook(b, by)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.ID = id
+
+	for _, target := range []string{"/feeds/updated.atom?tag=feedtest", "/feeds/new.rss?tag=feedtest"} {
+		w := getFeed(t, target, nil)
+		etag, modified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+		if w.Code != http.StatusOK || etag == "" || modified == "" || !strings.Contains(w.Body.String(), "Middlemarch") {
+			t.Fatalf("GET %s = %d with ETag %q and Last-Modified %q, want the feed of the book", target, w.Code, etag, modified)
+		}
+		for _, c := range []struct {
+			header, value string
+			want          int
+		}{
+			{"If-None-Match", etag, http.StatusNotModified},
+			{"If-None-Match", `"stale"`, http.StatusOK},
+			{"If-Modified-Since", modified, http.StatusNotModified},
+			{"If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT", http.StatusOK},
+		} {
+			if w := getFeed(t, target, map[string]string{c.header: c.value}); w.Code != c.want {
+				t.Errorf("GET %s with %s: %s = %d, want %d", target, c.header, c.value, w.Code, c.want)
+			}
+		}
+	}
+
+	target := "/feeds/updated.atom?tag=feedtest"
+	etag := getFeed(t, target, nil).Header().Get("ETag")
+	b.Title = "Middlemarch: A Study of Provincial Life"
+	if err := bookshelf.DB.UpdateBook(b, by); err != nil {
+		t.Fatal(err)
+	}
+	w := getFeed(t, target, map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag || !strings.Contains(w.Body.String(), "Provincial Life") {
+		t.Errorf("GET %s after an update = %d with ETag %q, want the changed feed with a new ETag", target, w.Code, w.Header().Get("ETag"))
+	}
+}
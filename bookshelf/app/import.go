@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	uuid "github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// storeImport uploads a CSV file to the bucket under the given import ID.
+func storeImport(ctx context.Context, id string, r io.Reader) error {
+	if bookshelf.StorageBucket == nil {
+		return errors.New("storage bucket is missing - check config.go")
+	}
+	w := bookshelf.StorageBucket.Object(bookshelf.ImportObject(id)).NewWriter(ctx)
+	w.ContentType = "text/csv"
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// readImport reads an uploaded CSV file if it is small enough to import
+// inline. Otherwise it returns the start of the file and false.
+func readImport(ctx context.Context, id string) ([]byte, bool, error) {
+	r, err := bookshelf.StorageBucket.Object(bookshelf.ImportObject(id)).NewReader(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(r, bookshelf.InlineImportLimit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	return b, len(b) <= bookshelf.InlineImportLimit, nil
+}
+
+// mappingFromForm reads the column mapping from the map.<field> form
+// values, guessing it from header when none are given.
+func mappingFromForm(r *http.Request, header []string) map[string]string {
+	mapping := make(map[string]string)
+	for _, f := range bookshelf.CSVFields() {
+		if v := r.FormValue("map." + f); v != "" {
+			mapping[f] = v
+		}
+	}
+	if len(mapping) == 0 {
+		return bookshelf.GuessMapping(header)
+	}
+	return mapping
+}
+
+// runImport imports the uploaded file with the given ID, inline if it is
+// small and by queueing it for the worker otherwise. It returns nil when
+// the import was queued.
+func runImport(ctx context.Context, id string, opts bookshelf.ImportOptions) (*bookshelf.ImportReport, error) {
+	data, inline, err := readImport(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("could not read import %s: %v", id, err)
+	}
+	if !inline {
+		return nil, bookshelf.PublishImportJob(ctx, bookshelf.ImportJob{ID: id, Options: opts})
+	}
+	report, err := bookshelf.ImportCSV(ctx, bookshelf.DB, bytes.NewReader(data), opts)
+	if report != nil {
+		if serr := bookshelf.SaveImportReport(ctx, id, report); serr != nil {
+			log.Printf("import %s: %v", id, serr)
+		}
+	}
+	return report, err
+}
+
+// importFormHandler displays a form to upload a CSV file of books.
+func importFormHandler(w http.ResponseWriter, r *http.Request) {
+	FORM := `<form method="post" enctype="multipart/form-data" action="/books/import">
+		<div class="form-group">
+			<label for="file">CSV file with a header row</label>
+			<input class="form-control" name="file" id="file" type="file" accept=".csv,text/csv">
+		</div>
+		<input type="submit" name="submit" id="submit" value="Upload">
+	</form>
+	<p><a href="/books/import/shelves">Import a Goodreads or LibraryThing export</a></p>`
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, FORM)
+}
+
+// uploadImportHandler stores an uploaded CSV file and asks which column
+// holds each book field.
+func uploadImportHandler(w http.ResponseWriter, r *http.Request) {
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "missing CSV file", http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	header, err := bookshelf.ReadCSVHeader(f)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id := uuid.Must(uuid.NewV4()).String()
+	if err := storeImport(r.Context(), id, f); err != nil {
+		log.Printf("could not store import %s: %v", id, err)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	guess := bookshelf.GuessMapping(header)
+	result := fmt.Sprintf(`<form method="post" action="/books/import/%s">`, id)
+	for _, field := range bookshelf.CSVFields() {
+		result += fmt.Sprintf(`<div class="form-group"><label>%s</label> <select name="map.%s"><option value="">(none)</option>`, field, field)
+		for _, h := range header {
+			selected := ""
+			if guess[field] == h {
+				selected = " selected"
+			}
+			result += fmt.Sprintf(`<option value="%s"%s>%s</option>`, html.EscapeString(h), selected, html.EscapeString(h))
+		}
+		result += `</select></div>`
+	}
+	result += `<label><input type="checkbox" name="dryRun" value="true" checked> Dry run: only check the rows</label>
+		<input type="submit" value="Import"></form>`
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, result)
+}
+
+// importHandler imports an uploaded CSV file with the chosen mapping,
+// showing the report, or where to find it once the worker is done.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	opts := bookshelf.ImportOptions{
+		Mapping: mappingFromForm(r, nil),
+		DryRun:  r.FormValue("dryRun") == "true",
+		Actor:   actorFromRequest(r, bookshelf.SourceHTML),
+	}
+	report, err := runImport(r.Context(), id, opts)
+	if report == nil && err == nil {
+		http.Redirect(w, r, "/books/import/"+id, http.StatusFound)
+		return
+	}
+	if report == nil {
+		log.Printf("import %s: %v", id, err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	if !opts.DryRun {
+		markWrite(w, r)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, importReport(id, report, opts.Mapping))
+}
+
+// importStatusHandler shows the report of an import run by the worker.
+func importStatusHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	report, err := bookshelf.LoadImportReport(r.Context(), id)
+	if errors.Is(err, bookshelf.ErrNotFound) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, "<p>The import is still running. Refresh this page to check on it.</p>")
+		return
+	} else if err != nil {
+		dbError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, importReport(id, report, nil))
+}
+
+// importReport renders the report of an import. After a dry run with a
+// known mapping it offers to run the import for real.
+func importReport(id string, report *bookshelf.ImportReport, mapping map[string]string) string {
+	verb := "Added"
+	if report.DryRun {
+		verb = "Would add"
+	}
+	result := fmt.Sprintf("<p>Read %d rows. %s %d books; %d rows failed.</p>", report.Rows, verb, report.Added, report.Failed)
+	if report.Error != "" {
+		result += "<p>The import stopped early: " + html.EscapeString(report.Error) + "</p>"
+	}
+	if len(report.Errors) > 0 {
+		result += "<table><tr><th>Row</th><th>Error</th></tr>"
+		for _, e := range report.Errors {
+			result += fmt.Sprintf("<tr><td>%d</td><td>%s</td></tr>", e.Row, html.EscapeString(e.Message))
+		}
+		result += "</table>"
+	}
+	if report.DryRun && mapping != nil && report.Error == "" {
+		result += fmt.Sprintf(`<form method="post" action="/books/import/%s">`, id)
+		for field, column := range mapping {
+			result += fmt.Sprintf(`<input type="hidden" name="map.%s" value="%s">`, html.EscapeString(field), html.EscapeString(column))
+		}
+		result += `<input type="submit" value="Import the valid rows"></form>`
+	}
+	return result + "<div><a href='/books'>Back to books</a></div>"
+}
+
+// exportHandler streams the books, or those matching the q parameter, as a
+// CSV file.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		books []*bookshelf.Book
+		err   error
+	)
+	if q := r.FormValue("q"); q != "" {
+		books, err = database(r).SearchBooks(q)
+	} else {
+		books, err = database(r).ListBooks()
+	}
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="books.csv"`)
+	if err := bookshelf.ExportCSV(w, books); err != nil {
+		log.Printf("could not export books: %v", err)
+	}
+}
+
+// apiImportHandler imports the CSV file in the request body. The mapping
+// is given as map.<field> parameters, or guessed from the header, and
+// dryRun=true only checks the rows. Small files are imported at once and
+// the report returned; larger ones are queued for the worker and their
+// report is served by apiImportStatusHandler.
+func apiImportHandler(w http.ResponseWriter, r *http.Request) {
+	head, err := ioutil.ReadAll(io.LimitReader(r.Body, bookshelf.InlineImportLimit+1))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	header, err := bookshelf.ReadCSVHeader(bytes.NewReader(head))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	opts := bookshelf.ImportOptions{
+		Mapping: mappingFromForm(r, header),
+		DryRun:  r.FormValue("dryRun") == "true",
+		Actor:   actorFromRequest(r, bookshelf.SourceAPI),
+	}
+
+	if len(head) <= bookshelf.InlineImportLimit {
+		report, err := bookshelf.ImportCSV(r.Context(), bookshelf.DB, bytes.NewReader(head), opts)
+		if report == nil {
+			writeJSON(w, errorStatus(err), map[string]string{"error": err.Error()})
+			return
+		}
+		if !opts.DryRun {
+			markWrite(w, r)
+		}
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+
+	id := uuid.Must(uuid.NewV4()).String()
+	if err := storeImport(r.Context(), id, io.MultiReader(bytes.NewReader(head), r.Body)); err != nil {
+		log.Printf("could not store import %s: %v", id, err)
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "could not store the file"})
+		return
+	}
+	if err := bookshelf.PublishImportJob(r.Context(), bookshelf.ImportJob{ID: id, Options: opts}); err != nil {
+		log.Printf("could not queue import %s: %v", id, err)
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "could not queue the import"})
+		return
+	}
+	w.Header().Set("Location", "/api/import/"+id)
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": id, "status": "/api/import/" + id})
+}
+
+// apiImportStatusHandler serves the report of a queued import, or 202
+// while the worker is still running it.
+func apiImportStatusHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	report, err := bookshelf.LoadImportReport(r.Context(), id)
+	if errors.Is(err, bookshelf.ErrNotFound) {
+		writeJSON(w, http.StatusAccepted, map[string]string{"id": id, "status": "running"})
+		return
+	} else if err != nil {
+		apiError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// metadataTimeout bounds how long adding a book by ISBN waits on the
+// metadata provider, and on copying the cover it links.
+const metadataTimeout = 10 * time.Second
+
+// maxAddByISBNSize caps the body of POST /api/books/isbn.
+const maxAddByISBNSize = 64 << 10
+
+// errNoMetadata reports a failure of the metadata provider itself, rather
+// than of the catalogue, so it is answered with 502.
+var errNoMetadata = errors.New("could not reach the metadata provider")
+
+// lookupISBN normalizes isbn and looks it up with the metadata provider,
+// returning its ISBN-13 with what the provider knows about it.
+func lookupISBN(ctx context.Context, isbn string) (string, *bookshelf.Metadata, error) {
+	_, isbn13, err := bookshelf.NormalizeISBN(isbn)
+	if err != nil {
+		return "", nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, metadataTimeout)
+	defer cancel()
+	md, err := bookshelf.LookupMetadata(ctx, isbn13)
+	if err != nil && !errors.Is(err, bookshelf.ErrNotFound) {
+		log.Printf("could not look up ISBN %s: %v", isbn13, err)
+		return "", nil, errNoMetadata
+	}
+	return isbn13, md, err
+}
+
+// addFromMetadata adds book, prefilled from md, copying the cover md links
+// into our own storage. A cover that cannot be copied is left out rather
+// than failing the book, for the worker to try again.
+func addFromMetadata(ctx context.Context, book *bookshelf.Book, md *bookshelf.Metadata, by bookshelf.Actor) (int64, error) {
+	if md.CoverURL != "" {
+		ctx, cancel := context.WithTimeout(ctx, metadataTimeout)
+		defer cancel()
+		imageURL, err := bookshelf.CopyCover(ctx, md.CoverURL)
+		if err != nil {
+			log.Printf("could not copy the cover of ISBN %s: %v", book.ISBN13, err)
+		}
+		book.ImageURL = imageURL
+	}
+	id, err := bookshelf.DB.AddBook(book, by)
+	if err != nil {
+		bookshelf.DeleteCover(ctx, book.ImageURL)
+		return 0, err
+	}
+	go publishUpdate(id)
+	go publishEvent(bookshelf.BookCreated, id)
+	return id, nil
+}
+
+// isbnForm asks for the ISBN of a book to add.
+func isbnForm(isbn string) string {
+	return fmt.Sprintf(`<form method="get" action="/books/add/isbn">
+		<div class="form-group">
+			<label for="isbn">ISBN</label>
+			<input class="form-control" name="isbn" id="isbn" value="%s">
+		</div>
+		<input type="submit" value="Look up">
+	</form>`, html.EscapeString(isbn))
+}
+
+// addByISBNHandler asks for an ISBN, then looks it up with the metadata
+// provider and shows the title, authors, published date, description and
+// cover it knows for the book, to be corrected and confirmed before the
+// book is added.
+func addByISBNHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	isbn := r.FormValue("isbn")
+	if isbn == "" {
+		fmt.Fprint(w, isbnForm("")+"<div><a href='/books/add'>Add a book by hand</a></div>")
+		return
+	}
+	if book, err := database(r).GetBookByISBN(isbn); err == nil {
+		fmt.Fprint(w, isbnForm(isbn)+fmt.Sprintf("<p>This ISBN is already <a href='/books/%d'>%s</a>.</p>",
+			book.ID, html.EscapeString(book.Title)))
+		return
+	} else if !errors.Is(err, bookshelf.ErrNotFound) {
+		dbError(w, err)
+		return
+	}
+	isbn13, md, err := lookupISBN(r.Context(), isbn)
+	if errors.Is(err, bookshelf.ErrInvalid) {
+		fmt.Fprint(w, isbnForm(isbn)+"<p>"+html.EscapeString(err.Error())+"</p>")
+		return
+	} else if errors.Is(err, bookshelf.ErrNotFound) {
+		fmt.Fprint(w, isbnForm(isbn)+"<p>No book with this ISBN was found. <a href='/books/add'>Add it by hand</a></p>")
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	book := md.Book(isbn13)
+	cover := ""
+	if md.CoverURL != "" {
+		cover = fmt.Sprintf(`<div class="form-group">
+			<img src="%s" width="128">
+		</div>`, html.EscapeString(md.CoverURL))
+	}
+	fmt.Fprintf(w, `<form method="post" action="/books/add/isbn">
+		<input type="hidden" name="isbn" value="%s">
+		<p>ISBN %s</p>
+		<div class="form-group">
+			<label for="title">Title</label>
+			<input class="form-control" name="title" id="title" value="%s">
+		</div>
+		<div class="form-group">
+			<label for="author">Author</label>
+			<input class="form-control" name="author" id="author" value="%s">
+		</div>
+		<div class="form-group">
+			<label for="publishedDate">Published</label>
+			<input class="form-control" name="publishedDate" id="publishedDate" value="%s" placeholder="YYYY-MM-DD">
+		</div>
+		<div class="form-group">
+			<label for="description">Description</label>
+			<textarea class="form-control" name="description" id="description">%s</textarea>
+		</div>
+		%s
+		<input type="submit" name="submit" id="submit" value="Add book">
+	</form>
+	<div><a href='/books/add/isbn'>Look up another ISBN</a></div>`,
+		isbn13, isbn13, html.EscapeString(book.Title), html.EscapeString(book.Author),
+		html.EscapeString(book.PublishedDate), html.EscapeString(book.Description), cover)
+}
+
+// createByISBNHandler adds the book confirmed on the add-by-ISBN page. The
+// ISBN is looked up again, so the cover copied is the one the provider
+// links rather than any URL the form could carry.
+func createByISBNHandler(w http.ResponseWriter, r *http.Request) {
+	isbn13, md, err := lookupISBN(r.Context(), r.FormValue("isbn"))
+	if errors.Is(err, errNoMetadata) {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	book := &bookshelf.Book{
+		Title:         r.FormValue("title"),
+		Author:        r.FormValue("author"),
+		Description:   r.FormValue("description"),
+		PublishedDate: r.FormValue("publishedDate"),
+		ISBN13:        isbn13,
+	}
+	id, err := addFromMetadata(r.Context(), book, md, actorFromRequest(r, bookshelf.SourceHTML))
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	markWrite(w, r)
+	http.Redirect(w, r, fmt.Sprintf("/books/%d", id), http.StatusFound)
+}
+
+// apiMetadata is the JSON form of what the metadata provider knows about a
+// book, prefilling a new one.
+type apiMetadata struct {
+	ISBN13        string   `json:"isbn13"`
+	Title         string   `json:"title"`
+	Authors       []string `json:"authors,omitempty"`
+	Categories    []string `json:"categories,omitempty"`
+	Description   string   `json:"description,omitempty"`
+	PublishedDate string   `json:"publishedDate,omitempty"`
+	CoverURL      string   `json:"coverUrl,omitempty"`
+}
+
+// apiMetadataError replies with the error of looking an ISBN up.
+func apiMetadataError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errNoMetadata) {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, errorStatus(err), map[string]string{"error": err.Error()})
+}
+
+// apiMetadataHandler returns what the metadata provider knows about the
+// book with the isbn route variable, or 404 if it knows nothing.
+func apiMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	isbn13, md, err := lookupISBN(r.Context(), mux.Vars(r)["isbn"])
+	if err != nil {
+		apiMetadataError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &apiMetadata{
+		ISBN13:        isbn13,
+		Title:         md.Title,
+		Authors:       md.Authors,
+		Categories:    md.Categories,
+		Description:   md.Description,
+		PublishedDate: md.PublishedDate,
+		CoverURL:      md.CoverURL,
+	})
+}
+
+// apiAddByISBN is the body of POST /api/books/isbn. The fields left out
+// are filled from the metadata provider.
+type apiAddByISBN struct {
+	ISBN          string  `json:"isbn"`
+	Title         *string `json:"title"`
+	Author        *string `json:"author"`
+	Description   *string `json:"description"`
+	PublishedDate *string `json:"publishedDate"`
+}
+
+// apiAddByISBNHandler adds a book by its ISBN, prefilled from the metadata
+// provider, and returns it with 201.
+func apiAddByISBNHandler(w http.ResponseWriter, r *http.Request) {
+	var body apiAddByISBN
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAddByISBNSize)).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid book: " + err.Error()})
+		return
+	}
+	isbn13, md, err := lookupISBN(r.Context(), body.ISBN)
+	if err != nil {
+		apiMetadataError(w, err)
+		return
+	}
+	book := md.Book(isbn13)
+	for _, f := range []struct{ field, value *string }{
+		{&book.Title, body.Title},
+		{&book.Author, body.Author},
+		{&book.Description, body.Description},
+		{&book.PublishedDate, body.PublishedDate},
+	} {
+		if f.value != nil {
+			*f.field = *f.value
+		}
+	}
+	id, err := addFromMetadata(r.Context(), book, md, actorFromRequest(r, bookshelf.SourceAPI))
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	markWrite(w, r)
+	if book, err = bookshelf.ReadPrimary(bookshelf.DB).GetBook(id); err != nil {
+		apiError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, toAPIBook(book))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+	"github.com/tony-yang/google-cloud-stack/bookshelf/metadatatest"
+)
+
+// useMetadataServer looks books up in a stub that knows volumes for the
+// rest of the test.
+func useMetadataServer(t *testing.T, volumes ...metadatatest.Volume) *metadatatest.Server {
+	srv := metadatatest.NewServer(volumes...)
+	saved := bookshelf.MetadataSource
+	bookshelf.MetadataSource = srv.Provider()
+	t.Cleanup(func() {
+		bookshelf.MetadataSource = saved
+		srv.Close()
+	})
+	return srv
+}
+
+func TestAddByISBN(t *testing.T) {
+	useMetadataServer(t, metadatatest.Volume{
+		ISBN13:        "9780441172719",
+		Title:         "Dune",
+		Authors:       []string{"Frank Herbert"},
+		Description:   "Arrakis.",
+		PublishedDate: "1965",
+	})
+
+	w := serve(t, "GET", "/api/metadata/0-441-17271-7", "")
+	var md apiMetadata
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &md) != nil || md.ISBN13 != "9780441172719" || md.Title != "Dune" {
+		t.Fatalf("GET /api/metadata = %d %s, want Dune", w.Code, w.Body)
+	}
+	if w := serve(t, "GET", "/books/add/isbn?isbn=9780441172719", ""); !strings.Contains(w.Body.String(), `value="Frank Herbert"`) {
+		t.Errorf("add by ISBN page = %s, want the author prefilled", w.Body)
+	}
+
+	w = serve(t, "POST", "/api/books/isbn", `{"isbn": "9780441172719", "title": "Dune (50th anniversary)"}`)
+	var book apiBook
+	if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &book) != nil {
+		t.Fatalf("POST /api/books/isbn = %d %s, want 201", w.Code, w.Body)
+	}
+	if book.Title != "Dune (50th anniversary)" || book.Author != "Frank Herbert" || book.Description != "Arrakis." || book.ISBN10 != "0441172717" {
+		t.Errorf("POST /api/books/isbn added %+v, want the provider's book with the title given", book)
+	}
+	if w := serve(t, "POST", "/api/books/isbn", `{"isbn": "9780441172719"}`); w.Code != http.StatusConflict {
+		t.Errorf("adding ISBN 9780441172719 again = %d %s, want 409", w.Code, w.Body)
+	}
+	if w := serve(t, "GET", "/books/add/isbn?isbn=9780441172719", ""); !strings.Contains(w.Body.String(), "already") {
+		t.Errorf("add by ISBN page for a book in the library = %s, want a link to it", w.Body)
+	}
+}
+
+func TestAddByISBNForm(t *testing.T) {
+	useMetadataServer(t, metadatatest.Volume{ISBN13: "9780765326355", Title: "The Way of Kings", Authors: []string{"Brandon Sanderson"}})
+
+	form := url.Values{"isbn": {"9780765326355"}, "title": {"The Way of Kings"}, "author": {"Brandon Sanderson"}}
+	w := serve(t, "POST", "/books/add/isbn", form.Encode())
+	if w.Code != http.StatusFound || !strings.HasPrefix(w.Header().Get("Location"), "/books/") {
+		t.Fatalf("POST /books/add/isbn = %d %s, want a redirect to the book", w.Code, w.Body)
+	}
+	book, err := bookshelf.DB.GetBookByISBN("9780765326355")
+	if err != nil || book.Title != "The Way of Kings" {
+		t.Errorf("GetBookByISBN after adding by ISBN = %v, %v, want The Way of Kings", book, err)
+	}
+}
+
+func TestAddByISBNNotFound(t *testing.T) {
+	useMetadataServer(t)
+
+	if w := serve(t, "GET", "/api/metadata/9780140449136", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET /api/metadata of an unknown ISBN = %d %s, want 404", w.Code, w.Body)
+	}
+	if w := serve(t, "POST", "/api/books/isbn", `{"isbn": "9780140449136"}`); w.Code != http.StatusNotFound {
+		t.Errorf("POST /api/books/isbn of an unknown ISBN = %d %s, want 404", w.Code, w.Body)
+	}
+	if w := serve(t, "GET", "/books/add/isbn?isbn=9780140449136", ""); !strings.Contains(w.Body.String(), "No book with this ISBN") {
+		t.Errorf("add by ISBN page for an unknown ISBN = %s, want a way to add it by hand", w.Body)
+	}
+	if w := serve(t, "GET", "/api/metadata/9780140449137", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("GET /api/metadata of an invalid ISBN = %d %s, want 400", w.Code, w.Body)
+	}
+}
+
+func TestAddByISBNProviderFailure(t *testing.T) {
+	srv := useMetadataServer(t, metadatatest.Volume{ISBN13: "9780547928227", Title: "The Hobbit"})
+
+	for _, fail := range []struct {
+		name  string
+		start func()
+	}{
+		{"503", func() { srv.Fail(http.StatusServiceUnavailable) }},
+		{"malformed JSON", func() { srv.Fail(0); srv.Malform(true) }},
+	} {
+		fail.start()
+		if w := serve(t, "GET", "/api/metadata/9780547928227", ""); w.Code != http.StatusBadGateway {
+			t.Errorf("GET /api/metadata from a provider answering %s = %d %s, want 502", fail.name, w.Code, w.Body)
+		}
+		if w := serve(t, "POST", "/api/books/isbn", `{"isbn": "9780547928227"}`); w.Code != http.StatusBadGateway {
+			t.Errorf("POST /api/books/isbn with a provider answering %s = %d %s, want 502", fail.name, w.Code, w.Body)
+		}
+		if w := serve(t, "GET", "/books/add/isbn?isbn=9780547928227", ""); w.Code != http.StatusBadGateway {
+			t.Errorf("add by ISBN page with a provider answering %s = %d, want 502", fail.name, w.Code)
+		}
+	}
+	if _, err := bookshelf.DB.GetBookByISBN("9780547928227"); err == nil {
+		t.Errorf("a book was added without its metadata")
+	}
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// loanPeriod is how long a copy is lent for. main sets it from
+// bookshelf.LoanPeriod.
+var loanPeriod = bookshelf.DefaultLoanPeriod
+
+// routeID parses the route variable name as an ID.
+func routeID(r *http.Request, name string) (int64, error) {
+	return strconv.ParseInt(mux.Vars(r)[name], 10, 64)
+}
+
+// availabilityNote says how many copies of a book are on the shelf, or
+// nothing if the library has none.
+func availabilityNote(a bookshelf.Availability) string {
+	if a.Copies == 0 {
+		return ""
+	}
+	note := fmt.Sprintf(" (%d of %d copies available", a.Available(), a.Copies)
+	if a.Holds > 0 {
+		note += fmt.Sprintf(", %d on hold", a.Holds)
+	}
+	return note + ")"
+}
+
+// loanLine describes a loan's dates, marking it if it is overdue.
+func loanLine(l *bookshelf.Loan) string {
+	line := fmt.Sprintf("checked out %s, due %s", formatDate(l.CheckedOutAt), formatDate(l.DueAt))
+	switch {
+	case !l.Open():
+		line += ", returned " + formatDate(l.ReturnedAt)
+	case l.Overdue(time.Now()):
+		line += ", overdue"
+	}
+	return line
+}
+
+// returnForm renders the button that returns a loan.
+func returnForm(l *bookshelf.Loan) string {
+	return fmt.Sprintf("<form method='post' action='/books/%d/loans/%d/return'><input type='submit' value='Return'></form>", l.BookID, l.ID)
+}
+
+// lendingSection renders the copies of the book with id and who may borrow
+// them. Logged in users can check a copy out, return theirs, or join the
+// holds queue. Borrowers are named only to admins, who can also return any
+// loan and add and remove copies.
+func lendingSection(r *http.Request, id int64) (string, error) {
+	db := database(r)
+	copies, err := db.ListCopies(id)
+	if err != nil {
+		return "", err
+	}
+	holds, err := db.ListHolds(id)
+	if err != nil {
+		return "", err
+	}
+	profile := profileFromSession(r)
+	admin := isAdmin(r)
+	var own *bookshelf.Loan
+	a := bookshelf.Availability{Copies: len(copies), Holds: len(holds)}
+	result := "<h3>Copies</h3><ul>"
+	for _, c := range copies {
+		line := "Copy " + strconv.FormatInt(c.ID, 10)
+		if c.Label != "" {
+			line += " (" + c.Label + ")"
+		}
+		result += "<li>"
+		switch l := c.Loan; {
+		case l == nil:
+			result += html.EscapeString(line + ": on the shelf")
+			if admin {
+				result += fmt.Sprintf("<form method='post' action='/books/%d/copies/%d/delete' onsubmit='return confirm(\"Remove this copy?\")'><input type='submit' value='Remove'></form>", id, c.ID)
+			}
+		case profile != nil && l.UserID == profile.ID:
+			own = l
+			a.OnLoan++
+			result += html.EscapeString(line+": lent to you, "+loanLine(l)) + returnForm(l)
+		case admin:
+			a.OnLoan++
+			result += html.EscapeString(fmt.Sprintf("%s: lent to %s, %s", line, l.UserName, loanLine(l))) + returnForm(l)
+		default:
+			a.OnLoan++
+			result += html.EscapeString(line + ": lent out, due " + formatDate(l.DueAt))
+		}
+		result += "</li>"
+	}
+	result += "</ul>"
+	if len(copies) == 0 {
+		result += "<p>The library has no copies of this book.</p>"
+	} else {
+		result += "<p>" + html.EscapeString(availabilityNote(a)) + "</p>"
+	}
+	if profile != nil && own == nil && len(copies) > 0 {
+		// Free copies are kept for the users ahead in the queue, as
+		// CheckOut does.
+		place, ahead := 0, len(holds)
+		for i, h := range holds {
+			if h.UserID == profile.ID {
+				place, ahead = i+1, i
+			}
+		}
+		if ahead < a.Available() {
+			result += fmt.Sprintf("<form method='post' action='/books/%d/checkout'><input type='submit' value='Check out'></form>", id)
+		}
+		if place == 0 {
+			result += fmt.Sprintf("<form method='post' action='/books/%d/hold'><input type='submit' value='Place hold'></form>", id)
+		} else {
+			result += fmt.Sprintf("<p>You are number %d in the holds queue.</p>", place)
+			result += fmt.Sprintf("<form method='post' action='/books/%d/hold/cancel'><input type='submit' value='Cancel hold'></form>", id)
+		}
+	}
+	if admin {
+		result += fmt.Sprintf(`<form method="post" action="/books/%d/copies">
+			<input name="label" placeholder="Label, such as a shelf mark"> <input type="submit" value="Add copy">
+		</form>`, id)
+	}
+	return result, nil
+}
+
+// loanTable renders loans with their books, naming the borrowers if
+// borrowers is set, with a button to return each open loan.
+func loanTable(loans []*bookshelf.Loan, borrowers bool) string {
+	result := "<table><tr><th>Book</th>"
+	if borrowers {
+		result += "<th>Borrower</th>"
+	}
+	result += "<th>Loan</th><th></th></tr>"
+	for _, l := range loans {
+		result += fmt.Sprintf("<tr><td><a href='/books/%d'>%s</a></td>", l.BookID, html.EscapeString(l.Book.Title))
+		if borrowers {
+			result += "<td>" + html.EscapeString(l.UserName) + "</td>"
+		}
+		result += "<td>" + html.EscapeString(loanLine(l)) + "</td><td>"
+		if l.Open() {
+			result += returnForm(l)
+		}
+		result += "</td></tr>"
+	}
+	return result + "</table>"
+}
+
+// loansHandler shows the logged in user's loans, open and returned.
+func loansHandler(w http.ResponseWriter, r *http.Request) {
+	profile := profileFromSession(r)
+	if profile == nil {
+		http.Redirect(w, r, "/login?redirect=/loans", http.StatusFound)
+		return
+	}
+	loans, err := database(r).ListLoans(bookshelf.LoanQuery{UserID: profile.ID})
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	result := "<h3>My loans</h3>"
+	if len(loans) == 0 {
+		result += "<p>You have not borrowed any books.</p>"
+	} else {
+		result += loanTable(loans, false)
+	}
+	result += "<div><a href='/books'>Back to books</a></div>"
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, result)
+}
+
+// adminLoansHandler shows every open loan, or only the overdue ones if the
+// overdue parameter is set, to admins.
+func adminLoansHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	q := bookshelf.LoanQuery{Open: true}
+	if r.FormValue("overdue") != "" {
+		q.DueBefore = time.Now()
+	}
+	loans, err := database(r).ListLoans(q)
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	result := "<h3>Open loans</h3><div><a href='/admin/loans'>All</a> <a href='/admin/loans?overdue=1'>Overdue</a></div>"
+	result += loanTable(loans, true) + "<div><a href='/books'>Back to books</a></div>"
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, result)
+}
+
+// userAction runs a change by the logged in user to the book in the path,
+// such as borrowing it, and goes back to its page. Logged out users are sent
+// to log in first.
+func userAction(w http.ResponseWriter, r *http.Request, f func(id int64, profile *Profile) error) {
+	id, err := routeID(r, "id")
+	if err != nil {
+		http.Redirect(w, r, "/books", http.StatusFound)
+		return
+	}
+	profile := profileFromSession(r)
+	if profile == nil {
+		http.Redirect(w, r, fmt.Sprintf("/login?redirect=/books/%d", id), http.StatusFound)
+		return
+	}
+	if err := f(id, profile); err != nil {
+		dbError(w, err)
+		return
+	}
+	markWrite(w, r)
+	http.Redirect(w, r, fmt.Sprintf("/books/%d", id), http.StatusFound)
+}
+
+// checkOut lends a copy of a book to profile for loanPeriod.
+func checkOut(id int64, profile *Profile) (*bookshelf.Loan, error) {
+	return bookshelf.DB.CheckOut(id, profile.ID, profile.DisplayName, time.Now().Add(loanPeriod))
+}
+
+// returnLoan returns a loan of a book on behalf of profile. Only the
+// borrower and admins may return it.
+func returnLoan(id, loanID int64, profile *Profile) (*bookshelf.Loan, error) {
+	if !bookshelf.IsAdmin(profile.ID) {
+		loans, err := bookshelf.DB.ListLoans(bookshelf.LoanQuery{UserID: profile.ID, BookID: id, Open: true})
+		if err != nil {
+			return nil, err
+		}
+		if len(loans) == 0 || loans[0].ID != loanID {
+			return nil, errForbidden
+		}
+	}
+	return bookshelf.DB.CheckIn(id, loanID)
+}
+
+// checkOutHandler lends a copy of a book to the logged in user.
+func checkOutHandler(w http.ResponseWriter, r *http.Request) {
+	userAction(w, r, func(id int64, profile *Profile) error {
+		_, err := checkOut(id, profile)
+		return err
+	})
+}
+
+// returnHandler returns the loan in the path.
+func returnHandler(w http.ResponseWriter, r *http.Request) {
+	userAction(w, r, func(id int64, profile *Profile) error {
+		loanID, err := routeID(r, "loanId")
+		if err != nil {
+			return fmt.Errorf("invalid loan id: %w", bookshelf.ErrInvalid)
+		}
+		_, err = returnLoan(id, loanID, profile)
+		return err
+	})
+}
+
+// placeHoldHandler puts the logged in user in the holds queue of a book.
+func placeHoldHandler(w http.ResponseWriter, r *http.Request) {
+	userAction(w, r, func(id int64, profile *Profile) error {
+		_, err := bookshelf.DB.PlaceHold(id, profile.ID, profile.DisplayName)
+		return err
+	})
+}
+
+// cancelHoldHandler takes the logged in user off the holds queue of a book.
+func cancelHoldHandler(w http.ResponseWriter, r *http.Request) {
+	userAction(w, r, func(id int64, profile *Profile) error {
+		return bookshelf.DB.CancelHold(id, profile.ID)
+	})
+}
+
+// addCopyHandler adds a copy of a book with the submitted label. Only
+// admins may add copies.
+func addCopyHandler(w http.ResponseWriter, r *http.Request) {
+	userAction(w, r, func(id int64, profile *Profile) error {
+		if !bookshelf.IsAdmin(profile.ID) {
+			return errForbidden
+		}
+		_, err := bookshelf.DB.AddCopy(id, r.FormValue("label"))
+		return err
+	})
+}
+
+// removeCopyHandler removes the copy in the path. Only admins may remove
+// copies.
+func removeCopyHandler(w http.ResponseWriter, r *http.Request) {
+	userAction(w, r, func(id int64, profile *Profile) error {
+		if !bookshelf.IsAdmin(profile.ID) {
+			return errForbidden
+		}
+		copyID, err := routeID(r, "copyId")
+		if err != nil {
+			return fmt.Errorf("invalid copy id: %w", bookshelf.ErrInvalid)
+		}
+		return bookshelf.DB.RemoveCopy(id, copyID)
+	})
+}
+
+// apiLoan is the JSON form of a Loan. The dates a loan has not reached yet
+// are left out.
+type apiLoan struct {
+	ID           int64      `json:"id"`
+	CopyID       int64      `json:"copyId"`
+	BookID       int64      `json:"bookId"`
+	UserID       string     `json:"userId,omitempty"`
+	UserName     string     `json:"userName,omitempty"`
+	CheckedOutAt time.Time  `json:"checkedOutAt"`
+	DueAt        time.Time  `json:"dueAt"`
+	ReturnedAt   *time.Time `json:"returnedAt,omitempty"`
+	Overdue      bool       `json:"overdue"`
+	Book         *apiBook   `json:"book,omitempty"`
+}
+
+func toAPILoan(l *bookshelf.Loan) *apiLoan {
+	a := &apiLoan{
+		ID:           l.ID,
+		CopyID:       l.CopyID,
+		BookID:       l.BookID,
+		UserID:       l.UserID,
+		UserName:     l.UserName,
+		CheckedOutAt: l.CheckedOutAt,
+		DueAt:        l.DueAt,
+		Overdue:      l.Overdue(time.Now()),
+	}
+	if !l.Open() {
+		a.ReturnedAt = &l.ReturnedAt
+	}
+	if l.Book != nil {
+		a.Book = toAPIBook(l.Book)
+	}
+	return a
+}
+
+func toAPILoans(loans []*bookshelf.Loan) []*apiLoan {
+	a := make([]*apiLoan, len(loans))
+	for i, l := range loans {
+		a[i] = toAPILoan(l)
+	}
+	return a
+}
+
+// apiCopy is the JSON form of a Copy.
+type apiCopy struct {
+	ID      int64     `json:"id"`
+	Label   string    `json:"label,omitempty"`
+	AddedAt time.Time `json:"addedAt"`
+	Loan    *apiLoan  `json:"loan,omitempty"`
+}
+
+// apiCopies is the reply listing the copies of a book and its holds queue.
+type apiCopies struct {
+	Available int        `json:"available"`
+	Copies    []*apiCopy `json:"copies"`
+	Holds     int        `json:"holds"`
+
+	// Place is the logged in user's place in the holds queue, counting
+	// from 1, or 0 if they are not in it.
+	Place int `json:"place,omitempty"`
+}
+
+// apiCopiesHandler lists the copies of a book and who may borrow them.
+// Like the book's page, it names borrowers only to themselves and admins.
+func apiCopiesHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r)
+	if !ok {
+		return
+	}
+	db := database(r)
+	copies, err := db.ListCopies(id)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	holds, err := db.ListHolds(id)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	profile := profileFromSession(r)
+	admin := isAdmin(r)
+	a := apiCopies{Copies: make([]*apiCopy, len(copies)), Holds: len(holds)}
+	for i, c := range copies {
+		a.Copies[i] = &apiCopy{ID: c.ID, Label: c.Label, AddedAt: c.AddedAt}
+		if c.Loan == nil {
+			a.Available++
+			continue
+		}
+		a.Copies[i].Loan = toAPILoan(c.Loan)
+		if !admin && (profile == nil || c.Loan.UserID != profile.ID) {
+			a.Copies[i].Loan.UserID, a.Copies[i].Loan.UserName = "", ""
+		}
+	}
+	for i, h := range holds {
+		if profile != nil && h.UserID == profile.ID {
+			a.Place = i + 1
+		}
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+// apiProfile returns the logged in user, replying with 401 if there is
+// none.
+func apiProfile(w http.ResponseWriter, r *http.Request) (*Profile, bool) {
+	profile := profileFromSession(r)
+	if profile == nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "log in first"})
+		return nil, false
+	}
+	return profile, true
+}
+
+// apiAddCopyHandler adds a copy of a book, with the label parameter, and
+// replies with it. Only admins may add copies.
+func apiAddCopyHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r)
+	if !ok {
+		return
+	}
+	if !isAdmin(r) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": http.StatusText(http.StatusForbidden)})
+		return
+	}
+	c, err := bookshelf.DB.AddCopy(id, r.FormValue("label"))
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	markWrite(w, r)
+	writeJSON(w, http.StatusCreated, &apiCopy{ID: c.ID, Label: c.Label, AddedAt: c.AddedAt})
+}
+
+// apiRemoveCopyHandler removes a copy of a book that is not lent out. Only
+// admins may remove copies.
+func apiRemoveCopyHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r)
+	if !ok {
+		return
+	}
+	if !isAdmin(r) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": http.StatusText(http.StatusForbidden)})
+		return
+	}
+	copyID, err := routeID(r, "copyId")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid copy id"})
+		return
+	}
+	if err := bookshelf.DB.RemoveCopy(id, copyID); err != nil {
+		apiError(w, err)
+		return
+	}
+	markWrite(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiCheckOutHandler lends a copy of a book to the logged in user and
+// replies with the loan.
+func apiCheckOutHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r)
+	if !ok {
+		return
+	}
+	profile, ok := apiProfile(w, r)
+	if !ok {
+		return
+	}
+	loan, err := checkOut(id, profile)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	markWrite(w, r)
+	writeJSON(w, http.StatusCreated, toAPILoan(loan))
+}
+
+// apiReturnHandler returns a loan and replies with it. Only the borrower
+// and admins may return it.
+func apiReturnHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r)
+	if !ok {
+		return
+	}
+	profile, ok := apiProfile(w, r)
+	if !ok {
+		return
+	}
+	loanID, err := routeID(r, "loanId")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid loan id"})
+		return
+	}
+	loan, err := returnLoan(id, loanID, profile)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	markWrite(w, r)
+	writeJSON(w, http.StatusOK, toAPILoan(loan))
+}
+
+// apiPlaceHoldHandler puts the logged in user in the holds queue of a book.
+func apiPlaceHoldHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r)
+	if !ok {
+		return
+	}
+	profile, ok := apiProfile(w, r)
+	if !ok {
+		return
+	}
+	hold, err := bookshelf.DB.PlaceHold(id, profile.ID, profile.DisplayName)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	markWrite(w, r)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"bookId": hold.BookID, "placedAt": hold.PlacedAt})
+}
+
+// apiCancelHoldHandler takes the logged in user off the holds queue of a
+// book.
+func apiCancelHoldHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r)
+	if !ok {
+		return
+	}
+	profile, ok := apiProfile(w, r)
+	if !ok {
+		return
+	}
+	if err := bookshelf.DB.CancelHold(id, profile.ID); err != nil {
+		apiError(w, err)
+		return
+	}
+	markWrite(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiLoansHandler lists the logged in user's loans with their books, or
+// only the open ones if the open parameter is set. Admins can list every
+// user's loans with all=1.
+func apiLoansHandler(w http.ResponseWriter, r *http.Request) {
+	profile, ok := apiProfile(w, r)
+	if !ok {
+		return
+	}
+	q := bookshelf.LoanQuery{UserID: profile.ID, Open: r.FormValue("open") != ""}
+	if r.FormValue("all") != "" {
+		if !isAdmin(r) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": http.StatusText(http.StatusForbidden)})
+			return
+		}
+		q.UserID = ""
+	}
+	loans, err := database(r).ListLoans(q)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPILoans(loans))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+	"golang.org/x/oauth2"
+)
+
+// TestMain runs the tests against an in-memory SQLite database, without
+// the other services.
+func TestMain(m *testing.M) {
+	bookshelf.DBBackend = "sqlite"
+	bookshelf.SQLitePath = ":memory:"
+	if err := bookshelf.ConfigureDatabase(); err != nil {
+		log.Fatal(err)
+	}
+	code := m.Run()
+	bookshelf.DB.Close()
+	os.Exit(code)
+}
+
+// serve sends a request with body, if any, to the app's router and returns
+// the response. A body starting with "{" is sent as JSON, and any other as
+// a form.
+func serve(t *testing.T, method, target, body string) *httptest.ResponseRecorder {
+	return serveAs(t, nil, method, target, body)
+}
+
+// serveAs is serve with the user of profile logged in, if it is not nil.
+func serveAs(t *testing.T, profile *Profile, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if strings.HasPrefix(body, "{") {
+		req.Header.Set("Content-Type", "application/json")
+	} else if body != "" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if profile != nil {
+		session, err := bookshelf.SessionStore.New(req, defaultSessionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		session.Values[oauthTokenSessionKey] = &oauth2.Token{AccessToken: "token", Expiry: time.Now().Add(time.Hour)}
+		session.Values[googleProfileSessionKey] = profile
+		login := httptest.NewRecorder()
+		if err := session.Save(req, login); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range login.Result().Cookies() {
+			req.AddCookie(c)
+		}
+	}
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, req)
+	return w
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// The OPDS 1.2 catalog at /opds lets e-reader apps browse the library. It
+// is a tree of Atom feeds: navigation feeds, whose entries link to other
+// feeds, and acquisition feeds, whose entries are books. Its links are
+// relative, to be resolved against the feed's own URL.
+
+// Content types of the catalog's documents.
+const (
+	opdsNavigationType  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opdsAcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	openSearchType      = "application/opensearchdescription+xml"
+)
+
+// Link relations of OPDS. A book's entry links to its page with the borrow
+// relation, since the library lends paper books rather than files.
+const (
+	opdsImageRel     = "http://opds-spec.org/image"
+	opdsThumbnailRel = "http://opds-spec.org/image/thumbnail"
+	opdsBorrowRel    = "http://opds-spec.org/acquisition/borrow"
+	opdsSortNewRel   = "http://opds-spec.org/sort/new"
+)
+
+// opdsPageSize is how many entries a page of a feed has.
+const opdsPageSize = 25
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term  string `xml:"term,attr"`
+	Label string `xml:"label,attr"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Updated    string         `xml:"updated"`
+	Published  string         `xml:"published,omitempty"`
+	Authors    []atomPerson   `xml:"author"`
+	Identifier string         `xml:"dc:identifier,omitempty"`
+	Issued     string         `xml:"dc:issued,omitempty"`
+	Categories []atomCategory `xml:"category"`
+	Summary    *atomText      `xml:"summary"`
+	Content    *atomText      `xml:"content"`
+	Links      []atomLink     `xml:"link"`
+}
+
+type atomFeed struct {
+	XMLName     xml.Name    `xml:"feed"`
+	Xmlns       string      `xml:"xmlns,attr"`
+	XmlnsDC     string      `xml:"xmlns:dc,attr,omitempty"`
+	XmlnsOPDS   string      `xml:"xmlns:opds,attr,omitempty"`
+	ID          string      `xml:"id"`
+	Title       string      `xml:"title"`
+	Updated     string      `xml:"updated"`
+	Author      atomPerson  `xml:"author"`
+	Links       []atomLink  `xml:"link"`
+	Entries     []atomEntry `xml:"entry"`
+	contentType string
+}
+
+// newOPDSFeed starts a feed of kind, the content type of a navigation or
+// acquisition feed, served at href, with links to itself, the root and
+// the search.
+func newOPDSFeed(id, title, href, kind string) *atomFeed {
+	return &atomFeed{
+		Xmlns:     "http://www.w3.org/2005/Atom",
+		XmlnsDC:   "http://purl.org/dc/terms/",
+		XmlnsOPDS: "http://opds-spec.org/2010/catalog",
+		ID:        "urn:bookshelf:opds:" + id,
+		Title:     title,
+		Updated:   opdsTime(time.Now()),
+		Author:    atomPerson{Name: "Bookshelf"},
+		Links: []atomLink{
+			{Rel: "self", Href: href, Type: kind},
+			{Rel: "start", Href: "/opds", Type: opdsNavigationType},
+			{Rel: "search", Href: "/opds/search.xml", Type: openSearchType},
+		},
+		contentType: kind,
+	}
+}
+
+// opdsTime formats t as Atom dates are.
+func opdsTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// navigation adds an entry linking to the feed at href with rel.
+func (f *atomFeed) navigation(id, title, summary, rel, href, kind string) {
+	f.Entries = append(f.Entries, atomEntry{
+		Title:   title,
+		ID:      "urn:bookshelf:opds:" + id,
+		Updated: f.Updated,
+		Content: &atomText{Type: "text", Text: summary},
+		Links:   []atomLink{{Rel: rel, Href: href, Type: kind}},
+	})
+}
+
+// book adds an entry for b. Books saved before their times were kept are
+// dated as updated now.
+func (f *atomFeed) book(b *bookshelf.Book) {
+	updated := b.UpdatedAt
+	if updated.IsZero() {
+		updated = b.CreatedAt
+	}
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	e := atomEntry{
+		Title:   b.Title,
+		ID:      fmt.Sprintf("urn:bookshelf:book:%d", b.ID),
+		Updated: opdsTime(updated),
+		Issued:  b.PublishedDate,
+		Links: []atomLink{
+			{Rel: "alternate", Href: fmt.Sprintf("/books/%d", b.ID), Type: "text/html"},
+			{Rel: opdsBorrowRel, Href: fmt.Sprintf("/books/%d", b.ID), Type: "text/html"},
+		},
+	}
+	contributors := b.Contributors
+	if contributors == nil {
+		contributors = bookshelf.ParseContributors(b.Author)
+	}
+	for _, c := range contributors {
+		p := atomPerson{Name: c.Name}
+		if c.AuthorID != 0 {
+			p.URI = fmt.Sprintf("/opds/authors/%d", c.AuthorID)
+		}
+		e.Authors = append(e.Authors, p)
+	}
+	if !b.CreatedAt.IsZero() {
+		e.Published = opdsTime(b.CreatedAt)
+	}
+	if b.ISBN13 != "" {
+		e.Identifier = "urn:isbn:" + b.ISBN13
+	}
+	for _, t := range append(append([]string(nil), b.Genres...), b.Tags...) {
+		e.Categories = append(e.Categories, atomCategory{Term: t, Label: t})
+	}
+	if b.Description != "" {
+		e.Summary = &atomText{Type: "text", Text: b.Description}
+	}
+	if b.ImageURL != "" {
+		imageType := mime.TypeByExtension(path.Ext(b.ImageURL))
+		e.Links = append(e.Links,
+			atomLink{Rel: opdsImageRel, Href: b.ImageURL, Type: imageType},
+			atomLink{Rel: opdsThumbnailRel, Href: b.ImageURL, Type: imageType})
+	}
+	f.Entries = append(f.Entries, e)
+}
+
+// books adds an entry for each of books, with links to the pages before
+// and after page, from 1, of the list they are part of, of total books.
+func (f *atomFeed) books(books []*bookshelf.Book, href string, q url.Values, page, total int) {
+	for _, b := range books {
+		f.book(b)
+	}
+	link := func(rel string, page int) {
+		q.Set("page", strconv.Itoa(page))
+		f.Links = append(f.Links, atomLink{Rel: rel, Href: href + "?" + q.Encode(), Type: f.contentType})
+	}
+	last := (total + opdsPageSize - 1) / opdsPageSize
+	if page > 1 {
+		link("first", 1)
+		link("previous", page-1)
+	}
+	if page < last {
+		link("next", page+1)
+		link("last", last)
+	}
+}
+
+// opdsPage parses the page parameter, from 1, replying with 400 if it is
+// not a page number.
+func opdsPage(w http.ResponseWriter, r *http.Request) (int, bool) {
+	v := r.FormValue("page")
+	if v == "" {
+		return 1, true
+	}
+	page, err := strconv.Atoi(v)
+	if err != nil || page < 1 {
+		http.Error(w, fmt.Sprintf("invalid page %q", v), http.StatusBadRequest)
+		return 0, false
+	}
+	return page, true
+}
+
+// pageOf returns page, from 1, of books.
+func pageOf(books []*bookshelf.Book, page int) []*bookshelf.Book {
+	from := (page - 1) * opdsPageSize
+	if from >= len(books) {
+		return nil
+	}
+	if to := from + opdsPageSize; to < len(books) {
+		return books[from:to]
+	}
+	return books[from:]
+}
+
+// writeOPDS serves f.
+func writeOPDS(w http.ResponseWriter, f *atomFeed) {
+	w.Header().Set("Content-Type", f.contentType+";charset=utf-8")
+	fmt.Fprint(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(f); err != nil {
+		log.Printf("writeOPDS: could not encode feed %s: %v", f.ID, err)
+	}
+}
+
+// opdsRootHandler serves the root of the catalog, linking to every book,
+// the newest books and the books by author and by tag.
+func opdsRootHandler(w http.ResponseWriter, r *http.Request) {
+	f := newOPDSFeed("root", "Bookshelf", "/opds", opdsNavigationType)
+	f.navigation("books", "All books", "Every book in the library, by title.", "subsection", "/opds/books", opdsAcquisitionType)
+	f.navigation("new", "Newest", "The books added most recently.", opdsSortNewRel, "/opds/new", opdsAcquisitionType)
+	f.navigation("authors", "By author", "The books of each author.", "subsection", "/opds/authors", opdsNavigationType)
+	f.navigation("tags", "By tag", "The books with each tag.", "subsection", "/opds/tags", opdsNavigationType)
+	writeOPDS(w, f)
+}
+
+// opdsBooksHandler serves every book by title, or those with the tag
+// parameter, or whose title or author contains the q parameter, which is
+// how the catalog is searched.
+func opdsBooksHandler(w http.ResponseWriter, r *http.Request) {
+	page, ok := opdsPage(w, r)
+	if !ok {
+		return
+	}
+	filter := bookshelf.BookFilter{Query: r.FormValue("q"), Tag: r.FormValue("tag")}
+	books, err := database(r).FilterBooks(filter)
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	f := newOPDSFeed("books", "All books", "/opds/books", opdsAcquisitionType)
+	params := url.Values{}
+	switch {
+	case filter.Query != "":
+		f.ID, f.Title = "urn:bookshelf:opds:search:"+url.QueryEscape(filter.Query), "Search: "+filter.Query
+		params.Set("q", filter.Query)
+	case filter.Tag != "":
+		f.ID, f.Title = "urn:bookshelf:opds:tag:"+url.QueryEscape(filter.Tag), "Tag: "+filter.Tag
+		params.Set("tag", filter.Tag)
+	}
+	if len(params) > 0 {
+		f.Links[0].Href += "?" + params.Encode()
+	}
+	f.books(pageOf(books, page), "/opds/books", params, page, len(books))
+	writeOPDS(w, f)
+}
+
+// opdsNewHandler serves the books added most recently, newest first.
+func opdsNewHandler(w http.ResponseWriter, r *http.Request) {
+	page, ok := opdsPage(w, r)
+	if !ok {
+		return
+	}
+	books, err := database(r).FilterBooks(bookshelf.BookFilter{Sort: bookshelf.SortNewest})
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	f := newOPDSFeed("new", "Newest", "/opds/new", opdsAcquisitionType)
+	f.books(pageOf(books, page), "/opds/new", url.Values{}, page, len(books))
+	writeOPDS(w, f)
+}
+
+// opdsAuthorsHandler serves a navigation feed of the authors, by name,
+// each linking to their books.
+func opdsAuthorsHandler(w http.ResponseWriter, r *http.Request) {
+	page, ok := opdsPage(w, r)
+	if !ok {
+		return
+	}
+	// Ask for one more author than the page holds, to know if there is a
+	// next page.
+	authors, err := database(r).SearchAuthors("", page*opdsPageSize+1)
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	f := newOPDSFeed("authors", "By author", "/opds/authors", opdsNavigationType)
+	for i := (page - 1) * opdsPageSize; i < len(authors) && i < page*opdsPageSize; i++ {
+		a := authors[i]
+		f.navigation(fmt.Sprintf("author:%d", a.ID), a.Name, "Books by "+a.Name+".", "subsection",
+			fmt.Sprintf("/opds/authors/%d", a.ID), opdsAcquisitionType)
+	}
+	if page > 1 {
+		f.Links = append(f.Links,
+			atomLink{Rel: "first", Href: "/opds/authors", Type: opdsNavigationType},
+			atomLink{Rel: "previous", Href: fmt.Sprintf("/opds/authors?page=%d", page-1), Type: opdsNavigationType})
+	}
+	if len(authors) > page*opdsPageSize {
+		f.Links = append(f.Links, atomLink{Rel: "next", Href: fmt.Sprintf("/opds/authors?page=%d", page+1), Type: opdsNavigationType})
+	}
+	writeOPDS(w, f)
+}
+
+// opdsAuthorHandler serves the books of the author with the id route
+// variable, by title.
+func opdsAuthorHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	page, ok := opdsPage(w, r)
+	if !ok {
+		return
+	}
+	db := database(r)
+	author, err := db.GetAuthor(id)
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	books, err := db.ListAuthorBooks(id)
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	href := fmt.Sprintf("/opds/authors/%d", id)
+	f := newOPDSFeed(fmt.Sprintf("author:%d", id), author.Name, href, opdsAcquisitionType)
+	f.books(pageOf(books, page), href, url.Values{}, page, len(books))
+	writeOPDS(w, f)
+}
+
+// opdsTagsHandler serves a navigation feed of the tags, each linking to
+// the books with it.
+func opdsTagsHandler(w http.ResponseWriter, r *http.Request) {
+	cloud, err := database(r).TagCloud()
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	f := newOPDSFeed("tags", "By tag", "/opds/tags", opdsNavigationType)
+	for _, c := range cloud.Tags {
+		f.navigation("tag:"+url.QueryEscape(c.Tag), c.Tag, fmt.Sprintf("%d books", c.Count), "subsection",
+			"/opds/books?"+url.Values{"tag": {c.Tag}}.Encode(), opdsAcquisitionType)
+	}
+	writeOPDS(w, f)
+}
+
+type openSearchURL struct {
+	Type     string `xml:"type,attr"`
+	Template string `xml:"template,attr"`
+}
+
+type openSearchDescription struct {
+	XMLName     xml.Name      `xml:"OpenSearchDescription"`
+	Xmlns       string        `xml:"xmlns,attr"`
+	ShortName   string        `xml:"ShortName"`
+	Description string        `xml:"Description"`
+	URL         openSearchURL `xml:"Url"`
+}
+
+// baseURL returns the scheme and host the request was sent to, for the
+// documents whose links must be absolute.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return (&url.URL{Scheme: scheme, Host: r.Host}).String()
+}
+
+// opdsSearchHandler serves the OpenSearch description of the catalog's
+// search. Its template must be absolute, so it is built from the host the
+// request was sent to.
+func opdsSearchHandler(w http.ResponseWriter, r *http.Request) {
+	d := openSearchDescription{
+		Xmlns:       "http://a9.com/-/spec/opensearch/1.1/",
+		ShortName:   "Bookshelf",
+		Description: "Search the books of the library by title or author.",
+		URL: openSearchURL{
+			Type:     opdsAcquisitionType,
+			Template: baseURL(r) + "/opds/books?q={searchTerms}",
+		},
+	}
+	w.Header().Set("Content-Type", openSearchType+";charset=utf-8")
+	fmt.Fprint(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(d); err != nil {
+		log.Printf("opdsSearchHandler: could not encode description: %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// opdsFeed decodes the parts of a catalog feed the tests check. The Dublin
+// Core elements are matched by namespace, as the decoder resolves their
+// prefix.
+type opdsFeed struct {
+	ID      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Links   []atomLink `xml:"link"`
+	Entries []struct {
+		Title      string         `xml:"title"`
+		ID         string         `xml:"id"`
+		Authors    []atomPerson   `xml:"author"`
+		Identifier string         `xml:"http://purl.org/dc/terms/ identifier"`
+		Issued     string         `xml:"http://purl.org/dc/terms/ issued"`
+		Categories []atomCategory `xml:"category"`
+		Summary    *atomText      `xml:"summary"`
+		Content    *atomText      `xml:"content"`
+		Links      []atomLink     `xml:"link"`
+	} `xml:"entry"`
+}
+
+// link returns the href of the first link of f with rel, or "".
+func (f *opdsFeed) link(rel string) string {
+	for _, l := range f.Links {
+		if l.Rel == rel {
+			return l.Href
+		}
+	}
+	return ""
+}
+
+// getOPDS fetches and decodes the feed at target, which must be served as
+// kind.
+func getOPDS(t *testing.T, target, kind string) *opdsFeed {
+	t.Helper()
+	w := serve(t, "GET", target, "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != kind+";charset=utf-8" {
+		t.Fatalf("GET %s = %d as %q, want a feed as %q", target, w.Code, w.Header().Get("Content-Type"), kind)
+	}
+	var f opdsFeed
+	if err := xml.NewDecoder(w.Body).Decode(&f); err != nil {
+		t.Fatalf("GET %s: could not decode feed: %v", target, err)
+	}
+	return &f
+}
+
+func TestOPDSRoot(t *testing.T) {
+	f := getOPDS(t, "/opds", opdsNavigationType)
+	if f.ID != "urn:bookshelf:opds:root" || f.link("self") != "/opds" || f.link("start") != "/opds" || f.link("search") != "/opds/search.xml" {
+		t.Errorf("the root is %s with links %+v, want links to itself and the search", f.ID, f.Links)
+	}
+	want := []atomLink{
+		{Rel: "subsection", Href: "/opds/books", Type: opdsAcquisitionType},
+		{Rel: opdsSortNewRel, Href: "/opds/new", Type: opdsAcquisitionType},
+		{Rel: "subsection", Href: "/opds/authors", Type: opdsNavigationType},
+		{Rel: "subsection", Href: "/opds/tags", Type: opdsNavigationType},
+	}
+	if len(f.Entries) != len(want) {
+		t.Fatalf("the root has %d entries, want %d", len(f.Entries), len(want))
+	}
+	for i, e := range f.Entries {
+		if len(e.Links) != 1 || e.Links[0] != want[i] || e.Content == nil || e.Content.Text == "" {
+			t.Errorf("root entry %q links to %+v, want %+v with a summary", e.Title, e.Links, want[i])
+		}
+	}
+	for _, target := range []string{"/opds/books", "/opds/new", "/opds/authors", "/opds/tags"} {
+		if w := serve(t, "GET", target, ""); w.Code != http.StatusOK {
+			t.Errorf("GET %s = %d, want 200", target, w.Code)
+		}
+	}
+}
+
+func TestOPDSBooks(t *testing.T) {
+	by := bookshelf.Actor{ID: "alice", Name: "Alice", Source: bookshelf.SourceHTML}
+	for i := 1; i <= opdsPageSize+5; i++ {
+		b := &bookshelf.Book{Title: fmt.Sprintf("OPDS Book %02d", i), Tags: []string{"opdstest"}}
+		if _, err := bookshelf.DB.AddBook(b, by); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := &bookshelf.Book{
+		Title: "Cranford", Author: "Elizabeth Gaskell", ISBN13: "9780140434194",
+		ImageURL: "https://example.com/cranford.jpg", Description: "Life in a small English town.",
+		PublishedDate: "1853", Tags: []string{"classic", "opdstest"}, Genres: []string{"fiction"},
+	}
+	id, err := bookshelf.DB.AddBook(b, by)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		page                                 string
+		entries                              int
+		first, previous, next, last, wantFor string
+	}{
+		{"", opdsPageSize, "", "", "page=2", "page=2", "Cranford"},
+		{"?page=1", opdsPageSize, "", "", "page=2", "page=2", "Cranford"},
+		{"?page=2", 6, "page=1", "page=1", "", "", "OPDS Book 25"},
+		{"?page=3", 0, "page=1", "page=2", "", "", ""},
+	} {
+		target := "/opds/books?tag=opdstest" + strings.Replace(c.page, "?", "&", 1)
+		f := getOPDS(t, target, opdsAcquisitionType)
+		if f.ID != "urn:bookshelf:opds:tag:opdstest" || f.link("self") != "/opds/books?tag=opdstest" {
+			t.Errorf("GET %s is %s served at %s, want the feed of the tag", target, f.ID, f.link("self"))
+		}
+		if len(f.Entries) != c.entries {
+			t.Fatalf("GET %s has %d entries, want %d", target, len(f.Entries), c.entries)
+		}
+		if c.entries > 0 && f.Entries[0].Title != c.wantFor {
+			t.Errorf("GET %s starts with %q, want %q", target, f.Entries[0].Title, c.wantFor)
+		}
+		for rel, want := range map[string]string{"first": c.first, "previous": c.previous, "next": c.next, "last": c.last} {
+			if want != "" {
+				want = "/opds/books?" + want + "&tag=opdstest"
+			}
+			if got := f.link(rel); got != want {
+				t.Errorf("GET %s links to %q as %s, want %q", target, got, rel, want)
+			}
+		}
+	}
+
+	f := getOPDS(t, "/opds/books?tag=opdstest", opdsAcquisitionType)
+	e := f.Entries[0]
+	if e.ID != fmt.Sprintf("urn:bookshelf:book:%d", id) || len(e.Authors) != 1 || e.Authors[0].Name != "Elizabeth Gaskell" ||
+		e.Identifier != "urn:isbn:9780140434194" || e.Issued != "1853" || e.Summary == nil || e.Summary.Text != b.Description {
+		t.Errorf("the entry of %q is %+v, want its ID, author, ISBN, date and description", b.Title, e)
+	}
+	wantCategories := []atomCategory{{"fiction", "fiction"}, {"classic", "classic"}, {"opdstest", "opdstest"}}
+	if !reflect.DeepEqual(e.Categories, wantCategories) {
+		t.Errorf("the categories of %q are %+v, want %+v", b.Title, e.Categories, wantCategories)
+	}
+	page := fmt.Sprintf("/books/%d", id)
+	wantLinks := []atomLink{
+		{Rel: "alternate", Href: page, Type: "text/html"},
+		{Rel: opdsBorrowRel, Href: page, Type: "text/html"},
+		{Rel: opdsImageRel, Href: b.ImageURL, Type: "image/jpeg"},
+		{Rel: opdsThumbnailRel, Href: b.ImageURL, Type: "image/jpeg"},
+	}
+	if !reflect.DeepEqual(e.Links, wantLinks) {
+		t.Errorf("the links of %q are %+v, want %+v", b.Title, e.Links, wantLinks)
+	}
+
+	stored, err := bookshelf.DB.GetBook(id)
+	if err != nil || len(stored.Contributors) != 1 {
+		t.Fatalf("GetBook(%d) = %v, %v; want one contributor", id, stored, err)
+	}
+	author := fmt.Sprintf("/opds/authors/%d", stored.Contributors[0].AuthorID)
+	f = getOPDS(t, author, opdsAcquisitionType)
+	if f.Title != "Elizabeth Gaskell" || len(f.Entries) != 1 || f.Entries[0].Title != "Cranford" {
+		t.Fatalf("GET %s is %q with %d entries, want the books of Elizabeth Gaskell", author, f.Title, len(f.Entries))
+	}
+	if a := f.Entries[0].Authors; len(a) != 1 || a[0].URI != author {
+		t.Errorf("the author of %q links to %+v in the author's feed, want %s", b.Title, a, author)
+	}
+	f = getOPDS(t, "/opds/books?q=cranford", opdsAcquisitionType)
+	if f.Title != "Search: cranford" || len(f.Entries) != 1 || f.link("self") != "/opds/books?q=cranford" {
+		t.Errorf("the search for cranford is %q with %d entries, want the book", f.Title, len(f.Entries))
+	}
+
+	for _, page := range []string{"0", "-1", "two"} {
+		if w := serve(t, "GET", "/opds/books?page="+page, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("GET /opds/books?page=%s = %d, want 400", page, w.Code)
+		}
+	}
+}
+
+func TestOPDSSearchDescription(t *testing.T) {
+	for _, c := range []struct {
+		proto, want string
+	}{
+		{"", "http://example.com/opds/books?q={searchTerms}"},
+		{"https", "https://example.com/opds/books?q={searchTerms}"},
+	} {
+		req := map[string]string{}
+		if c.proto != "" {
+			req["X-Forwarded-Proto"] = c.proto
+		}
+		w := getFeed(t, "/opds/search.xml", req)
+		var d struct {
+			ShortName string `xml:"ShortName"`
+			URL       struct {
+				Type     string `xml:"type,attr"`
+				Template string `xml:"template,attr"`
+			} `xml:"Url"`
+		}
+		if err := xml.NewDecoder(w.Body).Decode(&d); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("GET /opds/search.xml = %d, %v", w.Code, err)
+		}
+		if w.Header().Get("Content-Type") != openSearchType+";charset=utf-8" || d.URL.Type != opdsAcquisitionType || d.URL.Template != c.want {
+			t.Errorf("GET /opds/search.xml with X-Forwarded-Proto %q gave %+v, want the template %s", c.proto, d, c.want)
+		}
+	}
+}
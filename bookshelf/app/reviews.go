@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// maxReviewSize bounds the JSON body of a review.
+const maxReviewSize = 64 << 10
+
+// recentReviewsLimit is how many reviews the moderation page lists.
+const recentReviewsLimit = 100
+
+// ratingNote gives a book's average rating and number of ratings, or
+// nothing if it has none.
+func ratingNote(b *bookshelf.Book) string {
+	if b.RatingCount == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%.1f of %d stars from %d ratings)", b.AverageRating(), bookshelf.MaxRating, b.RatingCount)
+}
+
+// sortOptions renders the options of the sort select, with selected
+// chosen.
+func sortOptions(selected string) string {
+	result := "<option value=''>Title</option>"
+	for _, o := range []struct{ value, label string }{
+		{bookshelf.SortRating, "Rating"},
+		{bookshelf.SortNewest, "Newest"},
+		{bookshelf.SortUpdated, "Recently updated"},
+	} {
+		attr := ""
+		if selected == o.value {
+			attr = " selected"
+		}
+		result += fmt.Sprintf("<option value='%s'%s>%s</option>", o.value, attr, o.label)
+	}
+	return result
+}
+
+// ratingOptions renders the options of a rating select, with selected
+// chosen.
+func ratingOptions(selected int) string {
+	result := ""
+	for i := bookshelf.MaxRating; i >= bookshelf.MinRating; i-- {
+		attr := ""
+		if i == selected {
+			attr = " selected"
+		}
+		result += fmt.Sprintf("<option value='%d'%s>%s</option>", i, attr, strings.Repeat("★", i))
+	}
+	return result
+}
+
+// deleteReviewForm renders the button that deletes the review of book id
+// by userID.
+func deleteReviewForm(id int64, userID string) string {
+	return fmt.Sprintf(`<form method="post" action="/books/%d/review/delete" onsubmit="return confirm('Delete this review?')">
+		<input type="hidden" name="user" value="%s"><input type="submit" value="Delete">
+	</form>`, id, html.EscapeString(userID))
+}
+
+// reviewsSection renders a book's average rating and its reviews, with a
+// form for the logged in user to write or edit theirs. Reviewers can
+// delete their own reviews and admins any review.
+func reviewsSection(r *http.Request, book *bookshelf.Book) (string, error) {
+	reviews, err := database(r).ListReviews(bookshelf.ReviewQuery{BookID: book.ID})
+	if err != nil {
+		return "", err
+	}
+	profile := profileFromSession(r)
+	admin := isAdmin(r)
+	result := "<h3>Reviews</h3>"
+	if book.RatingCount == 0 {
+		result += "<p>No ratings yet.</p>"
+	} else {
+		result += "<p>" + html.EscapeString(strings.TrimSpace(ratingNote(book))) + "</p>"
+	}
+	var own *bookshelf.Review
+	result += "<ul>"
+	for _, review := range reviews {
+		line := fmt.Sprintf("%s by %s on %s", strings.Repeat("★", review.Rating), review.UserName, formatDate(review.UpdatedAt))
+		result += "<li>" + html.EscapeString(line)
+		if review.Text != "" {
+			result += "<p>" + html.EscapeString(review.Text) + "</p>"
+		}
+		mine := profile != nil && review.UserID == profile.ID
+		if mine {
+			own = review
+		}
+		if mine || admin {
+			result += deleteReviewForm(book.ID, review.UserID)
+		}
+		result += "</li>"
+	}
+	result += "</ul>"
+	if profile != nil {
+		if own == nil {
+			own = &bookshelf.Review{}
+		}
+		result += fmt.Sprintf(`<form method="post" action="/books/%d/review">
+			<select name="rating">%s</select>
+			<textarea name="text" placeholder="What did you think of it?">%s</textarea>
+			<input type="submit" value="Save review">
+		</form>`, book.ID, ratingOptions(own.Rating), html.EscapeString(own.Text))
+	}
+	return result, nil
+}
+
+// reviewFromForm reads the logged in user's review of the book with id
+// from the submitted form.
+func reviewFromForm(r *http.Request, profile *Profile, id int64) (*bookshelf.Review, error) {
+	rating, err := strconv.Atoi(r.FormValue("rating"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid rating %q: %w", r.FormValue("rating"), bookshelf.ErrInvalid)
+	}
+	return &bookshelf.Review{
+		BookID:   id,
+		UserID:   profile.ID,
+		UserName: profile.DisplayName,
+		Rating:   rating,
+		Text:     r.FormValue("text"),
+	}, nil
+}
+
+// deleteReview deletes the review of the book with id by userID on behalf
+// of profile. Users may delete their own reviews and admins any review.
+func deleteReview(id int64, userID string, profile *Profile) error {
+	if userID != profile.ID && !bookshelf.IsAdmin(profile.ID) {
+		return errForbidden
+	}
+	return bookshelf.DB.DeleteReview(id, userID)
+}
+
+// saveReviewHandler saves the logged in user's review of a book.
+func saveReviewHandler(w http.ResponseWriter, r *http.Request) {
+	userAction(w, r, func(id int64, profile *Profile) error {
+		review, err := reviewFromForm(r, profile, id)
+		if err == nil {
+			err = bookshelf.DB.SaveReview(review)
+		}
+		if err == nil {
+			go publishEvent(bookshelf.BookReviewed, id)
+		}
+		return err
+	})
+}
+
+// deleteReviewHandler deletes the review of a book by the user parameter,
+// or by the logged in user if it is empty.
+func deleteReviewHandler(w http.ResponseWriter, r *http.Request) {
+	userAction(w, r, func(id int64, profile *Profile) error {
+		userID := r.FormValue("user")
+		if userID == "" {
+			userID = profile.ID
+		}
+		err := deleteReview(id, userID, profile)
+		if err == nil {
+			go publishEvent(bookshelf.BookReviewed, id)
+		}
+		return err
+	})
+}
+
+// adminReviewsHandler lists the most recent reviews of every book, with a
+// button to delete each, for admins to moderate.
+func adminReviewsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	reviews, err := database(r).ListReviews(bookshelf.ReviewQuery{Limit: recentReviewsLimit})
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	result := "<h3>Recent reviews</h3><table><tr><th>Book</th><th>Reviewer</th><th>Rating</th><th>Review</th><th>Updated</th><th></th></tr>"
+	for _, review := range reviews {
+		result += fmt.Sprintf("<tr><td><a href='/books/%d'>%s</a></td><td>%s</td><td>%d</td><td>%s</td><td>%s</td><td>%s</td></tr>",
+			review.BookID, html.EscapeString(review.Book.Title), html.EscapeString(review.UserName), review.Rating,
+			html.EscapeString(review.Text), review.UpdatedAt.Format("2006-01-02 15:04 MST"), deleteReviewForm(review.BookID, review.UserID))
+	}
+	result += "</table><div><a href='/books'>Back to books</a></div>"
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, result)
+}
+
+// apiReview is the JSON form of a review.
+type apiReview struct {
+	BookID    int64     `json:"bookId"`
+	UserID    string    `json:"userId"`
+	UserName  string    `json:"userName,omitempty"`
+	Rating    int       `json:"rating"`
+	Text      string    `json:"text,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Book      *apiBook  `json:"book,omitempty"`
+}
+
+func toAPIReview(review *bookshelf.Review) *apiReview {
+	a := &apiReview{
+		BookID:    review.BookID,
+		UserID:    review.UserID,
+		UserName:  review.UserName,
+		Rating:    review.Rating,
+		Text:      review.Text,
+		CreatedAt: review.CreatedAt,
+		UpdatedAt: review.UpdatedAt,
+	}
+	if review.Book != nil {
+		a.Book = toAPIBook(review.Book)
+	}
+	return a
+}
+
+// apiReviewsHandler lists the reviews of a book, or of every book by the
+// user parameter, or the most recent reviews of every book, up to limit.
+func apiReviewsHandler(w http.ResponseWriter, r *http.Request) {
+	q := bookshelf.ReviewQuery{UserID: r.FormValue("user")}
+	if id := r.FormValue("book"); id != "" {
+		var err error
+		if q.BookID, err = strconv.ParseInt(id, 10, 64); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid book id"})
+			return
+		}
+	}
+	if limit := r.FormValue("limit"); limit != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+			return
+		}
+	}
+	reviews, err := database(r).ListReviews(q)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	a := make([]*apiReview, len(reviews))
+	for i, review := range reviews {
+		a[i] = toAPIReview(review)
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+// apiGetReviewHandler returns the logged in user's review of a book.
+func apiGetReviewHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r)
+	if !ok {
+		return
+	}
+	profile, ok := apiProfile(w, r)
+	if !ok {
+		return
+	}
+	review, err := database(r).GetReview(id, profile.ID)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIReview(review))
+}
+
+// apiPutReviewHandler saves the rating and text in the JSON body as the
+// logged in user's review of a book, replacing any they had, and replies
+// with it.
+func apiPutReviewHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r)
+	if !ok {
+		return
+	}
+	profile, ok := apiProfile(w, r)
+	if !ok {
+		return
+	}
+	var body apiReview
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxReviewSize)).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid review: " + err.Error()})
+		return
+	}
+	review := &bookshelf.Review{
+		BookID:   id,
+		UserID:   profile.ID,
+		UserName: profile.DisplayName,
+		Rating:   body.Rating,
+		Text:     body.Text,
+	}
+	if err := bookshelf.DB.SaveReview(review); err != nil {
+		apiError(w, err)
+		return
+	}
+	go publishEvent(bookshelf.BookReviewed, id)
+	markWrite(w, r)
+	writeJSON(w, http.StatusOK, toAPIReview(review))
+}
+
+// apiDeleteReviewHandler deletes the review of a book by the userId route
+// variable, or by the logged in user if there is none. Only admins may
+// delete other users' reviews.
+func apiDeleteReviewHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r)
+	if !ok {
+		return
+	}
+	profile, ok := apiProfile(w, r)
+	if !ok {
+		return
+	}
+	userID := mux.Vars(r)["userId"]
+	if userID == "" {
+		userID = profile.ID
+	}
+	if err := deleteReview(id, userID, profile); err != nil {
+		apiError(w, err)
+		return
+	}
+	go publishEvent(bookshelf.BookReviewed, id)
+	markWrite(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// searchLink is the escaped URL of the full-text search page for q.
+func searchLink(q bookshelf.SearchQuery) string {
+	return html.EscapeString("/search?" + q.Values().Encode())
+}
+
+// facetLinks renders the tags or genres of the books a search matched,
+// each narrowing q to it with set, or, if q is already narrowed to
+// selected, a link widening it again.
+func facetLinks(name string, q bookshelf.SearchQuery, counts []bookshelf.TagCount, selected string,
+	set func(q *bookshelf.SearchQuery, tag string)) string {
+	q.From = 0
+	if selected != "" {
+		set(&q, "")
+		return fmt.Sprintf("<p>%s: %s <a href='%s'>(any)</a></p>", name, html.EscapeString(selected), searchLink(q))
+	}
+	if len(counts) == 0 {
+		return ""
+	}
+	result := "<p>" + name + ":"
+	for _, c := range counts {
+		set(&q, c.Tag)
+		result += fmt.Sprintf(" <a href='%s'>%s</a> (%d)", searchLink(q), html.EscapeString(c.Tag), c.Count)
+	}
+	return result + "</p>"
+}
+
+// searchHit renders a hit with its fragments, which the index has already
+// escaped, with the matched words marked.
+func searchHit(h bookshelf.SearchHit) string {
+	title := html.EscapeString(h.Title)
+	if f := h.Fragments["title"]; len(f) > 0 {
+		title = f[0]
+	}
+	author := html.EscapeString(h.Author)
+	if f := h.Fragments["author"]; len(f) > 0 {
+		author = f[0]
+	}
+	result := fmt.Sprintf("<li><a href='/books/%d'>%s</a> by %s", h.BookID, title, author)
+	if f := h.Fragments["description"]; len(f) > 0 {
+		result += "<p>… " + strings.Join(f, " … ") + " …</p>"
+	}
+	return result + "</li>"
+}
+
+// fullTextHandler shows the books a full-text search matches, best first,
+// with the matched words highlighted and the tags and genres of the
+// matches to narrow it by. Without SEARCH_URL there is no index to ask, so
+// it falls back to the title and author search.
+func fullTextHandler(w http.ResponseWriter, r *http.Request) {
+	if bookshelf.SearchURL == "" {
+		http.Redirect(w, r, "/books/search?"+r.URL.RawQuery, http.StatusFound)
+		return
+	}
+	q, err := bookshelf.ParseSearchQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result := fmt.Sprintf(`<form method="get" action="/search">
+		<input name="q" value="%s" placeholder="Title, author, description or tag">
+		<input type="hidden" name="tag" value="%s"><input type="hidden" name="genre" value="%s">
+		<input type="submit" value="Search">
+	</form>`, html.EscapeString(q.Text), html.EscapeString(q.Tag), html.EscapeString(q.Genre))
+	results, err := bookshelf.Search(r.Context(), q)
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	result += fmt.Sprintf("<p>%d books found</p>", results.Total)
+	result += facetLinks("Genres", q, results.Genres, q.Genre, func(q *bookshelf.SearchQuery, g string) { q.Genre = g })
+	result += facetLinks("Tags", q, results.Tags, q.Tag, func(q *bookshelf.SearchQuery, t string) { q.Tag = t })
+	result += "<ol>"
+	for _, h := range results.Hits {
+		result += searchHit(h)
+	}
+	result += "</ol>"
+	if q.From > 0 {
+		prev := q
+		if prev.From -= prev.Size; prev.From < 0 {
+			prev.From = 0
+		}
+		result += fmt.Sprintf("<a href='%s'>Previous</a> ", searchLink(prev))
+	}
+	if q.From+len(results.Hits) < results.Total {
+		next := q
+		next.From += len(results.Hits)
+		result += fmt.Sprintf("<a href='%s'>Next</a>", searchLink(next))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, result+"<div><a href='/books'>Back to books</a></div>")
+}
+
+// apiSearchResults is the JSON form of the results of a full-text search.
+type apiSearchResults struct {
+	Total  int                   `json:"total"`
+	Hits   []bookshelf.SearchHit `json:"hits"`
+	Tags   []apiTagCount         `json:"tags"`
+	Genres []apiTagCount         `json:"genres"`
+}
+
+// apiSearchHandler runs the full-text search given by the q, tag, genre,
+// from and size parameters.
+func apiSearchHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := bookshelf.ParseSearchQuery(r.URL.Query())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	results, err := bookshelf.Search(r.Context(), q)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, apiSearchResults{
+		Total:  results.Total,
+		Hits:   results.Hits,
+		Tags:   toAPITagCounts(results.Tags),
+		Genres: toAPITagCounts(results.Genres),
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// shelfImportFormHandler displays a form to upload a Goodreads or
+// LibraryThing export.
+func shelfImportFormHandler(w http.ResponseWriter, r *http.Request) {
+	FORM := `<form method="post" enctype="multipart/form-data" action="/books/import/shelves">
+		<div class="form-group">
+			<label for="file">Goodreads CSV or LibraryThing TSV export</label>
+			<input class="form-control" name="file" id="file" type="file" accept=".csv,.tsv,.txt,text/csv,text/tab-separated-values">
+		</div>
+		<label><input type="checkbox" name="dryRun" value="true" checked> Dry run: only show what would happen</label>
+		<input type="submit" name="submit" id="submit" value="Import">
+	</form>`
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, FORM)
+}
+
+// shelfImportHandler imports an uploaded Goodreads or LibraryThing export
+// and shows what happened to each book. A logged in user also gets the
+// books on their shelves.
+func shelfImportHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, bookshelf.MaxShelfExportSize+1<<20)
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "missing export file", http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	opts := bookshelf.ShelfImportOptions{
+		DryRun: r.FormValue("dryRun") == "true",
+		Actor:  actorFromRequest(r, bookshelf.SourceHTML),
+	}
+	if profile := profileFromSession(r); profile != nil {
+		opts.UserID = profile.ID
+	}
+	report, err := bookshelf.ImportShelfExport(r.Context(), bookshelf.DB, f, opts)
+	if report == nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	if !opts.DryRun {
+		markWrite(w, r)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, shelfImportReport(report))
+}
+
+// shelfImportReport renders the report of a Goodreads or LibraryThing
+// import.
+func shelfImportReport(report *bookshelf.ShelfImportReport) string {
+	verb := "Created"
+	if report.DryRun {
+		verb = "Would create"
+	}
+	result := fmt.Sprintf("<p>Read %d books from a %s export. %s %d, merged %d into existing books, skipped %d.</p>",
+		report.Rows, report.Format, verb, report.Created, report.Merged, report.Skipped)
+	if report.Shelved > 0 {
+		result += fmt.Sprintf("<p>Put %d on <a href='/shelves'>your shelves</a>.</p>", report.Shelved)
+	}
+	if report.Error != "" {
+		result += "<p>The import stopped early: " + html.EscapeString(report.Error) + "</p>"
+	}
+	result += "<table><tr><th>Row</th><th>Book</th><th>ISBN</th><th>Shelves</th><th>Rating</th><th>Read</th><th>Outcome</th></tr>"
+	for _, e := range report.Results {
+		book := html.EscapeString(e.Title)
+		if e.Author != "" {
+			book += " by " + html.EscapeString(e.Author)
+		}
+		if e.BookID > 0 {
+			book = fmt.Sprintf("<a href='/books/%d'>%s</a>", e.BookID, book)
+		}
+		read := ""
+		if !e.DateRead.IsZero() {
+			read = e.DateRead.Format("2006-01-02")
+		}
+		outcome := e.Outcome
+		if e.Reason != "" {
+			outcome += ": " + e.Reason
+		}
+		result += fmt.Sprintf("<tr><td>%d</td><td>%s</td><td>%s</td><td>%s</td><td>%d</td><td>%s</td><td>%s</td></tr>",
+			e.Row, book, html.EscapeString(e.ISBN), html.EscapeString(strings.Join(e.Shelves, ", ")), e.Rating, read, html.EscapeString(outcome))
+	}
+	result += "</table>"
+	return result + "<div><a href='/books'>Back to books</a></div>"
+}
+
+// apiShelfImportHandler imports the Goodreads or LibraryThing export in
+// the request body and returns the report. dryRun=true only reports what
+// would happen. A logged in user also gets the books on their shelves. The
+// parameter is read from the URL only, so a client posting the file as a
+// form body does not have it parsed away.
+func apiShelfImportHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, bookshelf.MaxShelfExportSize)
+	opts := bookshelf.ShelfImportOptions{
+		DryRun: r.URL.Query().Get("dryRun") == "true",
+		Actor:  actorFromRequest(r, bookshelf.SourceAPI),
+	}
+	if profile := profileFromSession(r); profile != nil {
+		opts.UserID = profile.ID
+	}
+	report, err := bookshelf.ImportShelfExport(r.Context(), bookshelf.DB, r.Body, opts)
+	if report == nil {
+		writeJSON(w, errorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	if !opts.DryRun {
+		markWrite(w, r)
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// maxReadingSize bounds the JSON body of a reading.
+const maxReadingSize = 64 << 10
+
+// formatDate writes a reading's date as date inputs read it, or nothing
+// for a zero date.
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
+
+// statusOptions renders the options of a reading status select, with
+// selected chosen.
+func statusOptions(selected string) string {
+	result := ""
+	for _, s := range bookshelf.Statuses {
+		attr := ""
+		if s == selected {
+			attr = " selected"
+		}
+		result += fmt.Sprintf("<option%s>%s</option>", attr, html.EscapeString(s))
+	}
+	return result
+}
+
+// readingForm renders the logged in user's reading of a book, with a form
+// to change it and a button to take the book off their shelves. reading is
+// nil if the book is not on them.
+func readingForm(id int64, reading *bookshelf.Reading) string {
+	result := "<h3>My shelves</h3>"
+	if reading == nil {
+		reading = &bookshelf.Reading{}
+	}
+	result += fmt.Sprintf(`<form method="post" action="/books/%d/reading">
+		<select name="status">%s</select>
+		<input name="shelves" value="%s" placeholder="Other shelves, comma separated">
+		<label>Started <input type="date" name="startedAt" value="%s"></label>
+		<label>Finished <input type="date" name="finishedAt" value="%s"></label>
+		<label>Progress <input type="number" name="progress" min="0" max="100" value="%d">%%</label>
+		<input type="submit" value="Save">
+	</form>`, id, statusOptions(reading.Status), html.EscapeString(bookshelf.FormatTags(reading.Shelves)),
+		formatDate(reading.StartedAt), formatDate(reading.FinishedAt), reading.Progress)
+	if reading.BookID != 0 {
+		result += fmt.Sprintf("<form method='post' action='/books/%d/reading/delete'><input type='submit' value='Remove from my shelves'></form>", id)
+	}
+	return result
+}
+
+// userReading returns the reading of the book with id by the logged in
+// user, or nil if there is no such user or the book is not on their
+// shelves.
+func userReading(r *http.Request, id int64) (*bookshelf.Reading, error) {
+	profile := profileFromSession(r)
+	if profile == nil {
+		return nil, nil
+	}
+	reading, err := database(r).GetReading(profile.ID, id)
+	if errors.Is(err, bookshelf.ErrNotFound) {
+		return nil, nil
+	}
+	return reading, err
+}
+
+// readingFromForm reads the reading of the book with id by userID from the
+// submitted form.
+func readingFromForm(r *http.Request, userID string, id int64) (*bookshelf.Reading, error) {
+	reading := &bookshelf.Reading{
+		UserID:  userID,
+		BookID:  id,
+		Status:  r.FormValue("status"),
+		Shelves: bookshelf.ParseTags(r.FormValue("shelves")),
+	}
+	var err error
+	if reading.StartedAt, err = bookshelf.ParseDate(r.FormValue("startedAt")); err != nil {
+		return nil, err
+	}
+	if reading.FinishedAt, err = bookshelf.ParseDate(r.FormValue("finishedAt")); err != nil {
+		return nil, err
+	}
+	if p := r.FormValue("progress"); p != "" {
+		if reading.Progress, err = strconv.Atoi(p); err != nil {
+			return nil, fmt.Errorf("invalid progress %q: %w", p, bookshelf.ErrInvalid)
+		}
+	}
+	return reading, nil
+}
+
+// shelvesHandler shows the logged in user's shelves with the number of
+// books on each, and the books on the shelf given by the shelf parameter,
+// or on all of them.
+func shelvesHandler(w http.ResponseWriter, r *http.Request) {
+	profile := profileFromSession(r)
+	if profile == nil {
+		http.Redirect(w, r, "/login?redirect=/shelves", http.StatusFound)
+		return
+	}
+	db := database(r)
+	shelf := r.FormValue("shelf")
+	shelves, err := db.ListShelves(profile.ID)
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	readings, err := db.ListReadings(profile.ID, shelf)
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	result := "<h3>My shelves</h3><div><a href='/shelves'>All</a>"
+	for _, s := range shelves {
+		result += fmt.Sprintf(" <a href='/shelves?shelf=%s'>%s</a> (%d)", url.QueryEscape(s.Shelf), html.EscapeString(s.Shelf), s.Count)
+	}
+	result += "</div><table><tr><th>Book</th><th>Status</th><th>Shelves</th><th>Started</th><th>Finished</th><th>Progress</th></tr>"
+	for _, reading := range readings {
+		result += fmt.Sprintf("<tr><td><a href='/books/%d'>%s</a></td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%d%%</td></tr>",
+			reading.BookID, html.EscapeString(reading.Book.Title), html.EscapeString(reading.Status),
+			html.EscapeString(bookshelf.FormatTags(reading.Shelves)), formatDate(reading.StartedAt), formatDate(reading.FinishedAt), reading.Progress)
+	}
+	result += "</table><div><a href='/books'>Back to books</a></div>"
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, result)
+}
+
+// saveReadingHandler puts a book on the logged in user's shelves, or
+// changes what they recorded about it.
+func saveReadingHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Redirect(w, r, "/books", http.StatusFound)
+		return
+	}
+	profile := profileFromSession(r)
+	if profile == nil {
+		http.Redirect(w, r, fmt.Sprintf("/login?redirect=/books/%d", id), http.StatusFound)
+		return
+	}
+	reading, err := readingFromForm(r, profile.ID, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := bookshelf.DB.SaveReading(reading); err != nil {
+		dbError(w, err)
+		return
+	}
+	markWrite(w, r)
+	http.Redirect(w, r, fmt.Sprintf("/books/%d", id), http.StatusFound)
+}
+
+// deleteReadingHandler takes a book off the logged in user's shelves.
+func deleteReadingHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Redirect(w, r, "/books", http.StatusFound)
+		return
+	}
+	profile := profileFromSession(r)
+	if profile == nil {
+		http.Redirect(w, r, fmt.Sprintf("/login?redirect=/books/%d", id), http.StatusFound)
+		return
+	}
+	if err := bookshelf.DB.DeleteReading(profile.ID, id); err != nil {
+		dbError(w, err)
+		return
+	}
+	markWrite(w, r)
+	http.Redirect(w, r, fmt.Sprintf("/books/%d", id), http.StatusFound)
+}
+
+// apiReading is the JSON form of a reading. Dates are written as
+// 2006-01-02 and left out when not known.
+type apiReading struct {
+	BookID     int64     `json:"bookId"`
+	Status     string    `json:"status"`
+	Shelves    []string  `json:"shelves,omitempty"`
+	StartedAt  string    `json:"startedAt,omitempty"`
+	FinishedAt string    `json:"finishedAt,omitempty"`
+	Progress   int       `json:"progress"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+	Book       *apiBook  `json:"book,omitempty"`
+}
+
+func toAPIReading(reading *bookshelf.Reading) *apiReading {
+	a := &apiReading{
+		BookID:     reading.BookID,
+		Status:     reading.Status,
+		Shelves:    reading.Shelves,
+		StartedAt:  formatDate(reading.StartedAt),
+		FinishedAt: formatDate(reading.FinishedAt),
+		Progress:   reading.Progress,
+		UpdatedAt:  reading.UpdatedAt,
+	}
+	if reading.Book != nil {
+		a.Book = toAPIBook(reading.Book)
+	}
+	return a
+}
+
+// apiShelfCount is the JSON form of a ShelfCount.
+type apiShelfCount struct {
+	Shelf string `json:"shelf"`
+	Count int    `json:"count"`
+}
+
+// apiUserID returns the ID of the logged in user, replying with 401 if
+// there is none. Shelves are personal, so every shelf endpoint needs one.
+func apiUserID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	profile := profileFromSession(r)
+	if profile == nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "log in to use your shelves"})
+		return "", false
+	}
+	return profile.ID, true
+}
+
+// apiShelvesHandler counts the logged in user's books on each shelf.
+func apiShelvesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := apiUserID(w, r)
+	if !ok {
+		return
+	}
+	shelves, err := database(r).ListShelves(userID)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	a := make([]apiShelfCount, len(shelves))
+	for i, s := range shelves {
+		a[i] = apiShelfCount{Shelf: s.Shelf, Count: s.Count}
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+// apiReadingsHandler lists the logged in user's readings on the shelf
+// given by the shelf parameter, or on any shelf, with their books.
+func apiReadingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := apiUserID(w, r)
+	if !ok {
+		return
+	}
+	readings, err := database(r).ListReadings(userID, r.FormValue("shelf"))
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	a := make([]*apiReading, len(readings))
+	for i, reading := range readings {
+		a[i] = toAPIReading(reading)
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+// apiGetReadingHandler returns the logged in user's reading of a book.
+func apiGetReadingHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := apiUserID(w, r)
+	if !ok {
+		return
+	}
+	reading, err := database(r).GetReading(userID, id)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIReading(reading))
+}
+
+// apiPutReadingHandler saves the reading in the JSON body as the logged in
+// user's reading of a book, replacing any they had, and replies with it.
+func apiPutReadingHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := apiUserID(w, r)
+	if !ok {
+		return
+	}
+	var body apiReading
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxReadingSize)).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid reading: " + err.Error()})
+		return
+	}
+	reading := &bookshelf.Reading{
+		UserID:   userID,
+		BookID:   id,
+		Status:   body.Status,
+		Shelves:  body.Shelves,
+		Progress: body.Progress,
+	}
+	var err error
+	if reading.StartedAt, err = bookshelf.ParseDate(body.StartedAt); err == nil {
+		reading.FinishedAt, err = bookshelf.ParseDate(body.FinishedAt)
+	}
+	if err == nil {
+		err = bookshelf.DB.SaveReading(reading)
+	}
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	markWrite(w, r)
+	writeJSON(w, http.StatusOK, toAPIReading(reading))
+}
+
+// apiDeleteReadingHandler takes a book off the logged in user's shelves.
+func apiDeleteReadingHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := apiUserID(w, r)
+	if !ok {
+		return
+	}
+	if err := bookshelf.DB.DeleteReading(userID, id); err != nil {
+		apiError(w, err)
+		return
+	}
+	markWrite(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
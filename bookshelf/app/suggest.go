@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// maxSuggestions caps the limit parameter of /api/suggest and /api/authors,
+// and defaultSuggestions is the limit of /api/suggest without one.
+const (
+	maxSuggestions     = 50
+	defaultSuggestions = 10
+)
+
+// externalSuggestTimeout bounds how long a suggestion waits on Google
+// Books, since it is only useful while the user is still typing.
+const externalSuggestTimeout = 3 * time.Second
+
+// suggester suggests the titles and authors of the catalogue as book forms
+// are typed in. It is loaded when the app starts and kept up to date from
+// book events.
+var suggester = bookshelf.NewSuggester()
+
+// bookAutocomplete suggests titles and authors as the title and author
+// inputs of a book form are typed in, once typing pauses: first those in
+// the catalogue, with how many books have them, then those Google Books
+// knows. Only the name after the last separator of the author is looked
+// up, so a second contributor can be added after a semicolon.
+const bookAutocomplete = `<datalist id="title-suggestions"></datalist><datalist id="author-suggestions"></datalist>
+	<script>
+	(function() {
+		function suggest(kind, split) {
+			var input = document.getElementById(kind);
+			var list = document.getElementById(kind + "-suggestions");
+			var timer, seq = 0;
+			input.setAttribute("list", list.id);
+			input.addEventListener("input", function() {
+				clearTimeout(timer);
+				timer = setTimeout(function() {
+					var head = split ? input.value.replace(/[^;&]*$/, "") : "";
+					var text = input.value.slice(head.length).trim();
+					var n = ++seq, seen = {};
+					if (text.length < 2) {
+						list.innerHTML = "";
+						return;
+					}
+					function fill(external) {
+						var url = "/api/suggest?kind=" + kind + "&q=" + encodeURIComponent(text) + (external ? "&external=1" : "");
+						return fetch(url)
+							.then(function(res) { return res.ok ? res.json() : []; })
+							.then(function(suggestions) {
+								if (n != seq) {
+									return;
+								}
+								if (!external) {
+									list.innerHTML = "";
+								}
+								suggestions.forEach(function(s) {
+									if (seen[s.text]) {
+										return;
+									}
+									seen[s.text] = true;
+									var option = document.createElement("option");
+									option.value = head + (head ? " " : "") + s.text;
+									if (s.count) {
+										option.label = s.count + (s.count == 1 ? " book" : " books");
+									}
+									list.appendChild(option);
+								});
+							});
+					}
+					fill(false).then(function() {
+						if (n == seq) {
+							return fill(true);
+						}
+					});
+				}, 250);
+			});
+		}
+		suggest("title", false);
+		suggest("author", true);
+	})();
+	</script>`
+
+// loadSuggestions fills the suggester with every book outside the trash.
+func loadSuggestions() {
+	books, err := bookshelf.DB.ListBooks()
+	if err != nil {
+		log.Printf("could not load suggestions: %v", err)
+		return
+	}
+	suggester.Load(books)
+	log.Printf("loaded suggestions from %d books", len(books))
+}
+
+// refreshSuggestions updates the suggester after an event about a book,
+// dropping the book if it is gone. Events that cannot change its title or
+// authors are skipped.
+func refreshSuggestions(e bookshelf.BookEvent) error {
+	switch e.Type {
+	case bookshelf.BookReviewed, bookshelf.LoanOverdue:
+		return nil
+	}
+	book, err := bookshelf.ReadPrimary(bookshelf.DB).GetBook(e.BookID)
+	if errors.Is(err, bookshelf.ErrNotFound) {
+		suggester.Remove(e.BookID)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	suggester.Update(book)
+	return nil
+}
+
+// apiLimit parses the limit parameter, from 1 to maxSuggestions, replying
+// with 400 if it is not one. It is def if there is none.
+func apiLimit(w http.ResponseWriter, r *http.Request, def int) (int, bool) {
+	v := r.FormValue("limit")
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 || n > maxSuggestions {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("invalid limit %q: want 1 to %d", v, maxSuggestions)})
+		return 0, false
+	}
+	return n, true
+}
+
+// apiSuggestion is the JSON form of a suggestion.
+type apiSuggestion struct {
+	Kind  string `json:"kind"`
+	Text  string `json:"text"`
+	Count int    `json:"count,omitempty"`
+}
+
+// apiSuggestHandler suggests the titles and authors with a word starting
+// with the q parameter, narrowed to one kind by the kind parameter. They
+// come from the catalogue, or from Google Books if external is set.
+func apiSuggestHandler(w http.ResponseWriter, r *http.Request) {
+	kind := r.FormValue("kind")
+	if kind != "" && kind != bookshelf.SuggestTitle && kind != bookshelf.SuggestAuthor {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid kind %q", kind)})
+		return
+	}
+	limit, ok := apiLimit(w, r, defaultSuggestions)
+	if !ok {
+		return
+	}
+	q := r.FormValue("q")
+	var suggestions []bookshelf.Suggestion
+	if r.FormValue("external") != "" {
+		ctx, cancel := context.WithTimeout(r.Context(), externalSuggestTimeout)
+		defer cancel()
+		var err error
+		if suggestions, err = bookshelf.SuggestExternal(ctx, q, kind, limit); err != nil {
+			log.Printf("could not get suggestions for %q from Google Books: %v", q, err)
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "could not reach Google Books"})
+			return
+		}
+	} else {
+		suggestions = suggester.Suggest(q, kind, limit)
+	}
+	a := make([]apiSuggestion, len(suggestions))
+	for i, s := range suggestions {
+		a[i] = apiSuggestion{Kind: s.Kind, Text: s.Text, Count: s.Count}
+	}
+	writeJSON(w, http.StatusOK, a)
+}
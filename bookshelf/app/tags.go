@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// bookFilter reads the q, tag, genre and sort parameters.
+func bookFilter(r *http.Request) bookshelf.BookFilter {
+	return bookshelf.BookFilter{
+		Query: r.FormValue("q"),
+		Tag:   r.FormValue("tag"),
+		Genre: r.FormValue("genre"),
+		Sort:  r.FormValue("sort"),
+	}
+}
+
+// filterBooks lists the books f selects. Without a tag, genre or sort
+// order it goes through ListBooks or SearchBooks, which the cache and
+// replicas serve.
+func filterBooks(db bookshelf.BookDatabase, f bookshelf.BookFilter) ([]*bookshelf.Book, error) {
+	switch {
+	case f.Tag != "" || f.Genre != "" || f.Sort != "":
+		return db.FilterBooks(f)
+	case f.Query != "":
+		return db.SearchBooks(f.Query)
+	default:
+		return db.ListBooks()
+	}
+}
+
+// genreOptions renders the options of a genre select, with selected chosen.
+func genreOptions(selected string) string {
+	result := "<option value=''>Any genre</option>"
+	for _, g := range bookshelf.Genres {
+		attr := ""
+		if g == selected {
+			attr = " selected"
+		}
+		result += fmt.Sprintf("<option%s>%s</option>", attr, html.EscapeString(g))
+	}
+	return result
+}
+
+// tagFormGroups renders the tags input and genre checkboxes of the book
+// forms.
+func tagFormGroups(book *bookshelf.Book) string {
+	checked := make(map[string]bool)
+	for _, g := range book.Genres {
+		checked[g] = true
+	}
+	genres := ""
+	for _, g := range bookshelf.Genres {
+		attr := ""
+		if checked[g] {
+			attr = " checked"
+		}
+		genres += fmt.Sprintf(`<label><input type="checkbox" name="genre" value="%s"%s> %s</label> `,
+			html.EscapeString(g), attr, html.EscapeString(g))
+	}
+	return fmt.Sprintf(`<div class="form-group">
+			<label for="tags">Tags, comma separated</label>
+			<input class="form-control" name="tags" id="tags" value="%s">
+		</div>
+		<div class="form-group">
+			<label>Genres</label> %s
+		</div>`, html.EscapeString(bookshelf.FormatTags(book.Tags)), genres)
+}
+
+// setTags sets the tags and genres of book from the submitted form.
+func setTags(r *http.Request, book *bookshelf.Book) {
+	book.Tags = bookshelf.ParseTags(r.FormValue("tags"))
+	book.Genres = r.Form["genre"]
+}
+
+// tagLinks links each genre and tag of a book to the books sharing it.
+func tagLinks(book *bookshelf.Book) string {
+	result := ""
+	for _, g := range book.Genres {
+		result += fmt.Sprintf(" <a href='/books?genre=%s'>%s</a>", url.QueryEscape(g), html.EscapeString(g))
+	}
+	for _, t := range book.Tags {
+		result += fmt.Sprintf(" <a href='/books?tag=%s'>#%s</a>", url.QueryEscape(t), html.EscapeString(t))
+	}
+	if result == "" {
+		return ""
+	}
+	return "<p>" + result + "</p>"
+}
+
+// tagsHandler shows a cloud of the tags in use, each sized by the number
+// of books that have it, and the genres with their counts.
+func tagsHandler(w http.ResponseWriter, r *http.Request) {
+	cloud, err := database(r).TagCloud()
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	least, most := 0, 0
+	for i, c := range cloud.Tags {
+		if i == 0 || c.Count < least {
+			least = c.Count
+		}
+		if c.Count > most {
+			most = c.Count
+		}
+	}
+	result := "<h3>Genres</h3>"
+	for _, c := range cloud.Genres {
+		result += fmt.Sprintf("<div><a href='/books?genre=%s'>%s</a> (%d)</div>",
+			url.QueryEscape(c.Tag), html.EscapeString(c.Tag), c.Count)
+	}
+	result += "<h3>Tags</h3><p>"
+	for _, c := range cloud.Tags {
+		// Sizes run from 100% for the rarest tags to 250% for the most used.
+		size := 100
+		if most > least {
+			size += 150 * (c.Count - least) / (most - least)
+		}
+		result += fmt.Sprintf("<a href='/books?tag=%s' style='font-size: %d%%' title='%d books'>%s</a> ",
+			url.QueryEscape(c.Tag), size, c.Count, html.EscapeString(c.Tag))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, result+"</p>")
+}
+
+// apiTagCount is the JSON form of a TagCount.
+type apiTagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+func toAPITagCounts(counts []bookshelf.TagCount) []apiTagCount {
+	a := make([]apiTagCount, len(counts))
+	for i, c := range counts {
+		a[i] = apiTagCount{Tag: c.Tag, Count: c.Count}
+	}
+	return a
+}
+
+// apiTagsHandler counts the books with each tag and genre.
+func apiTagsHandler(w http.ResponseWriter, r *http.Request) {
+	cloud, err := database(r).TagCloud()
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]apiTagCount{
+		"tags":   toAPITagCounts(cloud.Tags),
+		"genres": toAPITagCounts(cloud.Genres),
+	})
+}
+
+// apiBooksHandler lists the books selected by the q, tag and genre
+// parameters.
+func apiBooksHandler(w http.ResponseWriter, r *http.Request) {
+	books, err := filterBooks(database(r), bookFilter(r))
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIBooks(books))
+}
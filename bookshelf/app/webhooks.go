@@ -0,0 +1,524 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// Users register webhooks to be told of changes to books. The worker
+// delivers the events; the app manages the webhooks, shows their delivery
+// logs and queues test events. Users see and change only their own
+// webhooks, and admins everyone's.
+
+// maxWebhookSize bounds the JSON body of a webhook.
+const maxWebhookSize = 16 << 10
+
+// deliveryLogLimit is how many of a webhook's deliveries its page and the
+// API list by default.
+const deliveryLogLimit = 50
+
+// webhookTime writes a time of a webhook or delivery for its page, or
+// nothing for a zero time.
+func webhookTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02 15:04:05 MST")
+}
+
+// listWebhooks returns the webhooks profile may manage: their own, or
+// everyone's for an admin.
+func listWebhooks(r *http.Request, profile *Profile) ([]*bookshelf.Webhook, error) {
+	if bookshelf.IsAdmin(profile.ID) {
+		return database(r).ListWebhooks("")
+	}
+	return database(r).ListWebhooks(profile.ID)
+}
+
+// getWebhook returns the webhook in the path if profile may manage it.
+// Webhooks are read from the primary, since they are changed right after.
+func getWebhook(r *http.Request, profile *Profile) (*bookshelf.Webhook, error) {
+	id, err := routeID(r, "id")
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook id: %w", bookshelf.ErrInvalid)
+	}
+	hook, err := bookshelf.DB.GetWebhook(id)
+	if err != nil {
+		return nil, err
+	}
+	if hook.OwnerID != profile.ID && !bookshelf.IsAdmin(profile.ID) {
+		return nil, errForbidden
+	}
+	return hook, nil
+}
+
+// webhookSecret returns the secret of hook as profile may see it: all of
+// it for its owner, and only its last few characters for an admin looking
+// at someone else's webhook, enough to tell secrets apart.
+func webhookSecret(hook *bookshelf.Webhook, profile *Profile) string {
+	if hook.OwnerID == profile.ID {
+		return hook.Secret
+	}
+	masked := "********"
+	if n := len(hook.Secret); n > 8 {
+		masked += hook.Secret[n-4:]
+	}
+	return masked
+}
+
+// webhookFromForm reads the settings of a webhook from the submitted form.
+// A blank secret keeps the webhook's, or makes one up for a new webhook.
+func webhookFromForm(r *http.Request) *bookshelf.Webhook {
+	r.ParseForm()
+	return &bookshelf.Webhook{
+		URL:    r.FormValue("url"),
+		Events: r.Form["events"],
+		Secret: strings.TrimSpace(r.FormValue("secret")),
+		Active: r.FormValue("active") != "",
+	}
+}
+
+// webhookForm renders the fields of a webhook's settings, for hook, or
+// for a new webhook if hook has no ID.
+func webhookForm(hook *bookshelf.Webhook) string {
+	result := fmt.Sprintf(`<div><label>URL <input name="url" type="url" size="60" value="%s" required></label></div><div>Events:`,
+		html.EscapeString(hook.URL))
+	for _, e := range bookshelf.WebhookEvents {
+		attr := ""
+		for _, want := range hook.Events {
+			if want == e {
+				attr = " checked"
+			}
+		}
+		result += fmt.Sprintf(` <label><input type="checkbox" name="events" value="%[1]s"%[2]s>%[1]s</label>`, html.EscapeString(e), attr)
+	}
+	result += " (none for all)</div>"
+	placeholder := "Leave blank to generate one"
+	if hook.ID != 0 {
+		placeholder = "Leave blank to keep the current secret"
+	}
+	active := ""
+	if hook.Active || hook.ID == 0 {
+		active = " checked"
+	}
+	result += fmt.Sprintf(`<div><label>Secret <input name="secret" size="50" placeholder="%s"></label></div>
+		<div><label><input type="checkbox" name="active" value="true"%s>Active</label></div>`, placeholder, active)
+	return result
+}
+
+// webhookStatus says whether a webhook is active and, if it was disabled
+// for failing, when.
+func webhookStatus(hook *bookshelf.Webhook) string {
+	switch {
+	case hook.Active && hook.Failures > 0:
+		return fmt.Sprintf("active, %d failed deliveries in a row", hook.Failures)
+	case hook.Active:
+		return "active"
+	case !hook.DisabledAt.IsZero():
+		return fmt.Sprintf("disabled on %s after %d failed deliveries", webhookTime(hook.DisabledAt), hook.Failures)
+	}
+	return "paused"
+}
+
+// webhookEvents lists the events a webhook is sent.
+func webhookEvents(hook *bookshelf.Webhook) string {
+	if len(hook.Events) == 0 {
+		return "all events"
+	}
+	return strings.Join(hook.Events, ", ")
+}
+
+// webhooksHandler lists the webhooks the logged in user may manage, with a
+// form to register one.
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	profile := profileFromSession(r)
+	if profile == nil {
+		http.Redirect(w, r, "/login?redirect=/webhooks", http.StatusFound)
+		return
+	}
+	hooks, err := listWebhooks(r, profile)
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	result := "<h3>Webhooks</h3><p>Webhooks are sent a signed JSON POST when books change.</p>"
+	result += "<table><tr><th>URL</th><th>Events</th><th>Owner</th><th>Status</th></tr>"
+	for _, hook := range hooks {
+		result += fmt.Sprintf("<tr><td><a href='/webhooks/%d'>%s</a></td><td>%s</td><td>%s</td><td>%s</td></tr>",
+			hook.ID, html.EscapeString(hook.URL), html.EscapeString(webhookEvents(hook)),
+			html.EscapeString(hook.OwnerName), html.EscapeString(webhookStatus(hook)))
+	}
+	result += "</table><h3>Add a webhook</h3><form method='post' action='/webhooks'>" +
+		webhookForm(&bookshelf.Webhook{}) + "<input type='submit' value='Add webhook'></form>"
+	result += "<div><a href='/books'>Back to books</a></div>"
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, result)
+}
+
+// webhookHandler shows a webhook, with forms to change, test and delete
+// it, and its recent deliveries.
+func webhookHandler(w http.ResponseWriter, r *http.Request) {
+	profile := profileFromSession(r)
+	if profile == nil {
+		http.Redirect(w, r, "/login?redirect="+r.URL.Path, http.StatusFound)
+		return
+	}
+	hook, err := getWebhook(r, profile)
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	deliveries, err := bookshelf.DB.ListWebhookDeliveries(bookshelf.DeliveryQuery{WebhookID: hook.ID, Limit: deliveryLogLimit})
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	e := html.EscapeString
+	result := fmt.Sprintf(`<h3>Webhook %d</h3><div>%s</div><div>Sent %s. Status: %s.</div>
+		<div>Secret: <code>%s</code></div>
+		<div>Deliveries are signed in the %s header: sha256= and the hex HMAC-SHA256, keyed with the secret, of the %s header, a dot and the body.</div>`,
+		hook.ID, e(hook.URL), e(webhookEvents(hook)), e(webhookStatus(hook)), e(webhookSecret(hook, profile)),
+		bookshelf.WebhookSignatureHeader, bookshelf.WebhookTimestampHeader)
+	result += fmt.Sprintf("<form method='post' action='/webhooks/%d/test'><input type='submit' value='Send test event'></form>", hook.ID)
+	result += fmt.Sprintf("<h3>Settings</h3><form method='post' action='/webhooks/%d'>%s<input type='submit' value='Save'></form>",
+		hook.ID, webhookForm(hook))
+	result += fmt.Sprintf(`<form method="post" action="/webhooks/%d/delete" onsubmit="return confirm('Delete this webhook?')">
+		<input type="submit" value="Delete webhook"></form>`, hook.ID)
+
+	result += "<h3>Recent deliveries</h3><table><tr><th>Queued</th><th>Event</th><th>Book</th><th>Status</th><th>Attempts</th><th>Last attempt</th><th>Response</th><th>Next attempt</th></tr>"
+	for _, d := range deliveries {
+		book := ""
+		if d.BookID != 0 {
+			book = fmt.Sprintf("<a href='/books/%d'>%d</a>", d.BookID, d.BookID)
+		}
+		response := e(d.Error)
+		if d.ResponseCode != 0 && d.Error == "" {
+			response = strconv.Itoa(d.ResponseCode)
+		}
+		next := ""
+		if d.Status == bookshelf.DeliveryPending {
+			next = webhookTime(d.NextAttemptAt)
+		}
+		result += fmt.Sprintf("<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%d</td><td>%s</td><td>%s</td><td>%s</td></tr>",
+			webhookTime(d.CreatedAt), e(d.Event), book, e(d.Status), d.Attempts, webhookTime(d.LastAttemptAt), response, next)
+	}
+	result += "</table><div><a href='/webhooks'>Back to webhooks</a></div>"
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, result)
+}
+
+// webhookAction runs a change by the logged in user to the webhook in the
+// path and goes back to its page, or to the list if f deleted it.
+func webhookAction(w http.ResponseWriter, r *http.Request, f func(hook *bookshelf.Webhook) error) {
+	profile := profileFromSession(r)
+	if profile == nil {
+		http.Redirect(w, r, "/login?redirect=/webhooks", http.StatusFound)
+		return
+	}
+	hook, err := getWebhook(r, profile)
+	if err == nil {
+		err = f(hook)
+	}
+	if err != nil {
+		dbError(w, err)
+		return
+	}
+	markWrite(w, r)
+	if hook.ID == 0 {
+		http.Redirect(w, r, "/webhooks", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/webhooks/%d", hook.ID), http.StatusFound)
+}
+
+// createWebhookHandler registers the submitted webhook for the logged in
+// user and shows it, with its secret.
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	profile := profileFromSession(r)
+	if profile == nil {
+		http.Redirect(w, r, "/login?redirect=/webhooks", http.StatusFound)
+		return
+	}
+	hook := webhookFromForm(r)
+	hook.OwnerID, hook.OwnerName = profile.ID, profile.DisplayName
+	if err := bookshelf.DB.AddWebhook(hook); err != nil {
+		dbError(w, err)
+		return
+	}
+	markWrite(w, r)
+	http.Redirect(w, r, fmt.Sprintf("/webhooks/%d", hook.ID), http.StatusFound)
+}
+
+// updateWebhookHandler saves the submitted settings of the webhook in the
+// path.
+func updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhookAction(w, r, func(hook *bookshelf.Webhook) error {
+		update := webhookFromForm(r)
+		update.ID = hook.ID
+		return bookshelf.DB.UpdateWebhook(update)
+	})
+}
+
+// deleteWebhookHandler deletes the webhook in the path.
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhookAction(w, r, func(hook *bookshelf.Webhook) error {
+		if err := bookshelf.DB.DeleteWebhook(hook.ID); err != nil {
+			return err
+		}
+		hook.ID = 0
+		return nil
+	})
+}
+
+// testWebhookHandler queues a test event to the webhook in the path. The
+// worker sends it shortly, and its page shows how that went.
+func testWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhookAction(w, r, func(hook *bookshelf.Webhook) error {
+		_, err := bookshelf.SendTestWebhook(hook)
+		return err
+	})
+}
+
+// apiWebhook is the JSON form of a webhook. Active defaults to true when
+// a webhook is added.
+type apiWebhook struct {
+	ID         int64      `json:"id"`
+	OwnerID    string     `json:"ownerId"`
+	URL        string     `json:"url"`
+	Events     []string   `json:"events"`
+	Secret     string     `json:"secret,omitempty"`
+	Active     *bool      `json:"active,omitempty"`
+	Failures   int        `json:"failures"`
+	DisabledAt *time.Time `json:"disabledAt,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+}
+
+// toAPIWebhook returns the JSON form of hook for profile, with its secret
+// masked unless they own it.
+func toAPIWebhook(hook *bookshelf.Webhook, profile *Profile) *apiWebhook {
+	active := hook.Active
+	a := &apiWebhook{
+		ID:        hook.ID,
+		OwnerID:   hook.OwnerID,
+		URL:       hook.URL,
+		Events:    hook.Events,
+		Secret:    webhookSecret(hook, profile),
+		Active:    &active,
+		Failures:  hook.Failures,
+		CreatedAt: hook.CreatedAt,
+		UpdatedAt: hook.UpdatedAt,
+	}
+	if a.Events == nil {
+		a.Events = []string{}
+	}
+	if !hook.DisabledAt.IsZero() {
+		a.DisabledAt = &hook.DisabledAt
+	}
+	return a
+}
+
+// apiDelivery is the JSON form of a webhook delivery. The payload is
+// included as the JSON it is.
+type apiDelivery struct {
+	ID            int64           `json:"id"`
+	WebhookID     int64           `json:"webhookId"`
+	Event         string          `json:"event"`
+	BookID        int64           `json:"bookId,omitempty"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	ResponseCode  int             `json:"responseCode,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	LastAttemptAt *time.Time      `json:"lastAttemptAt,omitempty"`
+	NextAttemptAt *time.Time      `json:"nextAttemptAt,omitempty"`
+}
+
+func toAPIDelivery(d *bookshelf.WebhookDelivery) *apiDelivery {
+	a := &apiDelivery{
+		ID:           d.ID,
+		WebhookID:    d.WebhookID,
+		Event:        d.Event,
+		BookID:       d.BookID,
+		Payload:      json.RawMessage(d.Payload),
+		Status:       d.Status,
+		Attempts:     d.Attempts,
+		ResponseCode: d.ResponseCode,
+		Error:        d.Error,
+		CreatedAt:    d.CreatedAt,
+	}
+	if !json.Valid(a.Payload) {
+		a.Payload, _ = json.Marshal(d.Payload)
+	}
+	if !d.LastAttemptAt.IsZero() {
+		a.LastAttemptAt = &d.LastAttemptAt
+	}
+	if d.Status == bookshelf.DeliveryPending {
+		a.NextAttemptAt = &d.NextAttemptAt
+	}
+	return a
+}
+
+// decodeWebhook reads a webhook from the JSON body, replying with 400 if
+// it is not one.
+func decodeWebhook(w http.ResponseWriter, r *http.Request) (*bookshelf.Webhook, bool) {
+	var body apiWebhook
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWebhookSize)).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid webhook: " + err.Error()})
+		return nil, false
+	}
+	hook := &bookshelf.Webhook{URL: body.URL, Events: body.Events, Secret: body.Secret, Active: true}
+	if body.Active != nil {
+		hook.Active = *body.Active
+	}
+	return hook, true
+}
+
+// apiGetWebhook returns the webhook in the path and the logged in user,
+// replying with an error if there is none they may manage.
+func apiGetWebhook(w http.ResponseWriter, r *http.Request) (*bookshelf.Webhook, *Profile, bool) {
+	profile, ok := apiProfile(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	hook, err := getWebhook(r, profile)
+	if err != nil {
+		apiError(w, err)
+		return nil, nil, false
+	}
+	return hook, profile, true
+}
+
+// apiWebhooksHandler lists the webhooks the logged in user may manage.
+func apiWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	profile, ok := apiProfile(w, r)
+	if !ok {
+		return
+	}
+	hooks, err := listWebhooks(r, profile)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	a := make([]*apiWebhook, len(hooks))
+	for i, hook := range hooks {
+		a[i] = toAPIWebhook(hook, profile)
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+// apiAddWebhookHandler registers the webhook in the JSON body for the
+// logged in user and replies with it, including its secret.
+func apiAddWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	profile, ok := apiProfile(w, r)
+	if !ok {
+		return
+	}
+	hook, ok := decodeWebhook(w, r)
+	if !ok {
+		return
+	}
+	hook.OwnerID, hook.OwnerName = profile.ID, profile.DisplayName
+	if err := bookshelf.DB.AddWebhook(hook); err != nil {
+		apiError(w, err)
+		return
+	}
+	markWrite(w, r)
+	writeJSON(w, http.StatusCreated, toAPIWebhook(hook, profile))
+}
+
+// apiWebhookHandler returns the webhook in the path.
+func apiWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if hook, profile, ok := apiGetWebhook(w, r); ok {
+		writeJSON(w, http.StatusOK, toAPIWebhook(hook, profile))
+	}
+}
+
+// apiUpdateWebhookHandler replaces the settings of the webhook in the path
+// with those in the JSON body, keeping its secret if none is given, and
+// replies with it.
+func apiUpdateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	hook, profile, ok := apiGetWebhook(w, r)
+	if !ok {
+		return
+	}
+	update, ok := decodeWebhook(w, r)
+	if !ok {
+		return
+	}
+	update.ID = hook.ID
+	if err := bookshelf.DB.UpdateWebhook(update); err != nil {
+		apiError(w, err)
+		return
+	}
+	markWrite(w, r)
+	writeJSON(w, http.StatusOK, toAPIWebhook(update, profile))
+}
+
+// apiDeleteWebhookHandler deletes the webhook in the path and its
+// deliveries.
+func apiDeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	hook, _, ok := apiGetWebhook(w, r)
+	if !ok {
+		return
+	}
+	if err := bookshelf.DB.DeleteWebhook(hook.ID); err != nil {
+		apiError(w, err)
+		return
+	}
+	markWrite(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiDeliveriesHandler lists the most recent deliveries to the webhook in
+// the path, as many as the limit parameter, deliveryLogLimit by default.
+func apiDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	hook, _, ok := apiGetWebhook(w, r)
+	if !ok {
+		return
+	}
+	limit := deliveryLogLimit
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit: " + v})
+			return
+		}
+		limit = n
+	}
+	deliveries, err := bookshelf.DB.ListWebhookDeliveries(bookshelf.DeliveryQuery{WebhookID: hook.ID, Limit: limit})
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	a := make([]*apiDelivery, len(deliveries))
+	for i, d := range deliveries {
+		a[i] = toAPIDelivery(d)
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+// apiTestWebhookHandler queues a test event to the webhook in the path for
+// the worker to send, and replies 202 with its delivery, whose status can
+// be followed in the delivery log.
+func apiTestWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	hook, _, ok := apiGetWebhook(w, r)
+	if !ok {
+		return
+	}
+	d, err := bookshelf.SendTestWebhook(hook)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	markWrite(w, r)
+	writeJSON(w, http.StatusAccepted, toAPIDelivery(d))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+func TestWebhookSecretShownToOwnerOnly(t *testing.T) {
+	saved := bookshelf.Admins
+	bookshelf.Admins = "admin"
+	t.Cleanup(func() { bookshelf.Admins = saved })
+	alice := &Profile{ID: "alice", DisplayName: "Alice"}
+	admin := &Profile{ID: "admin", DisplayName: "Admin"}
+
+	hook := &bookshelf.Webhook{OwnerID: alice.ID, URL: "https://example.com/hook", Active: true}
+	if err := bookshelf.DB.AddWebhook(hook); err != nil {
+		t.Fatalf("AddWebhook: %v", err)
+	}
+	t.Cleanup(func() { bookshelf.DB.DeleteWebhook(hook.ID) })
+	page := fmt.Sprintf("/webhooks/%d", hook.ID)
+	masked := "********" + hook.Secret[len(hook.Secret)-4:]
+
+	if w := serveAs(t, alice, "GET", page, ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), hook.Secret) {
+		t.Errorf("GET %s as the owner = %d, want the secret shown", page, w.Code)
+	}
+	w := serveAs(t, admin, "GET", page, "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), hook.Secret) || !strings.Contains(w.Body.String(), masked) {
+		t.Errorf("GET %s as an admin = %d, want the secret masked", page, w.Code)
+	}
+
+	for _, c := range []struct {
+		profile *Profile
+		want    string
+	}{
+		{alice, hook.Secret},
+		{admin, masked},
+	} {
+		w := serveAs(t, c.profile, "GET", "/api"+page, "")
+		var got apiWebhook
+		if err := json.NewDecoder(w.Body).Decode(&got); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("GET /api%s as %s = %d, %v", page, c.profile.ID, w.Code, err)
+		}
+		if got.Secret != c.want {
+			t.Errorf("GET /api%s as %s gave secret %q, want %q", page, c.profile.ID, got.Secret, c.want)
+		}
+
+		w = serveAs(t, c.profile, "GET", "/api/webhooks", "")
+		var list []apiWebhook
+		if err := json.NewDecoder(w.Body).Decode(&list); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("GET /api/webhooks as %s = %d, %v", c.profile.ID, w.Code, err)
+		}
+		if len(list) != 1 || list[0].Secret != c.want {
+			t.Errorf("GET /api/webhooks as %s = %+v, want the webhook with secret %q", c.profile.ID, list, c.want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package bookshelf
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Roles of a contributor to a book.
+const (
+	RoleAuthor      = "author"
+	RoleEditor      = "editor"
+	RoleTranslator  = "translator"
+	RoleIllustrator = "illustrator"
+)
+
+// roles lists the valid roles, in the order they are shown.
+var roles = []string{RoleAuthor, RoleEditor, RoleTranslator, RoleIllustrator}
+
+// Author is a person who contributed to one or more books.
+type Author struct {
+	ID   int64
+	Name string
+}
+
+// Contributor is an author's part in a book.
+type Contributor struct {
+	// AuthorID is assigned by the database, which finds authors by their
+	// name as normalized by NormalizeAuthor.
+	AuthorID int64
+	Name     string
+	Role     string
+}
+
+// DefaultAuthorSearchLimit caps the authors SearchAuthors returns when no
+// limit is given.
+const DefaultAuthorSearchLimit = 10
+
+// roleSuffix and rolePrefix match the notes after or before a name in an
+// author string that give its role, and roleNotes maps them to the role.
+// nameSeparator and nameSuffix find where one name ends and the next
+// starts.
+var (
+	roleSuffix = regexp.MustCompile(`(?i)\s*\((ed|eds|editor|editors|trans|tr|translator|ill|illus|illustrator|author)\.?\)\s*$`)
+	rolePrefix = regexp.MustCompile(`(?i)^(edited|translated|illustrated) by\s+`)
+	roleNotes  = map[string]string{
+		"ed": RoleEditor, "eds": RoleEditor, "editor": RoleEditor, "editors": RoleEditor, "edited": RoleEditor,
+		"trans": RoleTranslator, "tr": RoleTranslator, "translator": RoleTranslator, "translated": RoleTranslator,
+		"ill": RoleIllustrator, "illus": RoleIllustrator, "illustrator": RoleIllustrator, "illustrated": RoleIllustrator,
+		"author": RoleAuthor,
+	}
+	nameSeparator = regexp.MustCompile(`(?i)\s*;\s*|\s+(?:&|and|with)\s+`)
+	nameSuffix    = regexp.MustCompile(`(?i)^(jr|sr|ii|iii|iv|phd)\.?$`)
+)
+
+// splitCommas splits a list of names on commas, except where the comma
+// sits inside a single name, as in "Tolkien, J.R.R." or "King, Jr.".
+func splitCommas(s string) []string {
+	parts := strings.Split(s, ",")
+	if len(parts) == 1 {
+		return parts
+	}
+	if len(parts) == 2 {
+		left, right := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if nameSuffix.MatchString(right) || len(strings.Fields(left)) == 1 && len(strings.Fields(right)) <= 2 {
+			return []string{s}
+		}
+	}
+	var names []string
+	for i := 0; i < len(parts); i++ {
+		name := parts[i]
+		if i+1 < len(parts) && nameSuffix.MatchString(strings.TrimSpace(parts[i+1])) {
+			name += "," + parts[i+1]
+			i++
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// ParseContributors splits a free text author string, such as "Neil Gaiman
+// and Terry Pratchett" or "Homer; Emily Wilson (translator)", into its
+// contributors. Names are separated by semicolons, commas, "and", "&" or
+// "with"; a role is given by a note such as "(ed.)" after a name, or by
+// "edited by", "translated by" or "illustrated by" before it, and defaults
+// to RoleAuthor.
+func ParseContributors(s string) []Contributor {
+	var cs []Contributor
+	seen := make(map[string]bool)
+	for _, segment := range nameSeparator.Split(s, -1) {
+		segRole := ""
+		if m := rolePrefix.FindStringSubmatch(segment); m != nil {
+			segRole = roleNotes[strings.ToLower(m[1])]
+			segment = segment[len(m[0]):]
+		}
+		for _, name := range splitCommas(segment) {
+			role := segRole
+			if m := roleSuffix.FindStringSubmatch(name); m != nil {
+				role = roleNotes[strings.ToLower(m[1])]
+				name = name[:len(name)-len(m[0])]
+			}
+			if role == "" {
+				role = RoleAuthor
+			}
+			name = strings.TrimSpace(name)
+			key := NormalizeAuthor(name) + "|" + role
+			if name == "" || NormalizeAuthor(name) == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			cs = append(cs, Contributor{Name: name, Role: role})
+		}
+	}
+	return cs
+}
+
+// FormatContributors writes contributors as an author string that
+// ParseContributors reads back: names separated by semicolons, each
+// followed by its role unless it is RoleAuthor.
+func FormatContributors(cs []Contributor) string {
+	names := make([]string, len(cs))
+	for i, c := range cs {
+		names[i] = c.Name
+		if c.Role != RoleAuthor {
+			names[i] += " (" + c.Role + ")"
+		}
+	}
+	return strings.Join(names, "; ")
+}
+
+// sameContributors reports whether a and b list the same names in the same
+// roles and order.
+func sameContributors(a, b []Contributor) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if NormalizeAuthor(a[i].Name) != NormalizeAuthor(b[i].Name) || a[i].Role != b[i].Role {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeContributors reconciles the author string of b with its
+// contributors before b replaces old, or is added if old is nil. Whichever
+// of the two the caller changed wins: new contributors rewrite Author
+// unless it already lists them, and a new Author string is parsed into
+// contributors. Unknown roles are rejected with ErrInvalid.
+func (b *Book) normalizeContributors(old *Book) error {
+	seen := make(map[string]bool)
+	for _, c := range b.Contributors {
+		key := NormalizeAuthor(c.Name) + "|" + c.Role
+		if seen[key] {
+			return fmt.Errorf("contributor %q is listed twice as %s: %w", c.Name, c.Role, ErrInvalid)
+		}
+		seen[key] = true
+		valid := false
+		for _, r := range roles {
+			valid = valid || c.Role == r
+		}
+		if !valid {
+			return fmt.Errorf("contributor %q has unknown role %q: %w", c.Name, c.Role, ErrInvalid)
+		}
+		if strings.TrimSpace(c.Name) == "" {
+			return fmt.Errorf("contributor without a name: %w", ErrInvalid)
+		}
+	}
+	switch {
+	case old != nil && b.Author == old.Author &&
+		(len(b.Contributors) == 0 || sameContributors(b.Contributors, old.Contributors)):
+		b.Contributors = old.Contributors
+	case len(b.Contributors) == 0 || old != nil && sameContributors(b.Contributors, old.Contributors):
+		b.Contributors = ParseContributors(b.Author)
+	case !sameContributors(b.Contributors, ParseContributors(b.Author)):
+		b.Author = FormatContributors(b.Contributors)
+	}
+	return nil
+}
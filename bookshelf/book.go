@@ -2,16 +2,129 @@ package bookshelf
 
 import (
 	"fmt"
+	"strings"
+	"time"
 )
 
 // Book holds metadata about a book
 type Book struct {
-	ID       int64
-	Title    string
-	Author   string
+	ID    int64
+	Title string
+
+	// Author is the author string shown for the book, and Contributors
+	// the authors, editors, translators and illustrators it names. Either
+	// may be set on a book being saved; the backends derive the other.
+	// Contributors is loaded by GetBook, GetBookByISBN and
+	// ListAuthorBooks, and may be left nil by the other lists.
+	Author       string
+	Contributors []Contributor
+
 	ImageURL string
+
+	// Description is a summary of the book, and PublishedDate when it
+	// came out, as precisely as is known, such as "1954" or "1954-07-29".
+	// Both are typed in or filled in by the worker from its metadata.
+	Description   string
+	PublishedDate string
+
+	// ISBN10 and ISBN13 are stored without punctuation. Either may be set
+	// on a book being saved; the backends fill in the other. Books in the
+	// 979 range have no ISBN10.
+	ISBN10 string
+	ISBN13 string
+
+	// Tags are the user's own labels, and Genres come from the Genres
+	// list. Both are stored lower case and sorted, and loaded by the same
+	// calls as Contributors and by FilterBooks.
+	Tags   []string
+	Genres []string
+
+	// RatingCount and RatingSum add up the ratings of the book's reviews.
+	// The backends keep them up to date as reviews are saved and deleted;
+	// saving a book leaves them alone.
+	RatingCount int
+	RatingSum   int
+
+	// CreatedAt is when the book was added and UpdatedAt when it was last
+	// saved with a change, both set by the backends. They are zero for
+	// books added before they were recorded.
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// DeletedAt is set while the book is in the trash, along with who put
+	// it there.
+	DeletedAt   time.Time
+	DeletedBy   string
+	DeletedByID string
+}
+
+// Sources of a change, recorded in Actor.Source.
+const (
+	SourceHTML   = "html"
+	SourceAPI    = "api"
+	SourceWorker = "worker"
+)
+
+// Actor identifies who made a change.
+type Actor struct {
+	// ID is the user's profile ID, empty for anonymous users, or "worker".
+	ID string
+
+	// Name is shown to other users.
+	Name string
+
+	// Source is how the change was made: SourceHTML, SourceAPI or
+	// SourceWorker.
+	Source string
+}
+
+// WorkerActor makes the changes done by the worker.
+var WorkerActor = Actor{ID: "worker", Name: "worker", Source: SourceWorker}
+
+// SetISBN sets both ISBNs of b from an ISBN-10 or ISBN-13 in any
+// punctuation, or clears them if s is empty.
+func (b *Book) SetISBN(s string) error {
+	if StripISBN(s) == "" {
+		b.ISBN10, b.ISBN13 = "", ""
+		return nil
+	}
+	isbn10, isbn13, err := NormalizeISBN(s)
+	if err != nil {
+		return err
+	}
+	b.ISBN10, b.ISBN13 = isbn10, isbn13
+	return nil
+}
+
+// normalize puts the fields of b that have a canonical form in it, before
+// b is saved, or returns an ErrInvalid error for those that are invalid.
+func (b *Book) normalize() error {
+	if err := b.normalizeISBN(); err != nil {
+		return err
+	}
+	if err := b.normalizePublishedDate(); err != nil {
+		return err
+	}
+	return b.normalizeTags()
+}
+
+// publishedDateLayouts are the forms PublishedDate may take, from the most
+// to the least precise, as Google Books gives them.
+var publishedDateLayouts = []string{"2006-01-02", "2006-01", "2006"}
+
+func (b *Book) normalizePublishedDate() error {
+	b.PublishedDate = strings.TrimSpace(b.PublishedDate)
+	if b.PublishedDate == "" {
+		return nil
+	}
+	for _, layout := range publishedDateLayouts {
+		if _, err := time.Parse(layout, b.PublishedDate); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("published date %q is not YYYY, YYYY-MM or YYYY-MM-DD: %w", b.PublishedDate, ErrInvalid)
 }
 
 func (b *Book) String() string {
-	return fmt.Sprintf("ID: %d => Title: %s, Author: %s, ImageURL: %s", b.ID, b.Title, b.Author, b.ImageURL)
+	return fmt.Sprintf("ID: %d => Title: %s, Author: %s, ImageURL: %s, ISBN: %s", b.ID, b.Title, b.Author, b.ImageURL, b.ISBN13)
 }
@@ -0,0 +1,1476 @@
+// Package bookshelftest checks that implementations of
+// bookshelf.BookDatabase behave alike, so each backend's tests can run the
+// same suite against it.
+package bookshelftest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// TestBookDatabase checks that a BookDatabase implementation follows the
+// behaviour every caller relies on: title ordering, ID assignment, the
+// errors returned for missing and unassigned IDs, unique ISBNs, the trash,
+// the history of changes, merging duplicates, personal shelves, lending,
+// reviews, webhooks and their deliveries, and safe concurrent use.
+//
+// newDB is called once per subtest and must return an empty database. The
+// suite closes each database when its subtest finishes. A backend's own
+// tests call it with a factory, for example:
+//
+//	func TestSQLiteMemoryDB(t *testing.T) {
+//		bookshelftest.TestBookDatabase(t, newEmptySQLiteDB)
+//	}
+func TestBookDatabase(t *testing.T, newDB func(t *testing.T) bookshelf.BookDatabase) {
+	tests := []struct {
+		name string
+		f    func(t *testing.T, db bookshelf.BookDatabase)
+	}{
+		{"Empty", testEmpty},
+		{"AddAndGet", testAddAndGet},
+		{"IDAssignment", testIDAssignment},
+		{"ListOrderedByTitle", testListOrderedByTitle},
+		{"GetMissing", testGetMissing},
+		{"Search", testSearch},
+		{"ISBN", testISBN},
+		{"Update", testUpdate},
+		{"UpdateUnchanged", testUpdateUnchanged},
+		{"UpdateMissing", testUpdateMissing},
+		{"Delete", testDelete},
+		{"DeleteMissing", testDeleteMissing},
+		{"Trash", testTrash},
+		{"Restore", testRestore},
+		{"Purge", testPurge},
+		{"PurgeDeletedBooks", testPurgeDeletedBooks},
+		{"History", testHistory},
+		{"AuditLog", testAuditLog},
+		{"Rollback", testRollback},
+		{"Merge", testMerge},
+		{"Authors", testAuthors},
+		{"Tags", testTags},
+		{"Readings", testReadings},
+		{"Lending", testLending},
+		{"Reviews", testReviews},
+		{"Timestamps", testTimestamps},
+		{"Webhooks", testWebhooks},
+		{"Concurrent", testConcurrent},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			db := newDB(t)
+			defer db.Close()
+			tt.f(t, db)
+		})
+	}
+}
+
+// mustAdd adds b to db and fails the test if that is not possible.
+func mustAdd(t *testing.T, db bookshelf.BookDatabase, b *bookshelf.Book) int64 {
+	t.Helper()
+	id, err := db.AddBook(b, testActor)
+	if err != nil {
+		t.Fatalf("AddBook(%v): %v", b, err)
+	}
+	return id
+}
+
+// now returns the current time as the backends store it, to the second.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+// day truncates t to its date in UTC, as readings keep their dates.
+func day(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// testActor is recorded as having made the changes.
+var testActor = bookshelf.Actor{ID: "12345", Name: "Tester", Source: bookshelf.SourceAPI}
+
+// mustDelete moves the book with id to the trash and fails the test if that
+// is not possible.
+func mustDelete(t *testing.T, db bookshelf.BookDatabase, id int64) {
+	t.Helper()
+	if err := db.DeleteBook(id, testActor); err != nil {
+		t.Fatalf("DeleteBook(%d): %v", id, err)
+	}
+}
+
+// checkIDs fails the test unless books have exactly the given IDs, in order.
+func checkIDs(t *testing.T, call string, books []*bookshelf.Book, want ...int64) {
+	t.Helper()
+	var got []int64
+	for _, b := range books {
+		got = append(got, b.ID)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("%s returned books %v, want %v", call, got, want)
+	}
+}
+
+// checkErr fails the test unless err wraps want.
+func checkErr(t *testing.T, call string, err, want error) {
+	t.Helper()
+	if !errors.Is(err, want) {
+		t.Errorf("%s = %v, want an error wrapping %v", call, err, want)
+	}
+}
+
+func testEmpty(t *testing.T, db bookshelf.BookDatabase) {
+	books, err := db.ListBooks()
+	if err != nil {
+		t.Fatalf("ListBooks: %v", err)
+	}
+	if len(books) != 0 {
+		t.Errorf("ListBooks on an empty database returned %d books", len(books))
+	}
+}
+
+func testAddAndGet(t *testing.T, db bookshelf.BookDatabase) {
+	want := &bookshelf.Book{
+		Title:       "The Go Programming Language",
+		Author:      "Alan Donovan",
+		ImageURL:    "https://storage.googleapis.com/bucket/cover.jpg",
+		Description: "An introduction to Go.",
+	}
+	id := mustAdd(t, db, want)
+
+	got, err := db.GetBook(id)
+	if err != nil {
+		t.Fatalf("GetBook(%d): %v", id, err)
+	}
+	if got.ID != id || got.Title != want.Title || got.Author != want.Author || got.ImageURL != want.ImageURL ||
+		got.Description != want.Description {
+		t.Errorf("GetBook(%d) = %v, want %v with ID %d", id, got, want, id)
+	}
+}
+
+func testIDAssignment(t *testing.T, db bookshelf.BookDatabase) {
+	var last int64
+	for i := 0; i < 5; i++ {
+		id := mustAdd(t, db, &bookshelf.Book{Title: fmt.Sprintf("Book %d", i)})
+		if id <= 0 {
+			t.Fatalf("AddBook assigned ID %d, want a positive ID", id)
+		}
+		if id <= last {
+			t.Errorf("AddBook assigned ID %d after %d, want increasing IDs", id, last)
+		}
+		last = id
+	}
+}
+
+func testListOrderedByTitle(t *testing.T, db bookshelf.BookDatabase) {
+	// Capitals sort among the lower case titles, whatever the collation.
+	for _, title := range []string{"charlie", "alpha", "Delta", "Bravo"} {
+		mustAdd(t, db, &bookshelf.Book{Title: title})
+	}
+	books, err := db.ListBooks()
+	if err != nil {
+		t.Fatalf("ListBooks: %v", err)
+	}
+	want := []string{"alpha", "Bravo", "charlie", "Delta"}
+	if len(books) != len(want) {
+		t.Fatalf("ListBooks returned %d books, want %d", len(books), len(want))
+	}
+	for i, b := range books {
+		if b.Title != want[i] {
+			t.Errorf("ListBooks()[%d].Title = %q, want %q", i, b.Title, want[i])
+		}
+	}
+}
+
+func testGetMissing(t *testing.T, db bookshelf.BookDatabase) {
+	id := mustAdd(t, db, &bookshelf.Book{Title: "Present"})
+	_, err := db.GetBook(id + 1000)
+	checkErr(t, fmt.Sprintf("GetBook(%d)", id+1000), err, bookshelf.ErrNotFound)
+}
+
+func testSearch(t *testing.T, db bookshelf.BookDatabase) {
+	mustAdd(t, db, &bookshelf.Book{Title: "learning go", Author: "Jon Bodner"})
+	mustAdd(t, db, &bookshelf.Book{Title: "go in action", Author: "William Kennedy"})
+	mustAdd(t, db, &bookshelf.Book{Title: "100% pure", Author: "Someone"})
+	mustAdd(t, db, &bookshelf.Book{Title: "1000 recipes", Author: "Goran"})
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"GO", []string{"1000 recipes", "go in action", "learning go"}},
+		{"kennedy", []string{"go in action"}},
+		{"0%", []string{"100% pure"}},
+		{"missing", nil},
+	}
+	for _, tt := range tests {
+		books, err := db.SearchBooks(tt.query)
+		if err != nil {
+			t.Fatalf("SearchBooks(%q): %v", tt.query, err)
+		}
+		var got []string
+		for _, b := range books {
+			got = append(got, b.Title)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("SearchBooks(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func testISBN(t *testing.T, db bookshelf.BookDatabase) {
+	id := mustAdd(t, db, &bookshelf.Book{Title: "Dune", ISBN10: "0-441-17271-7"})
+	got, err := db.GetBook(id)
+	if err != nil {
+		t.Fatalf("GetBook(%d): %v", id, err)
+	}
+	if got.ISBN10 != "0441172717" || got.ISBN13 != "9780441172719" {
+		t.Errorf("GetBook(%d) has ISBNs %q and %q, want 0441172717 and 9780441172719", id, got.ISBN10, got.ISBN13)
+	}
+	for _, isbn := range []string{"9780441172719", "978-0-441-17271-9", "0441172717"} {
+		if got, err := db.GetBookByISBN(isbn); err != nil || got.ID != id {
+			t.Errorf("GetBookByISBN(%q) = %v, %v; want book %d", isbn, got, err, id)
+		}
+	}
+
+	_, err = db.AddBook(&bookshelf.Book{Title: "Dune, again", ISBN13: "9780441172719"}, testActor)
+	checkErr(t, "AddBook with a taken ISBN", err, bookshelf.ErrConflict)
+	_, err = db.AddBook(&bookshelf.Book{Title: "Dune, misprinted", ISBN13: "9780441172718"}, testActor)
+	checkErr(t, "AddBook with a bad check digit", err, bookshelf.ErrInvalid)
+	_, err = db.GetBookByISBN("12345")
+	checkErr(t, "GetBookByISBN(12345)", err, bookshelf.ErrInvalid)
+	_, err = db.GetBookByISBN("9780261102217")
+	checkErr(t, "GetBookByISBN of a missing book", err, bookshelf.ErrNotFound)
+
+	// Books without an ISBN do not conflict with each other.
+	mustAdd(t, db, &bookshelf.Book{Title: "No ISBN"})
+	mustAdd(t, db, &bookshelf.Book{Title: "No ISBN either"})
+
+	// Changing the ISBN frees the old one.
+	if err := db.UpdateBook(&bookshelf.Book{ID: id, Title: "Dune", ISBN13: "9780261102217"}, testActor); err != nil {
+		t.Fatalf("UpdateBook: %v", err)
+	}
+	if got, err := db.GetBookByISBN("0261102214"); err != nil || got.ID != id || got.ISBN10 != "0261102214" {
+		t.Errorf("GetBookByISBN after update = %v, %v; want book %d", got, err, id)
+	}
+	other := mustAdd(t, db, &bookshelf.Book{Title: "Dune", ISBN13: "9780441172719"})
+	err = db.UpdateBook(&bookshelf.Book{ID: other, Title: "Dune", ISBN13: "9780261102217"}, testActor)
+	checkErr(t, "UpdateBook to a taken ISBN", err, bookshelf.ErrConflict)
+
+	// A book in the trash keeps its ISBN but is not found by it.
+	mustDelete(t, db, other)
+	_, err = db.GetBookByISBN("9780441172719")
+	checkErr(t, "GetBookByISBN of a deleted book", err, bookshelf.ErrNotFound)
+	_, err = db.AddBook(&bookshelf.Book{Title: "Dune", ISBN13: "9780441172719"}, testActor)
+	checkErr(t, "AddBook with the ISBN of a deleted book", err, bookshelf.ErrConflict)
+}
+
+func testUpdate(t *testing.T, db bookshelf.BookDatabase) {
+	id := mustAdd(t, db, &bookshelf.Book{Title: "Draft", Author: "Someone"})
+	if err := db.UpdateBook(&bookshelf.Book{ID: id, Title: "Final", Author: "Someone Else"}, testActor); err != nil {
+		t.Fatalf("UpdateBook: %v", err)
+	}
+	got, err := db.GetBook(id)
+	if err != nil {
+		t.Fatalf("GetBook(%d): %v", id, err)
+	}
+	if got.Title != "Final" || got.Author != "Someone Else" {
+		t.Errorf("GetBook(%d) after update = %v", id, got)
+	}
+}
+
+func testUpdateUnchanged(t *testing.T, db bookshelf.BookDatabase) {
+	b := &bookshelf.Book{Title: "Same", Author: "Same"}
+	b.ID = mustAdd(t, db, b)
+	if err := db.UpdateBook(b, testActor); err != nil {
+		t.Errorf("UpdateBook without changes: %v", err)
+	}
+}
+
+func testUpdateMissing(t *testing.T, db bookshelf.BookDatabase) {
+	id := mustAdd(t, db, &bookshelf.Book{Title: "Present"})
+	err := db.UpdateBook(&bookshelf.Book{ID: id + 1000, Title: "Missing"}, testActor)
+	checkErr(t, fmt.Sprintf("UpdateBook(%d)", id+1000), err, bookshelf.ErrNotFound)
+
+	err = db.UpdateBook(&bookshelf.Book{Title: "Unassigned"}, testActor)
+	checkErr(t, "UpdateBook(0)", err, bookshelf.ErrInvalid)
+}
+
+func testDelete(t *testing.T, db bookshelf.BookDatabase) {
+	keep := mustAdd(t, db, &bookshelf.Book{Title: "Keep"})
+	gone := mustAdd(t, db, &bookshelf.Book{Title: "Gone"})
+	mustDelete(t, db, gone)
+	_, err := db.GetBook(gone)
+	checkErr(t, fmt.Sprintf("GetBook(%d) after delete", gone), err, bookshelf.ErrNotFound)
+
+	books, err := db.ListBooks()
+	if err != nil {
+		t.Fatalf("ListBooks: %v", err)
+	}
+	checkIDs(t, "ListBooks after delete", books, keep)
+
+	books, err = db.SearchBooks("gone")
+	if err != nil {
+		t.Fatalf("SearchBooks: %v", err)
+	}
+	checkIDs(t, "SearchBooks after delete", books)
+
+	err = db.UpdateBook(&bookshelf.Book{ID: gone, Title: "Edited"}, testActor)
+	checkErr(t, fmt.Sprintf("UpdateBook(%d) after delete", gone), err, bookshelf.ErrNotFound)
+}
+
+func testDeleteMissing(t *testing.T, db bookshelf.BookDatabase) {
+	id := mustAdd(t, db, &bookshelf.Book{Title: "Present"})
+	checkErr(t, fmt.Sprintf("DeleteBook(%d)", id+1000), db.DeleteBook(id+1000, testActor), bookshelf.ErrNotFound)
+	checkErr(t, "DeleteBook(0)", db.DeleteBook(0, testActor), bookshelf.ErrInvalid)
+
+	mustDelete(t, db, id)
+	checkErr(t, fmt.Sprintf("DeleteBook(%d) twice", id), db.DeleteBook(id, testActor), bookshelf.ErrNotFound)
+}
+
+func testTrash(t *testing.T, db bookshelf.BookDatabase) {
+	mustAdd(t, db, &bookshelf.Book{Title: "Keep"})
+	first := mustAdd(t, db, &bookshelf.Book{Title: "First"})
+	second := mustAdd(t, db, &bookshelf.Book{Title: "Second"})
+
+	start := time.Now().Add(-time.Second)
+	mustDelete(t, db, first)
+	mustDelete(t, db, second)
+
+	books, err := db.ListDeletedBooks()
+	if err != nil {
+		t.Fatalf("ListDeletedBooks: %v", err)
+	}
+	checkIDs(t, "ListDeletedBooks", books, second, first)
+	for _, b := range books {
+		if b.DeletedBy != testActor.Name || b.DeletedByID != testActor.ID {
+			t.Errorf("book %d deleted by %q (%q), want %q (%q)", b.ID, b.DeletedBy, b.DeletedByID, testActor.Name, testActor.ID)
+		}
+		if b.DeletedAt.Before(start) || b.DeletedAt.After(time.Now().Add(time.Second)) {
+			t.Errorf("book %d deleted at %v, want about %v", b.ID, b.DeletedAt, time.Now())
+		}
+	}
+}
+
+func testRestore(t *testing.T, db bookshelf.BookDatabase) {
+	id := mustAdd(t, db, &bookshelf.Book{Title: "Restored", Author: "Someone"})
+	checkErr(t, fmt.Sprintf("RestoreBook(%d) outside the trash", id), db.RestoreBook(id, testActor), bookshelf.ErrNotFound)
+
+	mustDelete(t, db, id)
+	if err := db.RestoreBook(id, testActor); err != nil {
+		t.Fatalf("RestoreBook(%d): %v", id, err)
+	}
+	got, err := db.GetBook(id)
+	if err != nil {
+		t.Fatalf("GetBook(%d) after restore: %v", id, err)
+	}
+	if got.Title != "Restored" || got.Author != "Someone" || !got.DeletedAt.IsZero() || got.DeletedBy != "" {
+		t.Errorf("GetBook(%d) after restore = %+v", id, got)
+	}
+
+	books, err := db.ListDeletedBooks()
+	if err != nil {
+		t.Fatalf("ListDeletedBooks: %v", err)
+	}
+	checkIDs(t, "ListDeletedBooks after restore", books)
+	checkErr(t, fmt.Sprintf("RestoreBook(%d) twice", id), db.RestoreBook(id, testActor), bookshelf.ErrNotFound)
+}
+
+func testPurge(t *testing.T, db bookshelf.BookDatabase) {
+	id := mustAdd(t, db, &bookshelf.Book{Title: "Purged", ImageURL: "https://storage.googleapis.com/bucket/cover.jpg"})
+	_, err := db.PurgeBook(id, testActor)
+	checkErr(t, fmt.Sprintf("PurgeBook(%d) outside the trash", id), err, bookshelf.ErrNotFound)
+
+	mustDelete(t, db, id)
+	got, err := db.PurgeBook(id, testActor)
+	if err != nil {
+		t.Fatalf("PurgeBook(%d): %v", id, err)
+	}
+	if got.ID != id || got.ImageURL != "https://storage.googleapis.com/bucket/cover.jpg" {
+		t.Errorf("PurgeBook(%d) = %v, want the purged book with its cover", id, got)
+	}
+
+	books, err := db.ListDeletedBooks()
+	if err != nil {
+		t.Fatalf("ListDeletedBooks: %v", err)
+	}
+	checkIDs(t, "ListDeletedBooks after purge", books)
+	checkErr(t, fmt.Sprintf("RestoreBook(%d) after purge", id), db.RestoreBook(id, testActor), bookshelf.ErrNotFound)
+	_, err = db.PurgeBook(id, testActor)
+	checkErr(t, fmt.Sprintf("PurgeBook(%d) twice", id), err, bookshelf.ErrNotFound)
+}
+
+func testPurgeDeletedBooks(t *testing.T, db bookshelf.BookDatabase) {
+	keep := mustAdd(t, db, &bookshelf.Book{Title: "Keep"})
+	first := mustAdd(t, db, &bookshelf.Book{Title: "First"})
+	second := mustAdd(t, db, &bookshelf.Book{Title: "Second"})
+	mustDelete(t, db, first)
+	mustDelete(t, db, second)
+
+	books, err := db.PurgeDeletedBooks(time.Now().Add(-time.Hour), testActor)
+	if err != nil {
+		t.Fatalf("PurgeDeletedBooks an hour ago: %v", err)
+	}
+	checkIDs(t, "PurgeDeletedBooks an hour ago", books)
+
+	books, err = db.PurgeDeletedBooks(time.Now().Add(time.Hour), testActor)
+	if err != nil {
+		t.Fatalf("PurgeDeletedBooks in an hour: %v", err)
+	}
+	if len(books) != 2 {
+		t.Errorf("PurgeDeletedBooks in an hour purged %d books, want 2", len(books))
+	}
+
+	if books, err = db.ListDeletedBooks(); err != nil {
+		t.Fatalf("ListDeletedBooks: %v", err)
+	}
+	checkIDs(t, "ListDeletedBooks after purge", books)
+	if books, err = db.ListBooks(); err != nil {
+		t.Fatalf("ListBooks: %v", err)
+	}
+	checkIDs(t, "ListBooks after purge", books, keep)
+}
+
+func testHistory(t *testing.T, db bookshelf.BookDatabase) {
+	id := mustAdd(t, db, &bookshelf.Book{Title: "Draft", Author: "Someone"})
+	if err := db.UpdateBook(&bookshelf.Book{ID: id, Title: "Final", Author: "Someone"}, bookshelf.WorkerActor); err != nil {
+		t.Fatalf("UpdateBook: %v", err)
+	}
+	// Saving without changes records nothing.
+	if err := db.UpdateBook(&bookshelf.Book{ID: id, Title: "Final", Author: "Someone"}, testActor); err != nil {
+		t.Fatalf("UpdateBook without changes: %v", err)
+	}
+	mustDelete(t, db, id)
+	if err := db.RestoreBook(id, testActor); err != nil {
+		t.Fatalf("RestoreBook(%d): %v", id, err)
+	}
+
+	history, err := db.BookHistory(id)
+	if err != nil {
+		t.Fatalf("BookHistory(%d): %v", id, err)
+	}
+	want := []struct {
+		action string
+		actor  bookshelf.Actor
+		diff   string
+	}{
+		{bookshelf.ChangeRestore, testActor, "[]"},
+		{bookshelf.ChangeDelete, testActor, "[]"},
+		{bookshelf.ChangeUpdate, bookshelf.WorkerActor, "[{title Draft Final}]"},
+		{bookshelf.ChangeCreate, testActor, "[{title  Draft} {author  Someone}]"},
+	}
+	if len(history) != len(want) {
+		t.Fatalf("BookHistory(%d) returned %d changes, want %d", id, len(history), len(want))
+	}
+	for i, c := range history {
+		if c.BookID != id || c.Action != want[i].action || c.Actor != want[i].actor || fmt.Sprint(c.Diff) != want[i].diff {
+			t.Errorf("BookHistory(%d)[%d] = %+v, want %s by %v with diff %s", id, i, c, want[i].action, want[i].actor, want[i].diff)
+		}
+		if i > 0 && c.ID >= history[i-1].ID {
+			t.Errorf("BookHistory(%d)[%d] has ID %d after %d, want newest first", id, i, c.ID, history[i-1].ID)
+		}
+		if time.Since(c.Time) > time.Minute || time.Until(c.Time) > time.Minute {
+			t.Errorf("BookHistory(%d)[%d] at %v, want about now", id, i, c.Time)
+		}
+	}
+
+	other := mustAdd(t, db, &bookshelf.Book{Title: "Other"})
+	if history, err = db.BookHistory(other); err != nil {
+		t.Fatalf("BookHistory(%d): %v", other, err)
+	}
+	if len(history) != 1 {
+		t.Errorf("BookHistory(%d) returned %d changes, want only its creation", other, len(history))
+	}
+}
+
+func testAuditLog(t *testing.T, db bookshelf.BookDatabase) {
+	first := mustAdd(t, db, &bookshelf.Book{Title: "First"})
+	second := mustAdd(t, db, &bookshelf.Book{Title: "Second"})
+	if err := db.UpdateBook(&bookshelf.Book{ID: first, Title: "First, enriched"}, bookshelf.WorkerActor); err != nil {
+		t.Fatalf("UpdateBook: %v", err)
+	}
+	mustDelete(t, db, second)
+
+	tests := []struct {
+		name string
+		q    bookshelf.AuditQuery
+		want []string
+	}{
+		{"All", bookshelf.AuditQuery{}, []string{"delete 2", "update 1", "create 2", "create 1"}},
+		{"Book", bookshelf.AuditQuery{BookID: first}, []string{"update 1", "create 1"}},
+		{"Actor", bookshelf.AuditQuery{ActorID: testActor.ID}, []string{"delete 2", "create 2", "create 1"}},
+		{"Source", bookshelf.AuditQuery{Source: bookshelf.SourceWorker}, []string{"update 1"}},
+		{"Action", bookshelf.AuditQuery{Action: bookshelf.ChangeCreate}, []string{"create 2", "create 1"}},
+		{"Limit", bookshelf.AuditQuery{Limit: 2}, []string{"delete 2", "update 1"}},
+		{"Since", bookshelf.AuditQuery{Since: time.Now().Add(time.Hour)}, nil},
+		{"Until", bookshelf.AuditQuery{Until: time.Now().Add(-time.Hour)}, nil},
+		{"Window", bookshelf.AuditQuery{Since: time.Now().Add(-time.Hour), Until: time.Now().Add(time.Hour), Action: bookshelf.ChangeDelete}, []string{"delete 2"}},
+	}
+	for _, tt := range tests {
+		changes, err := db.AuditLog(tt.q)
+		if err != nil {
+			t.Fatalf("AuditLog(%s): %v", tt.name, err)
+		}
+		var got []string
+		for _, c := range changes {
+			n := 1
+			if c.BookID == second {
+				n = 2
+			}
+			got = append(got, fmt.Sprintf("%s %d", c.Action, n))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("AuditLog(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Page through the log with BeforeID.
+	page, err := db.AuditLog(bookshelf.AuditQuery{Limit: 2})
+	if err != nil || len(page) != 2 {
+		t.Fatalf("AuditLog(Limit: 2) = %d changes, %v", len(page), err)
+	}
+	rest, err := db.AuditLog(bookshelf.AuditQuery{BeforeID: page[1].ID})
+	if err != nil {
+		t.Fatalf("AuditLog(BeforeID: %d): %v", page[1].ID, err)
+	}
+	if len(rest) != 2 || rest[0].Action != bookshelf.ChangeCreate {
+		t.Errorf("AuditLog(BeforeID: %d) = %v, want the two creates", page[1].ID, rest)
+	}
+}
+
+func testRollback(t *testing.T, db bookshelf.BookDatabase) {
+	id := mustAdd(t, db, &bookshelf.Book{Title: "First", Author: "Someone", ImageURL: "https://example.com/a.jpg"})
+	if err := db.UpdateBook(&bookshelf.Book{ID: id, Title: "Second", Author: "Someone", ImageURL: "https://example.com/a.jpg",
+		Description: "The second edition."}, testActor); err != nil {
+		t.Fatalf("UpdateBook: %v", err)
+	}
+	if err := db.UpdateBook(&bookshelf.Book{ID: id, Title: "Third", Author: "Someone Else"}, testActor); err != nil {
+		t.Fatalf("UpdateBook: %v", err)
+	}
+	history, err := db.BookHistory(id)
+	if err != nil || len(history) != 3 {
+		t.Fatalf("BookHistory(%d) = %d changes, %v; want 3", id, len(history), err)
+	}
+
+	// Roll back to just after the first update.
+	if _, err := bookshelf.RollbackBook(db, id, history[1].ID, testActor); err != nil {
+		t.Fatalf("RollbackBook(%d, %d): %v", id, history[1].ID, err)
+	}
+	got, err := db.GetBook(id)
+	if err != nil {
+		t.Fatalf("GetBook(%d): %v", id, err)
+	}
+	if got.Title != "Second" || got.Author != "Someone" || got.ImageURL != "https://example.com/a.jpg" ||
+		got.Description != "The second edition." {
+		t.Errorf("GetBook(%d) after rollback = %v, want the second version", id, got)
+	}
+	if history, err = db.BookHistory(id); err != nil || len(history) != 4 || history[0].Action != bookshelf.ChangeUpdate {
+		t.Errorf("BookHistory(%d) after rollback = %v, %v; want the rollback recorded as an update", id, history, err)
+	}
+
+	_, err = bookshelf.RollbackBook(db, id, history[0].ID+1000, testActor)
+	checkErr(t, "RollbackBook to a missing change", err, bookshelf.ErrNotFound)
+}
+
+func testMerge(t *testing.T, db bookshelf.BookDatabase) {
+	keep := mustAdd(t, db, &bookshelf.Book{Title: "Gödel, Escher, Bach", Author: "D. Hofstadter"})
+	dup := mustAdd(t, db, &bookshelf.Book{Title: "Godel Escher Bach", Author: "Douglas Hofstadter", ISBN13: "9780465026562"})
+	if err := db.UpdateBook(&bookshelf.Book{ID: dup, Title: "Godel Escher Bach", Author: "Douglas Hofstadter",
+		ImageURL: "https://example.com/geb.jpg", ISBN13: "9780465026562"}, testActor); err != nil {
+		t.Fatalf("UpdateBook: %v", err)
+	}
+
+	merged, _, err := bookshelf.MergeBooks(db, keep, dup, testActor)
+	if err != nil {
+		t.Fatalf("MergeBooks(%d, %d): %v", keep, dup, err)
+	}
+	got, err := db.GetBook(keep)
+	if err != nil {
+		t.Fatalf("GetBook(%d): %v", keep, err)
+	}
+	if got.Title != "Gödel, Escher, Bach" || got.Author != "Douglas Hofstadter" ||
+		got.ImageURL != "https://example.com/geb.jpg" || got.ISBN13 != "9780465026562" {
+		t.Errorf("GetBook(%d) after merge = %v, want the best fields of both books", keep, got)
+	}
+	if merged.Title != got.Title || merged.Author != got.Author {
+		t.Errorf("MergeBooks returned %v, want %v", merged, got)
+	}
+	_, err = db.GetBook(dup)
+	checkErr(t, "GetBook of the merged duplicate", err, bookshelf.ErrNotFound)
+	if b, err := db.GetBookByISBN("9780465026562"); err != nil || b.ID != keep {
+		t.Errorf("GetBookByISBN after merge = %v, %v; want book %d", b, err, keep)
+	}
+
+	history, err := db.BookHistory(keep)
+	if err != nil || len(history) != 4 {
+		t.Fatalf("BookHistory(%d) = %d changes, %v; want both books' 3 changes and the merge", keep, len(history), err)
+	}
+	if history[0].Action != bookshelf.ChangeMerge {
+		t.Errorf("newest change is %q, want %q", history[0].Action, bookshelf.ChangeMerge)
+	}
+	for _, c := range history {
+		if c.BookID != keep {
+			t.Errorf("change %d has book ID %d, want %d", c.ID, c.BookID, keep)
+		}
+	}
+	if history, err := db.BookHistory(dup); err != nil || len(history) != 0 {
+		t.Errorf("BookHistory(%d) of the duplicate = %v, %v; want no changes", dup, history, err)
+	}
+
+	_, _, err = bookshelf.MergeBooks(db, keep, keep, testActor)
+	checkErr(t, "MergeBooks of a book into itself", err, bookshelf.ErrInvalid)
+	_, _, err = bookshelf.MergeBooks(db, keep, dup, testActor)
+	checkErr(t, "MergeBooks of a removed duplicate", err, bookshelf.ErrNotFound)
+	err = db.MergeBook(&bookshelf.Book{ID: keep, Title: "Gödel, Escher, Bach"}, dup, testActor)
+	checkErr(t, "MergeBook of a removed duplicate", err, bookshelf.ErrNotFound)
+}
+
+func testAuthors(t *testing.T, db bookshelf.BookDatabase) {
+	id := mustAdd(t, db, &bookshelf.Book{Title: "The Odyssey", Author: "Homer; Emily Wilson (translator)"})
+	got, err := db.GetBook(id)
+	if err != nil {
+		t.Fatalf("GetBook(%d): %v", id, err)
+	}
+	if len(got.Contributors) != 2 || got.Contributors[0].Name != "Homer" || got.Contributors[0].Role != bookshelf.RoleAuthor ||
+		got.Contributors[1].Name != "Emily Wilson" || got.Contributors[1].Role != bookshelf.RoleTranslator {
+		t.Fatalf("GetBook(%d) has contributors %v, want Homer and Emily Wilson (translator)", id, got.Contributors)
+	}
+	wilson := got.Contributors[1].AuthorID
+
+	// Contributors set without an author string produce one, and an author
+	// already known is matched whatever the case or accents.
+	other := mustAdd(t, db, &bookshelf.Book{Title: "The Iliad", Contributors: []bookshelf.Contributor{
+		{Name: "homer", Role: bookshelf.RoleAuthor},
+		{Name: "Emily Wilson", Role: bookshelf.RoleTranslator},
+	}})
+	if got, err := db.GetBook(other); err != nil || got.Author != "homer; Emily Wilson (translator)" {
+		t.Errorf("GetBook(%d) = %v, %v; want the author string made of its contributors", other, got, err)
+	} else if got.Contributors[1].AuthorID != wilson || got.Contributors[0].Name != "Homer" {
+		t.Errorf("GetBook(%d) has contributors %v, want the authors of book %d", other, got.Contributors, id)
+	}
+	if a, err := db.GetAuthor(wilson); err != nil || a.Name != "Emily Wilson" {
+		t.Errorf("GetAuthor(%d) = %v, %v; want Emily Wilson", wilson, a, err)
+	}
+	_, err = db.GetAuthor(wilson + 1000)
+	checkErr(t, "GetAuthor of a missing author", err, bookshelf.ErrNotFound)
+
+	books, err := db.ListAuthorBooks(wilson)
+	if err != nil {
+		t.Fatalf("ListAuthorBooks(%d): %v", wilson, err)
+	}
+	checkIDs(t, "ListAuthorBooks", books, other, id)
+	if len(books) == 2 && len(books[0].Contributors) != 2 {
+		t.Errorf("ListAuthorBooks returned contributors %v, want both of the book's", books[0].Contributors)
+	}
+
+	for prefix, want := range map[string]int{"wil": 1, "EMI": 1, "hom": 1, "ilson": 0, "": 2} {
+		if authors, err := db.SearchAuthors(prefix, 0); err != nil || len(authors) != want {
+			t.Errorf("SearchAuthors(%q) = %v, %v; want %d authors", prefix, authors, err, want)
+		}
+	}
+	if authors, err := db.SearchAuthors("", 1); err != nil || len(authors) != 1 || authors[0].Name != "Emily Wilson" {
+		t.Errorf("SearchAuthors with limit 1 = %v, %v; want Emily Wilson", authors, err)
+	}
+
+	// Editing the author string replaces the contributors; editing other
+	// fields keeps them.
+	if err := db.UpdateBook(&bookshelf.Book{ID: id, Title: "The Odyssey", Author: "Homer; Robert Fagles (translator)"}, testActor); err != nil {
+		t.Fatalf("UpdateBook: %v", err)
+	}
+	mustDelete(t, db, other)
+	if books, err := db.ListAuthorBooks(wilson); err != nil || len(books) != 0 {
+		t.Errorf("ListAuthorBooks(%d) after the update = %v, %v; want no books", wilson, books, err)
+	}
+	if err := db.UpdateBook(&bookshelf.Book{ID: id, Title: "Odyssey", Author: "Homer; Robert Fagles (translator)"}, testActor); err != nil {
+		t.Fatalf("UpdateBook: %v", err)
+	}
+	if got, err := db.GetBook(id); err != nil || len(got.Contributors) != 2 || got.Contributors[1].Name != "Robert Fagles" {
+		t.Errorf("GetBook(%d) after the updates = %v, %v; want Homer and Robert Fagles", id, got, err)
+	}
+
+	_, err = db.AddBook(&bookshelf.Book{Title: "Bad", Contributors: []bookshelf.Contributor{{Name: "X", Role: "ghost"}}}, testActor)
+	checkErr(t, "AddBook with an unknown role", err, bookshelf.ErrInvalid)
+}
+
+func testTags(t *testing.T, db bookshelf.BookDatabase) {
+	dune := mustAdd(t, db, &bookshelf.Book{Title: "Dune", Author: "Frank Herbert",
+		Tags: []string{"Desert ", "classics", "desert"}, Genres: []string{"Science Fiction"}})
+	hobbit := mustAdd(t, db, &bookshelf.Book{Title: "The Hobbit", Genres: []string{"fantasy", "children"}, Tags: []string{"classics"}})
+	gone := mustAdd(t, db, &bookshelf.Book{Title: "Gone", Tags: []string{"classics"}, Genres: []string{"fantasy"}})
+	mustDelete(t, db, gone)
+
+	got, err := db.GetBook(dune)
+	if err != nil {
+		t.Fatalf("GetBook(%d): %v", dune, err)
+	}
+	if fmt.Sprint(got.Tags) != "[classics desert]" || fmt.Sprint(got.Genres) != "[science fiction]" {
+		t.Errorf("GetBook(%d) has tags %q and genres %q, want [classics desert] and [science fiction]", dune, got.Tags, got.Genres)
+	}
+
+	for _, tt := range []struct {
+		f    bookshelf.BookFilter
+		want []int64
+	}{
+		{bookshelf.BookFilter{}, []int64{dune, hobbit}},
+		{bookshelf.BookFilter{Tag: "Classics"}, []int64{dune, hobbit}},
+		{bookshelf.BookFilter{Tag: "desert"}, []int64{dune}},
+		{bookshelf.BookFilter{Genre: "fantasy"}, []int64{hobbit}},
+		{bookshelf.BookFilter{Tag: "classics", Genre: "children"}, []int64{hobbit}},
+		{bookshelf.BookFilter{Query: "herb", Tag: "classics"}, []int64{dune}},
+		{bookshelf.BookFilter{Tag: "none"}, nil},
+	} {
+		books, err := db.FilterBooks(tt.f)
+		if err != nil {
+			t.Errorf("FilterBooks(%+v): %v", tt.f, err)
+			continue
+		}
+		checkIDs(t, fmt.Sprintf("FilterBooks(%+v)", tt.f), books, tt.want...)
+		for _, b := range books {
+			if len(b.Genres) == 0 {
+				t.Errorf("FilterBooks(%+v) returned book %d without its genres", tt.f, b.ID)
+			}
+		}
+	}
+
+	cloud, err := db.TagCloud()
+	if err != nil {
+		t.Fatalf("TagCloud: %v", err)
+	}
+	if fmt.Sprint(cloud.Tags) != "[{classics 2} {desert 1}]" {
+		t.Errorf("TagCloud tags = %v, want classics 2 and desert 1", cloud.Tags)
+	}
+	if fmt.Sprint(cloud.Genres) != "[{children 1} {fantasy 1} {science fiction 1}]" {
+		t.Errorf("TagCloud genres = %v, want children, fantasy and science fiction once each", cloud.Genres)
+	}
+
+	// Tags are replaced by an update, and changes to them are recorded.
+	got.Tags = []string{"spice"}
+	if err := db.UpdateBook(got, testActor); err != nil {
+		t.Fatalf("UpdateBook: %v", err)
+	}
+	if books, err := db.FilterBooks(bookshelf.BookFilter{Tag: "desert"}); err != nil || len(books) != 0 {
+		t.Errorf("FilterBooks(desert) after the update = %v, %v; want no books", books, err)
+	}
+	history, err := db.BookHistory(dune)
+	if err != nil || len(history) != 2 || fmt.Sprint(history[0].Diff) != "[{tags classics, desert spice}]" {
+		t.Errorf("BookHistory(%d) = %v, %v; want the change of tags", dune, history, err)
+	}
+	if err := db.UpdateBook(&bookshelf.Book{ID: dune, Title: "Dune", Author: "Frank Herbert", Tags: []string{"Spice"},
+		Genres: []string{"science fiction"}}, testActor); err != nil {
+		t.Fatalf("UpdateBook: %v", err)
+	}
+	if history, err := db.BookHistory(dune); err != nil || len(history) != 2 {
+		t.Errorf("BookHistory(%d) has %d changes, %v; want a change of case to record nothing", dune, len(history), err)
+	}
+
+	_, err = db.AddBook(&bookshelf.Book{Title: "Bad", Genres: []string{"cyberpunk"}}, testActor)
+	checkErr(t, "AddBook with an unknown genre", err, bookshelf.ErrInvalid)
+	err = db.UpdateBook(&bookshelf.Book{ID: hobbit, Title: "The Hobbit", Genres: []string{"cyberpunk"}}, testActor)
+	checkErr(t, "UpdateBook with an unknown genre", err, bookshelf.ErrInvalid)
+}
+
+// readingIDs lists the IDs of the books of readings, in order.
+func readingIDs(readings []*bookshelf.Reading) []int64 {
+	var ids []int64
+	for _, r := range readings {
+		ids = append(ids, r.BookID)
+	}
+	return ids
+}
+
+func testReadings(t *testing.T, db bookshelf.BookDatabase) {
+	const alice, bob = "alice", "bob"
+	dune := mustAdd(t, db, &bookshelf.Book{Title: "Dune"})
+	hobbit := mustAdd(t, db, &bookshelf.Book{Title: "The Hobbit"})
+	emma := mustAdd(t, db, &bookshelf.Book{Title: "Emma"})
+
+	_, err := db.GetReading(alice, dune)
+	checkErr(t, "GetReading before saving", err, bookshelf.ErrNotFound)
+
+	started := time.Date(2020, 3, 1, 15, 4, 5, 0, time.UTC)
+	r := &bookshelf.Reading{UserID: alice, BookID: dune, Status: bookshelf.StatusReading, Shelves: []string{"Favourites", "reading"},
+		StartedAt: started, Progress: 40}
+	if err := db.SaveReading(r); err != nil {
+		t.Fatalf("SaveReading: %v", err)
+	}
+	got, err := db.GetReading(alice, dune)
+	if err != nil {
+		t.Fatalf("GetReading(%s, %d): %v", alice, dune, err)
+	}
+	if got.Status != bookshelf.StatusReading || fmt.Sprint(got.Shelves) != "[favourites]" || got.Progress != 40 ||
+		!got.StartedAt.Equal(day(started)) || !got.FinishedAt.IsZero() || got.UpdatedAt.IsZero() {
+		t.Errorf("GetReading(%s, %d) = %+v, want the saved reading on its date, with the favourites shelf", alice, dune, got)
+	}
+	for _, saved := range []*bookshelf.Reading{
+		{UserID: alice, BookID: hobbit, Status: bookshelf.StatusRead, Shelves: []string{"favourites"},
+			StartedAt: started, FinishedAt: started.AddDate(0, 1, 0)},
+		{UserID: alice, BookID: emma},
+		{UserID: bob, BookID: dune, Status: bookshelf.StatusRead},
+	} {
+		if err := db.SaveReading(saved); err != nil {
+			t.Fatalf("SaveReading(%+v): %v", saved, err)
+		}
+	}
+	if got, err := db.GetReading(alice, hobbit); err != nil || got.Progress != 100 {
+		t.Errorf("GetReading of a book read = %+v, %v; want progress 100", got, err)
+	}
+	if got, err := db.GetReading(alice, emma); err != nil || got.Status != bookshelf.StatusWantToRead {
+		t.Errorf("GetReading of a book saved without a status = %+v, %v; want %s", got, err, bookshelf.StatusWantToRead)
+	}
+
+	for _, tt := range []struct {
+		user, shelf string
+		want        []int64
+	}{
+		{alice, bookshelf.StatusReading, []int64{dune}},
+		{alice, bookshelf.StatusRead, []int64{hobbit}},
+		{alice, "Favourites", []int64{dune, hobbit}},
+		{alice, "none", nil},
+		{bob, bookshelf.StatusRead, []int64{dune}},
+		{"carol", "", nil},
+	} {
+		readings, err := db.ListReadings(tt.user, tt.shelf)
+		if err != nil {
+			t.Errorf("ListReadings(%s, %s): %v", tt.user, tt.shelf, err)
+			continue
+		}
+		ids := readingIDs(readings)
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		if fmt.Sprint(ids) != fmt.Sprint(tt.want) {
+			t.Errorf("ListReadings(%s, %s) returned books %v, want %v", tt.user, tt.shelf, ids, tt.want)
+		}
+		for _, r := range readings {
+			if r.Book == nil || r.Book.ID != r.BookID {
+				t.Errorf("ListReadings(%s, %s) returned a reading of book %d without it", tt.user, tt.shelf, r.BookID)
+			}
+		}
+	}
+	shelves, err := db.ListShelves(alice)
+	if err != nil || fmt.Sprint(shelves) != "[{want-to-read 1} {reading 1} {read 1} {favourites 2}]" {
+		t.Errorf("ListShelves(%s) = %v, %v; want one book on each status and two favourites", alice, shelves, err)
+	}
+
+	for _, bad := range []*bookshelf.Reading{
+		{UserID: alice, BookID: dune, Status: "abandoned"},
+		{UserID: alice, BookID: dune, Progress: 101},
+		{UserID: alice, BookID: dune, StartedAt: started, FinishedAt: started.AddDate(0, 0, -1)},
+		{BookID: dune},
+	} {
+		checkErr(t, fmt.Sprintf("SaveReading(%+v)", bad), db.SaveReading(bad), bookshelf.ErrInvalid)
+	}
+	checkErr(t, "SaveReading of a missing book", db.SaveReading(&bookshelf.Reading{UserID: alice, BookID: 12345}), bookshelf.ErrNotFound)
+
+	// Readings of books in the trash are hidden, and purged with them.
+	mustDelete(t, db, emma)
+	checkErr(t, "SaveReading of a book in the trash", db.SaveReading(&bookshelf.Reading{UserID: bob, BookID: emma}), bookshelf.ErrNotFound)
+	if readings, err := db.ListReadings(alice, bookshelf.StatusWantToRead); err != nil || len(readings) != 0 {
+		t.Errorf("ListReadings of a book in the trash = %v, %v; want none", readings, err)
+	}
+	if _, err := db.PurgeBook(emma, testActor); err != nil {
+		t.Fatalf("PurgeBook(%d): %v", emma, err)
+	}
+	_, err = db.GetReading(alice, emma)
+	checkErr(t, "GetReading of a purged book", err, bookshelf.ErrNotFound)
+
+	// Merging moves readings, keeping those of the book merged into.
+	dup := mustAdd(t, db, &bookshelf.Book{Title: "Dune (reprint)"})
+	for _, saved := range []*bookshelf.Reading{
+		{UserID: alice, BookID: dup, Status: bookshelf.StatusRead},
+		{UserID: "carol", BookID: dup, Status: bookshelf.StatusRead, Shelves: []string{"sci-fi"}},
+	} {
+		if err := db.SaveReading(saved); err != nil {
+			t.Fatalf("SaveReading(%+v): %v", saved, err)
+		}
+	}
+	if err := db.MergeBook(&bookshelf.Book{ID: dune, Title: "Dune"}, dup, testActor); err != nil {
+		t.Fatalf("MergeBook(%d, %d): %v", dune, dup, err)
+	}
+	if got, err := db.GetReading(alice, dune); err != nil || got.Status != bookshelf.StatusReading {
+		t.Errorf("GetReading(%s, %d) after merge = %+v, %v; want the reading kept", alice, dune, got, err)
+	}
+	if got, err := db.GetReading("carol", dune); err != nil || fmt.Sprint(got.Shelves) != "[sci-fi]" {
+		t.Errorf("GetReading(carol, %d) after merge = %+v, %v; want the moved reading", dune, got, err)
+	}
+	_, err = db.GetReading(alice, dup)
+	checkErr(t, "GetReading of the merged duplicate", err, bookshelf.ErrNotFound)
+
+	if err := db.DeleteReading(alice, dune); err != nil {
+		t.Fatalf("DeleteReading: %v", err)
+	}
+	_, err = db.GetReading(alice, dune)
+	checkErr(t, "GetReading after DeleteReading", err, bookshelf.ErrNotFound)
+	checkErr(t, "DeleteReading twice", db.DeleteReading(alice, dune), bookshelf.ErrNotFound)
+	if got, err := db.GetReading(bob, dune); err != nil || got.Status != bookshelf.StatusRead {
+		t.Errorf("GetReading(%s, %d) = %+v, %v; want another user's reading left alone", bob, dune, got, err)
+	}
+}
+
+func testLending(t *testing.T, db bookshelf.BookDatabase) {
+	const alice, bob, carol = "alice", "bob", "carol"
+	dune := mustAdd(t, db, &bookshelf.Book{Title: "Dune"})
+	due := time.Now().Add(bookshelf.DefaultLoanPeriod)
+
+	_, err := db.CheckOut(dune, alice, "Alice", due)
+	checkErr(t, "CheckOut of a book without copies", err, bookshelf.ErrConflict)
+	_, err = db.AddCopy(12345, "")
+	checkErr(t, "AddCopy of a missing book", err, bookshelf.ErrNotFound)
+	first, err := db.AddCopy(dune, " signed ")
+	if err != nil {
+		t.Fatalf("AddCopy: %v", err)
+	}
+	second, err := db.AddCopy(dune, "")
+	if err != nil {
+		t.Fatalf("AddCopy: %v", err)
+	}
+	if first.Label != "signed" || first.ID == second.ID {
+		t.Errorf("AddCopy returned copies %+v and %+v, want a trimmed label and distinct IDs", first, second)
+	}
+
+	loan, err := db.CheckOut(dune, alice, "Alice", due)
+	if err != nil {
+		t.Fatalf("CheckOut: %v", err)
+	}
+	if loan.CopyID != first.ID || loan.UserID != alice || !loan.Open() || loan.DueAt.Before(time.Now()) {
+		t.Errorf("CheckOut = %+v, want the first copy lent to %s until %v", loan, alice, due)
+	}
+	_, err = db.CheckOut(dune, alice, "Alice", due)
+	checkErr(t, "CheckOut of a second copy by one user", err, bookshelf.ErrConflict)
+	_, err = db.CheckOut(dune, bob, "Bob", time.Now().Add(-time.Hour))
+	checkErr(t, "CheckOut due in the past", err, bookshelf.ErrInvalid)
+	checkErr(t, "RemoveCopy of a lent copy", db.RemoveCopy(dune, first.ID), bookshelf.ErrConflict)
+
+	// Carol holds the book before Bob asks for it, so the free copy is
+	// hers.
+	if _, err := db.PlaceHold(dune, carol, "Carol"); err != nil {
+		t.Fatalf("PlaceHold: %v", err)
+	}
+	_, err = db.PlaceHold(dune, carol, "Carol")
+	checkErr(t, "PlaceHold twice", err, bookshelf.ErrConflict)
+	_, err = db.PlaceHold(dune, alice, "Alice")
+	checkErr(t, "PlaceHold by the borrower", err, bookshelf.ErrConflict)
+	if _, err := db.PlaceHold(dune, bob, "Bob"); err != nil {
+		t.Fatalf("PlaceHold: %v", err)
+	}
+	holds, err := db.ListHolds(dune)
+	if err != nil || len(holds) != 2 || holds[0].UserID != carol || holds[1].UserID != bob {
+		t.Errorf("ListHolds = %v, %v; want carol then bob", holds, err)
+	}
+	_, err = db.CheckOut(dune, bob, "Bob", due)
+	checkErr(t, "CheckOut with a user ahead in the queue", err, bookshelf.ErrConflict)
+	if _, err := db.CheckOut(dune, carol, "Carol", due); err != nil {
+		t.Fatalf("CheckOut by the first in the queue: %v", err)
+	}
+	if holds, err := db.ListHolds(dune); err != nil || len(holds) != 1 || holds[0].UserID != bob {
+		t.Errorf("ListHolds after checkout = %v, %v; want bob only", holds, err)
+	}
+
+	avail, err := db.Availability()
+	if err != nil || avail[dune] != (bookshelf.Availability{Copies: 2, OnLoan: 2, Holds: 1}) || avail[dune].Available() != 0 {
+		t.Errorf("Availability()[%d] = %+v, %v; want 2 copies lent out and 1 hold", dune, avail[dune], err)
+	}
+	copies, err := db.ListCopies(dune)
+	if err != nil || len(copies) != 2 || copies[0].Loan == nil || copies[0].Loan.UserID != alice || copies[1].Loan == nil {
+		t.Errorf("ListCopies = %v, %v; want both copies with their loans", copies, err)
+	}
+
+	returned, err := db.CheckIn(dune, loan.ID)
+	if err != nil {
+		t.Fatalf("CheckIn: %v", err)
+	}
+	if returned.Open() || returned.ID != loan.ID {
+		t.Errorf("CheckIn = %+v, want loan %d returned", returned, loan.ID)
+	}
+	_, err = db.CheckIn(dune, loan.ID)
+	checkErr(t, "CheckIn twice", err, bookshelf.ErrNotFound)
+	if _, err := db.CheckOut(dune, bob, "Bob", due); err != nil {
+		t.Fatalf("CheckOut of the returned copy: %v", err)
+	}
+	checkErr(t, "CancelHold after checkout", db.CancelHold(dune, bob), bookshelf.ErrNotFound)
+
+	// Loans stay in the borrower's history after they are returned.
+	loans, err := db.ListLoans(bookshelf.LoanQuery{UserID: alice})
+	if err != nil || len(loans) != 1 || loans[0].Open() || loans[0].Book == nil || loans[0].Book.Title != "Dune" {
+		t.Errorf("ListLoans(alice) = %v, %v; want the returned loan with its book", loans, err)
+	}
+	if loans, err := db.ListLoans(bookshelf.LoanQuery{BookID: dune, Open: true}); err != nil || len(loans) != 2 {
+		t.Errorf("ListLoans of open loans = %v, %v; want carol's and bob's", loans, err)
+	}
+	later := time.Now().Add(bookshelf.DefaultLoanPeriod + time.Hour)
+	overdue, err := db.ListLoans(bookshelf.LoanQuery{Open: true, DueBefore: later})
+	if err != nil || len(overdue) != 2 {
+		t.Fatalf("ListLoans due before %v = %v, %v; want 2", later, overdue, err)
+	}
+	if !overdue[0].Overdue(later) || overdue[0].Overdue(time.Now()) {
+		t.Errorf("loan %+v is not overdue after its due date only", overdue[0])
+	}
+	checkErr(t, "MarkOverdue before the due date", db.MarkOverdue(dune, overdue[0].ID, time.Now()), bookshelf.ErrNotFound)
+	if err := db.MarkOverdue(dune, overdue[0].ID, later); err != nil {
+		t.Fatalf("MarkOverdue: %v", err)
+	}
+	checkErr(t, "MarkOverdue twice", db.MarkOverdue(dune, overdue[0].ID, later), bookshelf.ErrNotFound)
+	if loans, err := db.ListLoans(bookshelf.LoanQuery{BookID: dune, Open: true}); err != nil || loans[0].OverdueAt.IsZero() == loans[1].OverdueAt.IsZero() {
+		t.Errorf("ListLoans after MarkOverdue = %v, %v; want one loan marked", loans, err)
+	}
+
+	// Merging moves copies, loans and holds; purging removes them.
+	dup := mustAdd(t, db, &bookshelf.Book{Title: "Dune (reprint)"})
+	if _, err := db.AddCopy(dup, ""); err != nil {
+		t.Fatalf("AddCopy: %v", err)
+	}
+	if _, err := db.PlaceHold(dup, alice, "Alice"); err != nil {
+		t.Fatalf("PlaceHold: %v", err)
+	}
+	if err := db.MergeBook(&bookshelf.Book{ID: dune, Title: "Dune"}, dup, testActor); err != nil {
+		t.Fatalf("MergeBook: %v", err)
+	}
+	if copies, err := db.ListCopies(dune); err != nil || len(copies) != 3 {
+		t.Errorf("ListCopies after merge = %v, %v; want 3 copies", copies, err)
+	}
+	if holds, err := db.ListHolds(dune); err != nil || len(holds) != 1 || holds[0].UserID != alice {
+		t.Errorf("ListHolds after merge = %v, %v; want alice's hold moved", holds, err)
+	}
+	checkErr(t, "CancelHold", db.CancelHold(dune, alice), nil)
+	if err := db.RemoveCopy(dune, second.ID); err == nil {
+		t.Errorf("RemoveCopy of a lent copy succeeded")
+	}
+	mustDelete(t, db, dune)
+	_, err = db.CheckOut(dune, alice, "Alice", due)
+	checkErr(t, "CheckOut of a book in the trash", err, bookshelf.ErrNotFound)
+	if _, err := db.PurgeBook(dune, testActor); err != nil {
+		t.Fatalf("PurgeBook: %v", err)
+	}
+	if loans, err := db.ListLoans(bookshelf.LoanQuery{}); err != nil || len(loans) != 0 {
+		t.Errorf("ListLoans after purge = %v, %v; want none", loans, err)
+	}
+	if avail, err := db.Availability(); err != nil || len(avail) != 0 {
+		t.Errorf("Availability after purge = %v, %v; want nothing", avail, err)
+	}
+}
+
+func testReviews(t *testing.T, db bookshelf.BookDatabase) {
+	dune := mustAdd(t, db, &bookshelf.Book{Title: "Dune"})
+	emma := mustAdd(t, db, &bookshelf.Book{Title: "Emma"})
+	checkRatings := func(id int64, count, sum int) {
+		t.Helper()
+		b, err := db.GetBook(id)
+		if err != nil {
+			t.Fatalf("GetBook(%d): %v", id, err)
+		}
+		if b.RatingCount != count || b.RatingSum != sum {
+			t.Errorf("book %d has %d ratings adding up to %d, want %d adding up to %d", id, b.RatingCount, b.RatingSum, count, sum)
+		}
+	}
+
+	checkErr(t, "SaveReview with rating 0", db.SaveReview(&bookshelf.Review{BookID: dune, UserID: "alice"}), bookshelf.ErrInvalid)
+	checkErr(t, "SaveReview with rating 6", db.SaveReview(&bookshelf.Review{BookID: dune, UserID: "alice", Rating: 6}), bookshelf.ErrInvalid)
+	checkErr(t, "SaveReview without a user", db.SaveReview(&bookshelf.Review{BookID: dune, Rating: 3}), bookshelf.ErrInvalid)
+	checkErr(t, "SaveReview of a missing book", db.SaveReview(&bookshelf.Review{BookID: 12345, UserID: "alice", Rating: 3}), bookshelf.ErrNotFound)
+	_, err := db.GetReview(dune, "alice")
+	checkErr(t, "GetReview before any review", err, bookshelf.ErrNotFound)
+
+	r := &bookshelf.Review{BookID: dune, UserID: "alice", UserName: "Alice", Rating: 4, Text: "  Sandy.  "}
+	if err := db.SaveReview(r); err != nil {
+		t.Fatalf("SaveReview: %v", err)
+	}
+	if r.Text != "Sandy." || r.CreatedAt.IsZero() || !r.UpdatedAt.Equal(r.CreatedAt) {
+		t.Errorf("SaveReview left %+v, want trimmed text and CreatedAt = UpdatedAt", r)
+	}
+	created := r.CreatedAt
+	if err := db.SaveReview(&bookshelf.Review{BookID: dune, UserID: "bob", UserName: "Bob", Rating: 2}); err != nil {
+		t.Fatalf("SaveReview: %v", err)
+	}
+	checkRatings(dune, 2, 6)
+
+	// Editing a review replaces its rating rather than adding another.
+	time.Sleep(time.Second)
+	if err := db.SaveReview(&bookshelf.Review{BookID: dune, UserID: "alice", UserName: "Alice", Rating: 5, Text: "Better twice."}); err != nil {
+		t.Fatalf("SaveReview: %v", err)
+	}
+	checkRatings(dune, 2, 7)
+	got, err := db.GetReview(dune, "alice")
+	if err != nil {
+		t.Fatalf("GetReview: %v", err)
+	}
+	if got.Rating != 5 || got.Text != "Better twice." || !got.CreatedAt.Equal(created) || !got.UpdatedAt.After(created) {
+		t.Errorf("GetReview = %+v, want the edited review created at %v", got, created)
+	}
+
+	if err := db.SaveReview(&bookshelf.Review{BookID: emma, UserID: "alice", Rating: 3}); err != nil {
+		t.Fatalf("SaveReview: %v", err)
+	}
+	reviews, err := db.ListReviews(bookshelf.ReviewQuery{BookID: dune})
+	if err != nil || len(reviews) != 2 || reviews[0].UserID != "alice" || reviews[0].Book == nil || reviews[0].Book.Title != "Dune" {
+		t.Errorf("ListReviews of dune = %v, %v; want alice's then bob's, with the book", reviews, err)
+	}
+	if reviews, err := db.ListReviews(bookshelf.ReviewQuery{UserID: "alice"}); err != nil || len(reviews) != 2 || reviews[0].BookID != emma {
+		t.Errorf("ListReviews of alice = %v, %v; want emma then dune", reviews, err)
+	}
+	if reviews, err := db.ListReviews(bookshelf.ReviewQuery{Limit: 1}); err != nil || len(reviews) != 1 || reviews[0].BookID != emma {
+		t.Errorf("ListReviews with limit 1 = %v, %v; want emma's review", reviews, err)
+	}
+
+	// Dune averages 3.5 and Emma 3, so Dune sorts first despite its
+	// title; Fable has no ratings and comes last.
+	fable := mustAdd(t, db, &bookshelf.Book{Title: "Fable"})
+	if err := db.SaveReview(&bookshelf.Review{BookID: dune, UserID: "carol", Rating: 1}); err != nil {
+		t.Fatalf("SaveReview: %v", err)
+	}
+	checkRatings(dune, 3, 8)
+	if err := db.SaveReview(&bookshelf.Review{BookID: emma, UserID: "bob", Rating: 3}); err != nil {
+		t.Fatalf("SaveReview: %v", err)
+	}
+	checkErr(t, "DeleteReview", db.DeleteReview(dune, "carol"), nil)
+	checkErr(t, "DeleteReview twice", db.DeleteReview(dune, "carol"), bookshelf.ErrNotFound)
+	checkRatings(dune, 2, 7)
+	books, err := db.FilterBooks(bookshelf.BookFilter{Sort: bookshelf.SortRating})
+	if err != nil {
+		t.Fatalf("FilterBooks: %v", err)
+	}
+	checkIDs(t, "FilterBooks by rating", books, dune, emma, fable)
+	if len(books) > 0 && books[0].AverageRating() != 3.5 {
+		t.Errorf("AverageRating() = %v, want 3.5", books[0].AverageRating())
+	}
+
+	// Updating a book keeps its ratings.
+	if err := db.UpdateBook(&bookshelf.Book{ID: dune, Title: "Dune", Author: "Frank Herbert"}, testActor); err != nil {
+		t.Fatalf("UpdateBook: %v", err)
+	}
+	checkRatings(dune, 2, 7)
+
+	// Merging keeps the review of the book merged into for alice and
+	// moves bob's and carol's.
+	if err := db.SaveReview(&bookshelf.Review{BookID: emma, UserID: "carol", Rating: 4}); err != nil {
+		t.Fatalf("SaveReview: %v", err)
+	}
+	if err := db.MergeBook(&bookshelf.Book{ID: dune, Title: "Dune", Author: "Frank Herbert"}, emma, testActor); err != nil {
+		t.Fatalf("MergeBook: %v", err)
+	}
+	checkRatings(dune, 3, 11)
+	if reviews, err := db.ListReviews(bookshelf.ReviewQuery{UserID: "alice"}); err != nil || len(reviews) != 1 || reviews[0].Rating != 5 {
+		t.Errorf("ListReviews of alice after merge = %v, %v; want her review of dune", reviews, err)
+	}
+
+	mustDelete(t, db, dune)
+	if reviews, err := db.ListReviews(bookshelf.ReviewQuery{}); err != nil || len(reviews) != 0 {
+		t.Errorf("ListReviews with the book in the trash = %v, %v; want none", reviews, err)
+	}
+	checkErr(t, "SaveReview of a book in the trash", db.SaveReview(&bookshelf.Review{BookID: dune, UserID: "dave", Rating: 2}), bookshelf.ErrNotFound)
+	if _, err := db.PurgeBook(dune, testActor); err != nil {
+		t.Fatalf("PurgeBook: %v", err)
+	}
+	_, err = db.GetReview(dune, "alice")
+	checkErr(t, "GetReview after purge", err, bookshelf.ErrNotFound)
+}
+
+func testTimestamps(t *testing.T, db bookshelf.BookDatabase) {
+	start := time.Now().Add(-time.Second)
+	first := mustAdd(t, db, &bookshelf.Book{Title: "First"})
+	second := mustAdd(t, db, &bookshelf.Book{Title: "Second"})
+	added, err := db.GetBook(first)
+	if err != nil {
+		t.Fatalf("GetBook(%d): %v", first, err)
+	}
+	if added.CreatedAt.Before(start) || added.CreatedAt.After(time.Now().Add(time.Second)) || !added.UpdatedAt.Equal(added.CreatedAt) {
+		t.Errorf("book %d created at %v and updated at %v, want both about %v", first, added.CreatedAt, added.UpdatedAt, time.Now())
+	}
+	books, err := db.FilterBooks(bookshelf.BookFilter{Sort: bookshelf.SortNewest})
+	if err != nil {
+		t.Fatalf("FilterBooks: %v", err)
+	}
+	checkIDs(t, "FilterBooks by newest", books, second, first)
+
+	// The times are kept to the second.
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.UpdateBook(&bookshelf.Book{ID: first, Title: "First", Author: "Someone"}, testActor); err != nil {
+		t.Fatalf("UpdateBook: %v", err)
+	}
+	updated, err := db.GetBook(first)
+	if err != nil {
+		t.Fatalf("GetBook(%d): %v", first, err)
+	}
+	if !updated.CreatedAt.Equal(added.CreatedAt) || !updated.UpdatedAt.After(added.UpdatedAt) {
+		t.Errorf("book %d after update created at %v and updated at %v, want created at %v and updated later",
+			first, updated.CreatedAt, updated.UpdatedAt, added.CreatedAt)
+	}
+	books, err = db.FilterBooks(bookshelf.BookFilter{Sort: bookshelf.SortUpdated})
+	if err != nil {
+		t.Fatalf("FilterBooks: %v", err)
+	}
+	checkIDs(t, "FilterBooks by updated", books, first, second)
+
+	// Saving a book without a change leaves it alone.
+	if err := db.UpdateBook(updated, testActor); err != nil {
+		t.Fatalf("UpdateBook: %v", err)
+	}
+	if got, err := db.GetBook(first); err != nil || !got.UpdatedAt.Equal(updated.UpdatedAt) {
+		t.Errorf("GetBook(%d) after an unchanged update = %v, %v; want it updated at %v", first, got, err, updated.UpdatedAt)
+	}
+}
+
+func testWebhooks(t *testing.T, db bookshelf.BookDatabase) {
+	for _, w := range []*bookshelf.Webhook{
+		{URL: "https://example.com/hook"},
+		{OwnerID: "alice", URL: "ftp://example.com/hook"},
+		{OwnerID: "alice", URL: "https://example.com/hook", Events: []string{"book.eaten"}},
+		{OwnerID: "alice", URL: "https://example.com/hook", Secret: "short"},
+	} {
+		checkErr(t, fmt.Sprintf("AddWebhook(%+v)", w), db.AddWebhook(w), bookshelf.ErrInvalid)
+	}
+	a := &bookshelf.Webhook{OwnerID: "alice", OwnerName: "Alice", URL: " https://example.com/hook ",
+		Events: []string{bookshelf.BookUpdated, bookshelf.BookCreated, bookshelf.BookUpdated}, Active: true}
+	if err := db.AddWebhook(a); err != nil {
+		t.Fatalf("AddWebhook: %v", err)
+	}
+	b := &bookshelf.Webhook{OwnerID: "bob", URL: "https://example.org/hook", Secret: "0123456789abcdef", Active: true}
+	if err := db.AddWebhook(b); err != nil {
+		t.Fatalf("AddWebhook: %v", err)
+	}
+	if a.ID == 0 || a.ID == b.ID {
+		t.Fatalf("AddWebhook gave IDs %d and %d, want distinct non-zero IDs", a.ID, b.ID)
+	}
+	got, err := db.GetWebhook(a.ID)
+	if err != nil {
+		t.Fatalf("GetWebhook(%d): %v", a.ID, err)
+	}
+	if got.URL != "https://example.com/hook" || fmt.Sprint(got.Events) != "[book.created book.updated]" ||
+		got.Secret == "" || got.Secret != a.Secret || !got.Active || got.CreatedAt.IsZero() {
+		t.Errorf("GetWebhook(%d) = %+v, want the URL trimmed, the events sorted once each and a secret", a.ID, got)
+	}
+	_, err = db.GetWebhook(b.ID + 100)
+	checkErr(t, "GetWebhook of a missing webhook", err, bookshelf.ErrNotFound)
+
+	if hooks, err := db.ListWebhooks("alice"); err != nil || len(hooks) != 1 || hooks[0].ID != a.ID {
+		t.Errorf("ListWebhooks(alice) = %v, %v; want webhook %d", hooks, err, a.ID)
+	}
+	if hooks, err := db.ListWebhooks(""); err != nil || len(hooks) != 2 || hooks[0].ID != a.ID || hooks[1].ID != b.ID {
+		t.Errorf("ListWebhooks() = %v, %v; want webhooks %d and %d", hooks, err, a.ID, b.ID)
+	}
+
+	// Updating without a secret keeps the one there was.
+	update := &bookshelf.Webhook{ID: b.ID, URL: "https://example.org/other", Events: []string{bookshelf.LoanOverdue}, Active: true}
+	if err := db.UpdateWebhook(update); err != nil {
+		t.Fatalf("UpdateWebhook: %v", err)
+	}
+	if got, err := db.GetWebhook(b.ID); err != nil || got.URL != update.URL || got.Secret != b.Secret ||
+		got.OwnerID != "bob" || !got.Wants(bookshelf.LoanOverdue) || got.Wants(bookshelf.BookCreated) {
+		t.Errorf("GetWebhook(%d) after update = %+v, %v; want %+v with its secret", b.ID, got, err, update)
+	}
+	checkErr(t, "UpdateWebhook with an invalid URL", db.UpdateWebhook(&bookshelf.Webhook{ID: b.ID, URL: "nowhere"}), bookshelf.ErrInvalid)
+	checkErr(t, "UpdateWebhook of a missing webhook",
+		db.UpdateWebhook(&bookshelf.Webhook{ID: b.ID + 100, URL: "https://example.org/hook"}), bookshelf.ErrNotFound)
+
+	// Deliveries are pending and due as soon as they are queued.
+	d := &bookshelf.WebhookDelivery{WebhookID: a.ID, Event: bookshelf.BookCreated, BookID: 7, Payload: `{"type":"book.created"}`}
+	if err := db.QueueWebhookDelivery(d); err != nil {
+		t.Fatalf("QueueWebhookDelivery: %v", err)
+	}
+	checkErr(t, "QueueWebhookDelivery to a missing webhook",
+		db.QueueWebhookDelivery(&bookshelf.WebhookDelivery{WebhookID: b.ID + 100, Event: bookshelf.BookCreated}), bookshelf.ErrNotFound)
+	due, err := db.ListWebhookDeliveries(bookshelf.DeliveryQuery{DueBy: now()})
+	if err != nil || len(due) != 1 || due[0].ID != d.ID || due[0].Status != bookshelf.DeliveryPending || due[0].Payload != d.Payload {
+		t.Fatalf("ListWebhookDeliveries(due) = %v, %v; want delivery %d pending", due, err, d.ID)
+	}
+
+	// A claimed delivery is not due, and cannot be claimed again.
+	until := now().Add(time.Minute)
+	if err := db.ClaimWebhookDelivery(d.ID, due[0].NextAttemptAt, until); err != nil {
+		t.Fatalf("ClaimWebhookDelivery: %v", err)
+	}
+	checkErr(t, "ClaimWebhookDelivery of a claimed delivery",
+		db.ClaimWebhookDelivery(d.ID, due[0].NextAttemptAt, until), bookshelf.ErrNotFound)
+	if due, err := db.ListWebhookDeliveries(bookshelf.DeliveryQuery{DueBy: now()}); err != nil || len(due) != 0 {
+		t.Errorf("ListWebhookDeliveries(due) after claim = %v, %v; want none", due, err)
+	}
+
+	// A failed attempt is kept for a retry without counting against the
+	// webhook until the delivery fails for good.
+	d.Attempts, d.LastAttemptAt, d.ResponseCode, d.Error = 1, now(), 500, "receiver answered 500"
+	d.NextAttemptAt = now().Add(-time.Second)
+	if w, err := db.RecordWebhookAttempt(d); err != nil || w.Failures != 0 || !w.Active {
+		t.Fatalf("RecordWebhookAttempt(retry) = %+v, %v; want the webhook active without failures", w, err)
+	}
+	got2, err := db.ListWebhookDeliveries(bookshelf.DeliveryQuery{WebhookID: a.ID})
+	if err != nil || len(got2) != 1 || got2[0].Attempts != 1 || got2[0].ResponseCode != 500 ||
+		got2[0].Error != d.Error || got2[0].Status != bookshelf.DeliveryPending {
+		t.Errorf("ListWebhookDeliveries(%d) = %v, %v; want the attempt recorded", a.ID, got2, err)
+	}
+
+	// MaxWebhookFailures deliveries failing in a row disable the webhook,
+	// and reactivating it starts the count again.
+	var w *bookshelf.Webhook
+	for i := 0; i < bookshelf.MaxWebhookFailures; i++ {
+		f := &bookshelf.WebhookDelivery{WebhookID: a.ID, Event: bookshelf.BookUpdated, BookID: 7, Payload: "{}"}
+		if err := db.QueueWebhookDelivery(f); err != nil {
+			t.Fatalf("QueueWebhookDelivery: %v", err)
+		}
+		f.Status, f.Attempts, f.LastAttemptAt, f.NextAttemptAt = bookshelf.DeliveryFailed, 8, now(), time.Time{}
+		if w, err = db.RecordWebhookAttempt(f); err != nil {
+			t.Fatalf("RecordWebhookAttempt: %v", err)
+		}
+		if i == 0 {
+			if w.Failures != 1 || !w.Active {
+				t.Errorf("webhook after a failed delivery = %+v, want 1 failure", w)
+			}
+		}
+	}
+	if w.Active || w.Failures != bookshelf.MaxWebhookFailures || w.DisabledAt.IsZero() {
+		t.Errorf("webhook after %d failed deliveries = %+v, want it disabled", bookshelf.MaxWebhookFailures, w)
+	}
+	if got, err := db.GetWebhook(a.ID); err != nil || got.Active || got.DisabledAt.IsZero() {
+		t.Errorf("GetWebhook(%d) after failures = %+v, %v; want it disabled", a.ID, got, err)
+	}
+	if err := db.UpdateWebhook(&bookshelf.Webhook{ID: a.ID, URL: a.URL, Events: a.Events, Active: true}); err != nil {
+		t.Fatalf("UpdateWebhook: %v", err)
+	}
+	if got, err := db.GetWebhook(a.ID); err != nil || !got.Active || got.Failures != 0 || !got.DisabledAt.IsZero() {
+		t.Errorf("GetWebhook(%d) after reactivation = %+v, %v; want it active without failures", a.ID, got, err)
+	}
+
+	// A test event never counts against the webhook.
+	test := &bookshelf.WebhookDelivery{WebhookID: a.ID, Event: bookshelf.WebhookTest, Payload: "{}"}
+	if err := db.QueueWebhookDelivery(test); err != nil {
+		t.Fatalf("QueueWebhookDelivery: %v", err)
+	}
+	test.Status, test.Attempts = bookshelf.DeliveryFailed, 1
+	if w, err := db.RecordWebhookAttempt(test); err != nil || w.Failures != 0 {
+		t.Errorf("RecordWebhookAttempt(test) = %+v, %v; want no failures", w, err)
+	}
+
+	deliveries, err := db.ListWebhookDeliveries(bookshelf.DeliveryQuery{WebhookID: a.ID, Limit: 3})
+	if err != nil || len(deliveries) != 3 || deliveries[0].ID != test.ID {
+		t.Errorf("ListWebhookDeliveries(limit 3) = %v, %v; want the 3 most recent, from %d", deliveries, err, test.ID)
+	}
+
+	// Purging keeps pending deliveries and the ones created since.
+	n, err := db.PurgeWebhookDeliveries(now().Add(time.Second))
+	if err != nil || n != bookshelf.MaxWebhookFailures+1 {
+		t.Errorf("PurgeWebhookDeliveries = %d, %v; want %d", n, err, bookshelf.MaxWebhookFailures+1)
+	}
+	if n, err := db.PurgeWebhookDeliveries(now().Add(time.Second)); err != nil || n != 0 {
+		t.Errorf("PurgeWebhookDeliveries again = %d, %v; want 0", n, err)
+	}
+	if left, err := db.ListWebhookDeliveries(bookshelf.DeliveryQuery{}); err != nil || len(left) != 1 || left[0].ID != d.ID {
+		t.Errorf("ListWebhookDeliveries after purge = %v, %v; want delivery %d", left, err, d.ID)
+	}
+
+	if err := db.DeleteWebhook(a.ID); err != nil {
+		t.Fatalf("DeleteWebhook: %v", err)
+	}
+	checkErr(t, "DeleteWebhook of a deleted webhook", db.DeleteWebhook(a.ID), bookshelf.ErrNotFound)
+	_, err = db.GetWebhook(a.ID)
+	checkErr(t, "GetWebhook of a deleted webhook", err, bookshelf.ErrNotFound)
+	if left, err := db.ListWebhookDeliveries(bookshelf.DeliveryQuery{}); err != nil || len(left) != 0 {
+		t.Errorf("ListWebhookDeliveries after delete = %v, %v; want none", left, err)
+	}
+}
+
+func testConcurrent(t *testing.T, db bookshelf.BookDatabase) {
+	const workers, perWorker = 8, 10
+
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		ids = make(map[int64]bool)
+	)
+	errc := make(chan error, workers*perWorker)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				b := &bookshelf.Book{Title: fmt.Sprintf("Worker %d book %d", w, i)}
+				id, err := db.AddBook(b, testActor)
+				if err != nil {
+					errc <- fmt.Errorf("AddBook: %v", err)
+					return
+				}
+				b.ID = id
+				b.Author = "Updated"
+				if err := db.UpdateBook(b, testActor); err != nil {
+					errc <- fmt.Errorf("UpdateBook(%d): %v", id, err)
+					return
+				}
+				if _, err := db.GetBook(id); err != nil {
+					errc <- fmt.Errorf("GetBook(%d): %v", id, err)
+					return
+				}
+				if _, err := db.ListBooks(); err != nil {
+					errc <- fmt.Errorf("ListBooks: %v", err)
+					return
+				}
+				mu.Lock()
+				if ids[id] {
+					errc <- fmt.Errorf("AddBook assigned ID %d twice", id)
+				}
+				ids[id] = true
+				mu.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		t.Error(err)
+	}
+
+	books, err := db.ListBooks()
+	if err != nil {
+		t.Fatalf("ListBooks: %v", err)
+	}
+	if len(books) != workers*perWorker {
+		t.Errorf("ListBooks returned %d books, want %d", len(books), workers*perWorker)
+	}
+	for _, b := range books {
+		if b.Author != "Updated" {
+			t.Errorf("book %d lost its concurrent update: %v", b.ID, b)
+		}
+	}
+
+	// A copy removed as it is checked out is either lent or removed, never
+	// lent and removed.
+	for i := 0; i < 10; i++ {
+		id, err := db.AddBook(&bookshelf.Book{Title: fmt.Sprintf("Contested book %d", i)}, testActor)
+		if err != nil {
+			t.Fatalf("AddBook: %v", err)
+		}
+		c, err := db.AddCopy(id, "only copy")
+		if err != nil {
+			t.Fatalf("AddCopy(%d): %v", id, err)
+		}
+		var checkOutErr, removeErr error
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, checkOutErr = db.CheckOut(id, "carol", "Carol", time.Now().Add(time.Hour))
+		}()
+		go func() {
+			defer wg.Done()
+			removeErr = db.RemoveCopy(id, c.ID)
+		}()
+		wg.Wait()
+		if (checkOutErr == nil) == (removeErr == nil) {
+			t.Errorf("book %d: CheckOut = %v and RemoveCopy = %v, want exactly one to succeed", id, checkOutErr, removeErr)
+			continue
+		}
+		for _, err := range []error{checkOutErr, removeErr} {
+			if err != nil && !errors.Is(err, bookshelf.ErrConflict) {
+				t.Errorf("book %d: the losing call failed with %v, want ErrConflict", id, err)
+			}
+		}
+		copies, err := db.ListCopies(id)
+		if err != nil {
+			t.Fatalf("ListCopies(%d): %v", id, err)
+		}
+		if checkOutErr == nil && (len(copies) != 1 || copies[0].Loan == nil) {
+			t.Errorf("book %d: lent its copy but ListCopies = %v, want the copy with its loan", id, copies)
+		}
+		if removeErr == nil && len(copies) != 0 {
+			t.Errorf("book %d: removed its copy but ListCopies = %v", id, copies)
+		}
+	}
+}
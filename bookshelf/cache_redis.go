@@ -0,0 +1,65 @@
+package bookshelf
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// redisCache is a SharedCache backed by Redis, such as a Memorystore
+// instance every replica can reach.
+type redisCache struct {
+	pool *redis.Pool
+}
+
+// Ensure redisCache conforms to the SharedCache interface.
+var _ SharedCache = &redisCache{}
+
+// newRedisCache returns a SharedCache using the Redis server at addr.
+func newRedisCache(addr string) *redisCache {
+	return &redisCache{
+		pool: &redis.Pool{
+			MaxIdle:     10,
+			IdleTimeout: 240 * time.Second,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", addr,
+					redis.DialConnectTimeout(time.Second),
+					redis.DialReadTimeout(time.Second),
+					redis.DialWriteTimeout(time.Second))
+			},
+		},
+	}
+}
+
+func (r *redisCache) Get(key string) ([]byte, bool, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+	b, err := redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+func (r *redisCache) Set(key string, value []byte, ttl time.Duration) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("SET", key, value, "PX", int64(ttl/time.Millisecond))
+	return err
+}
+
+func (r *redisCache) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	conn := r.pool.Get()
+	defer conn.Close()
+	args := make([]interface{}, len(keys))
+	for i, k := range keys {
+		args[i] = k
+	}
+	_, err := conn.Do("DEL", args...)
+	return err
+}
@@ -2,9 +2,12 @@ package bookshelf
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/pubsub"
 	"cloud.google.com/go/storage"
@@ -17,11 +20,13 @@ import (
 
 var (
 	DB                BookDatabase
+	BookCache         *CachedDB
 	OAuthConfig       *oauth2.Config
 	PubsubClient      *pubsub.Client
 	SessionStore      sessions.Store
 	StorageBucket     *storage.BucketHandle
 	StorageBucketName string
+	MetadataSource    MetadataProvider
 )
 
 var (
@@ -35,6 +40,68 @@ var (
 	CookieSecret      string = "something-secret"
 	oauthRedirectURL  string = "http://" + strings.TrimSuffix(os.Getenv("REDIRECT"), "\n") + "/oauth2callback"
 	PubsubTopicID     string = "fill-book-details"
+
+	// PubsubEventsTopicID carries a BookEvent for every change to a book.
+	PubsubEventsTopicID string = "book-events"
+
+	// PubsubImportTopicID carries the ImportJobs for CSV files too large to
+	// import while the user waits.
+	PubsubImportTopicID string = "import-jobs"
+
+	// BookCacheTTL enables the book cache when set to a duration such as
+	// "30s". RedisAddr adds a cache shared by every replica.
+	BookCacheTTL string = strings.TrimSuffix(os.Getenv("BOOK_CACHE_TTL"), "\n")
+	RedisAddr    string = strings.TrimSuffix(os.Getenv("REDIS_ADDR"), "\n")
+
+	// DBBackend selects the BookDatabase implementation: "mysql" (the
+	// default), "postgres", "sqlite" or "datastore".
+	DBBackend          string = strings.TrimSuffix(os.Getenv("DB_BACKEND"), "\n")
+	SQLitePath         string = strings.TrimSuffix(os.Getenv("SQLITE_PATH"), "\n")
+	DatastoreNamespace string = strings.TrimSuffix(os.Getenv("DATASTORE_NAMESPACE"), "\n")
+
+	// SQLReadReplicas lists MySQL read replicas as comma separated
+	// host:port addresses or unix socket paths.
+	SQLReadReplicas string = strings.TrimSuffix(os.Getenv("DB_READ_REPLICAS"), "\n")
+
+	// ReadYourWritesWindow is how long after a write a user's reads are
+	// pinned to the primary, so replica lag cannot hide their change.
+	ReadYourWritesWindow = 10 * time.Second
+
+	// TrashRetention is how long deleted books stay in the trash before the
+	// worker purges them, such as "720h". It defaults to 30 days.
+	TrashRetention string = strings.TrimSuffix(os.Getenv("TRASH_RETENTION"), "\n")
+
+	// LoanPeriod is how long a copy is lent for before it is due back,
+	// such as "336h". It defaults to 14 days.
+	LoanPeriod string = strings.TrimSuffix(os.Getenv("LOAN_PERIOD"), "\n")
+
+	// Admins lists the profile IDs, comma separated, of the users who may
+	// read the audit log and manage the copies of books.
+	Admins string = strings.TrimSuffix(os.Getenv("ADMINS"), "\n")
+
+	// GoogleBooksAPIKey, if set, is sent with the worker's Google Books
+	// lookups for a higher quota.
+	GoogleBooksAPIKey string = strings.TrimSuffix(os.Getenv("GOOGLE_BOOKS_API_KEY"), "\n")
+
+	// MetadataURL, if set, is the volumes endpoint of a server that
+	// answers like Google Books, such as a metadatatest server, to look
+	// books up in instead.
+	MetadataURL string = strings.TrimSuffix(os.Getenv("METADATA_URL"), "\n")
+
+	// SearchIndexPath is the directory of the worker's full-text index. It
+	// defaults to "bookshelf.bleve".
+	SearchIndexPath string = strings.TrimSuffix(os.Getenv("SEARCH_INDEX_PATH"), "\n")
+
+	// SearchURL is the worker's search endpoint the app sends full-text
+	// searches to, such as "http://worker:8080/search". Without it the
+	// app's search page falls back to matching titles and authors.
+	SearchURL string = strings.TrimSuffix(os.Getenv("SEARCH_URL"), "\n")
+
+	// WebhookAllowPrivate, when "true", lets the worker deliver webhooks to
+	// loopback and private addresses, for receivers on our own network.
+	// Otherwise only the web ports of public addresses are reached, as for
+	// covers.
+	WebhookAllowPrivate string = strings.TrimSuffix(os.Getenv("WEBHOOK_ALLOW_PRIVATE"), "\n")
 )
 
 type cloudSQLConfig struct {
@@ -42,56 +109,180 @@ type cloudSQLConfig struct {
 }
 
 func init() {
-	var err error
-	DB, err = configureCloudSQL(cloudSQLConfig{
-		Username: SQLUser,
-		Password: SQLPassword,
-		Instance: SQLInstance,
-	})
+	OAuthConfig = configureOAuthClient(OAuthClientID, OAuthClientSecret)
 
-	if err != nil {
-		log.Fatalf("cannot configure cloud SQL %v", err)
+	MetadataSource = NewGoogleBooks(MetadataURL, GoogleBooksAPIKey)
+
+	cookieStore := sessions.NewCookieStore([]byte(CookieSecret))
+	cookieStore.Options = &sessions.Options{
+		HttpOnly: true,
 	}
+	SessionStore = cookieStore
+}
 
+// Configure connects DB, BookCache, StorageBucket and PubsubClient to the
+// services the environment selects. The app and worker call it on start;
+// tests that bring their own database do not.
+func Configure() error {
+	if err := ConfigureDatabase(); err != nil {
+		return err
+	}
+
+	var err error
 	StorageBucketName = GCSBucketName
 	StorageBucket, err = configureStorage(StorageBucketName)
+	if err != nil {
+		return fmt.Errorf("cannot configure storage bucket %v", err)
+	}
 
+	PubsubClient, err = configurePubsub(ProjectID)
 	if err != nil {
-		log.Fatalf("cannot configure storage bucket %v", err)
+		return err
 	}
+	return nil
+}
 
-	OAuthConfig = configureOAuthClient(OAuthClientID, OAuthClientSecret)
+// ConfigureDatabase opens DB, with BookCache in front of it if enabled, as
+// DBBackend selects. Tests of the app that need no other service call it
+// with a SQLite backend.
+func ConfigureDatabase() error {
+	var err error
+	DB, err = configureDatabase(DBBackend)
+	if err != nil {
+		return fmt.Errorf("cannot configure %s database %v", DBBackend, err)
+	}
 
-	cookieStore := sessions.NewCookieStore([]byte(CookieSecret))
-	cookieStore.Options = &sessions.Options{
-		HttpOnly: true,
+	if BookCacheTTL != "" {
+		BookCache, err = configureCache(DB, BookCacheTTL, RedisAddr)
+		if err != nil {
+			return fmt.Errorf("cannot configure book cache %v", err)
+		}
+		DB = BookCache
 	}
-	SessionStore = cookieStore
+	return nil
+}
 
-	PubsubClient, err = configurePubsub(ProjectID)
-	if err != nil {
-		log.Fatal(err)
+// IsAdmin reports whether the user with the given profile ID is one of the
+// Admins.
+func IsAdmin(profileID string) bool {
+	if profileID == "" {
+		return false
+	}
+	for _, id := range strings.Split(Admins, ",") {
+		if strings.TrimSpace(id) == profileID {
+			return true
+		}
 	}
+	return false
+}
+
+// configureDatabase returns the BookDatabase selected by backend.
+func configureDatabase(backend string) (BookDatabase, error) {
+	c := cloudSQLConfig{
+		Username: SQLUser,
+		Password: SQLPassword,
+		Instance: SQLInstance,
+	}
+	switch backend {
+	case "", "mysql":
+		return configureCloudSQL(c)
+	case "postgres":
+		return configureCloudSQLPostgres(c)
+	case "sqlite":
+		path := SQLitePath
+		if path == "" {
+			path = "library.db"
+		}
+		return newSQLiteDB(SQLiteConfig{Path: path})
+	case "datastore":
+		return newDatastoreDB(DatastoreConfig{
+			ProjectID: ProjectID,
+			Namespace: DatastoreNamespace,
+		})
+	}
+	return nil, fmt.Errorf("unknown DB_BACKEND %q", backend)
 }
 
 func configureCloudSQL(c cloudSQLConfig) (BookDatabase, error) {
+	replicas, err := parseReplicas(SQLReadReplicas)
+	if err != nil {
+		return nil, err
+	}
 	if os.Getenv("GAE_INSTANCE") != "" {
 		// Running in GAE
 		return newMySQLDB(MySQLConfig{
+			Username:     c.Username,
+			Password:     c.Password,
+			UnixSocket:   "/cloudsql/" + c.Instance,
+			ReadReplicas: replicas,
+		})
+	}
+	// Running through the cloud_sql_proxy
+	return newMySQLDB(MySQLConfig{
+		Username:     c.Username,
+		Password:     c.Password,
+		Host:         "localhost",
+		Port:         3306,
+		ReadReplicas: replicas,
+	})
+}
+
+// parseReplicas parses a comma separated list of host:port addresses and
+// unix socket paths into replica configs.
+func parseReplicas(list string) ([]MySQLConfig, error) {
+	var replicas []MySQLConfig
+	for _, addr := range strings.Split(list, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if strings.HasPrefix(addr, "/") {
+			replicas = append(replicas, MySQLConfig{UnixSocket: addr})
+			continue
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid read replica %q: %v", addr, err)
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid read replica port %q: %v", addr, err)
+		}
+		replicas = append(replicas, MySQLConfig{Host: host, Port: p})
+	}
+	return replicas, nil
+}
+
+func configureCloudSQLPostgres(c cloudSQLConfig) (BookDatabase, error) {
+	if os.Getenv("GAE_INSTANCE") != "" {
+		// Running in GAE
+		return newPostgresDB(PostgresConfig{
 			Username:   c.Username,
 			Password:   c.Password,
 			UnixSocket: "/cloudsql/" + c.Instance,
 		})
 	}
 	// Running through the cloud_sql_proxy
-	return newMySQLDB(MySQLConfig{
+	return newPostgresDB(PostgresConfig{
 		Username: c.Username,
 		Password: c.Password,
 		Host:     "localhost",
-		Port:     3306,
+		Port:     5432,
 	})
 }
 
+func configureCache(db BookDatabase, ttl, redisAddr string) (*CachedDB, error) {
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BOOK_CACHE_TTL %q: %v", ttl, err)
+	}
+	config := CacheConfig{Size: 1000, TTL: d}
+	if redisAddr != "" {
+		config.Shared = newRedisCache(redisAddr)
+	}
+	return NewCachedDB(db, config), nil
+}
+
 func configureStorage(bucketID string) (*storage.BucketHandle, error) {
 	ctx := context.Background()
 	client, err := storage.NewClient(ctx)
@@ -122,12 +313,14 @@ func configurePubsub(projectID string) (*pubsub.Client, error) {
 		return nil, err
 	}
 
-	// Create the topic if it doesn't exist.
-	if exists, err := client.Topic(PubsubTopicID).Exists(ctx); err != nil {
-		return nil, err
-	} else if !exists {
-		if _, err := client.CreateTopic(ctx, PubsubTopicID); err != nil {
+	// Create the topics if they don't exist.
+	for _, id := range []string{PubsubTopicID, PubsubEventsTopicID, PubsubImportTopicID} {
+		if exists, err := client.Topic(id).Exists(ctx); err != nil {
 			return nil, err
+		} else if !exists {
+			if _, err := client.CreateTopic(ctx, id); err != nil {
+				return nil, err
+			}
 		}
 	}
 	return client, nil
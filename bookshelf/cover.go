@@ -0,0 +1,187 @@
+package bookshelf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/storage"
+	uuid "github.com/gofrs/uuid"
+)
+
+// maxCoverSize is the largest cover image CopyCover stores, in bytes.
+const maxCoverSize = 5 << 20
+
+// maxCoverRedirects is how many redirects CopyCover follows.
+const maxCoverRedirects = 3
+
+// AllowPrivateCovers lets CopyCover fetch from loopback and private
+// addresses, which it otherwise refuses so a cover URL cannot reach our own
+// network. It is meant for tests against local servers such as a
+// metadatatest server.
+var AllowPrivateCovers bool
+
+// sharedAddressSpace is the carrier-grade NAT range, private in all but
+// name.
+var _, sharedAddressSpace, _ = net.ParseCIDR("100.64.0.0/10")
+
+// publicIP reports whether ip is a public unicast address.
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || sharedAddressSpace.Contains(ip))
+}
+
+// publicAddrControl returns a net.Dialer Control that refuses connections
+// to anything but the web ports of public addresses, unless *allowPrivate
+// is set. It runs once the host is resolved, for every connection, so
+// neither a redirect nor a name that resolves differently the second time
+// can get past it.
+func publicAddrControl(allowPrivate *bool) func(network, address string, _ syscall.RawConn) error {
+	return func(network, address string, _ syscall.RawConn) error {
+		if *allowPrivate {
+			return nil
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+			return fmt.Errorf("%s is not a public address", host)
+		}
+		if port != "80" && port != "443" {
+			return fmt.Errorf("port %s is not allowed", port)
+		}
+		return nil
+	}
+}
+
+// checkWebURL refuses URLs that are not plain web addresses.
+func checkWebURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme %q is not allowed", u.Scheme)
+	}
+	if u.User != nil {
+		return errors.New("URLs with credentials are not allowed")
+	}
+	if u.Host == "" {
+		return errors.New("URL has no host")
+	}
+	return nil
+}
+
+// coverClient fetches the covers CopyCover copies. It ignores proxy
+// settings, since the proxy would make the connection in its place.
+var coverClient = &http.Client{
+	Timeout: 20 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: publicAddrControl(&AllowPrivateCovers),
+		}).DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       time.Minute,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxCoverRedirects {
+			return fmt.Errorf("cover: more than %d redirects", maxCoverRedirects)
+		}
+		if err := checkWebURL(req.URL); err != nil {
+			return fmt.Errorf("cover: %v", err)
+		}
+		return nil
+	},
+}
+
+// coverExtensions names the objects of the kinds of image CopyCover
+// accepts as covers, by the type their content is sniffed as.
+var coverExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// StoreCover uploads a cover image to StorageBucket under a new name with
+// the extension ext, publicly readable, and returns its public URL.
+func StoreCover(ctx context.Context, r io.Reader, contentType, ext string) (string, error) {
+	if StorageBucket == nil {
+		return "", errors.New("storage bucket is missing - check config.go")
+	}
+	name := uuid.Must(uuid.NewV4()).String() + ext
+	w := StorageBucket.Object(name).NewWriter(ctx)
+
+	w.ACL = []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}}
+	w.ContentType = contentType
+
+	w.CacheControl = "public, max-age=86400"
+
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	const publicURL = "https://storage.googleapis.com/%s/%s"
+	return fmt.Sprintf(publicURL, StorageBucketName, name), nil
+}
+
+// CopyCover downloads the cover image at src, such as the CoverURL of a
+// book's Metadata, into StorageBucket and returns its public URL, so the
+// book does not depend on another site keeping it. Only public web
+// addresses are fetched, and only images of up to maxCoverSize whose
+// content is a JPEG, PNG, GIF or WebP, whatever the server calls it.
+func CopyCover(ctx context.Context, src string) (string, error) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return "", fmt.Errorf("cover: invalid URL %q: %v", src, err)
+	}
+	if err := checkWebURL(u); err != nil {
+		return "", fmt.Errorf("cover: %v", err)
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("cover: invalid URL %q: %v", src, err)
+	}
+	resp, err := coverClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("cover: could not fetch %s: %v", src, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("cover: could not fetch %s: %s", src, resp.Status)
+	}
+	if resp.ContentLength > maxCoverSize {
+		return "", fmt.Errorf("cover: %s is larger than %d bytes", src, maxCoverSize)
+	}
+	// Read the image whole, so one that is too large is not stored.
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCoverSize+1))
+	if err != nil {
+		return "", fmt.Errorf("cover: could not fetch %s: %v", src, err)
+	}
+	if len(data) > maxCoverSize {
+		return "", fmt.Errorf("cover: %s is larger than %d bytes", src, maxCoverSize)
+	}
+	contentType := http.DetectContentType(data)
+	ext, ok := coverExtensions[contentType]
+	if !ok {
+		return "", fmt.Errorf("cover: %s is %s, not an image", src, strings.SplitN(contentType, ";", 2)[0])
+	}
+	imageURL, err := StoreCover(ctx, bytes.NewReader(data), contentType, ext)
+	if err != nil {
+		return "", fmt.Errorf("cover: could not store %s: %v", src, err)
+	}
+	return imageURL, nil
+}
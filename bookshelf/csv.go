@@ -0,0 +1,254 @@
+package bookshelf
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// csvFields are the book fields a CSV file can hold, in export order. They
+// share their names with the history fields.
+// The isbn column may hold either form of the ISBN, and the tags and genres
+// columns comma separated lists.
+var csvFields = []string{"title", "author", "imageUrl", "isbn", "tags", "genres"}
+
+// CSVFields returns the book fields a CSV column can be mapped to.
+func CSVFields() []string {
+	return append([]string(nil), csvFields...)
+}
+
+// maxFieldLength is the longest value the VARCHAR columns accept.
+const maxFieldLength = 255
+
+// maxReportedErrors caps the errors kept in an ImportReport, so a file that
+// is wrong throughout does not produce a report as big as itself.
+const maxReportedErrors = 1000
+
+// ImportOptions controls ImportCSV.
+type ImportOptions struct {
+	// Mapping maps book fields, as listed by CSVFields, to the CSV header
+	// of the column holding them. Fields that are not mapped are left
+	// empty. The title must be mapped.
+	Mapping map[string]string `json:"mapping"`
+
+	// DryRun validates every row without adding any books.
+	DryRun bool `json:"dryRun"`
+
+	// Actor is recorded as having added the books.
+	Actor Actor `json:"actor"`
+}
+
+// RowError reports why a row of a CSV file was not imported. Row counts
+// records, the header being row 1.
+type RowError struct {
+	Row     int    `json:"row"`
+	Message string `json:"message"`
+}
+
+// ImportReport is the outcome of ImportCSV.
+type ImportReport struct {
+	DryRun bool `json:"dryRun"`
+
+	// Rows counts the rows read, not including the header. Added counts
+	// the books added, or that would be added in a dry run, and Failed
+	// the rows that were rejected.
+	Rows   int `json:"rows"`
+	Added  int `json:"added"`
+	Failed int `json:"failed"`
+
+	// BookIDs lists the IDs of the books added.
+	BookIDs []int64 `json:"bookIds,omitempty"`
+
+	// Errors lists the rejected rows, up to a limit.
+	Errors []RowError `json:"errors,omitempty"`
+
+	// Error, if set, is why the import stopped before the end of the file.
+	Error string `json:"error,omitempty"`
+}
+
+func (r *ImportReport) rowError(row int, format string, args ...interface{}) {
+	r.Failed++
+	if len(r.Errors) < maxReportedErrors {
+		r.Errors = append(r.Errors, RowError{Row: row, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// ReadCSVHeader returns the header of a CSV file, to choose the column
+// mapping.
+func ReadCSVHeader(r io.Reader) ([]string, error) {
+	header, err := csv.NewReader(r).Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("csv: file is empty: %w", ErrInvalid)
+	} else if err != nil {
+		return nil, fmt.Errorf("csv: could not read header: %v: %w", err, ErrInvalid)
+	}
+	return header, nil
+}
+
+// GuessMapping maps each book field to the column of header with the same
+// name, ignoring case, spaces and underscores, so a file written by
+// ExportCSV maps without help.
+func GuessMapping(header []string) map[string]string {
+	normalize := func(s string) string {
+		return strings.ToLower(strings.NewReplacer(" ", "", "_", "").Replace(strings.TrimSpace(s)))
+	}
+	mapping := make(map[string]string)
+	for _, f := range csvFields {
+		for _, h := range header {
+			if normalize(h) == normalize(f) {
+				mapping[f] = h
+				break
+			}
+		}
+	}
+	return mapping
+}
+
+// validateBook checks that a book read from a CSV row can be stored.
+func validateBook(b *Book) error {
+	if strings.TrimSpace(b.Title) == "" {
+		return errors.New("title is required")
+	}
+	for _, f := range historyFields {
+		if v := f.get(b); len(v) > maxFieldLength {
+			return fmt.Errorf("%s is longer than %d characters", f.name, maxFieldLength)
+		}
+	}
+	if b.ImageURL != "" {
+		u, err := url.Parse(b.ImageURL)
+		if err != nil || !u.IsAbs() || u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("imageUrl %q is not an http or https URL", b.ImageURL)
+		}
+	}
+	return b.normalize()
+}
+
+// ImportCSV adds a book to db for each valid row of a CSV file whose first
+// row is a header, and reports the rows it rejected. Each new book is
+// announced and queued for enrichment, like a book added by hand.
+//
+// A row that cannot be added is reported and the import carries on. The
+// import stops if the file cannot be parsed, or db is unavailable; the
+// report then says how far it got.
+func ImportCSV(ctx context.Context, db BookDatabase, r io.Reader, opts ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{DryRun: opts.DryRun}
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("csv: file is empty: %w", ErrInvalid)
+	} else if err != nil {
+		return nil, fmt.Errorf("csv: could not read header: %v: %w", err, ErrInvalid)
+	}
+
+	columns := make(map[string]int)
+	for field, name := range opts.Mapping {
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, f := range csvFields {
+			known = known || f == field
+		}
+		if !known {
+			return nil, fmt.Errorf("csv: unknown field %q: %w", field, ErrInvalid)
+		}
+		i := -1
+		for j, h := range header {
+			if h == name {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			return nil, fmt.Errorf("csv: no column %q for %s: %w", name, field, ErrInvalid)
+		}
+		columns[field] = i
+	}
+	if _, ok := columns["title"]; !ok {
+		return nil, fmt.Errorf("csv: the title must be mapped to a column: %w", ErrInvalid)
+	}
+
+	for row := 2; ; row++ {
+		if err := ctx.Err(); err != nil {
+			report.Error = err.Error()
+			return report, err
+		}
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			report.Error = fmt.Sprintf("row %d: %v", row, err)
+			return report, fmt.Errorf("csv: %v: %w", err, ErrInvalid)
+		}
+		report.Rows++
+
+		b := &Book{}
+		for _, f := range historyFields {
+			if i, ok := columns[f.name]; ok && i < len(record) {
+				f.set(b, strings.TrimSpace(record[i]))
+			}
+		}
+		if err := validateBook(b); err != nil {
+			report.rowError(row, "%v", err)
+			continue
+		}
+		if opts.DryRun {
+			report.Added++
+			continue
+		}
+		id, err := db.AddBook(b, opts.Actor)
+		if err != nil {
+			if errors.Is(err, ErrConflict) || errors.Is(err, ErrInvalid) {
+				report.rowError(row, "%v", err)
+				continue
+			}
+			report.Error = fmt.Sprintf("row %d: %v", row, err)
+			return report, err
+		}
+		report.Added++
+		report.BookIDs = append(report.BookIDs, id)
+		if err := RequestEnrichment(ctx, id); err != nil {
+			log.Printf("[ID %d] could not request enrichment: %v", id, err)
+		}
+		if err := PublishBookEvent(ctx, BookCreated, id); err != nil {
+			log.Printf("[ID %d] could not publish create event: %v", id, err)
+		}
+	}
+	return report, nil
+}
+
+// ExportCSV writes books as a CSV file with a header, which ImportCSV reads
+// back with GuessMapping. Rows are flushed to w a hundred at a time, so a
+// large export streams rather than building up in memory.
+func ExportCSV(w io.Writer, books []*Book) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(append([]string{"id"}, csvFields...)); err != nil {
+		return err
+	}
+	record := make([]string, 1+len(csvFields))
+	for i, b := range books {
+		record[0] = strconv.FormatInt(b.ID, 10)
+		for j, name := range csvFields {
+			for _, f := range historyFields {
+				if f.name == name {
+					record[1+j] = f.get(b)
+				}
+			}
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+		if i%100 == 99 {
+			cw.Flush()
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
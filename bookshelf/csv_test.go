@@ -0,0 +1,160 @@
+package bookshelf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCSVRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	db := newEmptySQLiteDB(t)
+	defer db.Close()
+	for _, b := range []*Book{
+		{Title: "The Hobbit", Author: "J. R. R. Tolkien", ISBN13: "9780261103344", Tags: []string{"classic"}, Genres: []string{"fantasy"}},
+		{Title: "Dune, Messiah", Author: "Frank Herbert", ImageURL: "https://example.com/dune.jpg"},
+		{Title: `"Quoted"`, Tags: []string{"to read", "gift"}},
+	} {
+		if _, err := db.AddBook(b, testActor); err != nil {
+			t.Fatal(err)
+		}
+	}
+	books, err := db.ListBooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := ExportCSV(&buf, books); err != nil {
+		t.Fatalf("ExportCSV: %v", err)
+	}
+	exported := buf.String()
+
+	header, err := ReadCSVHeader(strings.NewReader(exported))
+	if err != nil {
+		t.Fatalf("ReadCSVHeader: %v", err)
+	}
+	to := newEmptySQLiteDB(t)
+	defer to.Close()
+	report, err := ImportCSV(ctx, to, strings.NewReader(exported), ImportOptions{Mapping: GuessMapping(header), Actor: testActor})
+	if err != nil || report.Rows != 3 || report.Added != 3 || report.Failed != 0 {
+		t.Fatalf("ImportCSV = %+v, %v; want the 3 books added", report, err)
+	}
+	got, err := to.ListBooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(books) {
+		t.Fatalf("imported %d books, want %d", len(got), len(books))
+	}
+	for i, b := range books {
+		for _, f := range historyFields {
+			if f.get(got[i]) != f.get(b) {
+				t.Errorf("book %q has %s %q after the round trip, want %q", b.Title, f.name, f.get(got[i]), f.get(b))
+			}
+		}
+	}
+}
+
+func TestGuessMapping(t *testing.T) {
+	for _, c := range []struct {
+		header []string
+		want   map[string]string
+	}{
+		{
+			[]string{"id", "title", "author", "imageUrl", "isbn", "tags", "genres"},
+			map[string]string{"title": "title", "author": "author", "imageUrl": "imageUrl", "isbn": "isbn", "tags": "tags", "genres": "genres"},
+		},
+		{
+			[]string{" Title ", "AUTHOR", "image_url", "Image URL"},
+			map[string]string{"title": " Title ", "author": "AUTHOR", "imageUrl": "image_url"},
+		},
+		{[]string{"Book Title", "Writer"}, map[string]string{}},
+	} {
+		if got := GuessMapping(c.header); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("GuessMapping(%q) = %v, want %v", c.header, got, c.want)
+		}
+	}
+}
+
+func TestImportCSVRows(t *testing.T) {
+	mapping := map[string]string{"title": "Book Title", "author": "Writer", "imageUrl": "Cover", "isbn": "ISBN", "genres": "Genre"}
+	for _, c := range []struct {
+		name    string
+		row     string
+		wantErr string
+	}{
+		{"valid", "Emma,Jane Austen,https://example.com/emma.jpg,,", ""},
+		{"quoted comma", `"Emma, Volume 1",Jane Austen,,,`, ""},
+		{"short row", "Emma", ""},
+		{"no title", " ,Jane Austen,,,", "title is required"},
+		{"long title", strings.Repeat("x", maxFieldLength+1) + ",,,,", "title is longer than"},
+		{"relative image", "Emma,,emma.jpg,,", "is not an http or https URL"},
+		{"ftp image", "Emma,,ftp://example.com/emma.jpg,,", "is not an http or https URL"},
+		{"bad ISBN", "Emma,,,9780261103345,", "isbn"},
+		{"unknown genre", "Emma,,,,gossip", "unknown genre"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			db := newEmptySQLiteDB(t)
+			defer db.Close()
+			in := "Book Title,Writer,Cover,ISBN,Genre\n" + c.row + "\n"
+			report, err := ImportCSV(context.Background(), db, strings.NewReader(in), ImportOptions{Mapping: mapping, Actor: testActor})
+			if err != nil {
+				t.Fatalf("ImportCSV: %v", err)
+			}
+			books, err := db.ListBooks()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.wantErr == "" {
+				if report.Added != 1 || len(books) != 1 || len(report.BookIDs) != 1 {
+					t.Errorf("ImportCSV = %+v, want the row added", report)
+				}
+				return
+			}
+			if report.Added != 0 || report.Failed != 1 || len(books) != 0 {
+				t.Fatalf("ImportCSV = %+v, want the row rejected", report)
+			}
+			if e := report.Errors[0]; e.Row != 2 || !strings.Contains(e.Message, c.wantErr) {
+				t.Errorf("row error %+v, want row 2 and a message containing %q", e, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestImportCSVDryRun(t *testing.T) {
+	db := newEmptySQLiteDB(t)
+	defer db.Close()
+	in := "title,author\nEmma,Jane Austen\n,Nobody\nPersuasion,Jane Austen\n"
+	report, err := ImportCSV(context.Background(), db, strings.NewReader(in), ImportOptions{Mapping: map[string]string{"title": "title", "author": "author"}, DryRun: true})
+	if err != nil || !report.DryRun || report.Rows != 3 || report.Added != 2 || report.Failed != 1 || len(report.BookIDs) != 0 {
+		t.Fatalf("ImportCSV = %+v, %v; want 2 of 3 rows accepted and none stored", report, err)
+	}
+	if books, err := db.ListBooks(); err != nil || len(books) != 0 {
+		t.Errorf("ListBooks after a dry run = %v, %v; want no books", books, err)
+	}
+}
+
+func TestImportCSVInvalidFile(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		in      string
+		mapping map[string]string
+	}{
+		{"empty", "", map[string]string{"title": "title"}},
+		{"title unmapped", "title,author\nEmma,Jane Austen\n", map[string]string{"author": "author"}},
+		{"unknown field", "title\nEmma\n", map[string]string{"title": "title", "rating": "title"}},
+		{"missing column", "title\nEmma\n", map[string]string{"title": "Title"}},
+		{"bad quoting", "title\n\"Emma\n", map[string]string{"title": "title"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			db := newEmptySQLiteDB(t)
+			defer db.Close()
+			if _, err := ImportCSV(context.Background(), db, strings.NewReader(c.in), ImportOptions{Mapping: c.mapping}); !errors.Is(err, ErrInvalid) {
+				t.Errorf("ImportCSV = %v, want ErrInvalid", err)
+			}
+		})
+	}
+}
@@ -1,21 +1,249 @@
 package bookshelf
 
+import (
+	"time"
+)
+
 // BookDatabase provides thread-safe access to a database of books.
+//
+// Implementations wrap ErrNotFound, ErrConflict and ErrInvalid so callers
+// can tell a missing book or a bad request from a storage failure. Every
+// write is recorded in the book's history, in the same transaction, along
+// with the Actor who made it.
 type BookDatabase interface {
-	// ListBooks returns a list of books, ordered by title
+	// ListBooks returns a list of books, ordered by title. Books in the
+	// trash are left out.
 	ListBooks() ([]*Book, error)
 
-	// GetBook retrieves a book by its ID
+	// SearchBooks returns the books whose title or author contains query,
+	// ignoring case, ordered by title. Books in the trash are left out.
+	SearchBooks(query string) ([]*Book, error)
+
+	// FilterBooks returns the books f selects, with their tags and genres,
+	// ordered by title or as f.Sort says. Books in the trash are left out.
+	FilterBooks(f BookFilter) ([]*Book, error)
+
+	// TagCloud counts the books outside the trash with each tag and genre.
+	TagCloud() (*TagCloud, error)
+
+	// GetBook retrieves a book by its ID, or returns ErrNotFound. Books in
+	// the trash are not found.
 	GetBook(id int64) (*Book, error)
 
-	// AddBook saves a given book, assigning it a new ID
-	AddBook(b *Book) (id int64, err error)
+	// GetBookByISBN retrieves a book by its ISBN-10 or ISBN-13, with or
+	// without hyphens. An invalid ISBN is rejected with ErrInvalid and a
+	// book that is missing or in the trash reports ErrNotFound.
+	GetBookByISBN(isbn string) (*Book, error)
+
+	// AddBook saves a given book, assigning it a new ID. Its ISBNs are
+	// validated and completed as by Book.SetISBN: an invalid one is
+	// rejected with ErrInvalid, and one already taken by another book,
+	// even in the trash, with ErrConflict. A genre that is not one of
+	// Genres is rejected with ErrInvalid.
+	AddBook(b *Book, by Actor) (id int64, err error)
+
+	// DeleteBook moves a given book to the trash, recording who deleted it.
+	// An unassigned ID is rejected with ErrInvalid and a missing book
+	// reports ErrNotFound.
+	DeleteBook(id int64, by Actor) error
+
+	// ListDeletedBooks returns the books in the trash, most recently
+	// deleted first
+	ListDeletedBooks() ([]*Book, error)
+
+	// RestoreBook takes a book out of the trash. A book that is not in the
+	// trash reports ErrNotFound.
+	RestoreBook(id int64, by Actor) error
+
+	// PurgeBook permanently removes a book from the trash and returns it,
+	// so its cover can be removed too. A book that is not in the trash
+	// reports ErrNotFound.
+	PurgeBook(id int64, by Actor) (*Book, error)
+
+	// PurgeDeletedBooks permanently removes the books deleted before a
+	// given time and returns them
+	PurgeDeletedBooks(before time.Time, by Actor) ([]*Book, error)
+
+	// UpdateBook updates the entry for a given book. An unassigned ID is
+	// rejected with ErrInvalid and a missing book reports ErrNotFound.
+	// ISBNs and genres are checked as by AddBook. Saving a book without
+	// changes records nothing in its history.
+	UpdateBook(b *Book, by Actor) error
+
+	// MergeBook saves into, moves the history of the book with dupID to it
+	// and permanently removes that book, recording the merge in the history
+	// of into. A missing book, or one in the trash, reports ErrNotFound and
+	// merging a book into itself is rejected with ErrInvalid.
+	MergeBook(into *Book, dupID int64, by Actor) error
+
+	// GetAuthor retrieves an author by ID, or returns ErrNotFound.
+	GetAuthor(id int64) (*Author, error)
+
+	// ListAuthorBooks returns the books an author contributed to in any
+	// role, with their contributors, ordered by title. Books in the trash
+	// are left out.
+	ListAuthorBooks(authorID int64) ([]*Book, error)
+
+	// SearchAuthors returns up to limit authors of books, ordered by name,
+	// with a word of their name starting with prefix, ignoring case and
+	// accents. A limit of 0 means DefaultAuthorSearchLimit.
+	SearchAuthors(prefix string, limit int) ([]*Author, error)
+
+	// GetReading retrieves a user's reading of a book, or returns
+	// ErrNotFound.
+	GetReading(userID string, bookID int64) (*Reading, error)
+
+	// SaveReading adds or replaces a user's reading of a book, setting its
+	// UpdatedAt. A book that is missing or in the trash reports
+	// ErrNotFound, and an invalid status, shelf, progress or pair of dates
+	// is rejected with ErrInvalid.
+	SaveReading(r *Reading) error
+
+	// DeleteReading takes a book off a user's shelves. A book that is not
+	// on them reports ErrNotFound.
+	DeleteReading(userID string, bookID int64) error
+
+	// ListReadings returns a user's readings on a shelf, which is a status
+	// or a custom shelf, or on any shelf if shelf is empty, with their
+	// books, most recently updated first. Books in the trash are left out.
+	// Purging a book removes its readings; merging books moves them.
+	ListReadings(userID, shelf string) ([]*Reading, error)
+
+	// ListShelves counts a user's books on each shelf: every status, even
+	// when empty, then each custom shelf by name.
+	ListShelves(userID string) ([]ShelfCount, error)
+
+	// AddCopy adds a copy of a book to the library. A book that is missing
+	// or in the trash reports ErrNotFound.
+	AddCopy(bookID int64, label string) (*Copy, error)
+
+	// RemoveCopy removes a copy of a book. A copy that is lent out is
+	// rejected with ErrConflict, and a missing one reports ErrNotFound.
+	// Its past loans are kept.
+	RemoveCopy(bookID, copyID int64) error
+
+	// ListCopies returns the copies of a book, oldest first, each with its
+	// open loan.
+	ListCopies(bookID int64) ([]*Copy, error)
+
+	// CheckOut lends a copy of a book to a user until due, taking them off
+	// its holds queue. A book that is missing or in the trash reports
+	// ErrNotFound. ErrConflict is returned when the user already has a
+	// copy, when every copy is lent out, or when the free copies are held
+	// for users ahead in the queue.
+	CheckOut(bookID int64, userID, userName string, due time.Time) (*Loan, error)
+
+	// CheckIn records that the copy of a loan was returned, and returns
+	// the loan. A loan that is missing or already returned reports
+	// ErrNotFound.
+	CheckIn(bookID, loanID int64) (*Loan, error)
+
+	// MarkOverdue records that an open loan due before at was found
+	// overdue at that time. A loan that is missing, returned, not due yet
+	// or already marked reports ErrNotFound, so concurrent workers mark a
+	// loan once.
+	MarkOverdue(bookID, loanID int64, at time.Time) error
+
+	// ListLoans returns the loans q selects, with their books, most
+	// recently checked out first. Loans of books in the trash are
+	// included.
+	ListLoans(q LoanQuery) ([]*Loan, error)
+
+	// PlaceHold puts a user at the end of a book's holds queue. A book that
+	// is missing or in the trash reports ErrNotFound, and a user who is
+	// already queued or has a copy is rejected with ErrConflict.
+	PlaceHold(bookID int64, userID, userName string) (*Hold, error)
+
+	// CancelHold takes a user off a book's holds queue. A user who is not
+	// queued reports ErrNotFound.
+	CancelHold(bookID int64, userID string) error
+
+	// ListHolds returns a book's holds queue, longest waiting first.
+	ListHolds(bookID int64) ([]*Hold, error)
+
+	// Availability counts the copies, open loans and holds of every book
+	// that has any, by book ID. Purging a book removes its copies, loans
+	// and holds; merging books moves them.
+	Availability() (map[int64]Availability, error)
+
+	// GetReview retrieves a user's review of a book, or returns
+	// ErrNotFound.
+	GetReview(bookID int64, userID string) (*Review, error)
+
+	// SaveReview adds or replaces a user's review of a book, setting its
+	// CreatedAt and UpdatedAt, and updates the book's RatingCount and
+	// RatingSum in the same transaction. A book that is missing or in the
+	// trash reports ErrNotFound, and a rating out of range or an overlong
+	// text is rejected with ErrInvalid.
+	SaveReview(r *Review) error
+
+	// DeleteReview removes a user's review of a book and takes its rating
+	// off the book's. A missing review reports ErrNotFound.
+	DeleteReview(bookID int64, userID string) error
+
+	// ListReviews returns the reviews q selects, with their books, most
+	// recently updated first. Reviews of books in the trash are left out.
+	// Purging a book removes its reviews; merging books moves them, keeping
+	// the review of the book merged into for a user who reviewed both.
+	ListReviews(q ReviewQuery) ([]*Review, error)
+
+	// AddWebhook saves a new webhook, setting its ID, CreatedAt and
+	// UpdatedAt and making up a secret if it has none. A webhook without
+	// an owner, with an invalid URL or secret, or with an unknown event is
+	// rejected with ErrInvalid.
+	AddWebhook(w *Webhook) error
+
+	// GetWebhook retrieves a webhook by its ID, or returns ErrNotFound.
+	GetWebhook(id int64) (*Webhook, error)
+
+	// ListWebhooks returns the webhooks of a user, or of every user if
+	// ownerID is empty, oldest first.
+	ListWebhooks(ownerID string) ([]*Webhook, error)
+
+	// UpdateWebhook saves the URL, events, secret and Active of a webhook,
+	// setting its UpdatedAt. Activating a webhook clears its Failures and
+	// DisabledAt. A missing webhook reports ErrNotFound, and an invalid one
+	// is rejected as by AddWebhook.
+	UpdateWebhook(w *Webhook) error
+
+	// DeleteWebhook removes a webhook and its deliveries. A missing webhook
+	// reports ErrNotFound.
+	DeleteWebhook(id int64) error
+
+	// QueueWebhookDelivery saves a new pending delivery due now, setting
+	// its ID, Status, CreatedAt and NextAttemptAt. A missing webhook
+	// reports ErrNotFound.
+	QueueWebhookDelivery(d *WebhookDelivery) error
+
+	// ListWebhookDeliveries returns the deliveries q selects, most recent
+	// first.
+	ListWebhookDeliveries(q DeliveryQuery) ([]*WebhookDelivery, error)
+
+	// ClaimWebhookDelivery moves a pending delivery that is due at due on
+	// to until, so no other worker attempts it meanwhile. A delivery that
+	// is missing, no longer pending or due at another time, because it
+	// was claimed since, reports ErrNotFound.
+	ClaimWebhookDelivery(id int64, due, until time.Time) error
+
+	// RecordWebhookAttempt saves the status, attempts, response and next
+	// attempt of a delivery and, in the same transaction, counts it
+	// against its webhook: a delivery that failed for good adds to its
+	// Failures, disabling it at MaxWebhookFailures, and one delivered
+	// clears them. It returns the webhook as saved. A missing delivery or
+	// webhook reports ErrNotFound.
+	RecordWebhookAttempt(d *WebhookDelivery) (*Webhook, error)
+
+	// PurgeWebhookDeliveries removes the deliveries that are no longer
+	// pending and were created before a time, and returns how many it
+	// removed.
+	PurgeWebhookDeliveries(before time.Time) (int, error)
 
-	// DeleteBook removes a given book by its ID
-	DeleteBook(id int64) error
+	// BookHistory returns the changes made to a book, newest first
+	BookHistory(id int64) ([]*BookChange, error)
 
-	// UpdateBook updates the entry for a given book
-	UpdateBook(b *Book) error
+	// AuditLog returns the changes made to every book that q selects,
+	// newest first
+	AuditLog(q AuditQuery) ([]*BookChange, error)
 
 	// Close closes the database, freeing up resources
 	Close()
@@ -0,0 +1,322 @@
+package bookshelf
+
+import (
+	"container/list"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// cacheStats counts how the book cache is doing. expvar serves them on
+// /debug/vars.
+var cacheStats = expvar.NewMap("bookcache")
+
+const listCacheKey = "books:list"
+
+func bookCacheKey(id int64) string { return fmt.Sprintf("books:%d", id) }
+
+// SharedCache is a cache shared by every replica, such as Memorystore.
+type SharedCache interface {
+	// Get returns the value stored under key, and whether there was one.
+	Get(key string) ([]byte, bool, error)
+
+	// Set stores a value under key for ttl.
+	Set(key string, value []byte, ttl time.Duration) error
+
+	// Delete removes the given keys.
+	Delete(keys ...string) error
+}
+
+// CacheConfig configures a CachedDB.
+type CacheConfig struct {
+	// Size is the number of entries kept in process.
+	Size int
+
+	// TTL bounds how long an entry is served without going back to the
+	// database, and so how stale a replica can be if it misses an event.
+	TTL time.Duration
+
+	// Shared, if set, is consulted when the in-process cache misses.
+	Shared SharedCache
+}
+
+// CachedDB is a read-through cache in front of a BookDatabase. Reads are
+// served from an in-process LRU, then the optional shared cache, then the
+// database. Writes through it invalidate the affected entries; writes made
+// elsewhere, such as by the worker or another replica, are dropped with
+// Invalidate when their book events arrive.
+type CachedDB struct {
+	BookDatabase
+
+	ttl    time.Duration
+	shared SharedCache
+
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List // of *cacheEntry, most recently used first
+	// gen counts invalidations. A read only stores what it loaded if no
+	// invalidation happened meanwhile, so it cannot cache a stale book.
+	gen uint64
+}
+
+type cacheEntry struct {
+	key     string
+	value   interface{} // *Book or []*Book
+	expires time.Time
+}
+
+// Ensure CachedDB conforms to the BookDatabase interface.
+var _ BookDatabase = &CachedDB{}
+
+// NewCachedDB wraps db with a read-through cache.
+func NewCachedDB(db BookDatabase, config CacheConfig) *CachedDB {
+	return &CachedDB{
+		BookDatabase: db,
+		ttl:          config.TTL,
+		shared:       config.Shared,
+		size:         config.Size,
+		entries:      make(map[string]*list.Element),
+		lru:          list.New(),
+	}
+}
+
+func copyBook(b *Book) *Book {
+	c := *b
+	c.Contributors = append([]Contributor(nil), b.Contributors...)
+	c.Tags = append([]string(nil), b.Tags...)
+	c.Genres = append([]string(nil), b.Genres...)
+	return &c
+}
+
+func copyBooks(books []*Book) []*Book {
+	c := make([]*Book, len(books))
+	for i, b := range books {
+		c[i] = copyBook(b)
+	}
+	return c
+}
+
+// getLocal returns the unexpired value cached in process under key.
+func (c *CachedDB) getLocal(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e.value, true
+}
+
+// setLocal caches value under key, unless an invalidation happened since
+// the caller read generation gen.
+func (c *CachedDB) setLocal(key string, value interface{}, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen || c.size <= 0 {
+		return
+	}
+	e := &cacheEntry{key: key, value: value, expires: time.Now().Add(c.ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		cacheStats.Add("evictions", 1)
+	}
+}
+
+func (c *CachedDB) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// getShared decodes the value stored in the shared cache under key into v.
+func (c *CachedDB) getShared(key string, v interface{}) bool {
+	if c.shared == nil {
+		return false
+	}
+	b, ok, err := c.shared.Get(key)
+	if err != nil {
+		log.Printf("bookcache: could not get %s: %v", key, err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		log.Printf("bookcache: could not decode %s: %v", key, err)
+		return false
+	}
+	return true
+}
+
+// setShared stores v in the shared cache under key, unless an invalidation
+// happened since the caller read generation gen. One that happens while
+// storing may have deleted the key before v arrived, so v is deleted again.
+func (c *CachedDB) setShared(key string, v interface{}, gen uint64) {
+	if c.shared == nil || c.generation() != gen {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("bookcache: could not encode %s: %v", key, err)
+		return
+	}
+	if err := c.shared.Set(key, b, c.ttl); err != nil {
+		log.Printf("bookcache: could not set %s: %v", key, err)
+		return
+	}
+	if c.generation() != gen {
+		if err := c.shared.Delete(key); err != nil {
+			log.Printf("bookcache: could not delete %s: %v", key, err)
+		}
+	}
+}
+
+// invalidate drops the given keys from both caches.
+func (c *CachedDB) invalidate(keys ...string) {
+	c.mu.Lock()
+	c.gen++
+	for _, key := range keys {
+		if el, ok := c.entries[key]; ok {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+	c.mu.Unlock()
+	cacheStats.Add("invalidations", 1)
+
+	if c.shared == nil {
+		return
+	}
+	if err := c.shared.Delete(keys...); err != nil {
+		log.Printf("bookcache: could not delete %v: %v", keys, err)
+	}
+}
+
+// Invalidate drops the cached copies of a book, and the list it appears in,
+// after it was changed by another process.
+func (c *CachedDB) Invalidate(id int64) {
+	c.invalidate(bookCacheKey(id), listCacheKey)
+}
+
+// ListBooks returns the cached list of books, loading it on a miss.
+func (c *CachedDB) ListBooks() ([]*Book, error) {
+	if v, ok := c.getLocal(listCacheKey); ok {
+		cacheStats.Add("hits", 1)
+		return copyBooks(v.([]*Book)), nil
+	}
+	gen := c.generation()
+	var books []*Book
+	if c.getShared(listCacheKey, &books) {
+		cacheStats.Add("shared_hits", 1)
+	} else {
+		cacheStats.Add("misses", 1)
+		var err error
+		if books, err = c.BookDatabase.ListBooks(); err != nil {
+			return nil, err
+		}
+		c.setShared(listCacheKey, books, gen)
+	}
+	c.setLocal(listCacheKey, copyBooks(books), gen)
+	return books, nil
+}
+
+// GetBook returns the cached book, loading it on a miss. Missing books are
+// not cached.
+func (c *CachedDB) GetBook(id int64) (*Book, error) {
+	key := bookCacheKey(id)
+	if v, ok := c.getLocal(key); ok {
+		cacheStats.Add("hits", 1)
+		return copyBook(v.(*Book)), nil
+	}
+	gen := c.generation()
+	book := &Book{}
+	if c.getShared(key, book) {
+		cacheStats.Add("shared_hits", 1)
+	} else {
+		cacheStats.Add("misses", 1)
+		var err error
+		if book, err = c.BookDatabase.GetBook(id); err != nil {
+			return nil, err
+		}
+		c.setShared(key, book, gen)
+	}
+	c.setLocal(key, copyBook(book), gen)
+	return book, nil
+}
+
+// Primary returns a view of the underlying database that bypasses the
+// cache and any read replicas, for a user who has just written.
+func (c *CachedDB) Primary() BookDatabase {
+	return ReadPrimary(c.BookDatabase)
+}
+
+// AddBook adds the book and drops the cached list.
+func (c *CachedDB) AddBook(b *Book, by Actor) (int64, error) {
+	id, err := c.BookDatabase.AddBook(b, by)
+	if err == nil {
+		c.Invalidate(id)
+	}
+	return id, err
+}
+
+// DeleteBook moves the book to the trash and drops its cached copies.
+func (c *CachedDB) DeleteBook(id int64, by Actor) error {
+	err := c.BookDatabase.DeleteBook(id, by)
+	c.Invalidate(id)
+	return err
+}
+
+// RestoreBook restores the book and drops the cached list.
+func (c *CachedDB) RestoreBook(id int64, by Actor) error {
+	err := c.BookDatabase.RestoreBook(id, by)
+	c.Invalidate(id)
+	return err
+}
+
+// MergeBook merges the books and drops the cached copies of both.
+func (c *CachedDB) MergeBook(into *Book, dupID int64, by Actor) error {
+	err := c.BookDatabase.MergeBook(into, dupID, by)
+	c.invalidate(bookCacheKey(into.ID), bookCacheKey(dupID), listCacheKey)
+	return err
+}
+
+// UpdateBook updates the book and drops its cached copies.
+func (c *CachedDB) UpdateBook(b *Book, by Actor) error {
+	err := c.BookDatabase.UpdateBook(b, by)
+	c.Invalidate(b.ID)
+	return err
+}
+
+// SaveReview saves the review and drops the cached copies of its book,
+// whose ratings it changed.
+func (c *CachedDB) SaveReview(r *Review) error {
+	err := c.BookDatabase.SaveReview(r)
+	c.Invalidate(r.BookID)
+	return err
+}
+
+// DeleteReview deletes the review and drops the cached copies of its book.
+func (c *CachedDB) DeleteReview(bookID int64, userID string) error {
+	err := c.BookDatabase.DeleteReview(bookID, userID)
+	c.Invalidate(bookID)
+	return err
+}
@@ -0,0 +1,105 @@
+package bookshelf_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+	"github.com/tony-yang/google-cloud-stack/bookshelf/bookshelftest"
+)
+
+// cacheActor is recorded as having made the changes.
+var cacheActor = bookshelf.Actor{ID: "12345", Name: "Tester", Source: bookshelf.SourceAPI}
+
+func TestCachedDB(t *testing.T) {
+	// A cache smaller than the suite's lists makes it evict as it goes.
+	bookshelftest.TestBookDatabase(t, func(t *testing.T) bookshelf.BookDatabase {
+		return bookshelf.NewCachedDB(newEmptySQLiteDB(t), bookshelf.CacheConfig{Size: 3, TTL: time.Minute})
+	})
+}
+
+// mapCache is a SharedCache in memory.
+type mapCache struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func (m *mapCache) Get(key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.values[key]
+	return b, ok, nil
+}
+
+func (m *mapCache) Set(key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] = value
+	return nil
+}
+
+func (m *mapCache) Delete(keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		delete(m.values, key)
+	}
+	return nil
+}
+
+// racingDB calls during before each read returns, as a write that lands
+// while the cache loads.
+type racingDB struct {
+	bookshelf.BookDatabase
+	during func()
+}
+
+func (db *racingDB) GetBook(id int64) (*bookshelf.Book, error) {
+	b, err := db.BookDatabase.GetBook(id)
+	db.during()
+	return b, err
+}
+
+func (db *racingDB) ListBooks() ([]*bookshelf.Book, error) {
+	books, err := db.BookDatabase.ListBooks()
+	db.during()
+	return books, err
+}
+
+func TestCachedDBSkipsStaleLoads(t *testing.T) {
+	inner := newEmptySQLiteDB(t)
+	defer inner.Close()
+	id, err := inner.AddBook(&bookshelf.Book{Title: "Draft"}, cacheActor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := &mapCache{values: map[string][]byte{}}
+	racing := &racingDB{BookDatabase: inner}
+	c := bookshelf.NewCachedDB(racing, bookshelf.CacheConfig{Size: 10, TTL: time.Minute, Shared: shared})
+	racing.during = func() {
+		if err := c.UpdateBook(&bookshelf.Book{ID: id, Title: "Final"}, cacheActor); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := c.GetBook(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ListBooks(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{bookshelf.BookCacheKey(id), bookshelf.ListCacheKey} {
+		if b, ok, _ := shared.Get(key); ok {
+			t.Errorf("shared cache kept %s loaded before an update: %s", key, b)
+		}
+	}
+
+	racing.during = func() {}
+	if b, err := c.GetBook(id); err != nil || b.Title != "Final" {
+		t.Errorf("GetBook(%d) = %v, %v, want the updated book", id, b, err)
+	}
+	if _, ok, _ := shared.Get(bookshelf.BookCacheKey(id)); !ok {
+		t.Errorf("shared cache did not keep %s loaded without a race", bookshelf.BookCacheKey(id))
+	}
+}
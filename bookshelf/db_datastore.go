@@ -0,0 +1,1118 @@
+package bookshelf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+const (
+	bookKind    = "Book"
+	changeKind  = "BookChange"
+	counterKind = "BookshelfCounter"
+	isbnKind    = "BookISBN"
+	authorKind  = "Author"
+	nameKind    = "AuthorName"
+	schemaKind  = "BookshelfSchema"
+)
+
+// datastoreDB persists books to Cloud Datastore, or Firestore in Datastore
+// mode. The client honours DATASTORE_EMULATOR_HOST, so it runs against the
+// local emulator without a GCP project.
+type datastoreDB struct {
+	client    *datastore.Client
+	namespace string
+}
+
+// Ensure datastoreDB conforms to the BookDatabase interface.
+var _ BookDatabase = &datastoreDB{}
+
+// datastoreBook is the entity stored for a book. TitleSort holds the lower
+// cased title so the built-in single property index orders titles the way
+// the SQL backends do. Fields that are never filtered or sorted on are not
+// indexed.
+//
+// Deleted is stored on every book, so queries can leave out the trash; the
+// books saved before it was are given it by a migration.
+type datastoreBook struct {
+	Title         string
+	TitleSort     string
+	Author        string
+	PublishedDate string `datastore:",noindex"`
+	ImageURL      string `datastore:",noindex"`
+	ISBN10        string `datastore:",noindex,omitempty"`
+	ISBN13        string `datastore:",noindex,omitempty"`
+	Contributors  []datastoreContributor
+	Tags          []string
+	Genres        []string
+	Description   string `datastore:",noindex"`
+	CreatedBy     string `datastore:",noindex"`
+	CreatedByID   string
+	Deleted       bool
+	DeletedAt     time.Time `datastore:",noindex,omitempty"`
+	DeletedBy     string    `datastore:",noindex,omitempty"`
+	DeletedByID   string    `datastore:",noindex,omitempty"`
+	RatingCount   int       `datastore:",noindex"`
+	RatingSum     int       `datastore:",noindex"`
+	CreatedAt     time.Time `datastore:",noindex,omitempty"`
+	UpdatedAt     time.Time `datastore:",noindex,omitempty"`
+}
+
+// datastoreChange is the entity stored for a BookChange. It is a child of
+// the book's key, so a book's history is read with a strongly consistent
+// ancestor query, and outlives the book when it is purged. Seq is the
+// change ID, from the changeKind counter, kept as a property so the audit
+// log is ordered by the built-in index.
+type datastoreChange struct {
+	Seq       int64
+	BookID    int64
+	Action    string
+	ActorID   string
+	ActorName string `datastore:",noindex"`
+	Source    string
+	Time      time.Time
+	Diff      string `datastore:",noindex"`
+}
+
+func (e *datastoreChange) change() (*BookChange, error) {
+	diff, err := decodeDiff(e.Diff)
+	if err != nil {
+		return nil, err
+	}
+	return &BookChange{
+		ID:     e.Seq,
+		BookID: e.BookID,
+		Action: e.Action,
+		Actor:  Actor{ID: e.ActorID, Name: e.ActorName, Source: e.Source},
+		Time:   e.Time.UTC(),
+		Diff:   diff,
+	}, nil
+}
+
+// datastoreContributor is stored in the book's entity. AuthorID is
+// indexed, so the books of an author are found by a query on
+// Contributors.AuthorID.
+type datastoreContributor struct {
+	AuthorID int64
+	Name     string `datastore:",noindex"`
+	Role     string `datastore:",noindex"`
+}
+
+// datastoreAuthor is the entity stored for an author. A datastoreAuthorName
+// keyed by NameKey points to it, the way the unique index on nameKey works
+// in the SQL backends.
+type datastoreAuthor struct {
+	Name    string `datastore:",noindex"`
+	NameKey string `datastore:",noindex"`
+}
+
+type datastoreAuthorName struct {
+	AuthorID int64 `datastore:",noindex"`
+}
+
+// datastoreSchema records how many of datastoreMigrations have run.
+type datastoreSchema struct {
+	Version int `datastore:",noindex"`
+}
+
+// datastoreISBN claims an ISBN-13 for a book. Its key is the ISBN, so the
+// claim is read and written inside the transactions that save books, which
+// keeps ISBNs unique the way a unique index does.
+type datastoreISBN struct {
+	BookID int64 `datastore:",noindex"`
+}
+
+// datastoreCounter hands out increasing IDs, the way AUTO_INCREMENT does.
+type datastoreCounter struct {
+	Next int64 `datastore:",noindex"`
+}
+
+func toDatastoreBook(b *Book) *datastoreBook {
+	return &datastoreBook{
+		Title:         b.Title,
+		TitleSort:     strings.ToLower(b.Title),
+		Author:        b.Author,
+		ImageURL:      b.ImageURL,
+		ISBN10:        b.ISBN10,
+		ISBN13:        b.ISBN13,
+		Contributors:  toDatastoreContributors(b.Contributors),
+		Tags:          b.Tags,
+		Genres:        b.Genres,
+		Description:   b.Description,
+		PublishedDate: b.PublishedDate,
+	}
+}
+
+func toDatastoreContributors(cs []Contributor) []datastoreContributor {
+	var dcs []datastoreContributor
+	for _, c := range cs {
+		dcs = append(dcs, datastoreContributor{AuthorID: c.AuthorID, Name: c.Name, Role: c.Role})
+	}
+	return dcs
+}
+
+func (e *datastoreBook) book(id int64) *Book {
+	b := &Book{
+		ID:       id,
+		Title:    e.Title,
+		Author:   e.Author,
+		ImageURL: e.ImageURL,
+		ISBN10:   e.ISBN10,
+		ISBN13:   e.ISBN13,
+		Tags:     e.Tags,
+		Genres:   e.Genres,
+
+		Description:   e.Description,
+		PublishedDate: e.PublishedDate,
+
+		RatingCount: e.RatingCount,
+		RatingSum:   e.RatingSum,
+
+		CreatedAt: e.CreatedAt,
+		UpdatedAt: e.UpdatedAt,
+	}
+	for _, c := range e.Contributors {
+		b.Contributors = append(b.Contributors, Contributor{AuthorID: c.AuthorID, Name: c.Name, Role: c.Role})
+	}
+	if e.Deleted {
+		b.DeletedAt = e.DeletedAt.UTC()
+		b.DeletedBy = e.DeletedBy
+		b.DeletedByID = e.DeletedByID
+	}
+	return b
+}
+
+func (db *datastoreDB) key(kind string, id int64) *datastore.Key {
+	k := datastore.IDKey(kind, id, nil)
+	k.Namespace = db.namespace
+	return k
+}
+
+func (db *datastoreDB) changeKey(bookID, seq int64) *datastore.Key {
+	k := datastore.IDKey(changeKind, seq, db.key(bookKind, bookID))
+	k.Namespace = db.namespace
+	return k
+}
+
+func (db *datastoreDB) counterKey(name string) *datastore.Key {
+	k := datastore.NameKey(counterKind, name, nil)
+	k.Namespace = db.namespace
+	return k
+}
+
+func (db *datastoreDB) isbnKey(isbn13 string) *datastore.Key {
+	k := datastore.NameKey(isbnKind, isbn13, nil)
+	k.Namespace = db.namespace
+	return k
+}
+
+// errISBNTaken aborts a transaction that would give two books one ISBN.
+var errISBNTaken = errors.New("ISBN is taken by another book")
+
+// claimISBN records inside tx that the book with id has isbn13, failing
+// with errISBNTaken if another book has it. An empty ISBN claims nothing.
+func (db *datastoreDB) claimISBN(tx *datastore.Transaction, isbn13 string, id int64) error {
+	if isbn13 == "" {
+		return nil
+	}
+	var c datastoreISBN
+	k := db.isbnKey(isbn13)
+	if err := tx.Get(k, &c); err == nil && c.BookID != id {
+		return errISBNTaken
+	} else if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	_, err := tx.Put(k, &datastoreISBN{BookID: id})
+	return err
+}
+
+// releaseISBN drops the claim on isbn13 inside tx.
+func (db *datastoreDB) releaseISBN(tx *datastore.Transaction, isbn13 string) error {
+	if isbn13 == "" {
+		return nil
+	}
+	return tx.Delete(db.isbnKey(isbn13))
+}
+
+func (db *datastoreDB) nameKey(key string) *datastore.Key {
+	k := datastore.NameKey(nameKind, key, nil)
+	k.Namespace = db.namespace
+	return k
+}
+
+// resolveContributors sets the author IDs of cs inside tx, adding the
+// authors that are new. Names are matched as normalized by NormalizeAuthor
+// and replaced by the author's name as first written. A transaction does
+// not read its own writes, so the new authors are collected first and get
+// their IDs from one reservation, and a name given twice is added once.
+func (db *datastoreDB) resolveContributors(tx *datastore.Transaction, cs []Contributor) error {
+	added := map[string][]int{} // indexes into cs, by the key of a new name
+	var keys []string
+	for i := range cs {
+		key := NormalizeAuthor(cs[i].Name)
+		if _, ok := added[key]; ok {
+			added[key] = append(added[key], i)
+			continue
+		}
+		var n datastoreAuthorName
+		err := tx.Get(db.nameKey(key), &n)
+		if err == nil {
+			var a datastoreAuthor
+			if err := tx.Get(db.key(authorKind, n.AuthorID), &a); err != nil {
+				return err
+			}
+			cs[i].AuthorID, cs[i].Name = n.AuthorID, a.Name
+			continue
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		added[key] = []int{i}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	id, err := db.nextIDs(tx, authorKind, len(keys))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		first := added[key][0]
+		if _, err := tx.Put(db.key(authorKind, id), &datastoreAuthor{Name: cs[first].Name, NameKey: key}); err != nil {
+			return err
+		}
+		if _, err := tx.Put(db.nameKey(key), &datastoreAuthorName{AuthorID: id}); err != nil {
+			return err
+		}
+		for _, i := range added[key] {
+			cs[i].AuthorID, cs[i].Name = id, cs[first].Name
+		}
+		id++
+	}
+	return nil
+}
+
+func (db *datastoreDB) query(kind string) *datastore.Query {
+	return datastore.NewQuery(kind).Namespace(db.namespace)
+}
+
+// nextID increments the named counter inside tx and returns its new value.
+// It may only be called once per counter in a transaction, which would
+// otherwise read the same value again; see nextIDs.
+func (db *datastoreDB) nextID(tx *datastore.Transaction, name string) (int64, error) {
+	return db.nextIDs(tx, name, 1)
+}
+
+// nextIDs reserves n IDs from the named counter inside tx and returns the
+// first; the others follow it.
+func (db *datastoreDB) nextIDs(tx *datastore.Transaction, name string, n int) (int64, error) {
+	var c datastoreCounter
+	k := db.counterKey(name)
+	if err := tx.Get(k, &c); err != nil && err != datastore.ErrNoSuchEntity {
+		return 0, err
+	}
+	first := c.Next + 1
+	c.Next += int64(n)
+	if _, err := tx.Put(k, &c); err != nil {
+		return 0, err
+	}
+	return first, nil
+}
+
+// recordChange appends a change to a book's history inside tx. Its ID comes
+// from a counter in the same transaction, so IDs follow the order changes
+// commit in whichever process makes them, and stay small enough for JSON
+// clients to read exactly.
+func (db *datastoreDB) recordChange(tx *datastore.Transaction, bookID int64, action string, by Actor, diff []FieldChange) error {
+	seq, err := db.nextID(tx, changeKind)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Put(db.changeKey(bookID, seq), &datastoreChange{
+		Seq:       seq,
+		BookID:    bookID,
+		Action:    action,
+		ActorID:   by.ID,
+		ActorName: by.Name,
+		Source:    by.Source,
+		Time:      now(),
+		Diff:      encodeDiff(diff),
+	})
+	return err
+}
+
+// runInTransaction runs f in a transaction, retrying on contention. Every
+// change to a book writes the same counter, so concurrent changes can
+// collide.
+func (db *datastoreDB) runInTransaction(f func(tx *datastore.Transaction) error) error {
+	_, err := db.client.RunInTransaction(context.Background(), f, datastore.MaxAttempts(10))
+	return err
+}
+
+// ListBooks lists all books outside the trash, ordered by title. Like
+// ListAuthorBooks, it sorts here rather than need a composite index.
+func (db *datastoreDB) ListBooks() ([]*Book, error) {
+	var entities []*datastoreBook
+	keys, err := db.client.GetAll(context.Background(), db.query(bookKind).Filter("Deleted =", false), &entities)
+	if err != nil {
+		return nil, fmt.Errorf("datastore: could not list books: %v", err)
+	}
+	books := make([]*Book, len(entities))
+	sortKeys := make(map[*Book]string)
+	for i, e := range entities {
+		books[i] = e.book(keys[i].ID)
+		sortKeys[books[i]] = e.TitleSort
+	}
+	sort.SliceStable(books, func(i, j int) bool { return sortKeys[books[i]] < sortKeys[books[j]] })
+	return books, nil
+}
+
+// SearchBooks lists the books whose title or author contains query, ordered
+// by title. Datastore has no substring queries, so the books are filtered
+// in memory; that is fine at the sizes this backend is meant for.
+func (db *datastoreDB) SearchBooks(query string) ([]*Book, error) {
+	books, err := db.ListBooks()
+	if err != nil {
+		return nil, err
+	}
+	q := strings.ToLower(query)
+	var matches []*Book
+	for _, b := range books {
+		if strings.Contains(strings.ToLower(b.Title), q) || strings.Contains(strings.ToLower(b.Author), q) {
+			matches = append(matches, b)
+		}
+	}
+	return matches, nil
+}
+
+// FilterBooks lists the books f selects, ordered by title. Tags and genres
+// are filtered by the query, the rest like SearchBooks. Like
+// ListAuthorBooks, it sorts here rather than need a composite index.
+func (db *datastoreDB) FilterBooks(f BookFilter) ([]*Book, error) {
+	q := db.query(bookKind).Filter("Deleted =", false)
+	if tag := NormalizeTag(f.Tag); tag != "" {
+		q = q.Filter("Tags =", tag)
+	}
+	if genre := NormalizeTag(f.Genre); genre != "" {
+		q = q.Filter("Genres =", genre)
+	}
+	var entities []*datastoreBook
+	keys, err := db.client.GetAll(context.Background(), q, &entities)
+	if err != nil {
+		return nil, fmt.Errorf("datastore: could not filter books: %v", err)
+	}
+	query := strings.ToLower(f.Query)
+	var books []*Book
+	sortKeys := make(map[*Book]string)
+	for i, e := range entities {
+		if strings.Contains(strings.ToLower(e.Title), query) || strings.Contains(strings.ToLower(e.Author), query) {
+			b := e.book(keys[i].ID)
+			books = append(books, b)
+			sortKeys[b] = e.TitleSort
+		}
+	}
+	sort.SliceStable(books, func(i, j int) bool { return sortKeys[books[i]] < sortKeys[books[j]] })
+	switch f.Sort {
+	case SortRating:
+		sortByRating(books)
+	case SortNewest, SortUpdated:
+		SortRecent(books, f.Sort)
+	}
+	return books, nil
+}
+
+// TagCloud counts the books with each tag and genre. Datastore cannot
+// group, so the books are counted here.
+func (db *datastoreDB) TagCloud() (*TagCloud, error) {
+	var entities []*datastoreBook
+	if _, err := db.client.GetAll(context.Background(), db.query(bookKind).Filter("Deleted =", false), &entities); err != nil {
+		return nil, fmt.Errorf("datastore: could not count tags: %v", err)
+	}
+	tags, genres := make(map[string]int), make(map[string]int)
+	for _, e := range entities {
+		for _, t := range e.Tags {
+			tags[t]++
+		}
+		for _, g := range e.Genres {
+			genres[g]++
+		}
+	}
+	counts := func(m map[string]int) []TagCount {
+		var cs []TagCount
+		for t, n := range m {
+			cs = append(cs, TagCount{Tag: t, Count: n})
+		}
+		sort.Slice(cs, func(i, j int) bool { return cs[i].Tag < cs[j].Tag })
+		return cs
+	}
+	return &TagCloud{Tags: counts(tags), Genres: counts(genres)}, nil
+}
+
+// GetBook retrieves a book by its ID.
+func (db *datastoreDB) GetBook(id int64) (*Book, error) {
+	e := &datastoreBook{}
+	err := db.client.Get(context.Background(), db.key(bookKind, id), e)
+	if err == datastore.ErrNoSuchEntity || err == nil && e.Deleted {
+		return nil, fmt.Errorf("datastore: could not find book with id %d: %w", id, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("datastore: could not get book: %v", err)
+	}
+	return e.book(id), nil
+}
+
+// GetBookByISBN retrieves a book by its ISBN-10 or ISBN-13. The ISBN's
+// claim is looked up by key, which is strongly consistent where a query on
+// the ISBN13 property is not.
+func (db *datastoreDB) GetBookByISBN(isbn string) (*Book, error) {
+	_, isbn13, err := NormalizeISBN(isbn)
+	if err != nil {
+		return nil, err
+	}
+	var c datastoreISBN
+	err = db.client.Get(context.Background(), db.isbnKey(isbn13), &c)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("datastore: could not find book with ISBN %s: %w", isbn13, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("datastore: could not get book: %v", err)
+	}
+	return db.GetBook(c.BookID)
+}
+
+// AddBook saves a given book, assigning it a new ID
+func (db *datastoreDB) AddBook(b *Book, by Actor) (id int64, err error) {
+	if err := b.normalize(); err != nil {
+		return -1, err
+	}
+	if err := b.normalizeContributors(nil); err != nil {
+		return -1, err
+	}
+	err = db.runInTransaction(func(tx *datastore.Transaction) error {
+		next, err := db.nextID(tx, bookKind)
+		if err != nil {
+			return err
+		}
+		if err := db.claimISBN(tx, b.ISBN13, next); err != nil {
+			return err
+		}
+		if err := db.resolveContributors(tx, b.Contributors); err != nil {
+			return err
+		}
+		e := toDatastoreBook(b)
+		e.CreatedAt = now()
+		e.UpdatedAt = e.CreatedAt
+		if _, err := tx.Put(db.key(bookKind, next), e); err != nil {
+			return err
+		}
+		id = next
+		return db.recordChange(tx, id, ChangeCreate, by, diffBooks(nil, b))
+	})
+	if err == errISBNTaken {
+		return -1, fmt.Errorf("datastore: could not add book: ISBN %s is taken: %w", b.ISBN13, ErrConflict)
+	} else if err != nil {
+		return -1, fmt.Errorf("datastore: could not add book: %v", err)
+	}
+	return id, nil
+}
+
+// DeleteBook moves a given book to the trash
+func (db *datastoreDB) DeleteBook(id int64, by Actor) error {
+	if id == 0 {
+		return fmt.Errorf("datastore: book with unassigned ID passed into deleteBook: %w", ErrInvalid)
+	}
+	err := db.runInTransaction(func(tx *datastore.Transaction) error {
+		k := db.key(bookKind, id)
+		e := &datastoreBook{}
+		if err := tx.Get(k, e); err != nil {
+			return err
+		}
+		if e.Deleted {
+			return datastore.ErrNoSuchEntity
+		}
+		e.Deleted = true
+		e.DeletedAt = now()
+		e.DeletedBy = by.Name
+		e.DeletedByID = by.ID
+		if _, err := tx.Put(k, e); err != nil {
+			return err
+		}
+		return db.recordChange(tx, id, ChangeDelete, by, nil)
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return fmt.Errorf("datastore: could not find book with id %d: %w", id, ErrNotFound)
+	} else if err != nil {
+		return fmt.Errorf("datastore: could not delete book: %v", err)
+	}
+	return nil
+}
+
+// deletedBooks returns the books in the trash, most recently deleted first.
+// Sorting them here saves a composite index on Deleted and DeletedAt.
+func (db *datastoreDB) deletedBooks() ([]*Book, error) {
+	var entities []*datastoreBook
+	keys, err := db.client.GetAll(context.Background(), db.query(bookKind).Filter("Deleted =", true), &entities)
+	if err != nil {
+		return nil, err
+	}
+	books := make([]*Book, len(entities))
+	for i, e := range entities {
+		books[i] = e.book(keys[i].ID)
+	}
+	sort.Slice(books, func(i, j int) bool {
+		if !books[i].DeletedAt.Equal(books[j].DeletedAt) {
+			return books[i].DeletedAt.After(books[j].DeletedAt)
+		}
+		return books[i].ID > books[j].ID
+	})
+	return books, nil
+}
+
+// ListDeletedBooks lists the books in the trash, most recently deleted
+// first.
+func (db *datastoreDB) ListDeletedBooks() ([]*Book, error) {
+	books, err := db.deletedBooks()
+	if err != nil {
+		return nil, fmt.Errorf("datastore: could not list deleted books: %v", err)
+	}
+	return books, nil
+}
+
+// RestoreBook takes a given book out of the trash
+func (db *datastoreDB) RestoreBook(id int64, by Actor) error {
+	err := db.runInTransaction(func(tx *datastore.Transaction) error {
+		k := db.key(bookKind, id)
+		e := &datastoreBook{}
+		if err := tx.Get(k, e); err != nil {
+			return err
+		}
+		if !e.Deleted {
+			return datastore.ErrNoSuchEntity
+		}
+		e.Deleted = false
+		e.DeletedAt = time.Time{}
+		e.DeletedBy = ""
+		e.DeletedByID = ""
+		if _, err := tx.Put(k, e); err != nil {
+			return err
+		}
+		return db.recordChange(tx, id, ChangeRestore, by, nil)
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return fmt.Errorf("datastore: could not find deleted book with id %d: %w", id, ErrNotFound)
+	} else if err != nil {
+		return fmt.Errorf("datastore: could not restore book: %v", err)
+	}
+	return nil
+}
+
+// purge deletes the given book, its readings, reviews and its copies,
+// loans and holds inside tx if it is in the trash, and returns it. Its
+// history is kept.
+func (db *datastoreDB) purge(tx *datastore.Transaction, id int64, by Actor) (*Book, error) {
+	k := db.key(bookKind, id)
+	e := &datastoreBook{}
+	if err := tx.Get(k, e); err != nil {
+		return nil, err
+	}
+	if !e.Deleted {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	if err := tx.Delete(k); err != nil {
+		return nil, err
+	}
+	if err := db.releaseISBN(tx, e.ISBN13); err != nil {
+		return nil, err
+	}
+	if err := db.purgeReadings(tx, k); err != nil {
+		return nil, err
+	}
+	if err := db.purgeLending(tx, k); err != nil {
+		return nil, err
+	}
+	if err := db.purgeReviews(tx, k); err != nil {
+		return nil, err
+	}
+	if err := db.recordChange(tx, id, ChangePurge, by, nil); err != nil {
+		return nil, err
+	}
+	return e.book(id), nil
+}
+
+// PurgeBook permanently removes a given book from the trash
+func (db *datastoreDB) PurgeBook(id int64, by Actor) (*Book, error) {
+	var book *Book
+	err := db.runInTransaction(func(tx *datastore.Transaction) error {
+		var err error
+		book, err = db.purge(tx, id, by)
+		return err
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("datastore: could not find deleted book with id %d: %w", id, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("datastore: could not purge book: %v", err)
+	}
+	return book, nil
+}
+
+// PurgeDeletedBooks permanently removes the books deleted before a given
+// time. Each book is purged in its own transaction, so one restored
+// meanwhile is left alone.
+func (db *datastoreDB) PurgeDeletedBooks(before time.Time, by Actor) ([]*Book, error) {
+	trash, err := db.deletedBooks()
+	if err != nil {
+		return nil, fmt.Errorf("datastore: could not list deleted books: %v", err)
+	}
+	var purged []*Book
+	for _, b := range trash {
+		if !b.DeletedAt.Before(before) {
+			continue
+		}
+		var book *Book
+		err := db.runInTransaction(func(tx *datastore.Transaction) error {
+			var err error
+			book, err = db.purge(tx, b.ID, by)
+			return err
+		})
+		if err == datastore.ErrNoSuchEntity {
+			continue
+		} else if err != nil {
+			return purged, fmt.Errorf("datastore: could not purge book: %v", err)
+		}
+		purged = append(purged, book)
+	}
+	return purged, nil
+}
+
+// UpdateBook updates the entry for a given book
+func (db *datastoreDB) UpdateBook(b *Book, by Actor) error {
+	if b.ID == 0 {
+		return fmt.Errorf("datastore: book with unassigned ID passed into updateBook: %w", ErrInvalid)
+	}
+	if err := b.normalize(); err != nil {
+		return err
+	}
+	err := db.runInTransaction(func(tx *datastore.Transaction) error {
+		k := db.key(bookKind, b.ID)
+		e := &datastoreBook{}
+		if err := tx.Get(k, e); err != nil {
+			return err
+		}
+		if e.Deleted {
+			return datastore.ErrNoSuchEntity
+		}
+		old := e.book(b.ID)
+		if err := b.normalizeContributors(old); err != nil {
+			return err
+		}
+		diff := diffBooks(old, b)
+		if len(diff) == 0 {
+			return nil
+		}
+		if err := db.resolveContributors(tx, b.Contributors); err != nil {
+			return err
+		}
+		if e.ISBN13 != b.ISBN13 {
+			if err := db.releaseISBN(tx, e.ISBN13); err != nil {
+				return err
+			}
+			if err := db.claimISBN(tx, b.ISBN13, b.ID); err != nil {
+				return err
+			}
+		}
+		e.Title = b.Title
+		e.TitleSort = strings.ToLower(b.Title)
+		e.Author = b.Author
+		e.ImageURL = b.ImageURL
+		e.ISBN10 = b.ISBN10
+		e.ISBN13 = b.ISBN13
+		e.Contributors = toDatastoreContributors(b.Contributors)
+		e.Tags = b.Tags
+		e.Genres = b.Genres
+		e.Description = b.Description
+		e.PublishedDate = b.PublishedDate
+		e.UpdatedAt = now()
+		if _, err := tx.Put(k, e); err != nil {
+			return err
+		}
+		return db.recordChange(tx, b.ID, ChangeUpdate, by, diff)
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return fmt.Errorf("datastore: could not find book with id %d: %w", b.ID, ErrNotFound)
+	} else if err == errISBNTaken {
+		return fmt.Errorf("datastore: could not update book: ISBN %s is taken: %w", b.ISBN13, ErrConflict)
+	} else if errors.Is(err, ErrInvalid) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("datastore: could not update book: %v", err)
+	}
+	return nil
+}
+
+// MergeBook saves into, moves the history, readings, lending records and
+// reviews of the book with dupID to it and removes that book. These are
+// children of their book's key, so each is written again under the kept
+// book; a transaction holds at most 500 writes, which bounds the history a
+// merged duplicate can have.
+func (db *datastoreDB) MergeBook(into *Book, dupID int64, by Actor) error {
+	if into.ID == 0 || dupID == 0 || into.ID == dupID {
+		return fmt.Errorf("datastore: cannot merge book %d into book %d: %w", dupID, into.ID, ErrInvalid)
+	}
+	if err := into.normalize(); err != nil {
+		return err
+	}
+	err := db.runInTransaction(func(tx *datastore.Transaction) error {
+		k, dk := db.key(bookKind, into.ID), db.key(bookKind, dupID)
+		e, de := &datastoreBook{}, &datastoreBook{}
+		if err := tx.Get(k, e); err != nil {
+			return err
+		}
+		if err := tx.Get(dk, de); err != nil {
+			return err
+		}
+		if e.Deleted || de.Deleted {
+			return datastore.ErrNoSuchEntity
+		}
+		old := e.book(into.ID)
+		if err := into.normalizeContributors(old); err != nil {
+			return err
+		}
+		if err := db.resolveContributors(tx, into.Contributors); err != nil {
+			return err
+		}
+
+		var changes []*datastoreChange
+		q := db.query(changeKind).Ancestor(dk).Transaction(tx)
+		keys, err := db.client.GetAll(context.Background(), q, &changes)
+		if err != nil {
+			return err
+		}
+		for i, c := range changes {
+			c.BookID = into.ID
+			if _, err := tx.Put(db.changeKey(into.ID, c.Seq), c); err != nil {
+				return err
+			}
+			if err := tx.Delete(keys[i]); err != nil {
+				return err
+			}
+		}
+		if err := db.moveReadings(tx, k, dk); err != nil {
+			return err
+		}
+		if err := db.moveLending(tx, k, dk); err != nil {
+			return err
+		}
+		if err := db.moveReviews(tx, k, dk, e); err != nil {
+			return err
+		}
+		if err := tx.Delete(dk); err != nil {
+			return err
+		}
+		// A transaction reads what was committed before it, so the claim
+		// on an ISBN moving over from the duplicate is handed over rather
+		// than released and claimed again, which would find it taken.
+		if de.ISBN13 != into.ISBN13 {
+			if err := db.releaseISBN(tx, de.ISBN13); err != nil {
+				return err
+			}
+		}
+
+		diff := append(diffBooks(old, into), FieldChange{Field: mergedFromField, New: strconv.FormatInt(dupID, 10)})
+		if e.ISBN13 != into.ISBN13 {
+			if err := db.releaseISBN(tx, e.ISBN13); err != nil {
+				return err
+			}
+			if into.ISBN13 != "" && into.ISBN13 == de.ISBN13 {
+				if _, err := tx.Put(db.isbnKey(into.ISBN13), &datastoreISBN{BookID: into.ID}); err != nil {
+					return err
+				}
+			} else if err := db.claimISBN(tx, into.ISBN13, into.ID); err != nil {
+				return err
+			}
+		}
+		e.Title = into.Title
+		e.TitleSort = strings.ToLower(into.Title)
+		e.Author = into.Author
+		e.ImageURL = into.ImageURL
+		e.ISBN10 = into.ISBN10
+		e.ISBN13 = into.ISBN13
+		e.Contributors = toDatastoreContributors(into.Contributors)
+		e.Tags = into.Tags
+		e.Genres = into.Genres
+		e.Description = into.Description
+		e.PublishedDate = into.PublishedDate
+		e.UpdatedAt = now()
+		if _, err := tx.Put(k, e); err != nil {
+			return err
+		}
+		return db.recordChange(tx, into.ID, ChangeMerge, by, diff)
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return fmt.Errorf("datastore: could not find books %d and %d: %w", into.ID, dupID, ErrNotFound)
+	} else if err == errISBNTaken {
+		return fmt.Errorf("datastore: could not merge books: ISBN %s is taken: %w", into.ISBN13, ErrConflict)
+	} else if errors.Is(err, ErrInvalid) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("datastore: could not merge books: %v", err)
+	}
+	return nil
+}
+
+// BookHistory lists the changes made to a given book, newest first.
+func (db *datastoreDB) BookHistory(id int64) ([]*BookChange, error) {
+	var entities []*datastoreChange
+	// Sorting here saves a composite index for the ancestor query.
+	q := db.query(changeKind).Ancestor(db.key(bookKind, id))
+	if _, err := db.client.GetAll(context.Background(), q, &entities); err != nil {
+		return nil, fmt.Errorf("datastore: could not get history of book %d: %v", id, err)
+	}
+	changes := make([]*BookChange, len(entities))
+	for i, e := range entities {
+		c, err := e.change()
+		if err != nil {
+			return nil, fmt.Errorf("datastore: could not get history of book %d: %v", id, err)
+		}
+		changes[i] = c
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].ID > changes[j].ID })
+	return changes, nil
+}
+
+// auditBatch is how many changes AuditLog reads at a time while filtering.
+const auditBatch = 500
+
+// AuditLog lists the changes selected by q, newest first. The changes are
+// read newest first and filtered in memory, which saves a composite index
+// for every combination of filters.
+func (db *datastoreDB) AuditLog(q AuditQuery) ([]*BookChange, error) {
+	var changes []*BookChange
+	before := q.BeforeID
+	for len(changes) < q.limit() {
+		query := db.query(changeKind).Order("-Seq").Limit(auditBatch)
+		if before != 0 {
+			query = query.Filter("Seq <", before)
+		}
+		var entities []*datastoreChange
+		if _, err := db.client.GetAll(context.Background(), query, &entities); err != nil {
+			return nil, fmt.Errorf("datastore: could not query audit log: %v", err)
+		}
+		for _, e := range entities {
+			c, err := e.change()
+			if err != nil {
+				return nil, fmt.Errorf("datastore: could not query audit log: %v", err)
+			}
+			if q.matches(c) && len(changes) < q.limit() {
+				changes = append(changes, c)
+			}
+		}
+		if len(entities) < auditBatch {
+			break
+		}
+		before = entities[len(entities)-1].Seq
+	}
+	return changes, nil
+}
+
+// GetAuthor retrieves an author by ID.
+func (db *datastoreDB) GetAuthor(id int64) (*Author, error) {
+	var e datastoreAuthor
+	err := db.client.Get(context.Background(), db.key(authorKind, id), &e)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("datastore: could not find author with id %d: %w", id, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("datastore: could not get author: %v", err)
+	}
+	return &Author{ID: id, Name: e.Name}, nil
+}
+
+// ListAuthorBooks lists the books an author contributed to, ordered by
+// title. Like deletedBooks, it sorts here rather than need a composite
+// index.
+func (db *datastoreDB) ListAuthorBooks(authorID int64) ([]*Book, error) {
+	var entities []*datastoreBook
+	q := db.query(bookKind).Filter("Contributors.AuthorID =", authorID).Filter("Deleted =", false)
+	keys, err := db.client.GetAll(context.Background(), q, &entities)
+	if err != nil {
+		return nil, fmt.Errorf("datastore: could not list books of author %d: %v", authorID, err)
+	}
+	books := make([]*Book, len(entities))
+	sortKeys := make(map[*Book]string)
+	for i, e := range entities {
+		books[i] = e.book(keys[i].ID)
+		sortKeys[books[i]] = e.TitleSort
+	}
+	sort.SliceStable(books, func(i, j int) bool { return sortKeys[books[i]] < sortKeys[books[j]] })
+	return books, nil
+}
+
+// SearchAuthors lists the authors with a word of their name starting with
+// prefix, ordered by name. Datastore has no prefix match on words, so the
+// authors are filtered here; there are far fewer of them than books.
+func (db *datastoreDB) SearchAuthors(prefix string, limit int) ([]*Author, error) {
+	if limit <= 0 {
+		limit = DefaultAuthorSearchLimit
+	}
+	ctx := context.Background()
+	var entities []*datastoreAuthor
+	keys, err := db.client.GetAll(ctx, db.query(authorKind), &entities)
+	if err != nil {
+		return nil, fmt.Errorf("datastore: could not search authors: %v", err)
+	}
+	p := normalizeText(prefix)
+	var matches []int
+	for i, e := range entities {
+		if strings.HasPrefix(e.NameKey, p) || strings.Contains(e.NameKey, " "+p) {
+			matches = append(matches, i)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return entities[matches[i]].NameKey < entities[matches[j]].NameKey })
+
+	var authors []*Author
+	for _, i := range matches {
+		if len(authors) == limit {
+			break
+		}
+		// Authors outlive their books; leave out those with none left.
+		q := db.query(bookKind).Filter("Contributors.AuthorID =", keys[i].ID).KeysOnly().Limit(1)
+		books, err := db.client.GetAll(ctx, q, nil)
+		if err != nil {
+			return nil, fmt.Errorf("datastore: could not search authors: %v", err)
+		}
+		if len(books) > 0 {
+			authors = append(authors, &Author{ID: keys[i].ID, Name: entities[i].Name})
+		}
+	}
+	return authors, nil
+}
+
+// datastoreMigrations fill in data that books saved by older versions
+// lack. Datastore has no schema to change, but like the SQL migrations they
+// are numbered, by their position, and run once each when the database is
+// opened. The version reached is recorded in a schema entity. A migration
+// can be run twice by processes starting together, so each must be safe to
+// repeat.
+var datastoreMigrations = []func(db *datastoreDB) error{
+	(*datastoreDB).splitAuthorStrings,
+	(*datastoreDB).storeDeletedFlags,
+}
+
+// migrate runs the migrations not yet recorded as run.
+func (db *datastoreDB) migrate() error {
+	ctx := context.Background()
+	k := datastore.NameKey(schemaKind, "version", nil)
+	k.Namespace = db.namespace
+	var s datastoreSchema
+	if err := db.client.Get(ctx, k, &s); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	for v := s.Version; v < len(datastoreMigrations); v++ {
+		if err := datastoreMigrations[v](db); err != nil {
+			return fmt.Errorf("migration %d: %v", v+1, err)
+		}
+		if _, err := db.client.Put(ctx, k, &datastoreSchema{Version: v + 1}); err != nil {
+			return err
+		}
+		log.Printf("datastore: migrated to version %d", v+1)
+	}
+	return nil
+}
+
+// splitAuthorStrings sets the contributors of the books saved before there
+// were any, by parsing their author strings. Each book is updated in a
+// transaction of its own.
+func (db *datastoreDB) splitAuthorStrings() error {
+	keys, err := db.client.GetAll(context.Background(), db.query(bookKind).KeysOnly(), nil)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		err := db.runInTransaction(func(tx *datastore.Transaction) error {
+			e := &datastoreBook{}
+			if err := tx.Get(k, e); err != nil {
+				return err
+			}
+			if len(e.Contributors) > 0 || e.Author == "" {
+				return nil
+			}
+			cs := ParseContributors(e.Author)
+			if err := db.resolveContributors(tx, cs); err != nil {
+				return err
+			}
+			e.Contributors = toDatastoreContributors(cs)
+			_, err := tx.Put(k, e)
+			return err
+		})
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return fmt.Errorf("book %d: %v", k.ID, err)
+		}
+	}
+	return nil
+}
+
+// storeDeletedFlags saves the books written when Deleted was left out
+// unless set, so queries for books outside the trash find them. Each book
+// is saved in a transaction of its own.
+func (db *datastoreDB) storeDeletedFlags() error {
+	keys, err := db.client.GetAll(context.Background(), db.query(bookKind).KeysOnly(), nil)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		err := db.runInTransaction(func(tx *datastore.Transaction) error {
+			e := &datastoreBook{}
+			if err := tx.Get(k, e); err != nil {
+				return err
+			}
+			_, err := tx.Put(k, e)
+			return err
+		})
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return fmt.Errorf("book %d: %v", k.ID, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the database, freeing up resources
+func (db *datastoreDB) Close() {
+	db.client.Close()
+}
+
+// DatastoreConfig describes a Datastore database.
+type DatastoreConfig struct {
+	// ProjectID of the Datastore database. The emulator accepts any ID.
+	ProjectID string
+
+	// Namespace keeps the books apart from other data in the project.
+	// Tests use a fresh namespace to start from an empty database.
+	Namespace string
+}
+
+// newDatastoreDB creates a new BookDatabase backed by Cloud Datastore.
+func newDatastoreDB(config DatastoreConfig) (BookDatabase, error) {
+	ctx := context.Background()
+	client, err := datastore.NewClient(ctx, config.ProjectID)
+	if err != nil {
+		return nil, fmt.Errorf("datastore: could not create client: %v", err)
+	}
+	db := &datastoreDB{
+		client:    client,
+		namespace: config.Namespace,
+	}
+	// Verify that we can communicate and authenticate with the service.
+	if err := client.Get(ctx, db.counterKey(bookKind), &datastoreCounter{}); err != nil && err != datastore.ErrNoSuchEntity {
+		client.Close()
+		return nil, fmt.Errorf("datastore: could not connect: %v", err)
+	}
+	if err := db.migrate(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("datastore: could not migrate: %v", err)
+	}
+	return db, nil
+}
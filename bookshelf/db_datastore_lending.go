@@ -0,0 +1,520 @@
+package bookshelf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+const (
+	copyKind = "BookCopy"
+	loanKind = "Loan"
+	holdKind = "Hold"
+)
+
+// Copies, loans and holds are children of their book's key, so the
+// transactions that lend a book read them with ancestor queries, and they
+// go with the book when it is purged or merged. Copy and loan IDs come
+// from counters, so they stay unique when moved to another book.
+
+type datastoreCopy struct {
+	Label   string    `datastore:",noindex"`
+	AddedAt time.Time `datastore:",noindex"`
+}
+
+// datastoreLoan is the entity stored for a Loan. Open is indexed along
+// with UserID, so open loans and a user's loans are found by equality
+// filters alone, which the built-in indexes serve.
+type datastoreLoan struct {
+	CopyID       int64 `datastore:",noindex"`
+	UserID       string
+	UserName     string `datastore:",noindex"`
+	Open         bool
+	CheckedOutAt time.Time `datastore:",noindex"`
+	DueAt        time.Time `datastore:",noindex"`
+	ReturnedAt   time.Time `datastore:",noindex,omitempty"`
+	OverdueAt    time.Time `datastore:",noindex,omitempty"`
+}
+
+// datastoreHold is the entity stored for a Hold, named by the user ID.
+// Seq orders the queue.
+type datastoreHold struct {
+	Seq      int64     `datastore:",noindex"`
+	UserName string    `datastore:",noindex"`
+	PlacedAt time.Time `datastore:",noindex"`
+}
+
+func (e *datastoreLoan) loan(k *datastore.Key) *Loan {
+	l := &Loan{
+		ID:           k.ID,
+		CopyID:       e.CopyID,
+		BookID:       k.Parent.ID,
+		UserID:       e.UserID,
+		UserName:     e.UserName,
+		CheckedOutAt: e.CheckedOutAt.UTC(),
+		DueAt:        e.DueAt.UTC(),
+	}
+	if !e.ReturnedAt.IsZero() {
+		l.ReturnedAt = e.ReturnedAt.UTC()
+	}
+	if !e.OverdueAt.IsZero() {
+		l.OverdueAt = e.OverdueAt.UTC()
+	}
+	return l
+}
+
+func (db *datastoreDB) childKey(kind string, bookID, id int64) *datastore.Key {
+	k := datastore.IDKey(kind, id, db.key(bookKind, bookID))
+	k.Namespace = db.namespace
+	return k
+}
+
+func (db *datastoreDB) holdKey(bookID int64, userID string) *datastore.Key {
+	k := datastore.NameKey(holdKind, userID, db.key(bookKind, bookID))
+	k.Namespace = db.namespace
+	return k
+}
+
+// liveBook fails with datastore.ErrNoSuchEntity inside tx unless the book
+// with id exists outside the trash.
+func (db *datastoreDB) liveBook(tx *datastore.Transaction, id int64) error {
+	var e datastoreBook
+	if err := tx.Get(db.key(bookKind, id), &e); err != nil {
+		return err
+	}
+	if e.Deleted {
+		return datastore.ErrNoSuchEntity
+	}
+	return nil
+}
+
+// lending reads the copies, open loans and holds queue of the book with
+// id, inside tx unless it is nil. Ancestor queries are strongly consistent
+// either way.
+func (db *datastoreDB) lending(tx *datastore.Transaction, id int64) ([]*Copy, []*Loan, []*Hold, error) {
+	ctx := context.Background()
+	k := db.key(bookKind, id)
+	children := func(kind string) *datastore.Query {
+		q := db.query(kind).Ancestor(k)
+		if tx != nil {
+			q = q.Transaction(tx)
+		}
+		return q
+	}
+
+	var ces []*datastoreCopy
+	ckeys, err := db.client.GetAll(ctx, children(copyKind), &ces)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	copies := make([]*Copy, len(ces))
+	for i, e := range ces {
+		copies[i] = &Copy{ID: ckeys[i].ID, BookID: id, Label: e.Label, AddedAt: e.AddedAt.UTC()}
+	}
+	sort.Slice(copies, func(i, j int) bool { return copies[i].ID < copies[j].ID })
+
+	var les []*datastoreLoan
+	lkeys, err := db.client.GetAll(ctx, children(loanKind).Filter("Open =", true), &les)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	open := make([]*Loan, len(les))
+	for i, e := range les {
+		open[i] = e.loan(lkeys[i])
+	}
+
+	var hes []*datastoreHold
+	hkeys, err := db.client.GetAll(ctx, children(holdKind), &hes)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	holds := make([]*Hold, len(hes))
+	seqs := make(map[*Hold]int64, len(hes))
+	for i, e := range hes {
+		holds[i] = &Hold{BookID: id, UserID: hkeys[i].Name, UserName: e.UserName, PlacedAt: e.PlacedAt.UTC()}
+		seqs[holds[i]] = e.Seq
+	}
+	sort.Slice(holds, func(i, j int) bool { return seqs[holds[i]] < seqs[holds[j]] })
+	return copies, open, holds, nil
+}
+
+// AddCopy adds a copy of a book to the library.
+func (db *datastoreDB) AddCopy(bookID int64, label string) (*Copy, error) {
+	c := &Copy{BookID: bookID, Label: strings.TrimSpace(label)}
+	err := db.runInTransaction(func(tx *datastore.Transaction) error {
+		if err := db.liveBook(tx, bookID); err != nil {
+			return err
+		}
+		id, err := db.nextID(tx, copyKind)
+		if err != nil {
+			return err
+		}
+		c.ID, c.AddedAt = id, now()
+		_, err = tx.Put(db.childKey(copyKind, bookID, id), &datastoreCopy{Label: c.Label, AddedAt: c.AddedAt})
+		return err
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("datastore: could not find book with id %d: %w", bookID, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("datastore: could not add copy: %v", err)
+	}
+	return c, nil
+}
+
+// RemoveCopy removes a copy of a book that is not lent out.
+func (db *datastoreDB) RemoveCopy(bookID, copyID int64) error {
+	err := db.runInTransaction(func(tx *datastore.Transaction) error {
+		k := db.childKey(copyKind, bookID, copyID)
+		if err := tx.Get(k, &datastoreCopy{}); err != nil {
+			return err
+		}
+		_, open, _, err := db.lending(tx, bookID)
+		if err != nil {
+			return err
+		}
+		for _, l := range open {
+			if l.CopyID == copyID {
+				return fmt.Errorf("datastore: copy %d is lent out: %w", copyID, ErrConflict)
+			}
+		}
+		return tx.Delete(k)
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return fmt.Errorf("datastore: could not find copy %d of book %d: %w", copyID, bookID, ErrNotFound)
+	} else if errors.Is(err, ErrConflict) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("datastore: could not remove copy: %v", err)
+	}
+	return nil
+}
+
+// ListCopies lists the copies of a book, each with its open loan.
+func (db *datastoreDB) ListCopies(bookID int64) ([]*Copy, error) {
+	copies, open, _, err := db.lending(nil, bookID)
+	if err != nil {
+		return nil, fmt.Errorf("datastore: could not list copies: %v", err)
+	}
+	for _, l := range open {
+		for _, c := range copies {
+			if c.ID == l.CopyID {
+				c.Loan = l
+			}
+		}
+	}
+	return copies, nil
+}
+
+// CheckOut lends a copy of a book to a user. Transactions that change the
+// same book's loans conflict, so one of two concurrent checkouts of the
+// last copy is retried and then refused.
+func (db *datastoreDB) CheckOut(bookID int64, userID, userName string, due time.Time) (*Loan, error) {
+	if userID == "" {
+		return nil, fmt.Errorf("datastore: checkout without a user: %w", ErrInvalid)
+	}
+	var l *Loan
+	err := db.runInTransaction(func(tx *datastore.Transaction) error {
+		l = &Loan{BookID: bookID, UserID: userID, UserName: userName, CheckedOutAt: now(), DueAt: due.UTC().Truncate(time.Second)}
+		if !l.DueAt.After(l.CheckedOutAt) {
+			return fmt.Errorf("datastore: loan due %s is already due: %w", l.DueAt.Format(time.RFC3339), ErrInvalid)
+		}
+		if err := db.liveBook(tx, bookID); err != nil {
+			return err
+		}
+		copies, open, holds, err := db.lending(tx, bookID)
+		if err != nil {
+			return err
+		}
+		var reason string
+		if l.CopyID, reason = checkOutCopy(copies, open, holds, userID); l.CopyID == 0 {
+			return fmt.Errorf("datastore: cannot lend book %d: %s: %w", bookID, reason, ErrConflict)
+		}
+		if l.ID, err = db.nextID(tx, loanKind); err != nil {
+			return err
+		}
+		if _, err := tx.Put(db.childKey(loanKind, bookID, l.ID), &datastoreLoan{
+			CopyID:       l.CopyID,
+			UserID:       l.UserID,
+			UserName:     l.UserName,
+			Open:         true,
+			CheckedOutAt: l.CheckedOutAt,
+			DueAt:        l.DueAt,
+		}); err != nil {
+			return err
+		}
+		return tx.Delete(db.holdKey(bookID, userID))
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("datastore: could not find book with id %d: %w", bookID, ErrNotFound)
+	} else if errors.Is(err, ErrConflict) || errors.Is(err, ErrInvalid) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("datastore: could not check out: %v", err)
+	}
+	return l, nil
+}
+
+// updateLoan applies f to an open loan inside a transaction. f reports
+// whether the loan may be changed; a loan that is missing, returned or
+// refused by f reports ErrNotFound.
+func (db *datastoreDB) updateLoan(bookID, loanID int64, f func(e *datastoreLoan) bool) (*Loan, error) {
+	var l *Loan
+	err := db.runInTransaction(func(tx *datastore.Transaction) error {
+		k := db.childKey(loanKind, bookID, loanID)
+		var e datastoreLoan
+		if err := tx.Get(k, &e); err != nil {
+			return err
+		}
+		if !e.Open || !f(&e) {
+			return datastore.ErrNoSuchEntity
+		}
+		if _, err := tx.Put(k, &e); err != nil {
+			return err
+		}
+		l = e.loan(k)
+		return nil
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("datastore: could not find open loan %d of book %d: %w", loanID, bookID, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("datastore: could not update loan: %v", err)
+	}
+	return l, nil
+}
+
+// CheckIn records that the copy of an open loan was returned.
+func (db *datastoreDB) CheckIn(bookID, loanID int64) (*Loan, error) {
+	return db.updateLoan(bookID, loanID, func(e *datastoreLoan) bool {
+		e.Open, e.ReturnedAt = false, now()
+		return true
+	})
+}
+
+// MarkOverdue records that an open loan was found overdue at at.
+func (db *datastoreDB) MarkOverdue(bookID, loanID int64, at time.Time) error {
+	_, err := db.updateLoan(bookID, loanID, func(e *datastoreLoan) bool {
+		if !e.OverdueAt.IsZero() || !e.DueAt.Before(at) {
+			return false
+		}
+		e.OverdueAt = at.UTC().Truncate(time.Second)
+		return true
+	})
+	return err
+}
+
+// ListLoans lists the loans q selects, with their books, newest first. The
+// most selective filter is left to Datastore and the rest done here.
+func (db *datastoreDB) ListLoans(q LoanQuery) ([]*Loan, error) {
+	ctx := context.Background()
+	dq := db.query(loanKind)
+	switch {
+	case q.BookID != 0:
+		dq = dq.Ancestor(db.key(bookKind, q.BookID))
+	case q.UserID != "":
+		dq = dq.Filter("UserID =", q.UserID)
+	}
+	if q.Open {
+		dq = dq.Filter("Open =", true)
+	}
+	var entities []*datastoreLoan
+	keys, err := db.client.GetAll(ctx, dq, &entities)
+	if err != nil {
+		return nil, fmt.Errorf("datastore: could not list loans: %v", err)
+	}
+	var loans []*Loan
+	for i, e := range entities {
+		if l := e.loan(keys[i]); q.matches(l) {
+			loans = append(loans, l)
+		}
+	}
+	sortLoans(loans)
+	if len(loans) == 0 {
+		return loans, nil
+	}
+
+	bookKeys := make([]*datastore.Key, len(loans))
+	books := make([]*datastoreBook, len(loans))
+	for i, l := range loans {
+		bookKeys[i], books[i] = db.key(bookKind, l.BookID), &datastoreBook{}
+	}
+	err = db.client.GetMulti(ctx, bookKeys, books)
+	errs, _ := err.(datastore.MultiError)
+	if err != nil && errs == nil {
+		return nil, fmt.Errorf("datastore: could not get books of loans: %v", err)
+	}
+	for i, l := range loans {
+		if errs == nil || errs[i] == nil {
+			l.Book = books[i].book(l.BookID)
+		} else if errs[i] != datastore.ErrNoSuchEntity {
+			return nil, fmt.Errorf("datastore: could not get books of loans: %v", errs[i])
+		}
+	}
+	return loans, nil
+}
+
+// PlaceHold puts a user at the end of a book's holds queue.
+func (db *datastoreDB) PlaceHold(bookID int64, userID, userName string) (*Hold, error) {
+	if userID == "" {
+		return nil, fmt.Errorf("datastore: hold without a user: %w", ErrInvalid)
+	}
+	h := &Hold{BookID: bookID, UserID: userID, UserName: userName}
+	err := db.runInTransaction(func(tx *datastore.Transaction) error {
+		if err := db.liveBook(tx, bookID); err != nil {
+			return err
+		}
+		_, open, holds, err := db.lending(tx, bookID)
+		if err != nil {
+			return err
+		}
+		for _, l := range open {
+			if l.UserID == userID {
+				return fmt.Errorf("datastore: book %d is already lent to user %s: %w", bookID, userID, ErrConflict)
+			}
+		}
+		for _, other := range holds {
+			if other.UserID == userID {
+				return fmt.Errorf("datastore: user %s already holds book %d: %w", userID, bookID, ErrConflict)
+			}
+		}
+		seq, err := db.nextID(tx, holdKind)
+		if err != nil {
+			return err
+		}
+		h.PlacedAt = now()
+		_, err = tx.Put(db.holdKey(bookID, userID), &datastoreHold{Seq: seq, UserName: userName, PlacedAt: h.PlacedAt})
+		return err
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("datastore: could not find book with id %d: %w", bookID, ErrNotFound)
+	} else if errors.Is(err, ErrConflict) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("datastore: could not place hold: %v", err)
+	}
+	return h, nil
+}
+
+// CancelHold takes a user off a book's holds queue.
+func (db *datastoreDB) CancelHold(bookID int64, userID string) error {
+	err := db.runInTransaction(func(tx *datastore.Transaction) error {
+		k := db.holdKey(bookID, userID)
+		if err := tx.Get(k, &datastoreHold{}); err != nil {
+			return err
+		}
+		return tx.Delete(k)
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return fmt.Errorf("datastore: user %s does not hold book %d: %w", userID, bookID, ErrNotFound)
+	} else if err != nil {
+		return fmt.Errorf("datastore: could not cancel hold: %v", err)
+	}
+	return nil
+}
+
+// ListHolds lists a book's holds queue, longest waiting first.
+func (db *datastoreDB) ListHolds(bookID int64) ([]*Hold, error) {
+	_, _, holds, err := db.lending(nil, bookID)
+	if err != nil {
+		return nil, fmt.Errorf("datastore: could not list holds: %v", err)
+	}
+	return holds, nil
+}
+
+// Availability counts the copies, open loans and holds of each book, by
+// the parent keys of keys-only queries.
+func (db *datastoreDB) Availability() (map[int64]Availability, error) {
+	ctx := context.Background()
+	counts := make(map[int64]Availability)
+	for _, c := range []struct {
+		q   *datastore.Query
+		add func(a *Availability)
+	}{
+		{db.query(copyKind), func(a *Availability) { a.Copies++ }},
+		{db.query(loanKind).Filter("Open =", true), func(a *Availability) { a.OnLoan++ }},
+		{db.query(holdKind), func(a *Availability) { a.Holds++ }},
+	} {
+		keys, err := db.client.GetAll(ctx, c.q.KeysOnly(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("datastore: could not count copies: %v", err)
+		}
+		for _, k := range keys {
+			a := counts[k.Parent.ID]
+			c.add(&a)
+			counts[k.Parent.ID] = a
+		}
+	}
+	return counts, nil
+}
+
+// purgeLending removes the copies, loans and holds of the book with key k
+// inside tx.
+func (db *datastoreDB) purgeLending(tx *datastore.Transaction, k *datastore.Key) error {
+	for _, kind := range []string{copyKind, loanKind, holdKind} {
+		keys, err := db.client.GetAll(context.Background(), db.query(kind).Ancestor(k).KeysOnly().Transaction(tx), nil)
+		if err != nil {
+			return err
+		}
+		if err := tx.DeleteMulti(keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveLending moves the copies, loans and holds of the book with key dk to
+// the book with key k inside tx, keeping their IDs. A user holding both
+// keeps their place in the queue of k.
+func (db *datastoreDB) moveLending(tx *datastore.Transaction, k, dk *datastore.Key) error {
+	ctx := context.Background()
+	var copies []*datastoreCopy
+	ckeys, err := db.client.GetAll(ctx, db.query(copyKind).Ancestor(dk).Transaction(tx), &copies)
+	if err != nil {
+		return err
+	}
+	for i, e := range copies {
+		if _, err := tx.Put(db.childKey(copyKind, k.ID, ckeys[i].ID), e); err != nil {
+			return err
+		}
+	}
+	var loans []*datastoreLoan
+	lkeys, err := db.client.GetAll(ctx, db.query(loanKind).Ancestor(dk).Transaction(tx), &loans)
+	if err != nil {
+		return err
+	}
+	for i, e := range loans {
+		if _, err := tx.Put(db.childKey(loanKind, k.ID, lkeys[i].ID), e); err != nil {
+			return err
+		}
+	}
+	kept, err := db.client.GetAll(ctx, db.query(holdKind).Ancestor(k).KeysOnly().Transaction(tx), nil)
+	if err != nil {
+		return err
+	}
+	has := make(map[string]bool, len(kept))
+	for _, hk := range kept {
+		has[hk.Name] = true
+	}
+	var holds []*datastoreHold
+	hkeys, err := db.client.GetAll(ctx, db.query(holdKind).Ancestor(dk).Transaction(tx), &holds)
+	if err != nil {
+		return err
+	}
+	for i, e := range holds {
+		if !has[hkeys[i].Name] {
+			if _, err := tx.Put(db.holdKey(k.ID, hkeys[i].Name), e); err != nil {
+				return err
+			}
+		}
+	}
+	for _, keys := range [][]*datastore.Key{ckeys, lkeys, hkeys} {
+		if err := tx.DeleteMulti(keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package bookshelf
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+const readingKind = "Reading"
+
+// datastoreReading is the entity stored for a Reading. It is a child of
+// the book's key, named by the user ID, so a user has one reading per book
+// and a book's readings go with it when it is purged or merged. UserID is
+// kept as a property to find a user's readings.
+type datastoreReading struct {
+	UserID     string
+	Status     string    `datastore:",noindex"`
+	Shelves    []string  `datastore:",noindex"`
+	StartedAt  time.Time `datastore:",noindex,omitempty"`
+	FinishedAt time.Time `datastore:",noindex,omitempty"`
+	Progress   int       `datastore:",noindex"`
+	UpdatedAt  time.Time `datastore:",noindex"`
+}
+
+func (e *datastoreReading) reading(bookID int64) *Reading {
+	r := &Reading{
+		UserID:    e.UserID,
+		BookID:    bookID,
+		Status:    e.Status,
+		Shelves:   e.Shelves,
+		Progress:  e.Progress,
+		UpdatedAt: e.UpdatedAt.UTC(),
+	}
+	if !e.StartedAt.IsZero() {
+		r.StartedAt = e.StartedAt.UTC()
+	}
+	if !e.FinishedAt.IsZero() {
+		r.FinishedAt = e.FinishedAt.UTC()
+	}
+	return r
+}
+
+func (db *datastoreDB) readingKey(userID string, bookID int64) *datastore.Key {
+	k := datastore.NameKey(readingKind, userID, db.key(bookKind, bookID))
+	k.Namespace = db.namespace
+	return k
+}
+
+// GetReading retrieves a user's reading of a book.
+func (db *datastoreDB) GetReading(userID string, bookID int64) (*Reading, error) {
+	var e datastoreReading
+	err := db.client.Get(context.Background(), db.readingKey(userID, bookID), &e)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("datastore: book %d is not on the shelves of user %s: %w", bookID, userID, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("datastore: could not get reading: %v", err)
+	}
+	return e.reading(bookID), nil
+}
+
+// SaveReading adds or replaces a user's reading of a book. The book is
+// read in the same transaction, so a reading is never saved for a book
+// being purged.
+func (db *datastoreDB) SaveReading(r *Reading) error {
+	if err := r.normalize(); err != nil {
+		return err
+	}
+	err := db.runInTransaction(func(tx *datastore.Transaction) error {
+		var b datastoreBook
+		if err := tx.Get(db.key(bookKind, r.BookID), &b); err != nil {
+			return err
+		}
+		if b.Deleted {
+			return datastore.ErrNoSuchEntity
+		}
+		r.UpdatedAt = now()
+		_, err := tx.Put(db.readingKey(r.UserID, r.BookID), &datastoreReading{
+			UserID:     r.UserID,
+			Status:     r.Status,
+			Shelves:    r.Shelves,
+			StartedAt:  r.StartedAt,
+			FinishedAt: r.FinishedAt,
+			Progress:   r.Progress,
+			UpdatedAt:  r.UpdatedAt,
+		})
+		return err
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return fmt.Errorf("datastore: could not find book with id %d: %w", r.BookID, ErrNotFound)
+	} else if err != nil {
+		return fmt.Errorf("datastore: could not save reading: %v", err)
+	}
+	return nil
+}
+
+// DeleteReading takes a book off a user's shelves.
+func (db *datastoreDB) DeleteReading(userID string, bookID int64) error {
+	err := db.runInTransaction(func(tx *datastore.Transaction) error {
+		k := db.readingKey(userID, bookID)
+		if err := tx.Get(k, &datastoreReading{}); err != nil {
+			return err
+		}
+		return tx.Delete(k)
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return fmt.Errorf("datastore: book %d is not on the shelves of user %s: %w", bookID, userID, ErrNotFound)
+	} else if err != nil {
+		return fmt.Errorf("datastore: could not delete reading: %v", err)
+	}
+	return nil
+}
+
+// ListReadings lists a user's readings on a shelf, with their books. The
+// books are fetched by key; those missing or in the trash are left out.
+func (db *datastoreDB) ListReadings(userID, shelf string) ([]*Reading, error) {
+	ctx := context.Background()
+	var entities []*datastoreReading
+	keys, err := db.client.GetAll(ctx, db.query(readingKind).Filter("UserID =", userID), &entities)
+	if err != nil {
+		return nil, fmt.Errorf("datastore: could not list readings: %v", err)
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	bookKeys := make([]*datastore.Key, len(keys))
+	for i, k := range keys {
+		bookKeys[i] = k.Parent
+	}
+	books := make([]*datastoreBook, len(keys))
+	for i := range books {
+		books[i] = &datastoreBook{}
+	}
+	err = db.client.GetMulti(ctx, bookKeys, books)
+	errs, _ := err.(datastore.MultiError)
+	if err != nil && errs == nil {
+		return nil, fmt.Errorf("datastore: could not get books of readings: %v", err)
+	}
+	var readings []*Reading
+	for i, e := range entities {
+		if errs != nil && errs[i] != nil {
+			if errs[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			return nil, fmt.Errorf("datastore: could not get books of readings: %v", errs[i])
+		}
+		if books[i].Deleted {
+			continue
+		}
+		id := bookKeys[i].ID
+		r := e.reading(id)
+		r.Book = books[i].book(id)
+		readings = append(readings, r)
+	}
+	return filterReadings(readings, shelf), nil
+}
+
+// ListShelves counts a user's books on each shelf.
+func (db *datastoreDB) ListShelves(userID string) ([]ShelfCount, error) {
+	readings, err := db.ListReadings(userID, "")
+	if err != nil {
+		return nil, err
+	}
+	return countShelves(readings), nil
+}
+
+// bookReadings returns the keys and entities of the readings of the book
+// with key k inside tx.
+func (db *datastoreDB) bookReadings(tx *datastore.Transaction, k *datastore.Key) ([]*datastore.Key, []*datastoreReading, error) {
+	var entities []*datastoreReading
+	q := db.query(readingKind).Ancestor(k).Transaction(tx)
+	keys, err := db.client.GetAll(context.Background(), q, &entities)
+	return keys, entities, err
+}
+
+// purgeReadings removes the readings of the book with key k inside tx.
+func (db *datastoreDB) purgeReadings(tx *datastore.Transaction, k *datastore.Key) error {
+	keys, _, err := db.bookReadings(tx, k)
+	if err != nil {
+		return err
+	}
+	return tx.DeleteMulti(keys)
+}
+
+// moveReadings moves the readings of the book with key dk to the book with
+// key k inside tx. A user with readings of both keeps the one of k.
+func (db *datastoreDB) moveReadings(tx *datastore.Transaction, k, dk *datastore.Key) error {
+	kept, _, err := db.bookReadings(tx, k)
+	if err != nil {
+		return err
+	}
+	has := make(map[string]bool, len(kept))
+	for _, rk := range kept {
+		has[rk.Name] = true
+	}
+	keys, entities, err := db.bookReadings(tx, dk)
+	if err != nil {
+		return err
+	}
+	for _, e := range entities {
+		if !has[e.UserID] {
+			if _, err := tx.Put(db.readingKey(e.UserID, k.ID), e); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.DeleteMulti(keys)
+}
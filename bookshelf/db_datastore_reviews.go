@@ -0,0 +1,238 @@
+package bookshelf
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+const reviewKind = "Review"
+
+// datastoreReview is the entity stored for a Review. Like a reading, it is
+// a child of the book's key named by the user ID, and keeps UserID as a
+// property to find a user's reviews.
+type datastoreReview struct {
+	UserID    string
+	UserName  string    `datastore:",noindex"`
+	Rating    int       `datastore:",noindex"`
+	Text      string    `datastore:",noindex"`
+	CreatedAt time.Time `datastore:",noindex"`
+	UpdatedAt time.Time `datastore:",noindex"`
+}
+
+func (e *datastoreReview) review(bookID int64) *Review {
+	return &Review{
+		BookID:    bookID,
+		UserID:    e.UserID,
+		UserName:  e.UserName,
+		Rating:    e.Rating,
+		Text:      e.Text,
+		CreatedAt: e.CreatedAt.UTC(),
+		UpdatedAt: e.UpdatedAt.UTC(),
+	}
+}
+
+func (db *datastoreDB) reviewKey(bookID int64, userID string) *datastore.Key {
+	k := datastore.NameKey(reviewKind, userID, db.key(bookKind, bookID))
+	k.Namespace = db.namespace
+	return k
+}
+
+// GetReview retrieves a user's review of a book.
+func (db *datastoreDB) GetReview(bookID int64, userID string) (*Review, error) {
+	var e datastoreReview
+	err := db.client.Get(context.Background(), db.reviewKey(bookID, userID), &e)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("datastore: user %s has not reviewed book %d: %w", userID, bookID, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("datastore: could not get review: %v", err)
+	}
+	return e.review(bookID), nil
+}
+
+// updateRating saves the review of a book by userID as f returns it, or
+// deletes it if f returns nil, and changes the ratings of the book to
+// match, all in one transaction. f is passed the current review, or nil.
+// A book that is missing or in the trash reports ErrNoSuchEntity.
+func (db *datastoreDB) updateRating(bookID int64, userID string, f func(old *Review) (*Review, error)) error {
+	return db.runInTransaction(func(tx *datastore.Transaction) error {
+		k := db.key(bookKind, bookID)
+		var b datastoreBook
+		if err := tx.Get(k, &b); err != nil {
+			return err
+		}
+		if b.Deleted {
+			return datastore.ErrNoSuchEntity
+		}
+		rk := db.reviewKey(bookID, userID)
+		var (
+			e   datastoreReview
+			old *Review
+		)
+		if err := tx.Get(rk, &e); err == nil {
+			old = e.review(bookID)
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		r, err := f(old)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			if err := tx.Delete(rk); err != nil {
+				return err
+			}
+		} else if _, err := tx.Put(rk, &datastoreReview{
+			UserID:    r.UserID,
+			UserName:  r.UserName,
+			Rating:    r.Rating,
+			Text:      r.Text,
+			CreatedAt: r.CreatedAt,
+			UpdatedAt: r.UpdatedAt,
+		}); err != nil {
+			return err
+		}
+		count, sum := ratingDelta(old, r)
+		b.RatingCount += count
+		b.RatingSum += sum
+		_, err = tx.Put(k, &b)
+		return err
+	})
+}
+
+// SaveReview adds or replaces a user's review of a book. The book is
+// written in the same transaction, so concurrent reviews of a book are
+// retried rather than losing a rating.
+func (db *datastoreDB) SaveReview(r *Review) error {
+	if err := r.normalize(); err != nil {
+		return err
+	}
+	err := db.updateRating(r.BookID, r.UserID, func(old *Review) (*Review, error) {
+		r.UpdatedAt = now()
+		r.CreatedAt = r.UpdatedAt
+		if old != nil {
+			r.CreatedAt = old.CreatedAt
+		}
+		return r, nil
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return fmt.Errorf("datastore: could not find book with id %d: %w", r.BookID, ErrNotFound)
+	} else if err != nil {
+		return fmt.Errorf("datastore: could not save review: %v", err)
+	}
+	return nil
+}
+
+// DeleteReview removes a user's review of a book.
+func (db *datastoreDB) DeleteReview(bookID int64, userID string) error {
+	err := db.updateRating(bookID, userID, func(old *Review) (*Review, error) {
+		if old == nil {
+			return nil, datastore.ErrNoSuchEntity
+		}
+		return nil, nil
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return fmt.Errorf("datastore: user %s has not reviewed book %d: %w", userID, bookID, ErrNotFound)
+	} else if err != nil {
+		return fmt.Errorf("datastore: could not delete review: %v", err)
+	}
+	return nil
+}
+
+// ListReviews lists the reviews q selects, with their books. A book's
+// reviews are read with an ancestor query and a user's by UserID; the
+// rest is sorted here, so no composite index is needed.
+func (db *datastoreDB) ListReviews(q ReviewQuery) ([]*Review, error) {
+	ctx := context.Background()
+	dq := db.query(reviewKind)
+	if q.BookID != 0 {
+		dq = dq.Ancestor(db.key(bookKind, q.BookID))
+	}
+	if q.UserID != "" {
+		dq = dq.Filter("UserID =", q.UserID)
+	}
+	var entities []*datastoreReview
+	keys, err := db.client.GetAll(ctx, dq, &entities)
+	if err != nil {
+		return nil, fmt.Errorf("datastore: could not list reviews: %v", err)
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	bookKeys := make([]*datastore.Key, len(keys))
+	books := make([]*datastoreBook, len(keys))
+	for i, k := range keys {
+		bookKeys[i], books[i] = k.Parent, &datastoreBook{}
+	}
+	err = db.client.GetMulti(ctx, bookKeys, books)
+	errs, _ := err.(datastore.MultiError)
+	if err != nil && errs == nil {
+		return nil, fmt.Errorf("datastore: could not get books of reviews: %v", err)
+	}
+	var reviews []*Review
+	for i, e := range entities {
+		if errs != nil && errs[i] != nil {
+			if errs[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			return nil, fmt.Errorf("datastore: could not get books of reviews: %v", errs[i])
+		}
+		if books[i].Deleted {
+			continue
+		}
+		id := bookKeys[i].ID
+		r := e.review(id)
+		r.Book = books[i].book(id)
+		reviews = append(reviews, r)
+	}
+	return sortReviews(reviews, q), nil
+}
+
+// bookReviews returns the keys and entities of the reviews of the book
+// with key k inside tx.
+func (db *datastoreDB) bookReviews(tx *datastore.Transaction, k *datastore.Key) ([]*datastore.Key, []*datastoreReview, error) {
+	var entities []*datastoreReview
+	q := db.query(reviewKind).Ancestor(k).Transaction(tx)
+	keys, err := db.client.GetAll(context.Background(), q, &entities)
+	return keys, entities, err
+}
+
+// purgeReviews removes the reviews of the book with key k inside tx.
+func (db *datastoreDB) purgeReviews(tx *datastore.Transaction, k *datastore.Key) error {
+	keys, _, err := db.bookReviews(tx, k)
+	if err != nil {
+		return err
+	}
+	return tx.DeleteMulti(keys)
+}
+
+// moveReviews moves the reviews of the book with key dk to the book with
+// key k inside tx, adding their ratings to e, the entity of k, which the
+// caller saves. A user with reviews of both keeps the one of k.
+func (db *datastoreDB) moveReviews(tx *datastore.Transaction, k, dk *datastore.Key, e *datastoreBook) error {
+	kept, _, err := db.bookReviews(tx, k)
+	if err != nil {
+		return err
+	}
+	has := make(map[string]bool, len(kept))
+	for _, rk := range kept {
+		has[rk.Name] = true
+	}
+	keys, entities, err := db.bookReviews(tx, dk)
+	if err != nil {
+		return err
+	}
+	for _, r := range entities {
+		if has[r.UserID] {
+			continue
+		}
+		if _, err := tx.Put(db.reviewKey(k.ID, r.UserID), r); err != nil {
+			return err
+		}
+		e.RatingCount++
+		e.RatingSum += r.Rating
+	}
+	return tx.DeleteMulti(keys)
+}
@@ -0,0 +1,29 @@
+package bookshelf_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+	"github.com/tony-yang/google-cloud-stack/bookshelf/bookshelftest"
+)
+
+// TestDatastoreDB runs against the Datastore emulator at
+// DATASTORE_EMULATOR_HOST, giving each subtest a namespace of its own.
+func TestDatastoreDB(t *testing.T) {
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		t.Skip("DATASTORE_EMULATOR_HOST is not set")
+	}
+	bookshelftest.TestBookDatabase(t, func(t *testing.T) bookshelf.BookDatabase {
+		db, err := bookshelf.NewDatastoreDB(bookshelf.DatastoreConfig{
+			ProjectID: "bookshelf-test",
+			Namespace: fmt.Sprintf("test%d", time.Now().UnixNano()),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
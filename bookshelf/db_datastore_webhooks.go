@@ -0,0 +1,375 @@
+package bookshelf
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+const (
+	webhookKind  = "Webhook"
+	deliveryKind = "WebhookDelivery"
+)
+
+// Webhooks and their deliveries are root entities with IDs from counters,
+// so a delivery is found by its ID alone. OwnerID, WebhookID and Pending
+// are indexed for the queries that list them by equality filters alone,
+// and the rest is filtered here.
+
+type datastoreWebhook struct {
+	OwnerID    string
+	OwnerName  string    `datastore:",noindex"`
+	URL        string    `datastore:",noindex"`
+	Events     []string  `datastore:",noindex"`
+	Secret     string    `datastore:",noindex"`
+	Active     bool      `datastore:",noindex"`
+	Failures   int       `datastore:",noindex"`
+	DisabledAt time.Time `datastore:",noindex,omitempty"`
+	CreatedAt  time.Time `datastore:",noindex"`
+	UpdatedAt  time.Time `datastore:",noindex"`
+}
+
+type datastoreDelivery struct {
+	WebhookID     int64
+	Event         string `datastore:",noindex"`
+	BookID        int64  `datastore:",noindex"`
+	Payload       string `datastore:",noindex"`
+	Status        string `datastore:",noindex"`
+	Pending       bool
+	Attempts      int       `datastore:",noindex"`
+	ResponseCode  int       `datastore:",noindex"`
+	Error         string    `datastore:",noindex"`
+	CreatedAt     time.Time `datastore:",noindex"`
+	LastAttemptAt time.Time `datastore:",noindex,omitempty"`
+	NextAttemptAt time.Time `datastore:",noindex,omitempty"`
+}
+
+func (e *datastoreWebhook) webhook(id int64) *Webhook {
+	w := &Webhook{
+		ID:        id,
+		OwnerID:   e.OwnerID,
+		OwnerName: e.OwnerName,
+		URL:       e.URL,
+		Events:    e.Events,
+		Secret:    e.Secret,
+		Active:    e.Active,
+		Failures:  e.Failures,
+		CreatedAt: e.CreatedAt.UTC(),
+		UpdatedAt: e.UpdatedAt.UTC(),
+	}
+	if !e.DisabledAt.IsZero() {
+		w.DisabledAt = e.DisabledAt.UTC()
+	}
+	return w
+}
+
+func newDatastoreWebhook(w *Webhook) *datastoreWebhook {
+	return &datastoreWebhook{
+		OwnerID:    w.OwnerID,
+		OwnerName:  w.OwnerName,
+		URL:        w.URL,
+		Events:     w.Events,
+		Secret:     w.Secret,
+		Active:     w.Active,
+		Failures:   w.Failures,
+		DisabledAt: w.DisabledAt,
+		CreatedAt:  w.CreatedAt,
+		UpdatedAt:  w.UpdatedAt,
+	}
+}
+
+func (e *datastoreDelivery) delivery(id int64) *WebhookDelivery {
+	d := &WebhookDelivery{
+		ID:           id,
+		WebhookID:    e.WebhookID,
+		Event:        e.Event,
+		BookID:       e.BookID,
+		Payload:      e.Payload,
+		Status:       e.Status,
+		Attempts:     e.Attempts,
+		ResponseCode: e.ResponseCode,
+		Error:        e.Error,
+		CreatedAt:    e.CreatedAt.UTC(),
+	}
+	if !e.LastAttemptAt.IsZero() {
+		d.LastAttemptAt = e.LastAttemptAt.UTC()
+	}
+	if !e.NextAttemptAt.IsZero() {
+		d.NextAttemptAt = e.NextAttemptAt.UTC()
+	}
+	return d
+}
+
+func newDatastoreDelivery(d *WebhookDelivery) *datastoreDelivery {
+	return &datastoreDelivery{
+		WebhookID:     d.WebhookID,
+		Event:         d.Event,
+		BookID:        d.BookID,
+		Payload:       d.Payload,
+		Status:        d.Status,
+		Pending:       d.Status == DeliveryPending,
+		Attempts:      d.Attempts,
+		ResponseCode:  d.ResponseCode,
+		Error:         d.Error,
+		CreatedAt:     d.CreatedAt,
+		LastAttemptAt: d.LastAttemptAt,
+		NextAttemptAt: d.NextAttemptAt,
+	}
+}
+
+// GetWebhook retrieves a webhook by its ID.
+func (db *datastoreDB) GetWebhook(id int64) (*Webhook, error) {
+	var e datastoreWebhook
+	err := db.client.Get(context.Background(), db.key(webhookKind, id), &e)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("datastore: could not find webhook with id %d: %w", id, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("datastore: could not get webhook: %v", err)
+	}
+	return e.webhook(id), nil
+}
+
+// ListWebhooks lists the webhooks of a user, or of every user.
+func (db *datastoreDB) ListWebhooks(ownerID string) ([]*Webhook, error) {
+	q := db.query(webhookKind)
+	if ownerID != "" {
+		q = q.Filter("OwnerID =", ownerID)
+	}
+	var entities []*datastoreWebhook
+	keys, err := db.client.GetAll(context.Background(), q, &entities)
+	if err != nil {
+		return nil, fmt.Errorf("datastore: could not list webhooks: %v", err)
+	}
+	hooks := make([]*Webhook, len(entities))
+	for i, e := range entities {
+		hooks[i] = e.webhook(keys[i].ID)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].ID < hooks[j].ID })
+	return hooks, nil
+}
+
+// AddWebhook saves a new webhook.
+func (db *datastoreDB) AddWebhook(w *Webhook) error {
+	if err := w.normalize(); err != nil {
+		return err
+	}
+	err := db.runInTransaction(func(tx *datastore.Transaction) error {
+		id, err := db.nextID(tx, webhookKind)
+		if err != nil {
+			return err
+		}
+		w.ID, w.CreatedAt = id, now()
+		w.UpdatedAt, w.Failures, w.DisabledAt = w.CreatedAt, 0, time.Time{}
+		_, err = tx.Put(db.key(webhookKind, id), newDatastoreWebhook(w))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("datastore: could not add webhook: %v", err)
+	}
+	return nil
+}
+
+// UpdateWebhook saves the settings of a webhook.
+func (db *datastoreDB) UpdateWebhook(w *Webhook) error {
+	var invalid error
+	err := db.runInTransaction(func(tx *datastore.Transaction) error {
+		k := db.key(webhookKind, w.ID)
+		var e datastoreWebhook
+		if err := tx.Get(k, &e); err != nil {
+			return err
+		}
+		old := e.webhook(w.ID)
+		w.OwnerID, w.OwnerName, w.CreatedAt = old.OwnerID, old.OwnerName, old.CreatedAt
+		if w.Secret == "" {
+			w.Secret = old.Secret
+		}
+		if invalid = w.normalize(); invalid != nil {
+			return invalid
+		}
+		w.Failures, w.DisabledAt = old.Failures, old.DisabledAt
+		if w.Active && !old.Active {
+			w.Failures, w.DisabledAt = 0, time.Time{}
+		}
+		w.UpdatedAt = now()
+		_, err := tx.Put(k, newDatastoreWebhook(w))
+		return err
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return fmt.Errorf("datastore: could not find webhook with id %d: %w", w.ID, ErrNotFound)
+	} else if invalid != nil {
+		return invalid
+	} else if err != nil {
+		return fmt.Errorf("datastore: could not update webhook: %v", err)
+	}
+	return nil
+}
+
+// deleteDeliveries removes the deliveries q selects but keep, if set,
+// keeps, in batches Datastore accepts, and returns how many it removed.
+func (db *datastoreDB) deleteDeliveries(q *datastore.Query, keep func(e *datastoreDelivery) bool) (int, error) {
+	ctx := context.Background()
+	var entities []*datastoreDelivery
+	keys, err := db.client.GetAll(ctx, q, &entities)
+	if err != nil {
+		return 0, err
+	}
+	var doomed []*datastore.Key
+	for i, k := range keys {
+		if keep == nil || !keep(entities[i]) {
+			doomed = append(doomed, k)
+		}
+	}
+	for i := 0; i < len(doomed); i += 500 {
+		end := i + 500
+		if end > len(doomed) {
+			end = len(doomed)
+		}
+		if err := db.client.DeleteMulti(ctx, doomed[i:end]); err != nil {
+			return i, err
+		}
+	}
+	return len(doomed), nil
+}
+
+// DeleteWebhook removes a webhook and then its deliveries, outside the
+// transaction, as there may be more than one can hold. Once the webhook is
+// gone no more are queued, and any a failure leaves behind are reported
+// ErrNotFound by DeliverWebhook.
+func (db *datastoreDB) DeleteWebhook(id int64) error {
+	err := db.runInTransaction(func(tx *datastore.Transaction) error {
+		k := db.key(webhookKind, id)
+		if err := tx.Get(k, &datastoreWebhook{}); err != nil {
+			return err
+		}
+		return tx.Delete(k)
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return fmt.Errorf("datastore: could not find webhook with id %d: %w", id, ErrNotFound)
+	} else if err != nil {
+		return fmt.Errorf("datastore: could not delete webhook: %v", err)
+	}
+	if _, err := db.deleteDeliveries(db.query(deliveryKind).Filter("WebhookID =", id), nil); err != nil {
+		return fmt.Errorf("datastore: could not remove deliveries of webhook %d: %v", id, err)
+	}
+	return nil
+}
+
+// QueueWebhookDelivery saves a new pending delivery.
+func (db *datastoreDB) QueueWebhookDelivery(d *WebhookDelivery) error {
+	err := db.runInTransaction(func(tx *datastore.Transaction) error {
+		if err := tx.Get(db.key(webhookKind, d.WebhookID), &datastoreWebhook{}); err != nil {
+			return err
+		}
+		id, err := db.nextID(tx, deliveryKind)
+		if err != nil {
+			return err
+		}
+		d.ID, d.Status, d.Attempts, d.CreatedAt = id, DeliveryPending, 0, now()
+		d.NextAttemptAt = d.CreatedAt
+		_, err = tx.Put(db.key(deliveryKind, id), newDatastoreDelivery(d))
+		return err
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return fmt.Errorf("datastore: could not find webhook with id %d: %w", d.WebhookID, ErrNotFound)
+	} else if err != nil {
+		return fmt.Errorf("datastore: could not queue delivery: %v", err)
+	}
+	return nil
+}
+
+// ListWebhookDeliveries lists the deliveries q selects. The most selective
+// filter is left to Datastore and the rest done here.
+func (db *datastoreDB) ListWebhookDeliveries(q DeliveryQuery) ([]*WebhookDelivery, error) {
+	dq := db.query(deliveryKind)
+	switch {
+	case q.WebhookID != 0:
+		dq = dq.Filter("WebhookID =", q.WebhookID)
+	case !q.DueBy.IsZero():
+		dq = dq.Filter("Pending =", true)
+	}
+	var entities []*datastoreDelivery
+	keys, err := db.client.GetAll(context.Background(), dq, &entities)
+	if err != nil {
+		return nil, fmt.Errorf("datastore: could not list webhook deliveries: %v", err)
+	}
+	var deliveries []*WebhookDelivery
+	for i, e := range entities {
+		if d := e.delivery(keys[i].ID); q.matches(d) {
+			deliveries = append(deliveries, d)
+		}
+	}
+	return sortDeliveries(deliveries, q), nil
+}
+
+// ClaimWebhookDelivery moves a pending delivery due at due on to until.
+func (db *datastoreDB) ClaimWebhookDelivery(id int64, due, until time.Time) error {
+	err := db.runInTransaction(func(tx *datastore.Transaction) error {
+		k := db.key(deliveryKind, id)
+		var e datastoreDelivery
+		if err := tx.Get(k, &e); err != nil {
+			return err
+		}
+		if !e.Pending || !e.NextAttemptAt.Equal(due) {
+			return datastore.ErrNoSuchEntity
+		}
+		e.NextAttemptAt = until
+		_, err := tx.Put(k, &e)
+		return err
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return fmt.Errorf("datastore: no delivery %d pending at %v: %w", id, due, ErrNotFound)
+	} else if err != nil {
+		return fmt.Errorf("datastore: could not claim delivery: %v", err)
+	}
+	return nil
+}
+
+// RecordWebhookAttempt saves how an attempt at a delivery went and counts
+// it against its webhook, in one transaction.
+func (db *datastoreDB) RecordWebhookAttempt(d *WebhookDelivery) (*Webhook, error) {
+	var w *Webhook
+	err := db.runInTransaction(func(tx *datastore.Transaction) error {
+		wk, dk := db.key(webhookKind, d.WebhookID), db.key(deliveryKind, d.ID)
+		var (
+			we datastoreWebhook
+			de datastoreDelivery
+		)
+		if err := tx.Get(wk, &we); err != nil {
+			return err
+		}
+		if err := tx.Get(dk, &de); err != nil {
+			return err
+		}
+		d.CreatedAt = de.CreatedAt.UTC()
+		if _, err := tx.Put(dk, newDatastoreDelivery(d)); err != nil {
+			return err
+		}
+		w = we.webhook(d.WebhookID)
+		active, failures := w.Active, w.Failures
+		if w.count(d, now()); w.Active == active && w.Failures == failures {
+			return nil
+		}
+		_, err := tx.Put(wk, newDatastoreWebhook(w))
+		return err
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("datastore: could not find delivery %d of webhook %d: %w", d.ID, d.WebhookID, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("datastore: could not record delivery: %v", err)
+	}
+	return w, nil
+}
+
+// PurgeWebhookDeliveries removes the finished deliveries created before a
+// time.
+func (db *datastoreDB) PurgeWebhookDeliveries(before time.Time) (int, error) {
+	n, err := db.deleteDeliveries(db.query(deliveryKind).Filter("Pending =", false),
+		func(e *datastoreDelivery) bool { return !e.CreatedAt.Before(before) })
+	if err != nil {
+		return n, fmt.Errorf("datastore: could not purge webhook deliveries: %v", err)
+	}
+	return n, nil
+}
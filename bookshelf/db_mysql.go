@@ -0,0 +1,492 @@
+package bookshelf
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const createDatabaseStatement = `CREATE DATABASE IF NOT EXISTS library DEFAULT CHARACTER SET = 'utf8' DEFAULT COLLATE 'utf8_general_ci'`
+
+// mysqlMigrations is the schema history of the MySQL backend. The SQLite
+// backend replays the same migrations.
+var mysqlMigrations = []migration{
+	{version: 1, stmts: []string{
+		`CREATE TABLE IF NOT EXISTS books (
+			id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+			title VARCHAR(255) NULL,
+			author VARCHAR(255) NULL,
+			publishedDate VARCHAR(255) NULL,
+			imageUrl VARCHAR(255) NULL,
+			description TEXT NULL,
+			createdBy VARCHAR(255) NULL,
+			createdById VARCHAR(255) NULL,
+			PRIMARY KEY (id)
+		)`,
+	}, sqlite: []string{
+		// INTEGER PRIMARY KEY is SQLite's auto-increment rowid, and NOCASE
+		// matches the case-insensitive title ordering of utf8_general_ci.
+		`CREATE TABLE IF NOT EXISTS books (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			title VARCHAR(255) NULL COLLATE NOCASE,
+			author VARCHAR(255) NULL,
+			publishedDate VARCHAR(255) NULL,
+			imageUrl VARCHAR(255) NULL,
+			description TEXT NULL,
+			createdBy VARCHAR(255) NULL,
+			createdById VARCHAR(255) NULL
+		)`,
+	}},
+	{version: 2, stmts: []string{
+		// Deleted books stay in the trash until restored or purged. SQLite
+		// only adds one column per ALTER TABLE, so neither does MySQL here.
+		`ALTER TABLE books ADD COLUMN deletedAt DATETIME NULL`,
+		`ALTER TABLE books ADD COLUMN deletedBy VARCHAR(255) NULL`,
+		`ALTER TABLE books ADD COLUMN deletedById VARCHAR(255) NULL`,
+		`CREATE INDEX books_deletedAt ON books (deletedAt)`,
+	}},
+	{version: 3, stmts: []string{
+		// book_history is append-only. It has no foreign key so the history
+		// of a purged book is kept.
+		`CREATE TABLE book_history (
+			id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+			bookId INT UNSIGNED NOT NULL,
+			action VARCHAR(32) NOT NULL,
+			actorId VARCHAR(255) NULL,
+			actorName VARCHAR(255) NULL,
+			source VARCHAR(32) NULL,
+			changedAt DATETIME NOT NULL,
+			diff TEXT NULL,
+			PRIMARY KEY (id)
+		)`,
+		`CREATE INDEX book_history_bookId ON book_history (bookId)`,
+		`CREATE INDEX book_history_actorId ON book_history (actorId)`,
+		`CREATE INDEX book_history_changedAt ON book_history (changedAt)`,
+	}, sqlite: []string{
+		`CREATE TABLE book_history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			bookId INTEGER NOT NULL,
+			action VARCHAR(32) NOT NULL,
+			actorId VARCHAR(255) NULL,
+			actorName VARCHAR(255) NULL,
+			source VARCHAR(32) NULL,
+			changedAt DATETIME NOT NULL,
+			diff TEXT NULL
+		)`,
+		`CREATE INDEX book_history_bookId ON book_history (bookId)`,
+		`CREATE INDEX book_history_actorId ON book_history (actorId)`,
+		`CREATE INDEX book_history_changedAt ON book_history (changedAt)`,
+	}},
+	{version: 4, stmts: []string{
+		// ISBNs are NULL rather than empty when unknown, so the unique index
+		// only applies to books that have one. The ISBN-10 follows from the
+		// ISBN-13, so only the latter needs to be unique.
+		`ALTER TABLE books ADD COLUMN isbn10 VARCHAR(10) NULL`,
+		`ALTER TABLE books ADD COLUMN isbn13 VARCHAR(13) NULL`,
+		`CREATE UNIQUE INDEX books_isbn13 ON books (isbn13)`,
+	}},
+	{version: 5, stmts: []string{
+		// book_authors links books to their authors, editors, translators and
+		// illustrators. nameKey is the name as NormalizeAuthor writes it, so
+		// one author is not added twice under different spellings.
+		`CREATE TABLE authors (
+			id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+			name VARCHAR(255) NOT NULL,
+			nameKey VARCHAR(255) NOT NULL,
+			PRIMARY KEY (id)
+		)`,
+		`CREATE UNIQUE INDEX authors_nameKey ON authors (nameKey)`,
+		`CREATE TABLE book_authors (
+			bookId INT UNSIGNED NOT NULL,
+			authorId INT UNSIGNED NOT NULL,
+			role VARCHAR(32) NOT NULL,
+			seq INT NOT NULL,
+			PRIMARY KEY (bookId, authorId, role)
+		)`,
+		`CREATE INDEX book_authors_authorId ON book_authors (authorId)`,
+	}, sqlite: []string{
+		`CREATE TABLE authors (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name VARCHAR(255) NOT NULL,
+			nameKey VARCHAR(255) NOT NULL
+		)`,
+		`CREATE UNIQUE INDEX authors_nameKey ON authors (nameKey)`,
+		`CREATE TABLE book_authors (
+			bookId INTEGER NOT NULL,
+			authorId INTEGER NOT NULL,
+			role VARCHAR(32) NOT NULL,
+			seq INTEGER NOT NULL,
+			PRIMARY KEY (bookId, authorId, role)
+		)`,
+		`CREATE INDEX book_authors_authorId ON book_authors (authorId)`,
+	}, fn: splitAuthorStrings},
+	{version: 6, stmts: []string{
+		// book_tags holds both the free tags of a book and its genres, told
+		// apart by kind, so filtering and counting work the same for each.
+		`CREATE TABLE book_tags (
+			bookId INT UNSIGNED NOT NULL,
+			kind VARCHAR(8) NOT NULL,
+			tag VARCHAR(64) NOT NULL,
+			PRIMARY KEY (bookId, kind, tag)
+		)`,
+		`CREATE INDEX book_tags_tag ON book_tags (kind, tag)`,
+	}},
+	{version: 7, stmts: []string{
+		// Readings are per user and kept out of books. Profile IDs are
+		// short, so userId is narrow enough for the keys to fit MySQL's
+		// index size limit.
+		`CREATE TABLE readings (
+			userId VARCHAR(128) NOT NULL,
+			bookId INT UNSIGNED NOT NULL,
+			status VARCHAR(16) NOT NULL,
+			startedAt DATETIME NULL,
+			finishedAt DATETIME NULL,
+			progress INT NOT NULL,
+			updatedAt DATETIME NOT NULL,
+			PRIMARY KEY (userId, bookId)
+		)`,
+		`CREATE INDEX readings_bookId ON readings (bookId)`,
+		`CREATE TABLE reading_shelves (
+			userId VARCHAR(128) NOT NULL,
+			bookId INT UNSIGNED NOT NULL,
+			shelf VARCHAR(64) NOT NULL,
+			PRIMARY KEY (userId, bookId, shelf)
+		)`,
+		`CREATE INDEX reading_shelves_bookId ON reading_shelves (bookId)`,
+	}},
+	{version: 8, stmts: []string{
+		// Lending. Loans are kept after they are returned, as the history of
+		// each borrower, and have no foreign keys so that history outlives a
+		// removed copy. A user holds a book once.
+		`CREATE TABLE copies (
+			id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+			bookId INT UNSIGNED NOT NULL,
+			label VARCHAR(255) NOT NULL,
+			addedAt DATETIME NOT NULL,
+			PRIMARY KEY (id)
+		)`,
+		`CREATE INDEX copies_bookId ON copies (bookId)`,
+		`CREATE TABLE loans (
+			id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+			copyId INT UNSIGNED NOT NULL,
+			bookId INT UNSIGNED NOT NULL,
+			userId VARCHAR(128) NOT NULL,
+			userName VARCHAR(255) NULL,
+			checkedOutAt DATETIME NOT NULL,
+			dueAt DATETIME NOT NULL,
+			returnedAt DATETIME NULL,
+			overdueAt DATETIME NULL,
+			PRIMARY KEY (id)
+		)`,
+		`CREATE INDEX loans_bookId ON loans (bookId)`,
+		`CREATE INDEX loans_userId ON loans (userId)`,
+		`CREATE INDEX loans_dueAt ON loans (returnedAt, dueAt)`,
+		`CREATE TABLE holds (
+			id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+			bookId INT UNSIGNED NOT NULL,
+			userId VARCHAR(128) NOT NULL,
+			userName VARCHAR(255) NULL,
+			placedAt DATETIME NOT NULL,
+			PRIMARY KEY (id)
+		)`,
+		`CREATE UNIQUE INDEX holds_bookId_userId ON holds (bookId, userId)`,
+	}, sqlite: []string{
+		`CREATE TABLE copies (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			bookId INTEGER NOT NULL,
+			label VARCHAR(255) NOT NULL,
+			addedAt DATETIME NOT NULL
+		)`,
+		`CREATE INDEX copies_bookId ON copies (bookId)`,
+		`CREATE TABLE loans (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			copyId INTEGER NOT NULL,
+			bookId INTEGER NOT NULL,
+			userId VARCHAR(128) NOT NULL,
+			userName VARCHAR(255) NULL,
+			checkedOutAt DATETIME NOT NULL,
+			dueAt DATETIME NOT NULL,
+			returnedAt DATETIME NULL,
+			overdueAt DATETIME NULL
+		)`,
+		`CREATE INDEX loans_bookId ON loans (bookId)`,
+		`CREATE INDEX loans_userId ON loans (userId)`,
+		`CREATE INDEX loans_dueAt ON loans (returnedAt, dueAt)`,
+		`CREATE TABLE holds (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			bookId INTEGER NOT NULL,
+			userId VARCHAR(128) NOT NULL,
+			userName VARCHAR(255) NULL,
+			placedAt DATETIME NOT NULL
+		)`,
+		`CREATE UNIQUE INDEX holds_bookId_userId ON holds (bookId, userId)`,
+	}},
+	{version: 9, stmts: []string{
+		// A user reviews a book once. The books table keeps the count and
+		// sum of the ratings so lists can be sorted by average without
+		// reading the reviews.
+		`ALTER TABLE books ADD COLUMN ratingCount INT NOT NULL DEFAULT 0`,
+		`ALTER TABLE books ADD COLUMN ratingSum INT NOT NULL DEFAULT 0`,
+		`CREATE TABLE reviews (
+			bookId INT UNSIGNED NOT NULL,
+			userId VARCHAR(128) NOT NULL,
+			userName VARCHAR(255) NULL,
+			rating INT NOT NULL,
+			text TEXT NULL,
+			createdAt DATETIME NOT NULL,
+			updatedAt DATETIME NOT NULL,
+			PRIMARY KEY (bookId, userId)
+		)`,
+		`CREATE INDEX reviews_userId ON reviews (userId)`,
+		`CREATE INDEX reviews_updatedAt ON reviews (updatedAt)`,
+	}},
+	{version: 10, stmts: []string{
+		// Books record when they were added and last changed, for feeds of
+		// recent books. Those already there take the times from their
+		// history.
+		`ALTER TABLE books ADD COLUMN createdAt DATETIME NULL`,
+		`ALTER TABLE books ADD COLUMN updatedAt DATETIME NULL`,
+		backfillCreatedAtStatement,
+		backfillUpdatedAtStatement,
+		`CREATE INDEX books_createdAt ON books (createdAt)`,
+		`CREATE INDEX books_updatedAt ON books (updatedAt)`,
+	}},
+	{version: 11, stmts: []string{
+		// Webhooks keep their events comma separated. Deliveries keep the
+		// payload they send, so every attempt sends the same one.
+		`CREATE TABLE webhooks (
+			id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+			ownerId VARCHAR(128) NOT NULL,
+			ownerName VARCHAR(255) NULL,
+			url VARCHAR(2048) NOT NULL,
+			events VARCHAR(255) NOT NULL,
+			secret VARCHAR(255) NOT NULL,
+			active BOOLEAN NOT NULL,
+			failures INT NOT NULL DEFAULT 0,
+			disabledAt DATETIME NULL,
+			createdAt DATETIME NOT NULL,
+			updatedAt DATETIME NOT NULL,
+			PRIMARY KEY (id)
+		)`,
+		`CREATE INDEX webhooks_ownerId ON webhooks (ownerId)`,
+		`CREATE TABLE webhook_deliveries (
+			id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+			webhookId INT UNSIGNED NOT NULL,
+			event VARCHAR(32) NOT NULL,
+			bookId INT UNSIGNED NOT NULL,
+			payload TEXT NOT NULL,
+			status VARCHAR(16) NOT NULL,
+			attempts INT NOT NULL DEFAULT 0,
+			responseCode INT NULL,
+			error TEXT NULL,
+			createdAt DATETIME NOT NULL,
+			lastAttemptAt DATETIME NULL,
+			nextAttemptAt DATETIME NULL,
+			PRIMARY KEY (id)
+		)`,
+		`CREATE INDEX webhook_deliveries_webhookId ON webhook_deliveries (webhookId)`,
+		`CREATE INDEX webhook_deliveries_due ON webhook_deliveries (status, nextAttemptAt)`,
+	}, sqlite: []string{
+		`CREATE TABLE webhooks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ownerId VARCHAR(128) NOT NULL,
+			ownerName VARCHAR(255) NULL,
+			url VARCHAR(2048) NOT NULL,
+			events VARCHAR(255) NOT NULL,
+			secret VARCHAR(255) NOT NULL,
+			active BOOLEAN NOT NULL,
+			failures INT NOT NULL DEFAULT 0,
+			disabledAt DATETIME NULL,
+			createdAt DATETIME NOT NULL,
+			updatedAt DATETIME NOT NULL
+		)`,
+		`CREATE INDEX webhooks_ownerId ON webhooks (ownerId)`,
+		`CREATE TABLE webhook_deliveries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			webhookId INTEGER NOT NULL,
+			event VARCHAR(32) NOT NULL,
+			bookId INTEGER NOT NULL,
+			payload TEXT NOT NULL,
+			status VARCHAR(16) NOT NULL,
+			attempts INT NOT NULL DEFAULT 0,
+			responseCode INT NULL,
+			error TEXT NULL,
+			createdAt DATETIME NOT NULL,
+			lastAttemptAt DATETIME NULL,
+			nextAttemptAt DATETIME NULL
+		)`,
+		`CREATE INDEX webhook_deliveries_webhookId ON webhook_deliveries (webhookId)`,
+		`CREATE INDEX webhook_deliveries_due ON webhook_deliveries (status, nextAttemptAt)`,
+	}},
+}
+
+// backfillCreatedAtStatement and backfillUpdatedAtStatement set the times of
+// the books added before they were recorded from their history, which
+// every backend writes the same way.
+const (
+	backfillCreatedAtStatement = `UPDATE books SET createdAt =
+		(SELECT MIN(changedAt) FROM book_history WHERE book_history.bookId = books.id AND action = 'create')`
+	backfillUpdatedAtStatement = `UPDATE books SET updatedAt =
+		(SELECT MAX(changedAt) FROM book_history WHERE book_history.bookId = books.id
+			AND action IN ('create', 'update', 'merge'))`
+)
+
+// mysqlDialect adapts sqlDB to MySQL.
+type mysqlDialect struct{}
+
+func (mysqlDialect) name() string { return "mysql" }
+
+func (mysqlDialect) rebind(query string) string { return query }
+
+func (mysqlDialect) insert(q querier, query string, args ...interface{}) (int64, error) {
+	r, err := q.Exec(query, args...)
+	if err != nil {
+		return -1, err
+	}
+	return r.LastInsertId()
+}
+
+func (mysqlDialect) isDuplicate(err error) bool {
+	// MySQL error 1062 is "duplicate entry".
+	mErr, ok := err.(*mysql.MySQLError)
+	return ok && mErr.Number == 1062
+}
+
+func (mysqlDialect) forUpdate() string { return " FOR UPDATE" }
+
+func (mysqlDialect) lockMigrations(ctx context.Context, conn *sql.Conn) (func(), error) {
+	var got sql.NullInt64
+	if err := conn.QueryRowContext(ctx, `SELECT GET_LOCK('bookshelf_migrations', 60)`).Scan(&got); err != nil {
+		return nil, err
+	}
+	if got.Int64 != 1 {
+		return nil, errors.New("timed out waiting for the migration lock")
+	}
+	return func() {
+		conn.ExecContext(ctx, `SELECT RELEASE_LOCK('bookshelf_migrations')`)
+	}, nil
+}
+
+func (mysqlDialect) migrations() []migration { return mysqlMigrations }
+
+type MySQLConfig struct {
+	// Optional.
+	Username, Password string
+
+	// Host of the MySQL instance.
+	//
+	// If set, UnixSocket shoud be unset.
+	Host string
+
+	// Port of the MySQL instance.
+	//
+	// If set, UnixSocket should be unset.
+	Port int
+
+	// UnixSocket is the filepath to a unix socket.
+	//
+	// If set, Host and Port should be unset.
+	UnixSocket string
+
+	// ReadReplicas, if set, take the reads: ListBooks, GetBook and
+	// SearchBooks. Unhealthy replicas are skipped, falling back to this
+	// server. Username and Password default to this server's.
+	ReadReplicas []MySQLConfig
+}
+
+// dataStoreName returns a connecton string suitable for sql.Open.
+//
+// clientFoundRows makes UPDATE report matched rather than changed rows, so
+// saving a book without modifications is not mistaken for a missing one.
+// parseTime scans DATETIME columns into time.Time, in UTC.
+func (c MySQLConfig) dataStoreName(dbName string) string {
+	cred := ""
+	if c.Username != "" {
+		cred = c.Username
+		if c.Password != "" {
+			cred = cred + ":" + c.Password
+		}
+		cred = cred + "@"
+	}
+	if c.UnixSocket != "" {
+		return fmt.Sprintf("%sunix(%s)/%s?clientFoundRows=true&parseTime=true", cred, c.UnixSocket, dbName)
+	}
+	return fmt.Sprintf("%stcp([%s]:%d)/%s?clientFoundRows=true&parseTime=true", cred, c.Host, c.Port, dbName)
+}
+
+// ensureDatabaseExists creates the library database if it is missing.
+func (c MySQLConfig) ensureDatabaseExists() error {
+	conn, err := sql.Open("mysql", c.dataStoreName(""))
+	if err != nil {
+		return fmt.Errorf("mysql: could not get a connection: %v", err)
+	}
+	defer conn.Close()
+
+	// Check the connection.
+	if conn.Ping() == driver.ErrBadConn {
+		return fmt.Errorf("mysql: could not connect to the database. " +
+			"could be bad address, or this address is not whitelisted for access.")
+	}
+
+	if _, err := conn.Exec(createDatabaseStatement); err != nil {
+		return fmt.Errorf("mysql: could not create the library database: %v", err)
+	}
+	return nil
+}
+
+// newMySQLDB creates a new BookDatabase backed by a given MySQL server.
+func newMySQLDB(config MySQLConfig) (BookDatabase, error) {
+	// Check database exists and the schema is current. If not, create it.
+	if err := config.ensureDatabaseExists(); err != nil {
+		return nil, err
+	}
+	conn, err := sql.Open("mysql", config.dataStoreName("library"))
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not get a connection: %v", err)
+	}
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("mysql: could not establish a good connection: %v", err)
+	}
+	if err := migrate(conn, mysqlDialect{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	db := &sqlDB{
+		conn:    conn,
+		dialect: mysqlDialect{},
+	}
+	if len(config.ReadReplicas) > 0 {
+		db.replicas = newReplicaSet(config.openReplicas())
+	}
+
+	return db, nil
+}
+
+// openReplicas opens a connection pool for each read replica. Pools connect
+// lazily, so replicas that are down are picked up by the health checks.
+func (c MySQLConfig) openReplicas() []*replica {
+	var replicas []*replica
+	for _, rc := range c.ReadReplicas {
+		if rc.Username == "" {
+			rc.Username, rc.Password = c.Username, c.Password
+		}
+		name := rc.UnixSocket
+		if name == "" {
+			name = fmt.Sprintf("%s:%d", rc.Host, rc.Port)
+		}
+		conn, err := sql.Open("mysql", rc.dataStoreName("library"))
+		if err != nil {
+			log.Printf("mysql: could not open replica %s: %v", name, err)
+			continue
+		}
+		replicas = append(replicas, &replica{name: name, conn: conn})
+	}
+	return replicas
+}
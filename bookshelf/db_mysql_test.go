@@ -0,0 +1,33 @@
+package bookshelf_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+	"github.com/tony-yang/google-cloud-stack/bookshelf/bookshelftest"
+)
+
+// TestMySQLDB runs against the MySQL server at MYSQL_TEST_ADDR, a host:port
+// or unix socket path, as DB_USER. It empties the library database.
+func TestMySQLDB(t *testing.T) {
+	addr := os.Getenv("MYSQL_TEST_ADDR")
+	if addr == "" {
+		t.Skip("MYSQL_TEST_ADDR is not set")
+	}
+	servers, err := bookshelf.ParseReplicas(addr)
+	if err != nil || len(servers) != 1 {
+		t.Fatalf("invalid MYSQL_TEST_ADDR %q: %v", addr, err)
+	}
+	config := servers[0]
+	config.Username, config.Password = bookshelf.SQLUser, bookshelf.SQLPassword
+
+	bookshelftest.TestBookDatabase(t, func(t *testing.T) bookshelf.BookDatabase {
+		db, err := bookshelf.NewMySQLDB(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bookshelf.EmptySQLDB(t, db)
+		return db
+	})
+}
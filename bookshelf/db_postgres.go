@@ -0,0 +1,323 @@
+package bookshelf
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// postgresMigrations is the schema history of the PostgreSQL backend.
+// Unquoted identifiers are folded to lower case, so the camel case column
+// names used by the shared queries resolve to the same columns.
+var postgresMigrations = []migration{
+	{version: 1, stmts: []string{
+		`CREATE TABLE IF NOT EXISTS books (
+			id BIGSERIAL PRIMARY KEY,
+			title VARCHAR(255) NULL,
+			author VARCHAR(255) NULL,
+			publishedDate VARCHAR(255) NULL,
+			imageUrl VARCHAR(255) NULL,
+			description TEXT NULL,
+			createdBy VARCHAR(255) NULL,
+			createdById VARCHAR(255) NULL
+		)`,
+	}},
+	{version: 2, stmts: []string{
+		`ALTER TABLE books ADD COLUMN deletedAt TIMESTAMP NULL`,
+		`ALTER TABLE books ADD COLUMN deletedBy VARCHAR(255) NULL`,
+		`ALTER TABLE books ADD COLUMN deletedById VARCHAR(255) NULL`,
+		`CREATE INDEX books_deletedAt ON books (deletedAt)`,
+	}},
+	{version: 3, stmts: []string{
+		`CREATE TABLE book_history (
+			id BIGSERIAL PRIMARY KEY,
+			bookId BIGINT NOT NULL,
+			action VARCHAR(32) NOT NULL,
+			actorId VARCHAR(255) NULL,
+			actorName VARCHAR(255) NULL,
+			source VARCHAR(32) NULL,
+			changedAt TIMESTAMP NOT NULL,
+			diff TEXT NULL
+		)`,
+		`CREATE INDEX book_history_bookId ON book_history (bookId)`,
+		`CREATE INDEX book_history_actorId ON book_history (actorId)`,
+		`CREATE INDEX book_history_changedAt ON book_history (changedAt)`,
+	}},
+	{version: 4, stmts: []string{
+		`ALTER TABLE books ADD COLUMN isbn10 VARCHAR(10) NULL`,
+		`ALTER TABLE books ADD COLUMN isbn13 VARCHAR(13) NULL`,
+		`CREATE UNIQUE INDEX books_isbn13 ON books (isbn13)`,
+	}},
+	{version: 5, stmts: []string{
+		`CREATE TABLE authors (
+			id BIGSERIAL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			nameKey VARCHAR(255) NOT NULL
+		)`,
+		`CREATE UNIQUE INDEX authors_nameKey ON authors (nameKey)`,
+		`CREATE TABLE book_authors (
+			bookId BIGINT NOT NULL,
+			authorId BIGINT NOT NULL,
+			role VARCHAR(32) NOT NULL,
+			seq INTEGER NOT NULL,
+			PRIMARY KEY (bookId, authorId, role)
+		)`,
+		`CREATE INDEX book_authors_authorId ON book_authors (authorId)`,
+	}, fn: splitAuthorStrings},
+	{version: 6, stmts: []string{
+		`CREATE TABLE book_tags (
+			bookId BIGINT NOT NULL,
+			kind VARCHAR(8) NOT NULL,
+			tag VARCHAR(64) NOT NULL,
+			PRIMARY KEY (bookId, kind, tag)
+		)`,
+		`CREATE INDEX book_tags_tag ON book_tags (kind, tag)`,
+	}},
+	{version: 7, stmts: []string{
+		`CREATE TABLE readings (
+			userId VARCHAR(128) NOT NULL,
+			bookId BIGINT NOT NULL,
+			status VARCHAR(16) NOT NULL,
+			startedAt TIMESTAMP NULL,
+			finishedAt TIMESTAMP NULL,
+			progress INTEGER NOT NULL,
+			updatedAt TIMESTAMP NOT NULL,
+			PRIMARY KEY (userId, bookId)
+		)`,
+		`CREATE INDEX readings_bookId ON readings (bookId)`,
+		`CREATE TABLE reading_shelves (
+			userId VARCHAR(128) NOT NULL,
+			bookId BIGINT NOT NULL,
+			shelf VARCHAR(64) NOT NULL,
+			PRIMARY KEY (userId, bookId, shelf)
+		)`,
+		`CREATE INDEX reading_shelves_bookId ON reading_shelves (bookId)`,
+	}},
+	{version: 8, stmts: []string{
+		`CREATE TABLE copies (
+			id BIGSERIAL PRIMARY KEY,
+			bookId BIGINT NOT NULL,
+			label VARCHAR(255) NOT NULL,
+			addedAt TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX copies_bookId ON copies (bookId)`,
+		`CREATE TABLE loans (
+			id BIGSERIAL PRIMARY KEY,
+			copyId BIGINT NOT NULL,
+			bookId BIGINT NOT NULL,
+			userId VARCHAR(128) NOT NULL,
+			userName VARCHAR(255) NULL,
+			checkedOutAt TIMESTAMP NOT NULL,
+			dueAt TIMESTAMP NOT NULL,
+			returnedAt TIMESTAMP NULL,
+			overdueAt TIMESTAMP NULL
+		)`,
+		`CREATE INDEX loans_bookId ON loans (bookId)`,
+		`CREATE INDEX loans_userId ON loans (userId)`,
+		`CREATE INDEX loans_dueAt ON loans (returnedAt, dueAt)`,
+		`CREATE TABLE holds (
+			id BIGSERIAL PRIMARY KEY,
+			bookId BIGINT NOT NULL,
+			userId VARCHAR(128) NOT NULL,
+			userName VARCHAR(255) NULL,
+			placedAt TIMESTAMP NOT NULL
+		)`,
+		`CREATE UNIQUE INDEX holds_bookId_userId ON holds (bookId, userId)`,
+	}},
+	{version: 9, stmts: []string{
+		`ALTER TABLE books ADD COLUMN ratingCount INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE books ADD COLUMN ratingSum INTEGER NOT NULL DEFAULT 0`,
+		`CREATE TABLE reviews (
+			bookId BIGINT NOT NULL,
+			userId VARCHAR(128) NOT NULL,
+			userName VARCHAR(255) NULL,
+			rating INTEGER NOT NULL,
+			text TEXT NULL,
+			createdAt TIMESTAMP NOT NULL,
+			updatedAt TIMESTAMP NOT NULL,
+			PRIMARY KEY (bookId, userId)
+		)`,
+		`CREATE INDEX reviews_userId ON reviews (userId)`,
+		`CREATE INDEX reviews_updatedAt ON reviews (updatedAt)`,
+	}},
+	{version: 10, stmts: []string{
+		`ALTER TABLE books ADD COLUMN createdAt TIMESTAMP NULL`,
+		`ALTER TABLE books ADD COLUMN updatedAt TIMESTAMP NULL`,
+		backfillCreatedAtStatement,
+		backfillUpdatedAtStatement,
+		`CREATE INDEX books_createdAt ON books (createdAt)`,
+		`CREATE INDEX books_updatedAt ON books (updatedAt)`,
+	}},
+	{version: 11, stmts: []string{
+		`CREATE TABLE webhooks (
+			id BIGSERIAL PRIMARY KEY,
+			ownerId VARCHAR(128) NOT NULL,
+			ownerName VARCHAR(255) NULL,
+			url VARCHAR(2048) NOT NULL,
+			events VARCHAR(255) NOT NULL,
+			secret VARCHAR(255) NOT NULL,
+			active BOOLEAN NOT NULL,
+			failures INTEGER NOT NULL DEFAULT 0,
+			disabledAt TIMESTAMP NULL,
+			createdAt TIMESTAMP NOT NULL,
+			updatedAt TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX webhooks_ownerId ON webhooks (ownerId)`,
+		`CREATE TABLE webhook_deliveries (
+			id BIGSERIAL PRIMARY KEY,
+			webhookId BIGINT NOT NULL,
+			event VARCHAR(32) NOT NULL,
+			bookId BIGINT NOT NULL,
+			payload TEXT NOT NULL,
+			status VARCHAR(16) NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			responseCode INTEGER NULL,
+			error TEXT NULL,
+			createdAt TIMESTAMP NOT NULL,
+			lastAttemptAt TIMESTAMP NULL,
+			nextAttemptAt TIMESTAMP NULL
+		)`,
+		`CREATE INDEX webhook_deliveries_webhookId ON webhook_deliveries (webhookId)`,
+		`CREATE INDEX webhook_deliveries_due ON webhook_deliveries (status, nextAttemptAt)`,
+	}},
+}
+
+// postgresDialect adapts sqlDB to PostgreSQL.
+type postgresDialect struct{}
+
+func (postgresDialect) name() string { return "postgres" }
+
+func (postgresDialect) rebind(query string) string { return rebindDollar(query) }
+
+func (postgresDialect) insert(q querier, query string, args ...interface{}) (int64, error) {
+	var id int64
+	err := q.QueryRow(query+" RETURNING id", args...).Scan(&id)
+	return id, err
+}
+
+func (postgresDialect) isDuplicate(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505" // unique_violation
+}
+
+// postgresMigrationLock is the key of the advisory lock held while
+// migrating.
+const postgresMigrationLock = 7260537
+
+func (postgresDialect) forUpdate() string { return " FOR UPDATE" }
+
+func (postgresDialect) lockMigrations(ctx context.Context, conn *sql.Conn) (func(), error) {
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, postgresMigrationLock); err != nil {
+		return nil, err
+	}
+	return func() {
+		conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, postgresMigrationLock)
+	}, nil
+}
+
+func (postgresDialect) migrations() []migration { return postgresMigrations }
+
+// PostgresConfig describes how to reach a PostgreSQL server.
+type PostgresConfig struct {
+	// Optional.
+	Username, Password string
+
+	// Host of the PostgreSQL instance.
+	//
+	// If set, UnixSocket should be unset.
+	Host string
+
+	// Port of the PostgreSQL instance.
+	//
+	// If set, UnixSocket should be unset.
+	Port int
+
+	// UnixSocket is the directory holding the server's unix socket, such
+	// as /cloudsql/project:region:instance.
+	//
+	// If set, Host and Port should be unset.
+	UnixSocket string
+}
+
+// quoteDSN quotes a value for a libpq connection string.
+func quoteDSN(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `'`, `\'`, -1)
+	return "'" + v + "'"
+}
+
+// dataStoreName returns a connection string suitable for sql.Open.
+// Cloud SQL terminates TLS in its proxy, so the driver does not use SSL.
+func (c PostgresConfig) dataStoreName(dbName string) string {
+	parts := []string{"dbname=" + quoteDSN(dbName), "sslmode=disable"}
+	if c.Username != "" {
+		parts = append(parts, "user="+quoteDSN(c.Username))
+	}
+	if c.Password != "" {
+		parts = append(parts, "password="+quoteDSN(c.Password))
+	}
+	if c.UnixSocket != "" {
+		parts = append(parts, "host="+quoteDSN(c.UnixSocket))
+	} else {
+		parts = append(parts, "host="+quoteDSN(c.Host), fmt.Sprintf("port=%d", c.Port))
+	}
+	return strings.Join(parts, " ")
+}
+
+// ensureDatabaseExists creates the library database if it is missing.
+// PostgreSQL has no CREATE DATABASE IF NOT EXISTS, so check the catalog,
+// and accept losing the race to another app or worker creating it.
+func (c PostgresConfig) ensureDatabaseExists() error {
+	conn, err := sql.Open("postgres", c.dataStoreName("postgres"))
+	if err != nil {
+		return fmt.Errorf("postgres: could not get a connection: %v", err)
+	}
+	defer conn.Close()
+
+	var exists bool
+	err = conn.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = 'library')`).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("postgres: could not connect to the database: %v", err)
+	}
+	if exists {
+		return nil
+	}
+	if _, err := conn.Exec(`CREATE DATABASE library ENCODING 'UTF8'`); err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "42P04" { // duplicate_database
+			return nil
+		}
+		return fmt.Errorf("postgres: could not create the library database: %v", err)
+	}
+	return nil
+}
+
+// newPostgresDB creates a new BookDatabase backed by a given PostgreSQL
+// server.
+func newPostgresDB(config PostgresConfig) (BookDatabase, error) {
+	// Check database exists and the schema is current. If not, create it.
+	if err := config.ensureDatabaseExists(); err != nil {
+		return nil, err
+	}
+	conn, err := sql.Open("postgres", config.dataStoreName("library"))
+	if err != nil {
+		return nil, fmt.Errorf("postgres: could not get a connection: %v", err)
+	}
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("postgres: could not establish a good connection: %v", err)
+	}
+	if err := migrate(conn, postgresDialect{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	db := &sqlDB{
+		conn:    conn,
+		dialect: postgresDialect{},
+	}
+
+	return db, nil
+}
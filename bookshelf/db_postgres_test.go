@@ -0,0 +1,44 @@
+package bookshelf_test
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+	"github.com/tony-yang/google-cloud-stack/bookshelf/bookshelftest"
+)
+
+// TestPostgresDB runs against the PostgreSQL server at POSTGRES_TEST_ADDR, a
+// host:port or unix socket directory, as DB_USER. It empties the library
+// database.
+func TestPostgresDB(t *testing.T) {
+	addr := os.Getenv("POSTGRES_TEST_ADDR")
+	if addr == "" {
+		t.Skip("POSTGRES_TEST_ADDR is not set")
+	}
+	config := bookshelf.PostgresConfig{Username: bookshelf.SQLUser, Password: bookshelf.SQLPassword}
+	if strings.HasPrefix(addr, "/") {
+		config.UnixSocket = addr
+	} else {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			t.Fatalf("invalid POSTGRES_TEST_ADDR %q: %v", addr, err)
+		}
+		config.Host = host
+		if config.Port, err = strconv.Atoi(port); err != nil {
+			t.Fatalf("invalid POSTGRES_TEST_ADDR port %q: %v", addr, err)
+		}
+	}
+
+	bookshelftest.TestBookDatabase(t, func(t *testing.T) bookshelf.BookDatabase {
+		db, err := bookshelf.NewPostgresDB(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bookshelf.EmptySQLDB(t, db)
+		return db
+	})
+}
@@ -0,0 +1,144 @@
+package bookshelf
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// replicaCheckInterval is how often replicas are pinged, so one that went
+// down is retried and one that came back is used again.
+const replicaCheckInterval = 10 * time.Second
+
+// replica is a read-only copy of the primary database.
+type replica struct {
+	name    string
+	conn    *sql.DB
+	healthy int32 // 1 if reads may be sent to it; accessed atomically
+}
+
+// markDown stops sending reads to the replica until it passes a health
+// check again.
+func (r *replica) markDown(err error) {
+	if atomic.SwapInt32(&r.healthy, 0) == 1 {
+		log.Printf("replica %s is unhealthy: %v", r.name, err)
+	}
+}
+
+// isConnError reports whether err means a server could not be reached or
+// dropped the connection, rather than that it failed the query.
+func isConnError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+func (r *replica) markUp() {
+	if atomic.SwapInt32(&r.healthy, 1) == 0 {
+		log.Printf("replica %s is healthy", r.name)
+	}
+}
+
+// replicaSet spreads reads over the healthy replicas, checking their health
+// in the background.
+type replicaSet struct {
+	replicas []*replica
+	next     uint32 // round robin position; accessed atomically
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newReplicaSet starts health checking the given replicas. They are used
+// once they first answer a ping.
+func newReplicaSet(replicas []*replica) *replicaSet {
+	s := &replicaSet{
+		replicas: replicas,
+		stop:     make(chan struct{}),
+	}
+	s.check()
+	go s.run()
+	return s
+}
+
+// pick returns the next healthy replica, or nil if there is none. It is
+// safe to call on a nil set.
+func (s *replicaSet) pick() *replica {
+	if s == nil {
+		return nil
+	}
+	n := uint32(len(s.replicas))
+	start := atomic.AddUint32(&s.next, 1)
+	for i := uint32(0); i < n; i++ {
+		r := s.replicas[(start+i)%n]
+		if atomic.LoadInt32(&r.healthy) == 1 {
+			return r
+		}
+	}
+	return nil
+}
+
+// check pings every replica and records whether it answered.
+func (s *replicaSet) check() {
+	for _, r := range s.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err := r.conn.PingContext(ctx)
+		cancel()
+		if err != nil {
+			r.markDown(err)
+		} else {
+			r.markUp()
+		}
+	}
+}
+
+func (s *replicaSet) run() {
+	t := time.NewTicker(replicaCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.check()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// close stops the health checks and closes the replica connections. It is
+// safe to call on a nil set.
+func (s *replicaSet) close() {
+	if s == nil {
+		return
+	}
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		for _, r := range s.replicas {
+			r.conn.Close()
+		}
+	})
+}
+
+// ReadPrimary returns a view of db whose reads go to the primary rather
+// than a replica or cache, for a user who has just written. Databases
+// without replicas are returned unchanged.
+func ReadPrimary(db BookDatabase) BookDatabase {
+	if p, ok := db.(interface{ Primary() BookDatabase }); ok {
+		return p.Primary()
+	}
+	return db
+}
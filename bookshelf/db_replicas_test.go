@@ -0,0 +1,54 @@
+package bookshelf
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplicaFallback(t *testing.T) {
+	dir := t.TempDir()
+	db, err := newSQLiteDB(SQLiteConfig{Path: filepath.Join(dir, "primary.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.AddBook(&Book{Title: "On the primary"}, testActor); err != nil {
+		t.Fatal(err)
+	}
+	// A replica the schema has not reached yet fails every query.
+	conn, err := sql.Open("sqlite", SQLiteConfig{Path: filepath.Join(dir, "replica.db")}.dataStoreName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &replica{name: "replica", conn: conn}
+	primary := db.(*sqlDB)
+	primary.replicas = newReplicaSet([]*replica{r})
+
+	books, err := primary.ListBooks()
+	if err != nil || len(books) != 1 {
+		t.Fatalf("ListBooks() = %v, %v, want the book on the primary", books, err)
+	}
+	if primary.replicas.pick() != r {
+		t.Errorf("replica was taken out of rotation for failing a query")
+	}
+}
+
+func TestIsConnError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{sql.ErrConnDone, true},
+		{errors.New("no such table: books"), false},
+		{sql.ErrNoRows, false},
+	}
+	for _, tt := range tests {
+		if got := isConnError(tt.err); got != tt.want {
+			t.Errorf("isConnError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -1,54 +1,95 @@
 package bookshelf
 
 import (
+	"context"
 	"database/sql"
-	"database/sql/driver"
-	"errors"
 	"fmt"
-
-	"github.com/go-sql-driver/mysql"
+	"strconv"
+	"strings"
+	"time"
 )
 
-var createTableStatements = []string{
-	`CREATE DATABASE IF NOT EXISTS library DEFAULT CHARACTER SET = 'utf8' DEFAULT COLLATE 'utf8_general_ci';`,
-	`USE library;`,
-	`CREATE TABLE IF NOT EXISTS books (
-		id INT UNSIGNED NOT NULL AUTO_INCREMENT,
-		title VARCHAR(255) NULL,
-		author VARCHAR(255) NULL,
-		publishedDate VARCHAR(255) NULL,
-		imageUrl VARCHAR(255) NULL,
-		description TEXT NULL,
-		createdBy VARCHAR(255) NULL,
-		createdById VARCHAR(255) NULL,
-		PRIMARY KEY (id)
-	);`,
-}
-
-// mysqlDB persists books to a MySQL instance.
-type mysqlDB struct {
+// dialect captures what differs between the SQL servers sqlDB can run on.
+type dialect interface {
+	// name identifies the server in error messages, e.g. "mysql".
+	name() string
+
+	// rebind rewrites the ? placeholders in query into the form the
+	// driver expects.
+	rebind(query string) string
+
+	// insert runs an INSERT statement and returns the ID of the new row.
+	insert(q querier, query string, args ...interface{}) (int64, error)
+
+	// isDuplicate reports whether err is a unique constraint violation.
+	isDuplicate(err error) bool
+
+	// forUpdate is appended to a SELECT inside a transaction to lock the
+	// rows it reads, or is empty where the transaction already excludes
+	// other writers.
+	forUpdate() string
+
+	// lockMigrations takes a lock that keeps concurrent processes from
+	// migrating the schema at the same time.
+	lockMigrations(ctx context.Context, conn *sql.Conn) (unlock func(), err error)
+
+	// migrations returns the schema migrations for this server, in order.
+	migrations() []migration
+}
+
+// querier is implemented by sql.DB, sql.Conn and sql.Tx.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// sqlDB persists books to a SQL database. The queries are shared by every
+// server; dialect covers the differences between them.
+type sqlDB struct {
+	// conn is the primary, which takes every write.
 	conn *sql.DB
+
+	// replicas, if set, serve reads while they are healthy.
+	replicas *replicaSet
+
+	dialect dialect
+
+	// view is set on databases returned by Primary, which share conn.
+	view bool
 }
 
-// Ensure mysqlDB conforms to the BookDatabase interface.
-var _ BookDatabase = &mysqlDB{}
+// Ensure sqlDB conforms to the BookDatabase interface.
+var _ BookDatabase = &sqlDB{}
+
+// errorf formats an error prefixed with the name of the SQL server.
+func (db *sqlDB) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf(db.dialect.name()+": "+format, args...)
+}
 
 // execSQL executes a given statement, expecting one row to be affected.
-func execSQL(stmt *sql.Stmt, args ...interface{}) (sql.Result, error) {
-	r, err := stmt.Exec(args...)
+// No affected rows is reported as ErrNotFound and a duplicate key as
+// ErrConflict.
+func (db *sqlDB) execSQL(q querier, query string, args ...interface{}) (sql.Result, error) {
+	r, err := q.Exec(db.dialect.rebind(query), args...)
 	if err != nil {
-		return r, fmt.Errorf("mysql: could not execute statement: %v", err)
+		if db.dialect.isDuplicate(err) {
+			return r, db.errorf("could not execute statement: %v: %w", err, ErrConflict)
+		}
+		return r, db.errorf("could not execute statement: %v", err)
 	}
 	rowsAffected, err := r.RowsAffected()
 	if err != nil {
-		return r, fmt.Errorf("mysql: could not get rows affected: %v", err)
+		return r, db.errorf("could not get rows affected: %v", err)
+	} else if rowsAffected == 0 {
+		return r, db.errorf("expected 1 row affected, got 0: %w", ErrNotFound)
 	} else if rowsAffected != 1 {
-		return r, fmt.Errorf("mysql: expected 1 row affected, got %d", rowsAffected)
+		return r, db.errorf("expected 1 row affected, got %d", rowsAffected)
 	}
 	return r, nil
 }
 
-//rowScanner is implemented by sql.Row and sql.Rows
+// rowScanner is implemented by sql.Row and sql.Rows
 type rowScanner interface {
 	Scan(dest ...interface{}) error
 }
@@ -64,219 +105,726 @@ func scanBook(row rowScanner) (*Book, error) {
 		description   sql.NullString
 		createdBy     sql.NullString
 		createdById   sql.NullString
+		deletedAt     sql.NullTime
+		deletedBy     sql.NullString
+		deletedById   sql.NullString
+		isbn10        sql.NullString
+		isbn13        sql.NullString
+		ratingCount   int
+		ratingSum     int
+		createdAt     sql.NullTime
+		updatedAt     sql.NullTime
 	)
-	if err := row.Scan(&id, &title, &author, &publishedDate, &imageUrl, &description, &createdBy, &createdById); err != nil {
+	if err := row.Scan(&id, &title, &author, &publishedDate, &imageUrl, &description, &createdBy, &createdById,
+		&deletedAt, &deletedBy, &deletedById, &isbn10, &isbn13, &ratingCount, &ratingSum,
+		&createdAt, &updatedAt); err != nil {
 		return nil, err
 	}
 
 	book := &Book{
-		ID:       id,
-		Title:    title.String,
-		Author:   author.String,
-		ImageURL: imageUrl.String,
+		ID:            id,
+		Title:         title.String,
+		Author:        author.String,
+		ImageURL:      imageUrl.String,
+		Description:   description.String,
+		PublishedDate: publishedDate.String,
+		ISBN10:        isbn10.String,
+		ISBN13:        isbn13.String,
+		DeletedAt:     deletedAt.Time,
+		DeletedBy:     deletedBy.String,
+		DeletedByID:   deletedById.String,
+		RatingCount:   ratingCount,
+		RatingSum:     ratingSum,
+		CreatedAt:     createdAt.Time,
+		UpdatedAt:     updatedAt.Time,
 	}
 	return book, nil
 }
 
-const listStatement = `SELECT * FROM books ORDER BY title`
+const bookColumns = `id, title, author, publishedDate, imageUrl, description, createdBy, createdById,
+deletedAt, deletedBy, deletedById, isbn10, isbn13, ratingCount, ratingSum, createdAt, updatedAt`
 
-// ListBooks lists all books, ordered by title.
-func (m *mysqlDB) ListBooks() ([]*Book, error) {
-	fmt.Println("DB ListBook")
-	list, err := m.conn.Prepare(listStatement)
-	if err != nil {
-		return nil, fmt.Errorf("mysql: prepare list: %v", err)
+// nullString stores an empty string as NULL, so the unique index on ISBNs
+// ignores books without one.
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// now returns the current time as it is stored: in UTC, to the second, which
+// is all a MySQL DATETIME keeps.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+// read runs f against a healthy read replica, falling back to the primary
+// when there is none or the replica fails. Only a replica that cannot be
+// reached is taken out of rotation; one that fails a query, say while a
+// migration has yet to reach it, keeps serving others.
+func (db *sqlDB) read(f func(q querier) error) error {
+	if r := db.replicas.pick(); r != nil {
+		err := f(r.conn)
+		if err == nil || err == sql.ErrNoRows {
+			return err
+		}
+		if isConnError(err) {
+			r.markDown(err)
+		}
 	}
-	rows, err := list.Query()
+	return f(db.conn)
+}
+
+// selectBooks runs a query returning books with q.
+func (db *sqlDB) selectBooks(q querier, query string, args ...interface{}) ([]*Book, error) {
+	rows, err := q.Query(db.dialect.rebind(query), args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-
 	var books []*Book
 	for rows.Next() {
 		book, err := scanBook(rows)
 		if err != nil {
-			return nil, fmt.Errorf("mysql: could not read row: %v", err)
+			return nil, err
 		}
 		books = append(books, book)
 	}
+	return books, rows.Err()
+}
+
+// queryBooks runs a query returning books, on a replica when possible.
+func (db *sqlDB) queryBooks(query string, args ...interface{}) ([]*Book, error) {
+	var books []*Book
+	err := db.read(func(q querier) error {
+		var err error
+		books, err = db.selectBooks(q, query, args...)
+		return err
+	})
+	return books, err
+}
+
+// loadDetails sets the contributors, tags and genres of book.
+func (db *sqlDB) loadDetails(q querier, book *Book) error {
+	if err := db.loadContributors(q, "ba.bookId = ?", []interface{}{book.ID}, book); err != nil {
+		return err
+	}
+	return db.loadTags(q, "bt.bookId = ?", []interface{}{book.ID}, book)
+}
+
+// queryBook runs a query returning one book, with its contributors and
+// tags, on a replica when possible.
+func (db *sqlDB) queryBook(query string, args ...interface{}) (*Book, error) {
+	var book *Book
+	err := db.read(func(q querier) error {
+		var err error
+		if book, err = scanBook(q.QueryRow(db.dialect.rebind(query), args...)); err != nil {
+			return err
+		}
+		return db.loadDetails(q, book)
+	})
+	return book, err
+}
+
+const listStatement = `SELECT ` + bookColumns + ` FROM books WHERE deletedAt IS NULL ORDER BY LOWER(title)`
+
+// ListBooks lists all books, ordered by title.
+func (db *sqlDB) ListBooks() ([]*Book, error) {
+	books, err := db.queryBooks(listStatement)
+	if err != nil {
+		return nil, db.errorf("could not list books: %v", err)
+	}
 	return books, nil
 }
 
-const getStatement = `SELECT * FROM books WHERE id = ?`
+const getStatement = `SELECT ` + bookColumns + ` FROM books WHERE id = ? AND deletedAt IS NULL`
 
 // GetBook retrieves a book by its ID.
-func (m *mysqlDB) GetBook(id int64) (*Book, error) {
-	fmt.Println("DB GetBook")
-	get, err := m.conn.Prepare(getStatement)
-	if err != nil {
-		return nil, fmt.Errorf("mysql: prepare get: %v", err)
+func (db *sqlDB) GetBook(id int64) (*Book, error) {
+	book, err := db.queryBook(getStatement, id)
+	if err == sql.ErrNoRows {
+		return nil, db.errorf("could not find book with id %d: %w", id, ErrNotFound)
+	} else if err != nil {
+		return nil, db.errorf("could not get book: %v", err)
 	}
+	return book, nil
+}
 
-	row := get.QueryRow(id)
-	book, err := scanBook(row)
+const getByISBNStatement = `SELECT ` + bookColumns + ` FROM books WHERE isbn13 = ? AND deletedAt IS NULL`
+
+// GetBookByISBN retrieves a book by its ISBN-10 or ISBN-13.
+func (db *sqlDB) GetBookByISBN(isbn string) (*Book, error) {
+	_, isbn13, err := NormalizeISBN(isbn)
+	if err != nil {
+		return nil, err
+	}
+	book, err := db.queryBook(getByISBNStatement, isbn13)
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("mysql: could not find book with id %d", id)
+		return nil, db.errorf("could not find book with ISBN %s: %w", isbn13, ErrNotFound)
 	} else if err != nil {
-		return nil, fmt.Errorf("mysql: could not get book: %v", err)
+		return nil, db.errorf("could not get book: %v", err)
 	}
 	return book, nil
 }
 
+// searchStatement matches titles and authors case-insensitively. '!' is
+// the LIKE escape because backslash is treated differently by each server.
+const searchStatement = `SELECT ` + bookColumns + ` FROM books
+WHERE deletedAt IS NULL AND (LOWER(title) LIKE ? ESCAPE '!' OR LOWER(author) LIKE ? ESCAPE '!')
+ORDER BY LOWER(title)`
+
+// likeEscape escapes the LIKE wildcards in s.
+func likeEscape(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+// likePattern returns a LIKE pattern matching s anywhere in a value.
+func likePattern(s string) string {
+	return "%" + likeEscape(strings.ToLower(s)) + "%"
+}
+
+// SearchBooks lists the books whose title or author contains query,
+// ordered by title.
+func (db *sqlDB) SearchBooks(query string) ([]*Book, error) {
+	pattern := likePattern(query)
+	books, err := db.queryBooks(searchStatement, pattern, pattern)
+	if err != nil {
+		return nil, db.errorf("could not search books: %v", err)
+	}
+	return books, nil
+}
+
+// inTx runs f in a transaction on the primary, committing it if f
+// succeeds. Errors from f are returned as they are.
+func (db *sqlDB) inTx(f func(tx *sql.Tx) error) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return db.errorf("could not begin transaction: %v", err)
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return db.errorf("could not commit transaction: %v", err)
+	}
+	return nil
+}
+
+const insertHistoryStatement = `
+INSERT INTO book_history (bookId, action, actorId, actorName, source, changedAt, diff) VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+// recordChange appends a change to a book's history inside tx.
+func (db *sqlDB) recordChange(tx *sql.Tx, bookID int64, action string, by Actor, diff []FieldChange) error {
+	_, err := tx.Exec(db.dialect.rebind(insertHistoryStatement),
+		bookID, action, by.ID, by.Name, by.Source, now(), encodeDiff(diff))
+	if err != nil {
+		return db.errorf("could not record %s of book %d: %v", action, bookID, err)
+	}
+	return nil
+}
+
 const insertStatement = `
-INSERT INTO books (title, author, imageUrl) VALUES (?, ?, ?)`
+INSERT INTO books (title, author, imageUrl, description, publishedDate, isbn10, isbn13, createdAt, updatedAt)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
 // AddBook saves a given book, assigning it a new ID
-func (m *mysqlDB) AddBook(b *Book) (id int64, err error) {
-	fmt.Println("DB AddBook")
-	insert, err := m.conn.Prepare(insertStatement)
-	if err != nil {
-		return -1, fmt.Errorf("mysql: prepare insert: %v", err)
+func (db *sqlDB) AddBook(b *Book, by Actor) (id int64, err error) {
+	if err := b.normalize(); err != nil {
+		return -1, err
 	}
-	r, err := execSQL(insert, b.Title, b.Author, b.ImageURL)
+	if err := b.normalizeContributors(nil); err != nil {
+		return -1, err
+	}
+	err = db.inTx(func(tx *sql.Tx) error {
+		var err error
+		at := now()
+		id, err = db.dialect.insert(tx, db.dialect.rebind(insertStatement),
+			b.Title, b.Author, b.ImageURL, nullString(b.Description), nullString(b.PublishedDate),
+			nullString(b.ISBN10), nullString(b.ISBN13), at, at)
+		if err != nil {
+			if db.dialect.isDuplicate(err) {
+				return db.errorf("could not insert book: %v: %w", err, ErrConflict)
+			}
+			return db.errorf("could not insert book: %v", err)
+		}
+		if err := db.writeContributors(tx, id, b.Contributors); err != nil {
+			return err
+		}
+		if err := db.writeTags(tx, id, b.Tags, b.Genres); err != nil {
+			return err
+		}
+		return db.recordChange(tx, id, ChangeCreate, by, diffBooks(nil, b))
+	})
 	if err != nil {
 		return -1, err
 	}
+	return id, nil
+}
+
+const deleteStatement = `
+UPDATE books SET deletedAt=?, deletedBy=?, deletedById=? WHERE id=? AND deletedAt IS NULL`
+
+// DeleteBook moves a given book to the trash
+func (db *sqlDB) DeleteBook(id int64, by Actor) error {
+	if id == 0 {
+		return db.errorf("book with unassigned ID passed into deleteBook: %w", ErrInvalid)
+	}
+	return db.inTx(func(tx *sql.Tx) error {
+		if _, err := db.execSQL(tx, deleteStatement, now(), by.Name, by.ID, id); err != nil {
+			return err
+		}
+		return db.recordChange(tx, id, ChangeDelete, by, nil)
+	})
+}
 
-	lastInsertID, err := r.LastInsertId()
+const listDeletedStatement = `SELECT ` + bookColumns + ` FROM books
+WHERE deletedAt IS NOT NULL ORDER BY deletedAt DESC, id DESC`
+
+// ListDeletedBooks lists the books in the trash, most recently deleted
+// first.
+func (db *sqlDB) ListDeletedBooks() ([]*Book, error) {
+	books, err := db.queryBooks(listDeletedStatement)
 	if err != nil {
-		return -1, fmt.Errorf("mysql: could not get last insert ID: %v", err)
+		return nil, db.errorf("could not list deleted books: %v", err)
 	}
-	return lastInsertID, nil
+	return books, nil
 }
 
-const deleteStatement = `DELETE FROM books WHERE id = ?`
+const restoreStatement = `
+UPDATE books SET deletedAt=NULL, deletedBy=NULL, deletedById=NULL WHERE id=? AND deletedAt IS NOT NULL`
 
-// DeleteBook removes a given book by its ID
-func (m *mysqlDB) DeleteBook(id int64) error {
-	fmt.Println("DB DeleteBook")
-	if id == 0 {
-		return errors.New("mysql: book with unassigned ID passed into deleteBook")
+// RestoreBook takes a given book out of the trash
+func (db *sqlDB) RestoreBook(id int64, by Actor) error {
+	return db.inTx(func(tx *sql.Tx) error {
+		if _, err := db.execSQL(tx, restoreStatement, id); err != nil {
+			return err
+		}
+		return db.recordChange(tx, id, ChangeRestore, by, nil)
+	})
+}
+
+const (
+	getDeletedStatement = `SELECT ` + bookColumns + ` FROM books WHERE id = ? AND deletedAt IS NOT NULL`
+	purgeStatement      = `DELETE FROM books WHERE id = ? AND deletedAt IS NOT NULL`
+)
+
+// purgeDetails removes the rows other tables hold for a book being purged
+// inside tx.
+func (db *sqlDB) purgeDetails(tx *sql.Tx, id int64) error {
+	if err := db.writeContributors(tx, id, nil); err != nil {
+		return err
+	}
+	if err := db.writeTags(tx, id, nil, nil); err != nil {
+		return err
+	}
+	if err := db.purgeReadings(tx, id); err != nil {
+		return err
+	}
+	if err := db.purgeLending(tx, id); err != nil {
+		return err
 	}
-	delete, err := m.conn.Prepare(deleteStatement)
+	return db.purgeReviews(tx, id)
+}
+
+// PurgeBook permanently removes a given book from the trash
+func (db *sqlDB) PurgeBook(id int64, by Actor) (*Book, error) {
+	var book *Book
+	err := db.inTx(func(tx *sql.Tx) error {
+		var err error
+		book, err = scanBook(tx.QueryRow(db.dialect.rebind(getDeletedStatement+db.dialect.forUpdate()), id))
+		if err == sql.ErrNoRows {
+			return db.errorf("could not find deleted book with id %d: %w", id, ErrNotFound)
+		} else if err != nil {
+			return db.errorf("could not get deleted book: %v", err)
+		}
+		if _, err := db.execSQL(tx, purgeStatement, id); err != nil {
+			return err
+		}
+		if err := db.purgeDetails(tx, id); err != nil {
+			return err
+		}
+		return db.recordChange(tx, id, ChangePurge, by, nil)
+	})
 	if err != nil {
-		return fmt.Errorf("mysql: prepare delete: %v", err)
+		return nil, err
 	}
-	_, err = execSQL(delete, id)
-	return err
+	return book, nil
 }
 
-const updateStatement = `UPDATE books SET title=?, author=? WHERE id=?`
+const listDeletedBeforeStatement = `SELECT ` + bookColumns + ` FROM books
+WHERE deletedAt IS NOT NULL AND deletedAt < ?`
 
-// UpdateBook updates the entry for a given book
-func (m *mysqlDB) UpdateBook(b *Book) error {
-	fmt.Println("DB UpdateBook")
-	update, err := m.conn.Prepare(updateStatement)
+// PurgeDeletedBooks permanently removes the books deleted before a given
+// time.
+func (db *sqlDB) PurgeDeletedBooks(before time.Time, by Actor) ([]*Book, error) {
+	var books []*Book
+	err := db.inTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(db.dialect.rebind(listDeletedBeforeStatement+db.dialect.forUpdate()), before.UTC())
+		if err != nil {
+			return db.errorf("could not list deleted books: %v", err)
+		}
+		for rows.Next() {
+			book, err := scanBook(rows)
+			if err != nil {
+				rows.Close()
+				return db.errorf("could not list deleted books: %v", err)
+			}
+			books = append(books, book)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return db.errorf("could not list deleted books: %v", err)
+		}
+
+		for _, b := range books {
+			if _, err := db.execSQL(tx, purgeStatement, b.ID); err != nil {
+				return err
+			}
+			if err := db.purgeDetails(tx, b.ID); err != nil {
+				return err
+			}
+			if err := db.recordChange(tx, b.ID, ChangePurge, by, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("mysql: prepare update: %v", err)
+		return nil, err
 	}
-	_, err = execSQL(update, b.Title, b.Author, b.ID)
-	return err
+	return books, nil
 }
 
-// Close closes the database, freeing up resources
-func (m *mysqlDB) Close() {
-	fmt.Println("DB close")
-	m.conn.Close()
+// lockBook reads a book outside the trash, with its contributors and tags,
+// locking its row until tx ends.
+func (db *sqlDB) lockBook(tx *sql.Tx, id int64) (*Book, error) {
+	book, err := scanBook(tx.QueryRow(db.dialect.rebind(getStatement+db.dialect.forUpdate()), id))
+	if err == sql.ErrNoRows {
+		return nil, db.errorf("could not find book with id %d: %w", id, ErrNotFound)
+	} else if err != nil {
+		return nil, db.errorf("could not get book: %v", err)
+	}
+	if err := db.loadDetails(tx, book); err != nil {
+		return nil, db.errorf("could not get details of book %d: %v", id, err)
+	}
+	return book, nil
 }
 
-type MySQLConfig struct {
-	// Optional.
-	Username, Password string
+const updateStatement = `
+UPDATE books SET title=?, author=?, imageUrl=?, description=?, publishedDate=?, isbn10=?, isbn13=?, updatedAt=?
+WHERE id=? AND deletedAt IS NULL`
 
-	// Host of the MySQL instance.
-	//
-	// If set, UnixSocket shoud be unset.
-	Host string
+// UpdateBook updates the entry for a given book
+func (db *sqlDB) UpdateBook(b *Book, by Actor) error {
+	if b.ID == 0 {
+		return db.errorf("book with unassigned ID passed into updateBook: %w", ErrInvalid)
+	}
+	if err := b.normalize(); err != nil {
+		return err
+	}
+	return db.inTx(func(tx *sql.Tx) error {
+		// Lock the row so the diff is against what the update replaces.
+		old, err := db.lockBook(tx, b.ID)
+		if err != nil {
+			return err
+		}
+		if err := b.normalizeContributors(old); err != nil {
+			return err
+		}
+		diff := diffBooks(old, b)
+		if len(diff) == 0 {
+			return nil
+		}
+		if _, err := db.execSQL(tx, updateStatement,
+			b.Title, b.Author, b.ImageURL, nullString(b.Description), nullString(b.PublishedDate),
+			nullString(b.ISBN10), nullString(b.ISBN13), now(), b.ID); err != nil {
+			return err
+		}
+		if err := db.writeContributors(tx, b.ID, b.Contributors); err != nil {
+			return err
+		}
+		if err := db.writeTags(tx, b.ID, b.Tags, b.Genres); err != nil {
+			return err
+		}
+		return db.recordChange(tx, b.ID, ChangeUpdate, by, diff)
+	})
+}
 
-	// Port of the MySQL instance.
-	//
-	// If set, UnixSocket should be unset.
-	Port int
+const (
+	deleteMergedStatement = `DELETE FROM books WHERE id = ? AND deletedAt IS NULL`
+	moveHistoryStatement  = `UPDATE book_history SET bookId = ? WHERE bookId = ?`
+)
 
-	// UnixSocket is the filepath to a unix socket.
-	//
-	// If set, Host and Port should be unset.
-	UnixSocket string
+// MergeBook saves into, moves the history of the book with dupID to it and
+// removes that book
+func (db *sqlDB) MergeBook(into *Book, dupID int64, by Actor) error {
+	if into.ID == 0 || dupID == 0 || into.ID == dupID {
+		return db.errorf("cannot merge book %d into book %d: %w", dupID, into.ID, ErrInvalid)
+	}
+	if err := into.normalize(); err != nil {
+		return err
+	}
+	return db.inTx(func(tx *sql.Tx) error {
+		old, err := db.lockBook(tx, into.ID)
+		if err != nil {
+			return err
+		}
+		if err := into.normalizeContributors(old); err != nil {
+			return err
+		}
+		// Removing the duplicate first frees its ISBN for the merged book.
+		if _, err := db.execSQL(tx, deleteMergedStatement, dupID); err != nil {
+			return err
+		}
+		if err := db.writeContributors(tx, dupID, nil); err != nil {
+			return err
+		}
+		if err := db.writeTags(tx, dupID, nil, nil); err != nil {
+			return err
+		}
+		if err := db.moveReadings(tx, into.ID, dupID); err != nil {
+			return err
+		}
+		if err := db.moveLending(tx, into.ID, dupID); err != nil {
+			return err
+		}
+		if err := db.moveReviews(tx, into.ID, dupID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(db.dialect.rebind(moveHistoryStatement), into.ID, dupID); err != nil {
+			return db.errorf("could not move history of book %d: %v", dupID, err)
+		}
+		if _, err := db.execSQL(tx, updateStatement,
+			into.Title, into.Author, into.ImageURL, nullString(into.Description), nullString(into.PublishedDate),
+			nullString(into.ISBN10), nullString(into.ISBN13), now(), into.ID); err != nil {
+			return err
+		}
+		if err := db.writeContributors(tx, into.ID, into.Contributors); err != nil {
+			return err
+		}
+		if err := db.writeTags(tx, into.ID, into.Tags, into.Genres); err != nil {
+			return err
+		}
+		diff := append(diffBooks(old, into), FieldChange{Field: mergedFromField, New: strconv.FormatInt(dupID, 10)})
+		return db.recordChange(tx, into.ID, ChangeMerge, by, diff)
+	})
 }
 
-// dataStoreName returns a connecton string suitable for sql.Open.
-func (c MySQLConfig) dataStoreName(dbName string) string {
-	cred := ""
-	if c.Username != "" {
-		cred = c.Username
-		if c.Password != "" {
-			cred = cred + ":" + c.Password
-		}
-		cred = cred + "@"
+const historyColumns = `id, bookId, action, actorId, actorName, source, changedAt, diff`
+
+// scanChange reads a history entry from a sql.Row or sql.Rows.
+func scanChange(row rowScanner) (*BookChange, error) {
+	var (
+		c                          BookChange
+		actorID, actorName, source sql.NullString
+		diff                       sql.NullString
+	)
+	if err := row.Scan(&c.ID, &c.BookID, &c.Action, &actorID, &actorName, &source, &c.Time, &diff); err != nil {
+		return nil, err
 	}
-	if c.UnixSocket != "" {
-		return fmt.Sprintf("%sunix(%s)/%s", cred, c.UnixSocket, dbName)
+	c.Actor = Actor{ID: actorID.String, Name: actorName.String, Source: source.String}
+	var err error
+	if c.Diff, err = decodeDiff(diff.String); err != nil {
+		return nil, err
 	}
-	return fmt.Sprintf("%stcp([%s]:%d)/%s", cred, c.Host, c.Port, dbName)
+	return &c, nil
 }
 
-func createTable(conn *sql.DB) error {
-	for _, stmt := range createTableStatements {
-		_, err := conn.Exec(stmt)
+// queryChanges runs a query returning history entries, on a replica when
+// possible.
+func (db *sqlDB) queryChanges(query string, args ...interface{}) ([]*BookChange, error) {
+	var changes []*BookChange
+	err := db.read(func(q querier) error {
+		changes = nil
+		rows, err := q.Query(db.dialect.rebind(query), args...)
 		if err != nil {
 			return err
 		}
-	}
-	return nil
+		defer rows.Close()
+		for rows.Next() {
+			c, err := scanChange(rows)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, c)
+		}
+		return rows.Err()
+	})
+	return changes, err
 }
 
-// ensureTableExists checks the table exists. If not, it creates it.
-func (c MySQLConfig) ensureTableExists() error {
-	conn, err := sql.Open("mysql", c.dataStoreName(""))
+const historyStatement = `SELECT ` + historyColumns + ` FROM book_history WHERE bookId = ? ORDER BY id DESC`
+
+// BookHistory lists the changes made to a given book, newest first.
+func (db *sqlDB) BookHistory(id int64) ([]*BookChange, error) {
+	changes, err := db.queryChanges(historyStatement, id)
 	if err != nil {
-		return fmt.Errorf("mysql: could not get a connection: %v", err)
+		return nil, db.errorf("could not get history of book %d: %v", id, err)
 	}
-	defer conn.Close()
+	return changes, nil
+}
 
-	// Check the connection.
-	if conn.Ping() == driver.ErrBadConn {
-		return fmt.Errorf("mysql: could not connect to the database. " +
-			"could be bad address, or this address is not whitelisted for access.")
+// AuditLog lists the changes selected by q, newest first.
+func (db *sqlDB) AuditLog(q AuditQuery) ([]*BookChange, error) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	add := func(cond string, arg interface{}) {
+		where = append(where, cond)
+		args = append(args, arg)
+	}
+	if q.BookID != 0 {
+		add("bookId = ?", q.BookID)
+	}
+	if q.ActorID != "" {
+		add("actorId = ?", q.ActorID)
+	}
+	if q.Source != "" {
+		add("source = ?", q.Source)
+	}
+	if q.Action != "" {
+		add("action = ?", q.Action)
+	}
+	if !q.Since.IsZero() {
+		add("changedAt >= ?", q.Since.UTC())
 	}
+	if !q.Until.IsZero() {
+		add("changedAt < ?", q.Until.UTC())
+	}
+	if q.BeforeID != 0 {
+		add("id < ?", q.BeforeID)
+	}
+	query := `SELECT ` + historyColumns + ` FROM book_history`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT %d", q.limit())
 
-	if _, err := conn.Exec("USE library"); err != nil {
-		// MySQL error 1049 is "database does not exist".
-		if mErr, ok := err.(*mysql.MySQLError); ok && mErr.Number == 1049 {
-			return createTable(conn)
-		}
+	changes, err := db.queryChanges(query, args...)
+	if err != nil {
+		return nil, db.errorf("could not query audit log: %v", err)
 	}
+	return changes, nil
+}
 
-	if _, err := conn.Exec("DESCRIBE books"); err != nil {
-		// MySQL error 1146 is "table does not exist".
-		if mErr, ok := err.(*mysql.MySQLError); ok && mErr.Number == 1146 {
-			return createTable(conn)
-		}
-		// Unknown error.
-		return fmt.Errorf("mysql: could not connect to the database: %v", err)
+// Primary returns a view of the database that reads from the primary, so
+// a user sees their own writes before the replicas catch up. Closing the
+// view does nothing.
+func (db *sqlDB) Primary() BookDatabase {
+	return &sqlDB{
+		conn:    db.conn,
+		dialect: db.dialect,
+		view:    true,
 	}
-	return nil
 }
 
-// newMySQLDB creates a new BookDatabase backed by a given MySQL server.
-func newMySQLDB(config MySQLConfig) (BookDatabase, error) {
-	// Check database and table exists. If not, create it.
-	if err := config.ensureTableExists(); err != nil {
-		return nil, err
+// Close closes the database, freeing up resources
+func (db *sqlDB) Close() {
+	if db.view {
+		return
+	}
+	db.replicas.close()
+	db.conn.Close()
+}
+
+// migration is one step in the evolution of the schema. Versions are
+// shared by every dialect so the same step has the same number everywhere.
+type migration struct {
+	version int
+	stmts   []string
+
+	// sqlite, if set, replaces stmts when the SQLite backend replays a
+	// MySQL migration whose syntax SQLite does not accept.
+	sqlite []string
+
+	// fn, if set, runs after stmts in the same transaction, for data
+	// migrations that need Go.
+	fn func(tx *sql.Tx, d dialect) error
+}
+
+const createMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER NOT NULL PRIMARY KEY
+)`
+
+// migrate brings the schema up to date, applying each migration that has
+// not been recorded in schema_migrations yet.
+func migrate(conn *sql.DB, d dialect) error {
+	ctx := context.Background()
+	c, err := conn.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: could not get a connection: %v", d.name(), err)
 	}
-	conn, err := sql.Open("mysql", config.dataStoreName("library"))
+	defer c.Close()
+
+	unlock, err := d.lockMigrations(ctx, c)
 	if err != nil {
-		return nil, fmt.Errorf("mysql: could not get a connection: %v", err)
+		return fmt.Errorf("%s: could not lock migrations: %v", d.name(), err)
+	}
+	defer unlock()
+
+	if _, err := c.ExecContext(ctx, createMigrationsTable); err != nil {
+		return fmt.Errorf("%s: could not create schema_migrations: %v", d.name(), err)
 	}
-	if err := conn.Ping(); err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("mysql: could not establish a good connection: %v", err)
+	var current int
+	if err := c.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("%s: could not read schema version: %v", d.name(), err)
 	}
 
-	db := &mysqlDB{
-		conn: conn,
+	for _, m := range d.migrations() {
+		if m.version <= current {
+			continue
+		}
+		tx, err := c.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("%s: migration %d: %v", d.name(), m.version, err)
+		}
+		// Another process may have applied it since the version was read.
+		var applied int
+		if err := tx.QueryRow(d.rebind(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`), m.version).Scan(&applied); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%s: migration %d: %v", d.name(), m.version, err)
+		}
+		if applied > 0 {
+			tx.Rollback()
+			continue
+		}
+		for _, stmt := range m.stmts {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("%s: migration %d: %v", d.name(), m.version, err)
+			}
+		}
+		if m.fn != nil {
+			if err := m.fn(tx, d); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("%s: migration %d: %v", d.name(), m.version, err)
+			}
+		}
+		if _, err := tx.Exec(d.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), m.version); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%s: migration %d: %v", d.name(), m.version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("%s: migration %d: %v", d.name(), m.version, err)
+		}
 	}
+	return nil
+}
 
-	return db, nil
+// rebindDollar rewrites ? placeholders as $1, $2, ... in order.
+func rebindDollar(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
 }
@@ -0,0 +1,207 @@
+package bookshelf
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const (
+	selectAuthorIDStatement     = `SELECT id FROM authors WHERE nameKey = ?`
+	insertAuthorStatement       = `INSERT INTO authors (name, nameKey) VALUES (?, ?)`
+	deleteContributorsStatement = `DELETE FROM book_authors WHERE bookId = ?`
+	insertContributorStatement  = `INSERT INTO book_authors (bookId, authorId, role, seq) VALUES (?, ?, ?, ?)`
+	contributorsStatement       = `SELECT ba.bookId, a.id, a.name, ba.role FROM book_authors ba JOIN authors a ON a.id = ba.authorId`
+)
+
+// authorID returns the ID of the author with the given name, adding the
+// author if there is none. Names are matched as normalized by
+// NormalizeAuthor, so "Tolkien, J.R.R." finds "J.R.R. Tolkien". Of two
+// transactions adding the same new author at once, the second fails on the
+// unique index.
+func authorID(q querier, d dialect, name string) (int64, error) {
+	key := NormalizeAuthor(name)
+	var id int64
+	err := q.QueryRow(d.rebind(selectAuthorIDStatement), key).Scan(&id)
+	if err == nil {
+		return id, nil
+	} else if err != sql.ErrNoRows {
+		return 0, err
+	}
+	return d.insert(q, d.rebind(insertAuthorStatement), name, key)
+}
+
+// saveContributors replaces the contributors of a book, setting their
+// author IDs.
+func saveContributors(q querier, d dialect, bookID int64, cs []Contributor) error {
+	if _, err := q.Exec(d.rebind(deleteContributorsStatement), bookID); err != nil {
+		return err
+	}
+	for i := range cs {
+		id, err := authorID(q, d, cs[i].Name)
+		if err != nil {
+			return err
+		}
+		cs[i].AuthorID = id
+		if _, err := q.Exec(d.rebind(insertContributorStatement), bookID, id, cs[i].Role, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeContributors replaces the contributors of a book inside tx.
+func (db *sqlDB) writeContributors(tx *sql.Tx, bookID int64, cs []Contributor) error {
+	if err := saveContributors(tx, db.dialect, bookID, cs); err != nil {
+		if db.dialect.isDuplicate(err) {
+			return db.errorf("could not save contributors of book %d: %v: %w", bookID, err, ErrConflict)
+		}
+		return db.errorf("could not save contributors of book %d: %v", bookID, err)
+	}
+	return nil
+}
+
+// loadContributors sets the contributors of books, reading the rows of
+// book_authors that where selects.
+func (db *sqlDB) loadContributors(q querier, where string, args []interface{}, books ...*Book) error {
+	byID := make(map[int64]*Book, len(books))
+	for _, b := range books {
+		b.Contributors = nil
+		byID[b.ID] = b
+	}
+	rows, err := q.Query(db.dialect.rebind(contributorsStatement+" WHERE "+where+" ORDER BY ba.bookId, ba.seq"), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			bookID int64
+			c      Contributor
+		)
+		if err := rows.Scan(&bookID, &c.AuthorID, &c.Name, &c.Role); err != nil {
+			return err
+		}
+		if b, ok := byID[bookID]; ok {
+			b.Contributors = append(b.Contributors, c)
+		}
+	}
+	return rows.Err()
+}
+
+// splitAuthorStrings is the data migration that fills book_authors from
+// the author strings of the books written before it existed.
+func splitAuthorStrings(tx *sql.Tx, d dialect) error {
+	type book struct {
+		id     int64
+		author string
+	}
+	var books []book
+	rows, err := tx.Query(`SELECT id, author FROM books WHERE author IS NOT NULL AND author <> ''`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var b book
+		if err := rows.Scan(&b.id, &b.author); err != nil {
+			rows.Close()
+			return err
+		}
+		books = append(books, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// Some drivers cannot run statements while rows are open, so the books
+	// are read first.
+	for _, b := range books {
+		if err := saveContributors(tx, d, b.id, ParseContributors(b.author)); err != nil {
+			return fmt.Errorf("could not split the author of book %d: %v", b.id, err)
+		}
+	}
+	return nil
+}
+
+// scanAuthors reads the id and name of each author in rows.
+func scanAuthors(rows *sql.Rows) ([]*Author, error) {
+	defer rows.Close()
+	var authors []*Author
+	for rows.Next() {
+		a := &Author{}
+		if err := rows.Scan(&a.ID, &a.Name); err != nil {
+			return nil, err
+		}
+		authors = append(authors, a)
+	}
+	return authors, rows.Err()
+}
+
+const getAuthorStatement = `SELECT id, name FROM authors WHERE id = ?`
+
+// GetAuthor retrieves an author by ID.
+func (db *sqlDB) GetAuthor(id int64) (*Author, error) {
+	a := &Author{}
+	err := db.read(func(q querier) error {
+		return q.QueryRow(db.dialect.rebind(getAuthorStatement), id).Scan(&a.ID, &a.Name)
+	})
+	if err == sql.ErrNoRows {
+		return nil, db.errorf("could not find author with id %d: %w", id, ErrNotFound)
+	} else if err != nil {
+		return nil, db.errorf("could not get author: %v", err)
+	}
+	return a, nil
+}
+
+const listAuthorBooksStatement = `SELECT ` + bookColumns + ` FROM books
+WHERE deletedAt IS NULL AND id IN (SELECT bookId FROM book_authors WHERE authorId = ?)
+ORDER BY LOWER(title)`
+
+// ListAuthorBooks lists the books an author contributed to, ordered by
+// title.
+func (db *sqlDB) ListAuthorBooks(authorID int64) ([]*Book, error) {
+	books, err := db.queryBooks(listAuthorBooksStatement, authorID)
+	if err != nil {
+		return nil, db.errorf("could not list books of author %d: %v", authorID, err)
+	}
+	err = db.read(func(q querier) error {
+		err := db.loadContributors(q, "ba.bookId IN (SELECT bookId FROM book_authors WHERE authorId = ?)",
+			[]interface{}{authorID}, books...)
+		if err != nil {
+			return err
+		}
+		return db.loadTags(q, "bt.bookId IN (SELECT bookId FROM book_authors WHERE authorId = ?)",
+			[]interface{}{authorID}, books...)
+	})
+	if err != nil {
+		return nil, db.errorf("could not list books of author %d: %v", authorID, err)
+	}
+	return books, nil
+}
+
+// searchAuthorsStatement matches a prefix of any word of the normalized
+// name, leaving out authors without books.
+const searchAuthorsStatement = `SELECT id, name FROM authors
+WHERE (nameKey LIKE ? ESCAPE '!' OR nameKey LIKE ? ESCAPE '!') AND id IN (SELECT authorId FROM book_authors)
+ORDER BY nameKey LIMIT %d`
+
+// SearchAuthors lists the authors with a word of their name starting with
+// prefix, ordered by name.
+func (db *sqlDB) SearchAuthors(prefix string, limit int) ([]*Author, error) {
+	if limit <= 0 {
+		limit = DefaultAuthorSearchLimit
+	}
+	p := likeEscape(normalizeText(prefix)) + "%"
+	var authors []*Author
+	err := db.read(func(q querier) error {
+		rows, err := q.Query(db.dialect.rebind(fmt.Sprintf(searchAuthorsStatement, limit)), p, "% "+p)
+		if err != nil {
+			return err
+		}
+		authors, err = scanAuthors(rows)
+		return err
+	})
+	if err != nil {
+		return nil, db.errorf("could not search authors: %v", err)
+	}
+	return authors, nil
+}
@@ -0,0 +1,451 @@
+package bookshelf
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+const (
+	copyColumns = `id, bookId, label, addedAt`
+	loanColumns = `id, copyId, bookId, userId, userName, checkedOutAt, dueAt, returnedAt, overdueAt`
+	holdColumns = `bookId, userId, userName, placedAt`
+
+	insertCopyStatement = `INSERT INTO copies (bookId, label, addedAt) VALUES (?, ?, ?)`
+	listCopiesStatement = `SELECT ` + copyColumns + ` FROM copies WHERE bookId = ? ORDER BY id`
+	deleteCopyStatement = `DELETE FROM copies WHERE id = ? AND bookId = ?`
+	copyLentStatement   = `SELECT COUNT(*) FROM loans WHERE copyId = ? AND returnedAt IS NULL`
+
+	openLoansStatement       = `SELECT ` + loanColumns + ` FROM loans WHERE bookId = ? AND returnedAt IS NULL ORDER BY id`
+	getOpenLoanStatement     = `SELECT ` + loanColumns + ` FROM loans WHERE id = ? AND bookId = ? AND returnedAt IS NULL`
+	insertLoanStatement      = `INSERT INTO loans (copyId, bookId, userId, userName, checkedOutAt, dueAt) VALUES (?, ?, ?, ?, ?, ?)`
+	returnLoanStatement      = `UPDATE loans SET returnedAt = ? WHERE id = ? AND returnedAt IS NULL`
+	markOverdueStatement     = `UPDATE loans SET overdueAt = ? WHERE id = ? AND bookId = ? AND returnedAt IS NULL AND overdueAt IS NULL AND dueAt < ?`
+	listHoldsStatement       = `SELECT ` + holdColumns + ` FROM holds WHERE bookId = ? ORDER BY id`
+	insertHoldStatement      = `INSERT INTO holds (bookId, userId, userName, placedAt) VALUES (?, ?, ?, ?)`
+	deleteHoldStatement      = `DELETE FROM holds WHERE bookId = ? AND userId = ?`
+	userHasLoanStatement     = `SELECT COUNT(*) FROM loans WHERE bookId = ? AND userId = ? AND returnedAt IS NULL`
+	countCopiesStatement     = `SELECT bookId, COUNT(*) FROM copies GROUP BY bookId`
+	countOnLoanStatement     = `SELECT bookId, COUNT(*) FROM loans WHERE returnedAt IS NULL GROUP BY bookId`
+	countHoldsStatement      = `SELECT bookId, COUNT(*) FROM holds GROUP BY bookId`
+	purgeCopiesStatement     = `DELETE FROM copies WHERE bookId = ?`
+	purgeLoansStatement      = `DELETE FROM loans WHERE bookId = ?`
+	purgeHoldsStatement      = `DELETE FROM holds WHERE bookId = ?`
+	moveCopiesStatement      = `UPDATE copies SET bookId = ? WHERE bookId = ?`
+	moveLoansStatement       = `UPDATE loans SET bookId = ? WHERE bookId = ?`
+	moveHoldsStatement       = `UPDATE holds SET bookId = ? WHERE bookId = ?`
+	dropMergedHoldsStatement = `DELETE FROM holds WHERE bookId = ?
+AND userId IN (SELECT userId FROM (SELECT userId FROM holds WHERE bookId = ?) kept)`
+)
+
+// scanCopy reads a copy from a sql.Row or sql.Rows.
+func scanCopy(row rowScanner) (*Copy, error) {
+	var c Copy
+	if err := row.Scan(&c.ID, &c.BookID, &c.Label, &c.AddedAt); err != nil {
+		return nil, err
+	}
+	c.AddedAt = c.AddedAt.UTC()
+	return &c, nil
+}
+
+// scanLoan reads a loan from a sql.Row or sql.Rows.
+func scanLoan(row rowScanner) (*Loan, error) {
+	var (
+		l                     Loan
+		userName              sql.NullString
+		returnedAt, overdueAt sql.NullTime
+	)
+	if err := row.Scan(&l.ID, &l.CopyID, &l.BookID, &l.UserID, &userName,
+		&l.CheckedOutAt, &l.DueAt, &returnedAt, &overdueAt); err != nil {
+		return nil, err
+	}
+	l.UserName = userName.String
+	l.CheckedOutAt, l.DueAt = l.CheckedOutAt.UTC(), l.DueAt.UTC()
+	if returnedAt.Valid {
+		l.ReturnedAt = returnedAt.Time.UTC()
+	}
+	if overdueAt.Valid {
+		l.OverdueAt = overdueAt.Time.UTC()
+	}
+	return &l, nil
+}
+
+// scanHold reads a hold from a sql.Row or sql.Rows.
+func scanHold(row rowScanner) (*Hold, error) {
+	var (
+		h        Hold
+		userName sql.NullString
+	)
+	if err := row.Scan(&h.BookID, &h.UserID, &userName, &h.PlacedAt); err != nil {
+		return nil, err
+	}
+	h.UserName = userName.String
+	h.PlacedAt = h.PlacedAt.UTC()
+	return &h, nil
+}
+
+// selectLoans runs a query returning loans with q.
+func (db *sqlDB) selectLoans(q querier, query string, args ...interface{}) ([]*Loan, error) {
+	rows, err := q.Query(db.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var loans []*Loan
+	for rows.Next() {
+		l, err := scanLoan(rows)
+		if err != nil {
+			return nil, err
+		}
+		loans = append(loans, l)
+	}
+	return loans, rows.Err()
+}
+
+// selectHolds lists a book's holds queue with q.
+func (db *sqlDB) selectHolds(q querier, bookID int64) ([]*Hold, error) {
+	rows, err := q.Query(db.dialect.rebind(listHoldsStatement), bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var holds []*Hold
+	for rows.Next() {
+		h, err := scanHold(rows)
+		if err != nil {
+			return nil, err
+		}
+		holds = append(holds, h)
+	}
+	return holds, rows.Err()
+}
+
+// selectCopies lists the copies of a book with q, each with its open loan.
+func (db *sqlDB) selectCopies(q querier, bookID int64) ([]*Copy, error) {
+	rows, err := q.Query(db.dialect.rebind(listCopiesStatement), bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var copies []*Copy
+	for rows.Next() {
+		c, err := scanCopy(rows)
+		if err != nil {
+			return nil, err
+		}
+		copies = append(copies, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	loans, err := db.selectLoans(q, openLoansStatement, bookID)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range loans {
+		for _, c := range copies {
+			if c.ID == l.CopyID {
+				c.Loan = l
+			}
+		}
+	}
+	return copies, nil
+}
+
+// AddCopy adds a copy of a book to the library.
+func (db *sqlDB) AddCopy(bookID int64, label string) (*Copy, error) {
+	c := &Copy{BookID: bookID, Label: strings.TrimSpace(label), AddedAt: now()}
+	err := db.inTx(func(tx *sql.Tx) error {
+		if err := db.lockBookID(tx, bookID); err != nil {
+			return err
+		}
+		var err error
+		if c.ID, err = db.dialect.insert(tx, db.dialect.rebind(insertCopyStatement), c.BookID, c.Label, c.AddedAt); err != nil {
+			return db.errorf("could not add copy: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// RemoveCopy removes a copy of a book that is not lent out. The book's row
+// is locked first, as by CheckOut, so a checkout cannot lend the copy as it
+// is removed.
+func (db *sqlDB) RemoveCopy(bookID, copyID int64) error {
+	return db.inTx(func(tx *sql.Tx) error {
+		if err := db.lockBookID(tx, bookID); err != nil {
+			return err
+		}
+		var lent int
+		if err := tx.QueryRow(db.dialect.rebind(copyLentStatement), copyID).Scan(&lent); err != nil {
+			return db.errorf("could not get loans of copy %d: %v", copyID, err)
+		}
+		if lent > 0 {
+			return db.errorf("copy %d is lent out: %w", copyID, ErrConflict)
+		}
+		_, err := db.execSQL(tx, deleteCopyStatement, copyID, bookID)
+		return err
+	})
+}
+
+// ListCopies lists the copies of a book, each with its open loan.
+func (db *sqlDB) ListCopies(bookID int64) ([]*Copy, error) {
+	var copies []*Copy
+	err := db.read(func(q querier) error {
+		var err error
+		copies, err = db.selectCopies(q, bookID)
+		return err
+	})
+	if err != nil {
+		return nil, db.errorf("could not list copies: %v", err)
+	}
+	return copies, nil
+}
+
+// CheckOut lends a copy of a book to a user. The book's row is locked
+// first, so concurrent checkouts of one book take turns.
+func (db *sqlDB) CheckOut(bookID int64, userID, userName string, due time.Time) (*Loan, error) {
+	if userID == "" {
+		return nil, db.errorf("checkout without a user: %w", ErrInvalid)
+	}
+	l := &Loan{BookID: bookID, UserID: userID, UserName: userName, CheckedOutAt: now(), DueAt: due.UTC().Truncate(time.Second)}
+	if !l.DueAt.After(l.CheckedOutAt) {
+		return nil, db.errorf("loan due %s is already due: %w", l.DueAt.Format(time.RFC3339), ErrInvalid)
+	}
+	err := db.inTx(func(tx *sql.Tx) error {
+		if err := db.lockBookID(tx, bookID); err != nil {
+			return err
+		}
+		copies, err := db.selectCopies(tx, bookID)
+		if err != nil {
+			return db.errorf("could not list copies: %v", err)
+		}
+		var open []*Loan
+		for _, c := range copies {
+			if c.Loan != nil {
+				open = append(open, c.Loan)
+			}
+		}
+		holds, err := db.selectHolds(tx, bookID)
+		if err != nil {
+			return db.errorf("could not list holds: %v", err)
+		}
+		var reason string
+		if l.CopyID, reason = checkOutCopy(copies, open, holds, userID); l.CopyID == 0 {
+			return db.errorf("cannot lend book %d: %s: %w", bookID, reason, ErrConflict)
+		}
+		if l.ID, err = db.dialect.insert(tx, db.dialect.rebind(insertLoanStatement),
+			l.CopyID, l.BookID, l.UserID, nullString(l.UserName), l.CheckedOutAt, l.DueAt); err != nil {
+			return db.errorf("could not check out: %v", err)
+		}
+		if _, err := tx.Exec(db.dialect.rebind(deleteHoldStatement), bookID, userID); err != nil {
+			return db.errorf("could not remove hold: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// CheckIn records that the copy of an open loan was returned.
+func (db *sqlDB) CheckIn(bookID, loanID int64) (*Loan, error) {
+	var l *Loan
+	err := db.inTx(func(tx *sql.Tx) error {
+		var err error
+		l, err = scanLoan(tx.QueryRow(db.dialect.rebind(getOpenLoanStatement+db.dialect.forUpdate()), loanID, bookID))
+		if err == sql.ErrNoRows {
+			return db.errorf("could not find open loan %d of book %d: %w", loanID, bookID, ErrNotFound)
+		} else if err != nil {
+			return db.errorf("could not get loan: %v", err)
+		}
+		l.ReturnedAt = now()
+		_, err = db.execSQL(tx, returnLoanStatement, l.ReturnedAt, loanID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// MarkOverdue records that an open loan was found overdue at at.
+func (db *sqlDB) MarkOverdue(bookID, loanID int64, at time.Time) error {
+	at = at.UTC().Truncate(time.Second)
+	return db.inTx(func(tx *sql.Tx) error {
+		_, err := db.execSQL(tx, markOverdueStatement, at, loanID, bookID, at)
+		return err
+	})
+}
+
+// ListLoans lists the loans q selects, with their books, newest first.
+func (db *sqlDB) ListLoans(q LoanQuery) ([]*Loan, error) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	if q.UserID != "" {
+		conds = append(conds, "userId = ?")
+		args = append(args, q.UserID)
+	}
+	if q.BookID != 0 {
+		conds = append(conds, "bookId = ?")
+		args = append(args, q.BookID)
+	}
+	if q.Open {
+		conds = append(conds, "returnedAt IS NULL")
+	}
+	if !q.DueBefore.IsZero() {
+		conds = append(conds, "dueAt < ?")
+		args = append(args, q.DueBefore.UTC())
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	var loans []*Loan
+	err := db.read(func(q querier) error {
+		var err error
+		if loans, err = db.selectLoans(q, `SELECT `+loanColumns+` FROM loans`+where+` ORDER BY checkedOutAt DESC, id DESC`, args...); err != nil {
+			return err
+		}
+		books, err := db.selectBooks(q, `SELECT `+bookColumns+` FROM books WHERE id IN (SELECT bookId FROM loans`+where+`)`, args...)
+		if err != nil {
+			return err
+		}
+		byID := make(map[int64]*Book, len(books))
+		for _, b := range books {
+			byID[b.ID] = b
+		}
+		for _, l := range loans {
+			l.Book = byID[l.BookID]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, db.errorf("could not list loans: %v", err)
+	}
+	return loans, nil
+}
+
+// PlaceHold puts a user at the end of a book's holds queue.
+func (db *sqlDB) PlaceHold(bookID int64, userID, userName string) (*Hold, error) {
+	if userID == "" {
+		return nil, db.errorf("hold without a user: %w", ErrInvalid)
+	}
+	h := &Hold{BookID: bookID, UserID: userID, UserName: userName, PlacedAt: now()}
+	err := db.inTx(func(tx *sql.Tx) error {
+		if err := db.lockBookID(tx, bookID); err != nil {
+			return err
+		}
+		var lent int
+		if err := tx.QueryRow(db.dialect.rebind(userHasLoanStatement), bookID, userID).Scan(&lent); err != nil {
+			return db.errorf("could not get loans: %v", err)
+		}
+		if lent > 0 {
+			return db.errorf("book %d is already lent to user %s: %w", bookID, userID, ErrConflict)
+		}
+		_, err := db.execSQL(tx, insertHoldStatement, h.BookID, h.UserID, nullString(h.UserName), h.PlacedAt)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// CancelHold takes a user off a book's holds queue.
+func (db *sqlDB) CancelHold(bookID int64, userID string) error {
+	return db.inTx(func(tx *sql.Tx) error {
+		_, err := db.execSQL(tx, deleteHoldStatement, bookID, userID)
+		return err
+	})
+}
+
+// ListHolds lists a book's holds queue, longest waiting first.
+func (db *sqlDB) ListHolds(bookID int64) ([]*Hold, error) {
+	var holds []*Hold
+	err := db.read(func(q querier) error {
+		var err error
+		holds, err = db.selectHolds(q, bookID)
+		return err
+	})
+	if err != nil {
+		return nil, db.errorf("could not list holds: %v", err)
+	}
+	return holds, nil
+}
+
+// Availability counts the copies, open loans and holds of each book.
+func (db *sqlDB) Availability() (map[int64]Availability, error) {
+	var counts map[int64]Availability
+	err := db.read(func(q querier) error {
+		counts = make(map[int64]Availability)
+		for _, c := range []struct {
+			stmt string
+			add  func(a *Availability, n int)
+		}{
+			{countCopiesStatement, func(a *Availability, n int) { a.Copies = n }},
+			{countOnLoanStatement, func(a *Availability, n int) { a.OnLoan = n }},
+			{countHoldsStatement, func(a *Availability, n int) { a.Holds = n }},
+		} {
+			rows, err := q.Query(db.dialect.rebind(c.stmt))
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				var (
+					bookID int64
+					n      int
+				)
+				if err := rows.Scan(&bookID, &n); err != nil {
+					rows.Close()
+					return err
+				}
+				a := counts[bookID]
+				c.add(&a, n)
+				counts[bookID] = a
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, db.errorf("could not count copies: %v", err)
+	}
+	return counts, nil
+}
+
+// purgeLending removes the copies, loans and holds of a book being purged
+// inside tx.
+func (db *sqlDB) purgeLending(tx *sql.Tx, bookID int64) error {
+	for _, stmt := range []string{purgeCopiesStatement, purgeLoansStatement, purgeHoldsStatement} {
+		if _, err := tx.Exec(db.dialect.rebind(stmt), bookID); err != nil {
+			return db.errorf("could not remove copies of book %d: %v", bookID, err)
+		}
+	}
+	return nil
+}
+
+// moveLending moves the copies, loans and holds of the book with dupID to
+// the book with intoID inside tx. A user holding both keeps their place in
+// the queue of intoID.
+func (db *sqlDB) moveLending(tx *sql.Tx, intoID, dupID int64) error {
+	if _, err := tx.Exec(db.dialect.rebind(dropMergedHoldsStatement), dupID, intoID); err != nil {
+		return db.errorf("could not move holds of book %d: %v", dupID, err)
+	}
+	for _, stmt := range []string{moveCopiesStatement, moveLoansStatement, moveHoldsStatement} {
+		if _, err := tx.Exec(db.dialect.rebind(stmt), intoID, dupID); err != nil {
+			return db.errorf("could not move copies of book %d: %v", dupID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package bookshelf
+
+import (
+	"database/sql"
+	"time"
+)
+
+const (
+	readingColumns          = `userId, bookId, status, startedAt, finishedAt, progress, updatedAt`
+	getReadingStatement     = `SELECT ` + readingColumns + ` FROM readings WHERE userId = ? AND bookId = ?`
+	listReadingsStatement   = `SELECT ` + readingColumns + ` FROM readings WHERE userId = ?`
+	readingShelvesStatement = `SELECT bookId, shelf FROM reading_shelves WHERE userId = ?`
+	readingBooksStatement   = `SELECT ` + bookColumns + ` FROM books
+WHERE deletedAt IS NULL AND id IN (SELECT bookId FROM readings WHERE userId = ?)`
+	checkBookStatement = `SELECT id FROM books WHERE id = ? AND deletedAt IS NULL`
+
+	deleteReadingStatement        = `DELETE FROM readings WHERE userId = ? AND bookId = ?`
+	deleteReadingShelvesStatement = `DELETE FROM reading_shelves WHERE userId = ? AND bookId = ?`
+	insertReadingStatement        = `INSERT INTO readings (` + readingColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	insertReadingShelfStatement   = `INSERT INTO reading_shelves (userId, bookId, shelf) VALUES (?, ?, ?)`
+
+	purgeReadingsStatement       = `DELETE FROM readings WHERE bookId = ?`
+	purgeReadingShelvesStatement = `DELETE FROM reading_shelves WHERE bookId = ?`
+
+	// A user with readings of both merged books keeps the reading of the
+	// book merged into. MySQL cannot select from the table it deletes
+	// from, hence the derived table.
+	dropMergedReadingShelvesStatement = `DELETE FROM reading_shelves WHERE bookId = ?
+AND userId IN (SELECT userId FROM (SELECT userId FROM readings WHERE bookId = ?) kept)`
+	dropMergedReadingsStatement = `DELETE FROM readings WHERE bookId = ?
+AND userId IN (SELECT userId FROM (SELECT userId FROM readings WHERE bookId = ?) kept)`
+	moveReadingShelvesStatement = `UPDATE reading_shelves SET bookId = ? WHERE bookId = ?`
+	moveReadingsStatement       = `UPDATE readings SET bookId = ? WHERE bookId = ?`
+)
+
+// lockBookID locks the row of the book with id inside tx, so the book is
+// not purged or merged before tx commits. A book that is missing or in the
+// trash reports ErrNotFound.
+func (db *sqlDB) lockBookID(tx *sql.Tx, id int64) error {
+	err := tx.QueryRow(db.dialect.rebind(checkBookStatement+db.dialect.forUpdate()), id).Scan(&id)
+	if err == sql.ErrNoRows {
+		return db.errorf("could not find book with id %d: %w", id, ErrNotFound)
+	} else if err != nil {
+		return db.errorf("could not get book: %v", err)
+	}
+	return nil
+}
+
+// scanReading reads a reading from a sql.Row or sql.Rows.
+func scanReading(row rowScanner) (*Reading, error) {
+	var (
+		r                     Reading
+		startedAt, finishedAt sql.NullTime
+	)
+	if err := row.Scan(&r.UserID, &r.BookID, &r.Status, &startedAt, &finishedAt, &r.Progress, &r.UpdatedAt); err != nil {
+		return nil, err
+	}
+	r.StartedAt, r.FinishedAt = startedAt.Time, finishedAt.Time
+	r.UpdatedAt = r.UpdatedAt.UTC()
+	return &r, nil
+}
+
+// nullTime stores a zero time as NULL.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// loadReadingShelves sets the custom shelves of a user's readings.
+func (db *sqlDB) loadReadingShelves(q querier, userID string, readings ...*Reading) error {
+	byBook := make(map[int64]*Reading, len(readings))
+	for _, r := range readings {
+		r.Shelves = nil
+		byBook[r.BookID] = r
+	}
+	rows, err := q.Query(db.dialect.rebind(readingShelvesStatement+" ORDER BY shelf"), userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			bookID int64
+			shelf  string
+		)
+		if err := rows.Scan(&bookID, &shelf); err != nil {
+			return err
+		}
+		if r, ok := byBook[bookID]; ok {
+			r.Shelves = append(r.Shelves, shelf)
+		}
+	}
+	return rows.Err()
+}
+
+// GetReading retrieves a user's reading of a book.
+func (db *sqlDB) GetReading(userID string, bookID int64) (*Reading, error) {
+	var r *Reading
+	err := db.read(func(q querier) error {
+		var err error
+		if r, err = scanReading(q.QueryRow(db.dialect.rebind(getReadingStatement), userID, bookID)); err != nil {
+			return err
+		}
+		return db.loadReadingShelves(q, userID, r)
+	})
+	if err == sql.ErrNoRows {
+		return nil, db.errorf("book %d is not on the shelves of user %s: %w", bookID, userID, ErrNotFound)
+	} else if err != nil {
+		return nil, db.errorf("could not get reading: %v", err)
+	}
+	return r, nil
+}
+
+// SaveReading adds or replaces a user's reading of a book.
+func (db *sqlDB) SaveReading(r *Reading) error {
+	if err := r.normalize(); err != nil {
+		return err
+	}
+	return db.inTx(func(tx *sql.Tx) error {
+		if err := db.lockBookID(tx, r.BookID); err != nil {
+			return err
+		}
+		for _, stmt := range []string{deleteReadingShelvesStatement, deleteReadingStatement} {
+			if _, err := tx.Exec(db.dialect.rebind(stmt), r.UserID, r.BookID); err != nil {
+				return db.errorf("could not save reading: %v", err)
+			}
+		}
+		r.UpdatedAt = now()
+		if _, err := tx.Exec(db.dialect.rebind(insertReadingStatement), r.UserID, r.BookID, r.Status,
+			nullTime(r.StartedAt), nullTime(r.FinishedAt), r.Progress, r.UpdatedAt); err != nil {
+			return db.errorf("could not save reading: %v", err)
+		}
+		for _, s := range r.Shelves {
+			if _, err := tx.Exec(db.dialect.rebind(insertReadingShelfStatement), r.UserID, r.BookID, s); err != nil {
+				return db.errorf("could not save reading: %v", err)
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteReading takes a book off a user's shelves.
+func (db *sqlDB) DeleteReading(userID string, bookID int64) error {
+	return db.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(db.dialect.rebind(deleteReadingShelvesStatement), userID, bookID); err != nil {
+			return db.errorf("could not delete reading: %v", err)
+		}
+		_, err := db.execSQL(tx, deleteReadingStatement, userID, bookID)
+		return err
+	})
+}
+
+// ListReadings lists a user's readings on a shelf, with their books.
+func (db *sqlDB) ListReadings(userID, shelf string) ([]*Reading, error) {
+	var readings []*Reading
+	err := db.read(func(q querier) error {
+		readings = nil
+		books, err := db.selectBooks(q, readingBooksStatement, userID)
+		if err != nil {
+			return err
+		}
+		byID := make(map[int64]*Book, len(books))
+		for _, b := range books {
+			byID[b.ID] = b
+		}
+		rows, err := q.Query(db.dialect.rebind(listReadingsStatement), userID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			r, err := scanReading(rows)
+			if err != nil {
+				return err
+			}
+			if r.Book = byID[r.BookID]; r.Book != nil {
+				readings = append(readings, r)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return db.loadReadingShelves(q, userID, readings...)
+	})
+	if err != nil {
+		return nil, db.errorf("could not list readings: %v", err)
+	}
+	return filterReadings(readings, shelf), nil
+}
+
+// ListShelves counts a user's books on each shelf.
+func (db *sqlDB) ListShelves(userID string) ([]ShelfCount, error) {
+	readings, err := db.ListReadings(userID, "")
+	if err != nil {
+		return nil, err
+	}
+	return countShelves(readings), nil
+}
+
+// purgeReadings removes the readings of a book being purged inside tx.
+func (db *sqlDB) purgeReadings(tx *sql.Tx, bookID int64) error {
+	for _, stmt := range []string{purgeReadingShelvesStatement, purgeReadingsStatement} {
+		if _, err := tx.Exec(db.dialect.rebind(stmt), bookID); err != nil {
+			return db.errorf("could not remove readings of book %d: %v", bookID, err)
+		}
+	}
+	return nil
+}
+
+// moveReadings moves the readings of the book with dupID to the book with
+// intoID inside tx.
+func (db *sqlDB) moveReadings(tx *sql.Tx, intoID, dupID int64) error {
+	for _, stmt := range []string{dropMergedReadingShelvesStatement, dropMergedReadingsStatement} {
+		if _, err := tx.Exec(db.dialect.rebind(stmt), dupID, intoID); err != nil {
+			return db.errorf("could not move readings of book %d: %v", dupID, err)
+		}
+	}
+	for _, stmt := range []string{moveReadingShelvesStatement, moveReadingsStatement} {
+		if _, err := tx.Exec(db.dialect.rebind(stmt), intoID, dupID); err != nil {
+			return db.errorf("could not move readings of book %d: %v", dupID, err)
+		}
+	}
+	return nil
+}
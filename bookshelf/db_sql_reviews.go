@@ -0,0 +1,208 @@
+package bookshelf
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+const (
+	reviewColumns         = `bookId, userId, userName, rating, text, createdAt, updatedAt`
+	getReviewStatement    = `SELECT ` + reviewColumns + ` FROM reviews WHERE bookId = ? AND userId = ?`
+	insertReviewStatement = `INSERT INTO reviews (` + reviewColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	updateReviewStatement = `UPDATE reviews SET userName = ?, rating = ?, text = ?, updatedAt = ?
+WHERE bookId = ? AND userId = ?`
+	deleteReviewStatement = `DELETE FROM reviews WHERE bookId = ? AND userId = ?`
+	addRatingStatement    = `UPDATE books SET ratingCount = ratingCount + ?, ratingSum = ratingSum + ? WHERE id = ?`
+
+	// ratingOrder sorts books as sortByRating does. Unrated books have an
+	// average of 0, below any rating.
+	ratingOrder = `CASE WHEN ratingCount = 0 THEN 0 ELSE ratingSum * 1.0 / ratingCount END DESC,
+ratingCount DESC, LOWER(title)`
+
+	purgeReviewsStatement = `DELETE FROM reviews WHERE bookId = ?`
+
+	// A user with reviews of both merged books keeps the review of the
+	// book merged into, as for readings. The ratings of the merged book are
+	// then counted again from its reviews.
+	dropMergedReviewsStatement = `DELETE FROM reviews WHERE bookId = ?
+AND userId IN (SELECT userId FROM (SELECT userId FROM reviews WHERE bookId = ?) kept)`
+	moveReviewsStatement  = `UPDATE reviews SET bookId = ? WHERE bookId = ?`
+	countRatingsStatement = `UPDATE books SET
+ratingCount = (SELECT COUNT(*) FROM reviews WHERE bookId = ?),
+ratingSum = (SELECT COALESCE(SUM(rating), 0) FROM reviews WHERE bookId = ?)
+WHERE id = ?`
+)
+
+// scanReview reads a review from a sql.Row or sql.Rows.
+func scanReview(row rowScanner) (*Review, error) {
+	var (
+		r              Review
+		userName, text sql.NullString
+	)
+	if err := row.Scan(&r.BookID, &r.UserID, &userName, &r.Rating, &text, &r.CreatedAt, &r.UpdatedAt); err != nil {
+		return nil, err
+	}
+	r.UserName, r.Text = userName.String, text.String
+	r.CreatedAt, r.UpdatedAt = r.CreatedAt.UTC(), r.UpdatedAt.UTC()
+	return &r, nil
+}
+
+// GetReview retrieves a user's review of a book.
+func (db *sqlDB) GetReview(bookID int64, userID string) (*Review, error) {
+	var r *Review
+	err := db.read(func(q querier) error {
+		var err error
+		r, err = scanReview(q.QueryRow(db.dialect.rebind(getReviewStatement), bookID, userID))
+		return err
+	})
+	if err == sql.ErrNoRows {
+		return nil, db.errorf("user %s has not reviewed book %d: %w", userID, bookID, ErrNotFound)
+	} else if err != nil {
+		return nil, db.errorf("could not get review: %v", err)
+	}
+	return r, nil
+}
+
+// lockReview reads a user's review of a book inside tx, locking it, or
+// returns nil if there is none.
+func (db *sqlDB) lockReview(tx *sql.Tx, bookID int64, userID string) (*Review, error) {
+	r, err := scanReview(tx.QueryRow(db.dialect.rebind(getReviewStatement+db.dialect.forUpdate()), bookID, userID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, db.errorf("could not get review: %v", err)
+	}
+	return r, nil
+}
+
+// addRating changes the ratings of a book by the difference between the
+// reviews old and r, either of which may be nil, inside tx.
+func (db *sqlDB) addRating(tx *sql.Tx, bookID int64, old, r *Review) error {
+	count, sum := ratingDelta(old, r)
+	_, err := db.execSQL(tx, addRatingStatement, count, sum, bookID)
+	return err
+}
+
+// SaveReview adds or replaces a user's review of a book. The book's row is
+// locked first, so concurrent reviews add up their ratings one at a time.
+func (db *sqlDB) SaveReview(r *Review) error {
+	if err := r.normalize(); err != nil {
+		return err
+	}
+	return db.inTx(func(tx *sql.Tx) error {
+		if err := db.lockBookID(tx, r.BookID); err != nil {
+			return err
+		}
+		old, err := db.lockReview(tx, r.BookID, r.UserID)
+		if err != nil {
+			return err
+		}
+		r.UpdatedAt = now()
+		if old == nil {
+			r.CreatedAt = r.UpdatedAt
+			_, err = tx.Exec(db.dialect.rebind(insertReviewStatement), r.BookID, r.UserID, nullString(r.UserName),
+				r.Rating, nullString(r.Text), r.CreatedAt, r.UpdatedAt)
+		} else {
+			r.CreatedAt = old.CreatedAt
+			_, err = tx.Exec(db.dialect.rebind(updateReviewStatement), nullString(r.UserName), r.Rating,
+				nullString(r.Text), r.UpdatedAt, r.BookID, r.UserID)
+		}
+		if err != nil {
+			return db.errorf("could not save review: %v", err)
+		}
+		return db.addRating(tx, r.BookID, old, r)
+	})
+}
+
+// DeleteReview removes a user's review of a book.
+func (db *sqlDB) DeleteReview(bookID int64, userID string) error {
+	return db.inTx(func(tx *sql.Tx) error {
+		old, err := db.lockReview(tx, bookID, userID)
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			return db.errorf("user %s has not reviewed book %d: %w", userID, bookID, ErrNotFound)
+		}
+		if _, err := db.execSQL(tx, deleteReviewStatement, bookID, userID); err != nil {
+			return err
+		}
+		return db.addRating(tx, bookID, old, nil)
+	})
+}
+
+// ListReviews lists the reviews q selects, with their books.
+func (db *sqlDB) ListReviews(q ReviewQuery) ([]*Review, error) {
+	conds := []string{"bookId IN (SELECT id FROM books WHERE deletedAt IS NULL)"}
+	var args []interface{}
+	if q.BookID != 0 {
+		conds = append(conds, "bookId = ?")
+		args = append(args, q.BookID)
+	}
+	if q.UserID != "" {
+		conds = append(conds, "userId = ?")
+		args = append(args, q.UserID)
+	}
+	where := " WHERE " + strings.Join(conds, " AND ")
+	query := `SELECT ` + reviewColumns + ` FROM reviews` + where + ` ORDER BY updatedAt DESC, bookId DESC, userId`
+	if q.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+
+	var reviews []*Review
+	err := db.read(func(q querier) error {
+		reviews = nil
+		books, err := db.selectBooks(q, `SELECT `+bookColumns+` FROM books
+WHERE deletedAt IS NULL AND id IN (SELECT bookId FROM reviews`+where+`)`, args...)
+		if err != nil {
+			return err
+		}
+		byID := make(map[int64]*Book, len(books))
+		for _, b := range books {
+			byID[b.ID] = b
+		}
+		rows, err := q.Query(db.dialect.rebind(query), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			r, err := scanReview(rows)
+			if err != nil {
+				return err
+			}
+			if r.Book = byID[r.BookID]; r.Book != nil {
+				reviews = append(reviews, r)
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, db.errorf("could not list reviews: %v", err)
+	}
+	return sortReviews(reviews, q), nil
+}
+
+// purgeReviews removes the reviews of a book being purged inside tx.
+func (db *sqlDB) purgeReviews(tx *sql.Tx, bookID int64) error {
+	if _, err := tx.Exec(db.dialect.rebind(purgeReviewsStatement), bookID); err != nil {
+		return db.errorf("could not remove reviews of book %d: %v", bookID, err)
+	}
+	return nil
+}
+
+// moveReviews moves the reviews of the book with dupID to the book with
+// intoID inside tx, and counts the ratings of intoID again.
+func (db *sqlDB) moveReviews(tx *sql.Tx, intoID, dupID int64) error {
+	if _, err := tx.Exec(db.dialect.rebind(dropMergedReviewsStatement), dupID, intoID); err != nil {
+		return db.errorf("could not move reviews of book %d: %v", dupID, err)
+	}
+	if _, err := tx.Exec(db.dialect.rebind(moveReviewsStatement), intoID, dupID); err != nil {
+		return db.errorf("could not move reviews of book %d: %v", dupID, err)
+	}
+	if _, err := tx.Exec(db.dialect.rebind(countRatingsStatement), intoID, intoID, intoID); err != nil {
+		return db.errorf("could not count ratings of book %d: %v", intoID, err)
+	}
+	return nil
+}
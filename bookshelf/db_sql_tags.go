@@ -0,0 +1,146 @@
+package bookshelf
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// Kinds of the rows of book_tags.
+const (
+	tagKind   = "tag"
+	genreKind = "genre"
+)
+
+const (
+	deleteTagsStatement = `DELETE FROM book_tags WHERE bookId = ?`
+	insertTagStatement  = `INSERT INTO book_tags (bookId, kind, tag) VALUES (?, ?, ?)`
+	tagsStatement       = `SELECT bt.bookId, bt.kind, bt.tag FROM book_tags bt`
+	tagCloudStatement   = `SELECT bt.kind, bt.tag, COUNT(*) FROM book_tags bt
+JOIN books b ON b.id = bt.bookId WHERE b.deletedAt IS NULL
+GROUP BY bt.kind, bt.tag ORDER BY bt.tag`
+)
+
+// writeTags replaces the tags and genres of a book inside tx.
+func (db *sqlDB) writeTags(tx *sql.Tx, bookID int64, tags, genres []string) error {
+	if _, err := tx.Exec(db.dialect.rebind(deleteTagsStatement), bookID); err != nil {
+		return db.errorf("could not save tags of book %d: %v", bookID, err)
+	}
+	insert := func(kind string, tags []string) error {
+		for _, t := range tags {
+			if _, err := tx.Exec(db.dialect.rebind(insertTagStatement), bookID, kind, t); err != nil {
+				return db.errorf("could not save tags of book %d: %v", bookID, err)
+			}
+		}
+		return nil
+	}
+	if err := insert(tagKind, tags); err != nil {
+		return err
+	}
+	return insert(genreKind, genres)
+}
+
+// loadTags sets the tags and genres of books, reading the rows of book_tags
+// that where selects.
+func (db *sqlDB) loadTags(q querier, where string, args []interface{}, books ...*Book) error {
+	byID := make(map[int64]*Book, len(books))
+	for _, b := range books {
+		b.Tags, b.Genres = nil, nil
+		byID[b.ID] = b
+	}
+	rows, err := q.Query(db.dialect.rebind(tagsStatement+" WHERE "+where+" ORDER BY bt.bookId, bt.tag"), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			bookID    int64
+			kind, tag string
+		)
+		if err := rows.Scan(&bookID, &kind, &tag); err != nil {
+			return err
+		}
+		b, ok := byID[bookID]
+		if !ok {
+			continue
+		}
+		if kind == genreKind {
+			b.Genres = append(b.Genres, tag)
+		} else {
+			b.Tags = append(b.Tags, tag)
+		}
+	}
+	return rows.Err()
+}
+
+// FilterBooks lists the books f selects, ordered by title.
+func (db *sqlDB) FilterBooks(f BookFilter) ([]*Book, error) {
+	conds := []string{"deletedAt IS NULL"}
+	var args []interface{}
+	if f.Query != "" {
+		pattern := likePattern(f.Query)
+		conds = append(conds, "(LOWER(title) LIKE ? ESCAPE '!' OR LOWER(author) LIKE ? ESCAPE '!')")
+		args = append(args, pattern, pattern)
+	}
+	for _, t := range []struct{ kind, tag string }{{tagKind, f.Tag}, {genreKind, f.Genre}} {
+		if tag := NormalizeTag(t.tag); tag != "" {
+			conds = append(conds, "id IN (SELECT bookId FROM book_tags WHERE kind = ? AND tag = ?)")
+			args = append(args, t.kind, tag)
+		}
+	}
+	where := strings.Join(conds, " AND ")
+	order := "LOWER(title)"
+	switch f.Sort {
+	case SortRating:
+		order = ratingOrder
+	case SortNewest:
+		order = "createdAt IS NULL, createdAt DESC, id DESC"
+	case SortUpdated:
+		order = "updatedAt IS NULL, updatedAt DESC, id DESC"
+	}
+
+	var books []*Book
+	err := db.read(func(q querier) error {
+		var err error
+		if books, err = db.selectBooks(q, `SELECT `+bookColumns+` FROM books WHERE `+where+` ORDER BY `+order, args...); err != nil {
+			return err
+		}
+		return db.loadTags(q, "bt.bookId IN (SELECT id FROM books WHERE "+where+")", args, books...)
+	})
+	if err != nil {
+		return nil, db.errorf("could not filter books: %v", err)
+	}
+	return books, nil
+}
+
+// TagCloud counts the books with each tag and genre.
+func (db *sqlDB) TagCloud() (*TagCloud, error) {
+	var cloud *TagCloud
+	err := db.read(func(q querier) error {
+		cloud = &TagCloud{}
+		rows, err := q.Query(db.dialect.rebind(tagCloudStatement))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var (
+				kind string
+				c    TagCount
+			)
+			if err := rows.Scan(&kind, &c.Tag, &c.Count); err != nil {
+				return err
+			}
+			if kind == genreKind {
+				cloud.Genres = append(cloud.Genres, c)
+			} else {
+				cloud.Tags = append(cloud.Tags, c)
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, db.errorf("could not count tags: %v", err)
+	}
+	return cloud, nil
+}
@@ -0,0 +1,60 @@
+package bookshelf
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// emptySQLDB removes every row but the schema migrations from a shared
+// MySQL or PostgreSQL test database, so each subtest starts empty.
+func emptySQLDB(t *testing.T, bdb BookDatabase) {
+	t.Helper()
+	db := bdb.(*sqlDB)
+	ctx := context.Background()
+	c, err := db.conn.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	schema := "DATABASE()"
+	if db.dialect.name() == "postgres" {
+		schema = "current_schema()"
+	}
+	rows, err := c.QueryContext(ctx, `SELECT table_name FROM information_schema.tables
+		WHERE table_schema = `+schema+` AND table_name <> 'schema_migrations'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db.dialect.name() == "postgres" {
+		if _, err := c.ExecContext(ctx, `TRUNCATE `+strings.Join(tables, ", ")+` RESTART IDENTITY CASCADE`); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	// MySQL cannot truncate a table other tables refer to unless this
+	// session stops checking foreign keys.
+	if _, err := c.ExecContext(ctx, `SET FOREIGN_KEY_CHECKS = 0`); err != nil {
+		t.Fatal(err)
+	}
+	defer c.ExecContext(ctx, `SET FOREIGN_KEY_CHECKS = 1`)
+	for _, table := range tables {
+		if _, err := c.ExecContext(ctx, `TRUNCATE TABLE `+table); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package bookshelf
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	webhookColumns  = `id, ownerId, ownerName, url, events, secret, active, failures, disabledAt, createdAt, updatedAt`
+	deliveryColumns = `id, webhookId, event, bookId, payload, status, attempts, responseCode, error,
+createdAt, lastAttemptAt, nextAttemptAt`
+
+	getWebhookStatement    = `SELECT ` + webhookColumns + ` FROM webhooks WHERE id = ?`
+	insertWebhookStatement = `INSERT INTO webhooks (ownerId, ownerName, url, events, secret, active, failures, createdAt, updatedAt)
+VALUES (?, ?, ?, ?, ?, ?, 0, ?, ?)`
+	updateWebhookStatement = `UPDATE webhooks SET url = ?, events = ?, secret = ?, active = ?, failures = ?, disabledAt = ?,
+updatedAt = ? WHERE id = ?`
+	countWebhookStatement  = `UPDATE webhooks SET active = ?, failures = ?, disabledAt = ? WHERE id = ?`
+	deleteWebhookStatement = `DELETE FROM webhooks WHERE id = ?`
+
+	insertDeliveryStatement = `INSERT INTO webhook_deliveries (webhookId, event, bookId, payload, status, attempts,
+createdAt, nextAttemptAt) VALUES (?, ?, ?, ?, ?, 0, ?, ?)`
+	claimDeliveryStatement = `UPDATE webhook_deliveries SET nextAttemptAt = ?
+WHERE id = ? AND status = 'pending' AND nextAttemptAt = ?`
+	recordDeliveryStatement = `UPDATE webhook_deliveries SET status = ?, attempts = ?, responseCode = ?, error = ?,
+lastAttemptAt = ?, nextAttemptAt = ? WHERE id = ?`
+	deleteDeliveriesStatement = `DELETE FROM webhook_deliveries WHERE webhookId = ?`
+	purgeDeliveriesStatement  = `DELETE FROM webhook_deliveries WHERE status <> 'pending' AND createdAt < ?`
+)
+
+// scanWebhook reads a webhook from a sql.Row or sql.Rows.
+func scanWebhook(row rowScanner) (*Webhook, error) {
+	var (
+		w          Webhook
+		ownerName  sql.NullString
+		events     string
+		disabledAt sql.NullTime
+	)
+	if err := row.Scan(&w.ID, &w.OwnerID, &ownerName, &w.URL, &events, &w.Secret, &w.Active, &w.Failures,
+		&disabledAt, &w.CreatedAt, &w.UpdatedAt); err != nil {
+		return nil, err
+	}
+	w.OwnerName = ownerName.String
+	if events != "" {
+		w.Events = strings.Split(events, ",")
+	}
+	if disabledAt.Valid {
+		w.DisabledAt = disabledAt.Time.UTC()
+	}
+	w.CreatedAt, w.UpdatedAt = w.CreatedAt.UTC(), w.UpdatedAt.UTC()
+	return &w, nil
+}
+
+// scanDelivery reads a webhook delivery from a sql.Row or sql.Rows.
+func scanDelivery(row rowScanner) (*WebhookDelivery, error) {
+	var (
+		d                            WebhookDelivery
+		responseCode                 sql.NullInt64
+		errText                      sql.NullString
+		lastAttemptAt, nextAttemptAt sql.NullTime
+	)
+	if err := row.Scan(&d.ID, &d.WebhookID, &d.Event, &d.BookID, &d.Payload, &d.Status, &d.Attempts,
+		&responseCode, &errText, &d.CreatedAt, &lastAttemptAt, &nextAttemptAt); err != nil {
+		return nil, err
+	}
+	d.ResponseCode, d.Error = int(responseCode.Int64), errText.String
+	d.CreatedAt = d.CreatedAt.UTC()
+	if lastAttemptAt.Valid {
+		d.LastAttemptAt = lastAttemptAt.Time.UTC()
+	}
+	if nextAttemptAt.Valid {
+		d.NextAttemptAt = nextAttemptAt.Time.UTC()
+	}
+	return &d, nil
+}
+
+// GetWebhook retrieves a webhook by its ID.
+func (db *sqlDB) GetWebhook(id int64) (*Webhook, error) {
+	var w *Webhook
+	err := db.read(func(q querier) error {
+		var err error
+		w, err = scanWebhook(q.QueryRow(db.dialect.rebind(getWebhookStatement), id))
+		return err
+	})
+	if err == sql.ErrNoRows {
+		return nil, db.errorf("could not find webhook with id %d: %w", id, ErrNotFound)
+	} else if err != nil {
+		return nil, db.errorf("could not get webhook: %v", err)
+	}
+	return w, nil
+}
+
+// lockWebhook reads a webhook inside tx, locking it.
+func (db *sqlDB) lockWebhook(tx *sql.Tx, id int64) (*Webhook, error) {
+	w, err := scanWebhook(tx.QueryRow(db.dialect.rebind(getWebhookStatement+db.dialect.forUpdate()), id))
+	if err == sql.ErrNoRows {
+		return nil, db.errorf("could not find webhook with id %d: %w", id, ErrNotFound)
+	} else if err != nil {
+		return nil, db.errorf("could not get webhook: %v", err)
+	}
+	return w, nil
+}
+
+// ListWebhooks lists the webhooks of a user, or of every user.
+func (db *sqlDB) ListWebhooks(ownerID string) ([]*Webhook, error) {
+	query := `SELECT ` + webhookColumns + ` FROM webhooks`
+	var args []interface{}
+	if ownerID != "" {
+		query += ` WHERE ownerId = ?`
+		args = append(args, ownerID)
+	}
+	query += ` ORDER BY id`
+
+	var hooks []*Webhook
+	err := db.read(func(q querier) error {
+		hooks = nil
+		rows, err := q.Query(db.dialect.rebind(query), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			w, err := scanWebhook(rows)
+			if err != nil {
+				return err
+			}
+			hooks = append(hooks, w)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, db.errorf("could not list webhooks: %v", err)
+	}
+	return hooks, nil
+}
+
+// AddWebhook saves a new webhook.
+func (db *sqlDB) AddWebhook(w *Webhook) error {
+	if err := w.normalize(); err != nil {
+		return err
+	}
+	w.CreatedAt = now()
+	w.UpdatedAt, w.Failures, w.DisabledAt = w.CreatedAt, 0, time.Time{}
+	return db.inTx(func(tx *sql.Tx) error {
+		var err error
+		w.ID, err = db.dialect.insert(tx, db.dialect.rebind(insertWebhookStatement), w.OwnerID, nullString(w.OwnerName),
+			w.URL, strings.Join(w.Events, ","), w.Secret, w.Active, w.CreatedAt, w.UpdatedAt)
+		if err != nil {
+			return db.errorf("could not add webhook: %v", err)
+		}
+		return nil
+	})
+}
+
+// UpdateWebhook saves the settings of a webhook. Its row is locked first so
+// that a delivery failing meanwhile does not undo its reactivation.
+func (db *sqlDB) UpdateWebhook(w *Webhook) error {
+	return db.inTx(func(tx *sql.Tx) error {
+		old, err := db.lockWebhook(tx, w.ID)
+		if err != nil {
+			return err
+		}
+		w.OwnerID, w.OwnerName, w.CreatedAt = old.OwnerID, old.OwnerName, old.CreatedAt
+		if w.Secret == "" {
+			w.Secret = old.Secret
+		}
+		if err := w.normalize(); err != nil {
+			return err
+		}
+		w.Failures, w.DisabledAt = old.Failures, old.DisabledAt
+		if w.Active && !old.Active {
+			w.Failures, w.DisabledAt = 0, time.Time{}
+		}
+		w.UpdatedAt = now()
+		_, err = db.execSQL(tx, updateWebhookStatement, w.URL, strings.Join(w.Events, ","), w.Secret, w.Active,
+			w.Failures, nullTime(w.DisabledAt), w.UpdatedAt, w.ID)
+		return err
+	})
+}
+
+// DeleteWebhook removes a webhook and its deliveries.
+func (db *sqlDB) DeleteWebhook(id int64) error {
+	return db.inTx(func(tx *sql.Tx) error {
+		if _, err := db.execSQL(tx, deleteWebhookStatement, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(db.dialect.rebind(deleteDeliveriesStatement), id); err != nil {
+			return db.errorf("could not remove deliveries of webhook %d: %v", id, err)
+		}
+		return nil
+	})
+}
+
+// QueueWebhookDelivery saves a new pending delivery.
+func (db *sqlDB) QueueWebhookDelivery(d *WebhookDelivery) error {
+	return db.inTx(func(tx *sql.Tx) error {
+		if _, err := db.lockWebhook(tx, d.WebhookID); err != nil {
+			return err
+		}
+		d.Status, d.Attempts, d.CreatedAt = DeliveryPending, 0, now()
+		d.NextAttemptAt = d.CreatedAt
+		var err error
+		d.ID, err = db.dialect.insert(tx, db.dialect.rebind(insertDeliveryStatement), d.WebhookID, d.Event, d.BookID,
+			d.Payload, d.Status, d.CreatedAt, d.NextAttemptAt)
+		if err != nil {
+			return db.errorf("could not queue delivery: %v", err)
+		}
+		return nil
+	})
+}
+
+// ListWebhookDeliveries lists the deliveries q selects. Due deliveries are
+// read from the primary, which claims them.
+func (db *sqlDB) ListWebhookDeliveries(q DeliveryQuery) ([]*WebhookDelivery, error) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	if q.WebhookID != 0 {
+		conds = append(conds, "webhookId = ?")
+		args = append(args, q.WebhookID)
+	}
+	if !q.DueBy.IsZero() {
+		conds = append(conds, "status = 'pending' AND nextAttemptAt <= ?")
+		args = append(args, q.DueBy)
+	}
+	query := `SELECT ` + deliveryColumns + ` FROM webhook_deliveries`
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += ` ORDER BY id DESC`
+	if q.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+
+	var deliveries []*WebhookDelivery
+	list := func(q querier) error {
+		deliveries = nil
+		rows, err := q.Query(db.dialect.rebind(query), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			d, err := scanDelivery(rows)
+			if err != nil {
+				return err
+			}
+			deliveries = append(deliveries, d)
+		}
+		return rows.Err()
+	}
+	var err error
+	if q.DueBy.IsZero() {
+		err = db.read(list)
+	} else {
+		err = list(db.conn)
+	}
+	if err != nil {
+		return nil, db.errorf("could not list webhook deliveries: %v", err)
+	}
+	return deliveries, nil
+}
+
+// ClaimWebhookDelivery moves a pending delivery due at due on to until.
+func (db *sqlDB) ClaimWebhookDelivery(id int64, due, until time.Time) error {
+	_, err := db.execSQL(db.conn, claimDeliveryStatement, until, id, due)
+	return err
+}
+
+// RecordWebhookAttempt saves how an attempt at a delivery went and counts
+// it against its webhook, whose row is locked first so concurrent
+// deliveries count one at a time.
+func (db *sqlDB) RecordWebhookAttempt(d *WebhookDelivery) (*Webhook, error) {
+	var w *Webhook
+	err := db.inTx(func(tx *sql.Tx) error {
+		var err error
+		if w, err = db.lockWebhook(tx, d.WebhookID); err != nil {
+			return err
+		}
+		var code interface{}
+		if d.ResponseCode != 0 {
+			code = d.ResponseCode
+		}
+		if _, err := db.execSQL(tx, recordDeliveryStatement, d.Status, d.Attempts, code, nullString(d.Error),
+			nullTime(d.LastAttemptAt), nullTime(d.NextAttemptAt), d.ID); err != nil {
+			return err
+		}
+		active, failures := w.Active, w.Failures
+		if w.count(d, now()); w.Active == active && w.Failures == failures {
+			return nil
+		}
+		_, err = db.execSQL(tx, countWebhookStatement, w.Active, w.Failures, nullTime(w.DisabledAt), w.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// PurgeWebhookDeliveries removes the finished deliveries created before a
+// time.
+func (db *sqlDB) PurgeWebhookDeliveries(before time.Time) (int, error) {
+	r, err := db.conn.Exec(db.dialect.rebind(purgeDeliveriesStatement), before)
+	if err != nil {
+		return 0, db.errorf("could not purge webhook deliveries: %v", err)
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return 0, db.errorf("could not get rows affected: %v", err)
+	}
+	return int(n), nil
+}
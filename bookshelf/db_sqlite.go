@@ -0,0 +1,108 @@
+package bookshelf
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	"modernc.org/sqlite"
+)
+
+// sqliteDialect adapts sqlDB to an embedded SQLite file. It replays the
+// MySQL migrations so both backends share one schema.
+type sqliteDialect struct{}
+
+func (sqliteDialect) name() string { return "sqlite" }
+
+func (sqliteDialect) rebind(query string) string { return query }
+
+func (sqliteDialect) insert(q querier, query string, args ...interface{}) (int64, error) {
+	r, err := q.Exec(query, args...)
+	if err != nil {
+		return -1, err
+	}
+	return r.LastInsertId()
+}
+
+func (sqliteDialect) isDuplicate(err error) bool {
+	const (
+		constraintPrimaryKey = 1555 // SQLITE_CONSTRAINT_PRIMARYKEY
+		constraintUnique     = 2067 // SQLITE_CONSTRAINT_UNIQUE
+	)
+	sErr, ok := err.(*sqlite.Error)
+	return ok && (sErr.Code() == constraintUnique || sErr.Code() == constraintPrimaryKey)
+}
+
+// forUpdate is empty: transactions begin immediately, taking the write
+// lock, so there are no row locks to take.
+func (sqliteDialect) forUpdate() string { return "" }
+
+// lockMigrations does nothing: transactions are opened with BEGIN
+// IMMEDIATE, which already serialises writers to the file, and migrate
+// re-checks each version inside its transaction.
+func (sqliteDialect) lockMigrations(ctx context.Context, conn *sql.Conn) (func(), error) {
+	return func() {}, nil
+}
+
+func (sqliteDialect) migrations() []migration {
+	ms := make([]migration, len(mysqlMigrations))
+	for i, m := range mysqlMigrations {
+		ms[i] = migration{version: m.version, stmts: m.stmts, fn: m.fn}
+		if m.sqlite != nil {
+			ms[i].stmts = m.sqlite
+		}
+	}
+	return ms
+}
+
+// SQLiteConfig describes an embedded SQLite database file.
+type SQLiteConfig struct {
+	// Path of the database file. It is created if it does not exist.
+	// ":memory:" opens a private in-memory database.
+	Path string
+}
+
+// dataStoreName returns a connection string suitable for sql.Open.
+//
+// WAL mode lets the app and worker read while the other writes, the busy
+// timeout makes a writer wait for the file lock rather than fail, and
+// immediate transactions take that lock up front so they cannot deadlock
+// upgrading from a read.
+func (c SQLiteConfig) dataStoreName() string {
+	v := url.Values{}
+	v.Add("_pragma", "busy_timeout(5000)")
+	v.Add("_pragma", "foreign_keys(1)")
+	if c.Path != ":memory:" {
+		v.Add("_pragma", "journal_mode(WAL)")
+	}
+	v.Set("_txlock", "immediate")
+	return "file:" + c.Path + "?" + v.Encode()
+}
+
+// newSQLiteDB creates a new BookDatabase backed by a SQLite file.
+func newSQLiteDB(config SQLiteConfig) (BookDatabase, error) {
+	conn, err := sql.Open("sqlite", config.dataStoreName())
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not open %s: %v", config.Path, err)
+	}
+	if config.Path == ":memory:" {
+		// Every connection to :memory: is a separate database.
+		conn.SetMaxOpenConns(1)
+	}
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sqlite: could not open %s: %v", config.Path, err)
+	}
+	if err := migrate(conn, sqliteDialect{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	db := &sqlDB{
+		conn:    conn,
+		dialect: sqliteDialect{},
+	}
+
+	return db, nil
+}
@@ -0,0 +1,32 @@
+package bookshelf_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+	"github.com/tony-yang/google-cloud-stack/bookshelf/bookshelftest"
+)
+
+// newEmptySQLiteDB opens a fresh in-memory SQLite database.
+func newEmptySQLiteDB(t *testing.T) bookshelf.BookDatabase {
+	db, err := bookshelf.NewSQLiteDB(bookshelf.SQLiteConfig{Path: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestSQLiteDB(t *testing.T) {
+	bookshelftest.TestBookDatabase(t, func(t *testing.T) bookshelf.BookDatabase {
+		db, err := bookshelf.NewSQLiteDB(bookshelf.SQLiteConfig{Path: filepath.Join(t.TempDir(), "library.db")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
+
+func TestSQLiteMemoryDB(t *testing.T) {
+	bookshelftest.TestBookDatabase(t, newEmptySQLiteDB)
+}
@@ -0,0 +1,206 @@
+package bookshelf
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultDuplicateThreshold is the score from which two books are shown as
+// likely duplicates.
+const DefaultDuplicateThreshold = 0.85
+
+// Duplicate is a pair of books that are likely the same book.
+type Duplicate struct {
+	A, B *Book
+
+	// Score runs from 0 to 1, which is given for identical normalized
+	// titles and authors.
+	Score float64
+
+	// Reason says what the score rests on.
+	Reason string
+}
+
+// levenshtein returns the number of single rune edits that turn a into b.
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// similarity scores two strings from 0, nothing in common, to 1, equal, by
+// their edit distance relative to the longer one.
+func similarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+// lengthRatio bounds similarity from above without computing it.
+func lengthRatio(a, b string) float64 {
+	la, lb := utf8.RuneCountInString(a), utf8.RuneCountInString(b)
+	if la == lb {
+		return 1
+	}
+	if la > lb {
+		la, lb = lb, la
+	}
+	return float64(la) / float64(lb)
+}
+
+// sortedWords puts the words of s in order, so names compare equal
+// whichever order they are written in.
+func sortedWords(s string) string {
+	words := strings.Fields(s)
+	sort.Strings(words)
+	return strings.Join(words, " ")
+}
+
+// normalizedBook holds the forms of a book that duplicates are found by.
+type normalizedBook struct {
+	*Book
+	title, author string
+}
+
+// duplicateScore scores how likely a and b are the same book. Books with
+// different ISBNs are different editions, which are kept apart on purpose.
+func duplicateScore(a, b normalizedBook, threshold float64) (float64, string) {
+	if a.ISBN13 != "" && b.ISBN13 != "" {
+		if a.ISBN13 == b.ISBN13 {
+			return 1, "same ISBN"
+		}
+		return 0, ""
+	}
+	if a.title == b.title && a.author == b.author {
+		return 1, "same title and author"
+	}
+	// Titles weigh more than authors, whose names are often abbreviated.
+	const titleWeight = 0.7
+	if titleWeight*lengthRatio(a.title, b.title)+(1-titleWeight) < threshold {
+		return 0, ""
+	}
+	title := similarity(a.title, b.title)
+	if a.author == "" || b.author == "" {
+		return 0.9 * title, "similar title, author missing"
+	}
+	author := similarity(a.author, b.author)
+	if s := similarity(sortedWords(a.author), sortedWords(b.author)); s > author {
+		author = s
+	}
+	return titleWeight*title + (1-titleWeight)*author, "similar title and author"
+}
+
+// FindDuplicates returns the pairs of books whose titles and authors,
+// normalized as by NormalizeTitle and NormalizeAuthor, are close enough to
+// score at least threshold, most likely first.
+//
+// Every pair is compared, which takes a few seconds for ten thousand books;
+// pairs whose titles differ too much in length to reach the threshold are
+// skipped without computing their edit distance.
+func FindDuplicates(books []*Book, threshold float64) []Duplicate {
+	normalized := make([]normalizedBook, len(books))
+	for i, b := range books {
+		normalized[i] = normalizedBook{b, NormalizeTitle(b.Title), NormalizeAuthor(b.Author)}
+	}
+	var dups []Duplicate
+	for i := range normalized {
+		for j := i + 1; j < len(normalized); j++ {
+			score, reason := duplicateScore(normalized[i], normalized[j], threshold)
+			if score >= threshold {
+				dups = append(dups, Duplicate{A: books[i], B: books[j], Score: score, Reason: reason})
+			}
+		}
+	}
+	sort.SliceStable(dups, func(i, j int) bool { return dups[i].Score > dups[j].Score })
+	return dups
+}
+
+// mergeFields returns keep with the fields it lacks filled in from dup.
+// Where both have a title or author the longer is kept, as more likely to
+// carry accents, a subtitle or a full name, and the contributors go with
+// the author string; the cover and ISBN are keep's unless it has none. The
+// tags and genres of both are kept.
+func mergeFields(keep, dup *Book) *Book {
+	merged := *keep
+	longer := func(a, b string) string {
+		if utf8.RuneCountInString(strings.TrimSpace(b)) > utf8.RuneCountInString(strings.TrimSpace(a)) {
+			return b
+		}
+		return a
+	}
+	merged.Title = longer(keep.Title, dup.Title)
+	merged.Description = longer(keep.Description, dup.Description)
+	if merged.Author = longer(keep.Author, dup.Author); merged.Author != keep.Author {
+		merged.Contributors = dup.Contributors
+	}
+	if merged.ImageURL == "" {
+		merged.ImageURL = dup.ImageURL
+	}
+	if merged.PublishedDate == "" {
+		merged.PublishedDate = dup.PublishedDate
+	}
+	if merged.ISBN13 == "" && merged.ISBN10 == "" {
+		merged.ISBN10, merged.ISBN13 = dup.ISBN10, dup.ISBN13
+	}
+	merged.Tags = sortedSet(append(append([]string(nil), keep.Tags...), dup.Tags...))
+	merged.Genres = sortedSet(append(append([]string(nil), keep.Genres...), dup.Genres...))
+	return &merged
+}
+
+// MergeBooks merges the book with dupID into the book with keepID: the
+// kept book takes the best of both books' fields, and the duplicate's
+// history, with everything else that refers to it, moves to the kept book
+// before the duplicate is removed. It returns the merged book and the
+// duplicate as it was, so a cover that was not kept can be removed.
+func MergeBooks(db BookDatabase, keepID, dupID int64, by Actor) (merged, dup *Book, err error) {
+	if keepID == dupID {
+		return nil, nil, fmt.Errorf("cannot merge book %d into itself: %w", keepID, ErrInvalid)
+	}
+	// Only the reads skip the cache and replicas; the merge itself goes
+	// through db so a cache drops both books.
+	primary := ReadPrimary(db)
+	keep, err := primary.GetBook(keepID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dup, err = primary.GetBook(dupID); err != nil {
+		return nil, nil, err
+	}
+	merged = mergeFields(keep, dup)
+	if err := db.MergeBook(merged, dupID, by); err != nil {
+		return nil, nil, err
+	}
+	return merged, dup, nil
+}
@@ -0,0 +1,42 @@
+package bookshelf
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMergeBooksInvalidatesCache(t *testing.T) {
+	db := NewCachedDB(newEmptySQLiteDB(t), CacheConfig{Size: 10, TTL: time.Minute})
+	defer db.Close()
+	keepID, err := db.AddBook(&Book{Title: "The Hobbit"}, testActor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dupID, err := db.AddBook(&Book{Title: "Hobbit", Author: "J. R. R. Tolkien"}, testActor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cache both books and the list.
+	for _, id := range []int64{keepID, dupID} {
+		if _, err := db.GetBook(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.ListBooks(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := MergeBooks(db, keepID, dupID, testActor); err != nil {
+		t.Fatalf("MergeBooks: %v", err)
+	}
+	if b, err := db.GetBook(keepID); err != nil || b.Author != "J. R. R. Tolkien" {
+		t.Errorf("GetBook(%d) after MergeBooks = %v, %v, want the author filled in", keepID, b, err)
+	}
+	if _, err := db.GetBook(dupID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetBook(%d) after MergeBooks = %v, want ErrNotFound", dupID, err)
+	}
+	if books, err := db.ListBooks(); err != nil || len(books) != 1 {
+		t.Errorf("ListBooks after MergeBooks = %v, %v, want the kept book alone", books, err)
+	}
+}
@@ -0,0 +1,21 @@
+package bookshelf
+
+import (
+	"errors"
+)
+
+// Errors returned by every BookDatabase implementation. Backends wrap them
+// with %w so callers can check for them with errors.Is, whatever the
+// underlying storage reported.
+var (
+	// ErrNotFound is returned when the requested book does not exist.
+	ErrNotFound = errors.New("bookshelf: not found")
+
+	// ErrConflict is returned when a write clashes with existing data,
+	// such as a duplicate unique value.
+	ErrConflict = errors.New("bookshelf: conflict")
+
+	// ErrInvalid is returned when the arguments are rejected before any
+	// storage is touched, such as an unassigned book ID.
+	ErrInvalid = errors.New("bookshelf: invalid argument")
+)
@@ -0,0 +1,113 @@
+package bookshelf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Types of BookEvent.
+const (
+	BookCreated  = "book.created"
+	BookUpdated  = "book.updated"
+	BookDeleted  = "book.deleted"
+	BookRestored = "book.restored"
+	BookPurged   = "book.purged"
+
+	// BookReviewed announces that a review of the book was saved or
+	// deleted, changing its ratings.
+	BookReviewed = "book.reviewed"
+
+	// LoanOverdue announces that a copy of the book was not returned by
+	// its due date.
+	LoanOverdue = "loan.overdue"
+)
+
+// BookEvent announces a change to a book on PubsubEventsTopicID. Unlike
+// the fill-book-details queue, which one worker consumes, every subscriber
+// sees every event.
+type BookEvent struct {
+	Type   string    `json:"type"`
+	BookID int64     `json:"bookId"`
+	Time   time.Time `json:"time"`
+
+	// MessageID is the ID of the Pub/Sub message SubscribeBookEvents got
+	// the event in, which stays the same when the message is redelivered.
+	MessageID string `json:"-"`
+}
+
+// PublishBookEvent publishes an event of the given type for a book. It does
+// nothing when Pub/Sub is not configured.
+func PublishBookEvent(ctx context.Context, eventType string, bookID int64) error {
+	if PubsubClient == nil {
+		return nil
+	}
+	b, err := json.Marshal(BookEvent{Type: eventType, BookID: bookID, Time: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	topic := PubsubClient.Topic(PubsubEventsTopicID)
+	_, err = topic.Publish(ctx, &pubsub.Message{Data: b}).Get(ctx)
+	return err
+}
+
+// RequestEnrichment queues a book on PubsubTopicID for the worker to fill
+// in its details. It does nothing when Pub/Sub is not configured.
+func RequestEnrichment(ctx context.Context, bookID int64) error {
+	if PubsubClient == nil {
+		return nil
+	}
+	b, err := json.Marshal(bookID)
+	if err != nil {
+		return err
+	}
+	topic := PubsubClient.Topic(PubsubTopicID)
+	_, err = topic.Publish(ctx, &pubsub.Message{Data: b}).Get(ctx)
+	return err
+}
+
+// SubscribeBookEvents calls f for each book event delivered to the named
+// subscription, creating it if needed, until ctx is done. Events f fails to
+// handle are redelivered.
+//
+// If expiration is non-zero the subscription is deleted after being unused
+// for that long, which suits subscriptions named after a single replica.
+func SubscribeBookEvents(ctx context.Context, subID string, expiration time.Duration, f func(context.Context, BookEvent) error) error {
+	if PubsubClient == nil {
+		return errors.New("pubsub: client is not configured")
+	}
+	sub := PubsubClient.Subscription(subID)
+	exists, err := sub.Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("pubsub: could not check subscription %s: %v", subID, err)
+	}
+	if !exists {
+		cfg := pubsub.SubscriptionConfig{Topic: PubsubClient.Topic(PubsubEventsTopicID)}
+		if expiration != 0 {
+			cfg.ExpirationPolicy = expiration
+		}
+		if sub, err = PubsubClient.CreateSubscription(ctx, subID, cfg); err != nil {
+			return fmt.Errorf("pubsub: could not create subscription %s: %v", subID, err)
+		}
+	}
+	return sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		var e BookEvent
+		if err := json.Unmarshal(msg.Data, &e); err != nil {
+			log.Printf("could not decode book event: %#v", msg)
+			msg.Ack()
+			return
+		}
+		e.MessageID = msg.ID
+		if err := f(ctx, e); err != nil {
+			log.Printf("[ID %d] could not handle %s: %v", e.BookID, e.Type, err)
+			msg.Nack()
+			return
+		}
+		msg.Ack()
+	})
+}
@@ -0,0 +1,30 @@
+package bookshelf
+
+import "testing"
+
+// Constructors and helpers for the tests in package bookshelf_test, which
+// run the bookshelftest suite. bookshelftest imports this package, so the
+// backends are tested from outside it.
+var (
+	NewSQLiteDB    = newSQLiteDB
+	NewMySQLDB     = newMySQLDB
+	NewPostgresDB  = newPostgresDB
+	NewDatastoreDB = newDatastoreDB
+	ParseReplicas  = parseReplicas
+	EmptySQLDB     = emptySQLDB
+	BookCacheKey   = bookCacheKey
+	ListCacheKey   = listCacheKey
+)
+
+// testActor is recorded as having made the changes in this package's
+// tests.
+var testActor = Actor{ID: "12345", Name: "Tester", Source: SourceAPI}
+
+// newEmptySQLiteDB opens a fresh in-memory SQLite database.
+func newEmptySQLiteDB(t *testing.T) BookDatabase {
+	db, err := newSQLiteDB(SQLiteConfig{Path: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
@@ -0,0 +1,188 @@
+package bookshelf
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Actions recorded in BookChange.Action.
+const (
+	ChangeCreate  = "create"
+	ChangeUpdate  = "update"
+	ChangeDelete  = "delete"
+	ChangeRestore = "restore"
+	ChangePurge   = "purge"
+	ChangeMerge   = "merge"
+)
+
+// mergedFromField is the pseudo field of a merge's diff that records the ID
+// of the book merged in. RollbackBook ignores it.
+const mergedFromField = "mergedFrom"
+
+// BookChange is one entry in the append-only history of a book.
+type BookChange struct {
+	// ID orders the changes: a later change has a higher ID.
+	ID     int64
+	BookID int64
+	Action string
+	Actor  Actor
+	Time   time.Time
+
+	// Diff lists the fields the change set, for creates and updates.
+	Diff []FieldChange
+}
+
+// FieldChange is a change to one field of a book.
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// AuditQuery selects entries from the audit log. Zero fields match every
+// change.
+type AuditQuery struct {
+	BookID  int64
+	ActorID string
+	Source  string
+	Action  string
+	Since   time.Time
+	Until   time.Time
+
+	// BeforeID returns only changes older than the one with this ID, to
+	// page through the log.
+	BeforeID int64
+
+	// Limit caps the number of changes returned. It defaults to
+	// DefaultAuditLimit and cannot exceed MaxAuditLimit.
+	Limit int
+}
+
+const (
+	DefaultAuditLimit = 100
+	MaxAuditLimit     = 1000
+)
+
+// limit returns the number of changes the query may return.
+func (q AuditQuery) limit() int {
+	if q.Limit <= 0 {
+		return DefaultAuditLimit
+	}
+	if q.Limit > MaxAuditLimit {
+		return MaxAuditLimit
+	}
+	return q.Limit
+}
+
+// matches reports whether c is selected by q, for backends that filter the
+// log in memory.
+func (q AuditQuery) matches(c *BookChange) bool {
+	switch {
+	case q.BookID != 0 && c.BookID != q.BookID,
+		q.ActorID != "" && c.Actor.ID != q.ActorID,
+		q.Source != "" && c.Actor.Source != q.Source,
+		q.Action != "" && c.Action != q.Action,
+		!q.Since.IsZero() && c.Time.Before(q.Since),
+		!q.Until.IsZero() && !c.Time.Before(q.Until),
+		q.BeforeID != 0 && c.ID >= q.BeforeID:
+		return false
+	}
+	return true
+}
+
+// historyFields are the book fields the history tracks and RollbackBook
+// restores.
+var historyFields = []struct {
+	name string
+	get  func(b *Book) string
+	set  func(b *Book, v string)
+}{
+	{"title", func(b *Book) string { return b.Title }, func(b *Book, v string) { b.Title = v }},
+	// The contributors follow from the author string, so only the latter
+	// is tracked.
+	{"author", func(b *Book) string { return b.Author }, func(b *Book, v string) { b.Author = v }},
+	{"imageUrl", func(b *Book) string { return b.ImageURL }, func(b *Book, v string) { b.ImageURL = v }},
+	// The ISBN-10 follows from the ISBN-13, so only the latter is tracked.
+	{"isbn", func(b *Book) string { return b.ISBN13 }, func(b *Book, v string) { b.ISBN10, b.ISBN13 = "", v }},
+	{"tags", func(b *Book) string { return FormatTags(b.Tags) }, func(b *Book, v string) { b.Tags = ParseTags(v) }},
+	{"genres", func(b *Book) string { return FormatTags(b.Genres) }, func(b *Book, v string) { b.Genres = ParseTags(v) }},
+	{"description", func(b *Book) string { return b.Description }, func(b *Book, v string) { b.Description = v }},
+	{"publishedDate", func(b *Book) string { return b.PublishedDate }, func(b *Book, v string) { b.PublishedDate = v }},
+}
+
+// diffBooks lists the tracked fields that differ between old and new. A
+// nil old diffs against an empty book, for a book being created.
+func diffBooks(old, new *Book) []FieldChange {
+	if old == nil {
+		old = &Book{}
+	}
+	var diff []FieldChange
+	for _, f := range historyFields {
+		if o, n := f.get(old), f.get(new); o != n {
+			diff = append(diff, FieldChange{Field: f.name, Old: o, New: n})
+		}
+	}
+	return diff
+}
+
+// encodeDiff stores a diff as JSON text.
+func encodeDiff(diff []FieldChange) string {
+	if len(diff) == 0 {
+		return ""
+	}
+	// A slice of strings always encodes.
+	b, _ := json.Marshal(diff)
+	return string(b)
+}
+
+func decodeDiff(s string) ([]FieldChange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var diff []FieldChange
+	if err := json.Unmarshal([]byte(s), &diff); err != nil {
+		return nil, fmt.Errorf("could not decode diff %q: %v", s, err)
+	}
+	return diff, nil
+}
+
+// RollbackBook restores the tracked fields of a book to how they were right
+// after the change with changeID, recording it as an update by the given
+// actor. It works back from the current book, undoing every later change,
+// so it also works for books older than their history.
+func RollbackBook(db BookDatabase, id, changeID int64, by Actor) (*Book, error) {
+	// Read the book as it was last saved, but write through db so a cache
+	// in front of it sees the change.
+	primary := ReadPrimary(db)
+	book, err := primary.GetBook(id)
+	if err != nil {
+		return nil, err
+	}
+	history, err := primary.BookHistory(id)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	// The history is newest first.
+	for _, c := range history {
+		if c.ID == changeID {
+			found = true
+			break
+		}
+		for _, d := range c.Diff {
+			for _, f := range historyFields {
+				if f.name == d.Field {
+					f.set(book, d.Old)
+				}
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("could not find change %d of book %d: %w", changeID, id, ErrNotFound)
+	}
+	if err := db.UpdateBook(book, by); err != nil {
+		return nil, err
+	}
+	return book, nil
+}
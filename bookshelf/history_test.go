@@ -0,0 +1,33 @@
+package bookshelf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRollbackBookInvalidatesCache(t *testing.T) {
+	db := NewCachedDB(newEmptySQLiteDB(t), CacheConfig{Size: 10, TTL: time.Minute})
+	defer db.Close()
+	id, err := db.AddBook(&Book{Title: "Draft"}, testActor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := db.BookHistory(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateBook(&Book{ID: id, Title: "Final"}, testActor); err != nil {
+		t.Fatal(err)
+	}
+	// Cache the book as updated.
+	if _, err := db.GetBook(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RollbackBook(db, id, history[0].ID, testActor); err != nil {
+		t.Fatalf("RollbackBook: %v", err)
+	}
+	if b, err := db.GetBook(id); err != nil || b.Title != "Draft" {
+		t.Errorf("GetBook(%d) after RollbackBook = %v, %v, want the title rolled back", id, b, err)
+	}
+}
@@ -0,0 +1,102 @@
+package bookshelf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/storage"
+)
+
+// InlineImportLimit is the largest CSV file, in bytes, the app imports
+// while the user waits. Larger files are imported by the worker.
+const InlineImportLimit = 1 << 20
+
+// ImportJob asks the worker to import a CSV file uploaded to StorageBucket.
+type ImportJob struct {
+	ID      string        `json:"id"`
+	Options ImportOptions `json:"options"`
+}
+
+// ImportObject is the name of the uploaded CSV file of the import with the
+// given ID. Files and their reports are kept under imports/ until a lifecycle
+// rule on the bucket expires them.
+func ImportObject(id string) string { return "imports/" + id + ".csv" }
+
+// importReportObject is the name of the report of the import with the given
+// ID.
+func importReportObject(id string) string { return "imports/" + id + ".report.json" }
+
+// PublishImportJob queues an import for the worker.
+func PublishImportJob(ctx context.Context, job ImportJob) error {
+	if PubsubClient == nil {
+		return errors.New("pubsub: client is not configured")
+	}
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	topic := PubsubClient.Topic(PubsubImportTopicID)
+	_, err = topic.Publish(ctx, &pubsub.Message{Data: b}).Get(ctx)
+	return err
+}
+
+// RunImportJob imports the uploaded file of job into DB and saves the
+// report where LoadImportReport finds it. The report is saved even when
+// the import stops early, unless storage itself fails.
+func RunImportJob(ctx context.Context, job ImportJob) (*ImportReport, error) {
+	if StorageBucket == nil {
+		return nil, errors.New("storage bucket is missing - check config.go")
+	}
+	r, err := StorageBucket.Object(ImportObject(job.ID)).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not open import %s: %v", job.ID, err)
+	}
+	defer r.Close()
+
+	report, err := ImportCSV(ctx, DB, r, job.Options)
+	if report == nil {
+		report = &ImportReport{DryRun: job.Options.DryRun, Error: err.Error()}
+	}
+	if serr := SaveImportReport(ctx, job.ID, report); serr != nil {
+		return report, serr
+	}
+	return report, err
+}
+
+// SaveImportReport stores the report of the import with the given ID.
+func SaveImportReport(ctx context.Context, id string, report *ImportReport) error {
+	b, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	w := StorageBucket.Object(importReportObject(id)).NewWriter(ctx)
+	w.ContentType = "application/json"
+	if _, err := w.Write(b); err != nil {
+		w.Close()
+		return fmt.Errorf("could not save report of import %s: %v", id, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("could not save report of import %s: %v", id, err)
+	}
+	return nil
+}
+
+// LoadImportReport returns the report of the import with the given ID, or
+// ErrNotFound while the worker has not finished it.
+func LoadImportReport(ctx context.Context, id string) (*ImportReport, error) {
+	r, err := StorageBucket.Object(importReportObject(id)).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, fmt.Errorf("no report for import %s yet: %w", id, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("could not open report of import %s: %v", id, err)
+	}
+	defer r.Close()
+	report := &ImportReport{}
+	if err := json.NewDecoder(r).Decode(report); err != nil {
+		return nil, fmt.Errorf("could not decode report of import %s: %v", id, err)
+	}
+	return report, nil
+}
@@ -0,0 +1,143 @@
+package bookshelf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StripISBN removes the hyphens and spaces ISBNs are printed with, and
+// upper-cases an ISBN-10 check digit of x.
+func StripISBN(s string) string {
+	s = strings.NewReplacer("-", "", " ", "", "‐", "", "‑", "").Replace(strings.TrimSpace(s))
+	return strings.ToUpper(s)
+}
+
+// ValidISBN10 reports whether s, without punctuation, is an ISBN-10 with a
+// correct check digit.
+func ValidISBN10(s string) bool {
+	if len(s) != 10 {
+		return false
+	}
+	sum := 0
+	for i := 0; i < 10; i++ {
+		var d int
+		switch c := s[i]; {
+		case c >= '0' && c <= '9':
+			d = int(c - '0')
+		case c == 'X' && i == 9:
+			d = 10
+		default:
+			return false
+		}
+		sum += (10 - i) * d
+	}
+	return sum%11 == 0
+}
+
+// ValidISBN13 reports whether s, without punctuation, is an ISBN-13 with a
+// correct check digit.
+func ValidISBN13(s string) bool {
+	if len(s) != 13 || !strings.HasPrefix(s, "978") && !strings.HasPrefix(s, "979") {
+		return false
+	}
+	sum := 0
+	for i := 0; i < 13; i++ {
+		c := s[i]
+		if c < '0' || c > '9' {
+			return false
+		}
+		if i%2 == 0 {
+			sum += int(c - '0')
+		} else {
+			sum += 3 * int(c-'0')
+		}
+	}
+	return sum%10 == 0
+}
+
+// ISBN10To13 converts a valid ISBN-10 to its ISBN-13.
+func ISBN10To13(isbn10 string) (string, error) {
+	if !ValidISBN10(isbn10) {
+		return "", fmt.Errorf("isbn: %q is not a valid ISBN-10: %w", isbn10, ErrInvalid)
+	}
+	s := "978" + isbn10[:9]
+	sum := 0
+	for i := 0; i < 12; i++ {
+		if i%2 == 0 {
+			sum += int(s[i] - '0')
+		} else {
+			sum += 3 * int(s[i]-'0')
+		}
+	}
+	return s + string(rune('0'+(10-sum%10)%10)), nil
+}
+
+// ISBN13To10 converts a valid ISBN-13 to its ISBN-10. Only ISBNs in the
+// 978 range have one.
+func ISBN13To10(isbn13 string) (string, error) {
+	if !ValidISBN13(isbn13) {
+		return "", fmt.Errorf("isbn: %q is not a valid ISBN-13: %w", isbn13, ErrInvalid)
+	}
+	if !strings.HasPrefix(isbn13, "978") {
+		return "", fmt.Errorf("isbn: %s has no ISBN-10 form: %w", isbn13, ErrInvalid)
+	}
+	s := isbn13[3:12]
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += (10 - i) * int(s[i]-'0')
+	}
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return s + "X", nil
+	}
+	return s + string(rune('0'+check)), nil
+}
+
+// NormalizeISBN validates an ISBN-10 or ISBN-13, with or without hyphens,
+// and returns both forms. isbn10 is empty for ISBNs in the 979 range, which
+// have no ISBN-10.
+func NormalizeISBN(s string) (isbn10, isbn13 string, err error) {
+	s = StripISBN(s)
+	switch len(s) {
+	case 10:
+		if isbn13, err = ISBN10To13(s); err != nil {
+			return "", "", err
+		}
+		return s, isbn13, nil
+	case 13:
+		if !ValidISBN13(s) {
+			return "", "", fmt.Errorf("isbn: %q is not a valid ISBN-13: %w", s, ErrInvalid)
+		}
+		isbn10, _ = ISBN13To10(s)
+		return isbn10, s, nil
+	}
+	return "", "", fmt.Errorf("isbn: %q is neither an ISBN-10 nor an ISBN-13: %w", s, ErrInvalid)
+}
+
+// normalizeISBN validates the ISBNs of b and fills in whichever form is
+// missing, so the backends store both forms without punctuation. ISBN13
+// takes precedence: ISBN10 is derived from it when both are set, and a
+// different ISBN10 is rejected.
+func (b *Book) normalizeISBN() error {
+	switch {
+	case b.ISBN13 != "":
+		isbn10, isbn13, err := NormalizeISBN(b.ISBN13)
+		if err != nil {
+			return err
+		}
+		if b.ISBN10 != "" && StripISBN(b.ISBN10) != isbn10 {
+			return fmt.Errorf("isbn: ISBN-10 %s does not match ISBN-13 %s: %w", b.ISBN10, isbn13, ErrInvalid)
+		}
+		b.ISBN10, b.ISBN13 = isbn10, isbn13
+	case b.ISBN10 != "":
+		isbn10, isbn13, err := NormalizeISBN(b.ISBN10)
+		if err != nil {
+			return err
+		}
+		if len(isbn10) != 10 || StripISBN(b.ISBN10) != isbn10 {
+			return fmt.Errorf("isbn: %q is not a valid ISBN-10: %w", b.ISBN10, ErrInvalid)
+		}
+		b.ISBN10, b.ISBN13 = isbn10, isbn13
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package bookshelf
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizeISBN(t *testing.T) {
+	for _, c := range []struct {
+		in             string
+		isbn10, isbn13 string
+		ok             bool
+	}{
+		{"0261103342", "0261103342", "9780261103344", true},
+		{"9780261103344", "0261103342", "9780261103344", true},
+		{"978-0-261-10334-4", "0261103342", "9780261103344", true},
+		{" 0 261 10334 2 ", "0261103342", "9780261103344", true},
+		{"0-8044-2957-X", "080442957X", "9780804429573", true},
+		{"080442957x", "080442957X", "9780804429573", true},
+		{"9780804429573", "080442957X", "9780804429573", true},
+		{"979-10-90636-07-1", "", "9791090636071", true},
+		{"0261103343", "", "", false},     // wrong check digit
+		{"9780261103345", "", "", false},  // wrong check digit
+		{"X261103342", "", "", false},     // X before the check digit
+		{"9770261103344", "", "", false},  // not a book
+		{"026110334", "", "", false},      // too short
+		{"97802611033440", "", "", false}, // too long
+		{"", "", "", false},
+	} {
+		isbn10, isbn13, err := NormalizeISBN(c.in)
+		if !c.ok {
+			if !errors.Is(err, ErrInvalid) {
+				t.Errorf("NormalizeISBN(%q) = %q, %q, %v; want ErrInvalid", c.in, isbn10, isbn13, err)
+			}
+			continue
+		}
+		if err != nil || isbn10 != c.isbn10 || isbn13 != c.isbn13 {
+			t.Errorf("NormalizeISBN(%q) = %q, %q, %v; want %q, %q", c.in, isbn10, isbn13, err, c.isbn10, c.isbn13)
+		}
+	}
+}
+
+func TestISBNConversion(t *testing.T) {
+	for _, c := range []struct {
+		isbn10, isbn13 string
+	}{
+		{"0261103342", "9780261103344"},
+		{"080442957X", "9780804429573"},
+		{"0306406152", "9780306406157"},
+		{"0575046066", "9780575046061"},
+	} {
+		if got, err := ISBN10To13(c.isbn10); err != nil || got != c.isbn13 {
+			t.Errorf("ISBN10To13(%q) = %q, %v; want %q", c.isbn10, got, err, c.isbn13)
+		}
+		if got, err := ISBN13To10(c.isbn13); err != nil || got != c.isbn10 {
+			t.Errorf("ISBN13To10(%q) = %q, %v; want %q", c.isbn13, got, err, c.isbn10)
+		}
+	}
+	if got, err := ISBN13To10("9791090636071"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("ISBN13To10 in the 979 range = %q, %v; want ErrInvalid", got, err)
+	}
+}
+
+func TestBookNormalizeISBN(t *testing.T) {
+	for _, c := range []struct {
+		name           string
+		isbn10, isbn13 string
+		want10, want13 string
+		ok             bool
+	}{
+		{"none", "", "", "", "", true},
+		{"ISBN-10 only", "0-261-10334-2", "", "0261103342", "9780261103344", true},
+		{"ISBN-13 only", "", "978-0-261-10334-4", "0261103342", "9780261103344", true},
+		{"matching", "0261103342", "9780261103344", "0261103342", "9780261103344", true},
+		{"979 range", "", "9791090636071", "", "9791090636071", true},
+		{"mismatch", "0306406152", "9780261103344", "", "", false},
+		{"ISBN-13 as ISBN-10", "9780261103344", "", "", "", false},
+		{"bad ISBN-13", "", "9780261103345", "", "", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			b := &Book{ISBN10: c.isbn10, ISBN13: c.isbn13}
+			err := b.normalizeISBN()
+			if !c.ok {
+				if !errors.Is(err, ErrInvalid) {
+					t.Errorf("normalizeISBN = %v, want ErrInvalid", err)
+				}
+				return
+			}
+			if err != nil || b.ISBN10 != c.want10 || b.ISBN13 != c.want13 {
+				t.Errorf("normalizeISBN = %v, leaving %q, %q; want %q, %q", err, b.ISBN10, b.ISBN13, c.want10, c.want13)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package bookshelf
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// DefaultLoanPeriod is used when LoanPeriod is not set.
+const DefaultLoanPeriod = 14 * 24 * time.Hour
+
+// LoanPeriodDuration returns how long a book is lent for, parsed from
+// LoanPeriod.
+func LoanPeriodDuration() (time.Duration, error) {
+	if LoanPeriod == "" {
+		return DefaultLoanPeriod, nil
+	}
+	d, err := time.ParseDuration(LoanPeriod)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid LOAN_PERIOD %q: want a positive duration such as 336h", LoanPeriod)
+	}
+	return d, nil
+}
+
+// Copy is a physical copy of a book that can be lent out.
+type Copy struct {
+	ID     int64
+	BookID int64
+
+	// Label tells copies of one book apart, such as a shelf mark or
+	// "signed". It may be empty.
+	Label   string
+	AddedAt time.Time
+
+	// Loan is the copy's open loan, if it is lent out. It is set by
+	// ListCopies.
+	Loan *Loan
+}
+
+// Loan records a copy of a book lent to a user. A loan stays on record
+// after it is returned, as part of the user's history.
+type Loan struct {
+	ID     int64
+	CopyID int64
+	BookID int64
+
+	// UserID is the profile ID of the borrower, and UserName their name
+	// at the time.
+	UserID   string
+	UserName string
+
+	CheckedOutAt time.Time
+	DueAt        time.Time
+
+	// ReturnedAt is zero while the loan is open.
+	ReturnedAt time.Time
+
+	// OverdueAt is when the worker found the loan overdue, or zero.
+	OverdueAt time.Time
+
+	// Book is set by ListLoans.
+	Book *Book
+}
+
+// Open reports whether the copy has not been returned.
+func (l *Loan) Open() bool {
+	return l.ReturnedAt.IsZero()
+}
+
+// Overdue reports whether the loan is open past its due date at t.
+func (l *Loan) Overdue(t time.Time) bool {
+	return l.Open() && t.After(l.DueAt)
+}
+
+// Hold is a user's place in the queue for a book. When a copy comes back,
+// it goes to the user who has waited longest.
+type Hold struct {
+	BookID   int64
+	UserID   string
+	UserName string
+	PlacedAt time.Time
+}
+
+// Availability counts the copies of a book and the demand for them.
+type Availability struct {
+	Copies int
+	OnLoan int
+	Holds  int
+}
+
+// Available is the number of copies on the shelf.
+func (a Availability) Available() int {
+	if a.OnLoan > a.Copies {
+		return 0
+	}
+	return a.Copies - a.OnLoan
+}
+
+// LoanQuery selects loans for ListLoans. Zero fields select every loan.
+type LoanQuery struct {
+	UserID string
+	BookID int64
+
+	// Open leaves out returned loans.
+	Open bool
+
+	// DueBefore, if set, keeps only loans due before it.
+	DueBefore time.Time
+}
+
+// matches reports whether q selects l. The backends filter what their
+// indexes allow and leave the rest to it.
+func (q LoanQuery) matches(l *Loan) bool {
+	return (q.UserID == "" || l.UserID == q.UserID) &&
+		(q.BookID == 0 || l.BookID == q.BookID) &&
+		(!q.Open || l.Open()) &&
+		(q.DueBefore.IsZero() || l.DueAt.Before(q.DueBefore))
+}
+
+// sortLoans orders loans newest first.
+func sortLoans(loans []*Loan) {
+	sort.SliceStable(loans, func(i, j int) bool {
+		if !loans[i].CheckedOutAt.Equal(loans[j].CheckedOutAt) {
+			return loans[i].CheckedOutAt.After(loans[j].CheckedOutAt)
+		}
+		return loans[i].ID > loans[j].ID
+	})
+}
+
+// checkOutCopy picks the copy to lend to userID from the copies of a book,
+// its open loans and its holds queue, oldest first. A user may borrow only
+// one copy of a book at a time, and copies are kept for the users ahead in
+// the queue. It returns 0 with the reason when no copy can be lent.
+func checkOutCopy(copies []*Copy, open []*Loan, holds []*Hold, userID string) (int64, string) {
+	lent := make(map[int64]bool, len(open))
+	for _, l := range open {
+		if l.UserID == userID {
+			return 0, "the book is already lent to you"
+		}
+		lent[l.CopyID] = true
+	}
+	var free []int64
+	for _, c := range copies {
+		if !lent[c.ID] {
+			free = append(free, c.ID)
+		}
+	}
+	ahead := len(holds)
+	for i, h := range holds {
+		if h.UserID == userID {
+			ahead = i
+			break
+		}
+	}
+	switch {
+	case len(copies) == 0:
+		return 0, "the library has no copies"
+	case len(free) == 0:
+		return 0, "every copy is lent out"
+	case ahead >= len(free):
+		return 0, fmt.Sprintf("the free copies are held for %d users ahead of you", ahead)
+	}
+	sort.Slice(free, func(i, j int) bool { return free[i] < free[j] })
+	return free[0], ""
+}
+
+// MarkOverdueLoans flags the open loans past their due date that are not
+// flagged yet, announcing each with a LoanOverdue event, and returns how
+// many were flagged.
+func MarkOverdueLoans(ctx context.Context) (int, error) {
+	t := time.Now()
+	loans, err := DB.ListLoans(LoanQuery{Open: true, DueBefore: t})
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, l := range loans {
+		if !l.OverdueAt.IsZero() {
+			continue
+		}
+		if err := DB.MarkOverdue(l.BookID, l.ID, t); err != nil {
+			// Another worker flagged it, or it was returned meanwhile.
+			log.Printf("[ID %d] could not mark loan %d overdue: %v", l.BookID, l.ID, err)
+			continue
+		}
+		n++
+		log.Printf("[ID %d] loan %d to %s was due %s", l.BookID, l.ID, l.UserID, l.DueAt.Format(time.RFC3339))
+		if err := PublishBookEvent(ctx, LoanOverdue, l.BookID); err != nil {
+			log.Printf("[ID %d] could not publish overdue event: %v", l.BookID, err)
+		}
+	}
+	return n, nil
+}
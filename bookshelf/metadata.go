@@ -0,0 +1,189 @@
+package bookshelf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metadata is what a catalogue knows about a book.
+type Metadata struct {
+	Title   string
+	Authors []string
+
+	// Categories are subject headings such as "Fiction / Fantasy / Epic",
+	// which ClassifyCategories sorts into genres and tags.
+	Categories []string
+
+	// Description is the publisher's summary, as plain text, and
+	// PublishedDate is in one of the forms Book.PublishedDate takes.
+	Description   string
+	PublishedDate string
+
+	// CoverURL links to an image of the cover on the catalogue's site.
+	CoverURL string
+}
+
+// Book prefills a new book with the ISBN isbn13 from md. The cover is left
+// out, to be copied into StorageBucket by CopyCover.
+func (md *Metadata) Book(isbn13 string) *Book {
+	return &Book{
+		Title:         md.Title,
+		Author:        strings.Join(md.Authors, "; "),
+		Description:   md.Description,
+		PublishedDate: md.PublishedDate,
+		ISBN13:        isbn13,
+	}
+}
+
+// MetadataProvider looks books up in a catalogue. MetadataSource is the one
+// in use.
+type MetadataProvider interface {
+	// Lookup finds a book by its ISBN-13. A book the catalogue does not
+	// know reports ErrNotFound.
+	Lookup(ctx context.Context, isbn13 string) (*Metadata, error)
+
+	// Search returns up to limit books whose title, or author if kind is
+	// SuggestAuthor, matches query, best first.
+	Search(ctx context.Context, kind, query string, limit int) ([]*Metadata, error)
+}
+
+// markup matches the HTML tags Google Books puts in descriptions, and
+// lineBreaks those that end a line.
+var (
+	markup     = regexp.MustCompile(`<[^>]*>`)
+	lineBreaks = regexp.MustCompile(`(?i)<br\s*/?>|</p>`)
+)
+
+// plainText strips the markup from an HTML snippet and decodes its
+// entities, turning line breaks and paragraphs into newlines.
+func plainText(s string) string {
+	s = lineBreaks.ReplaceAllString(s, "\n")
+	return strings.TrimSpace(html.UnescapeString(markup.ReplaceAllString(s, "")))
+}
+
+// googleBooksURL is the volumes endpoint of the Google Books API.
+const googleBooksURL = "https://www.googleapis.com/books/v1/volumes"
+
+// maxSearchMetadata is the most volumes Google Books returns for a query.
+const maxSearchMetadata = 40
+
+// googleBooks is a MetadataProvider for the Google Books API, or a server
+// with the same volumes endpoint.
+type googleBooks struct {
+	url, key string
+	client   *http.Client
+}
+
+// NewGoogleBooks returns a MetadataProvider that queries the volumes
+// endpoint at url, or Google Books' own if url is empty, sending key, if
+// set, for a higher quota.
+func NewGoogleBooks(url, key string) MetadataProvider {
+	if url == "" {
+		url = googleBooksURL
+	}
+	// The client bounds how long a lookup can hold up the worker.
+	return &googleBooks{url: url, key: key, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// volumes runs a Google Books query, such as "isbn:9780261103344" or
+// "intitle:hobbit", and returns up to max of the volumes it finds, or as
+// many as Google Books sends if max is 0.
+func (g *googleBooks) volumes(ctx context.Context, query string, max int) ([]*Metadata, error) {
+	q := url.Values{"q": {query}}
+	if max > 0 {
+		q.Set("maxResults", strconv.Itoa(max))
+	}
+	if g.key != "" {
+		q.Set("key", g.key)
+	}
+	req, err := http.NewRequest("GET", g.url+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := g.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("googlebooks: could not search for %s: %v", query, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("googlebooks: could not search for %s: %s", query, resp.Status)
+	}
+
+	var result struct {
+		Items []struct {
+			VolumeInfo struct {
+				Title         string   `json:"title"`
+				Authors       []string `json:"authors"`
+				Categories    []string `json:"categories"`
+				Description   string   `json:"description"`
+				PublishedDate string   `json:"publishedDate"`
+				ImageLinks    struct {
+					Thumbnail string `json:"thumbnail"`
+				} `json:"imageLinks"`
+			} `json:"volumeInfo"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("googlebooks: could not decode volumes for %s: %v", query, err)
+	}
+	var volumes []*Metadata
+	for _, item := range result.Items {
+		v := item.VolumeInfo
+		volumes = append(volumes, &Metadata{
+			Title:         v.Title,
+			Authors:       v.Authors,
+			Categories:    v.Categories,
+			Description:   plainText(v.Description),
+			PublishedDate: v.PublishedDate,
+			// Google Books links covers over plain HTTP, but serves
+			// them over HTTPS too.
+			CoverURL: strings.Replace(v.ImageLinks.Thumbnail, "http://books.google.com/", "https://books.google.com/", 1),
+		})
+	}
+	return volumes, nil
+}
+
+// Lookup finds a book on Google Books by its ISBN-13.
+func (g *googleBooks) Lookup(ctx context.Context, isbn13 string) (*Metadata, error) {
+	volumes, err := g.volumes(ctx, "isbn:"+isbn13, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(volumes) == 0 {
+		return nil, fmt.Errorf("googlebooks: no volume has ISBN %s: %w", isbn13, ErrNotFound)
+	}
+	return volumes[0], nil
+}
+
+// Search returns up to limit, at most maxSearchMetadata, of the books
+// Google Books finds by title or author.
+func (g *googleBooks) Search(ctx context.Context, kind, query string, limit int) ([]*Metadata, error) {
+	prefix := "intitle:"
+	if kind == SuggestAuthor {
+		prefix = "inauthor:"
+	}
+	if limit <= 0 || limit > maxSearchMetadata {
+		limit = maxSearchMetadata
+	}
+	return g.volumes(ctx, prefix+query, limit)
+}
+
+// LookupMetadata looks a book up by its ISBN-13 with MetadataSource. A
+// book it does not know reports ErrNotFound.
+func LookupMetadata(ctx context.Context, isbn13 string) (*Metadata, error) {
+	return MetadataSource.Lookup(ctx, isbn13)
+}
+
+// SearchMetadata returns up to limit of the books MetadataSource has whose
+// title, or author if kind is SuggestAuthor, matches query.
+func SearchMetadata(ctx context.Context, kind, query string, limit int) ([]*Metadata, error) {
+	return MetadataSource.Search(ctx, kind, query, limit)
+}
@@ -0,0 +1,87 @@
+package bookshelf_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+	"github.com/tony-yang/google-cloud-stack/bookshelf/metadatatest"
+)
+
+var hobbit = metadatatest.Volume{
+	ISBN13:        "9780261103344",
+	Title:         "The Hobbit",
+	Authors:       []string{"J. R. R. Tolkien", "Christopher Tolkien"},
+	Categories:    []string{"Fiction / Fantasy / Epic"},
+	Description:   "<p>A <b>hobbit</b> &amp; a dragon</p>",
+	PublishedDate: "1937-09-21",
+	Cover:         []byte("\xff\xd8\xff\xe0cover"),
+}
+
+// useMetadataServer looks books up in srv for the rest of the test.
+func useMetadataServer(t *testing.T, srv *metadatatest.Server) {
+	saved := bookshelf.MetadataSource
+	bookshelf.MetadataSource = srv.Provider()
+	t.Cleanup(func() {
+		bookshelf.MetadataSource = saved
+		srv.Close()
+	})
+}
+
+func TestLookupMetadata(t *testing.T) {
+	srv := metadatatest.NewServer(hobbit)
+	useMetadataServer(t, srv)
+	ctx := context.Background()
+
+	md, err := bookshelf.LookupMetadata(ctx, hobbit.ISBN13)
+	if err != nil {
+		t.Fatalf("LookupMetadata(%s): %v", hobbit.ISBN13, err)
+	}
+	b := md.Book(hobbit.ISBN13)
+	if b.Title != "The Hobbit" || b.Author != "J. R. R. Tolkien; Christopher Tolkien" ||
+		b.Description != "A hobbit & a dragon" || b.PublishedDate != "1937-09-21" || b.ISBN13 != hobbit.ISBN13 {
+		t.Errorf("LookupMetadata(%s).Book = %+v, want the stub's volume with a plain text description", hobbit.ISBN13, b)
+	}
+	if !strings.HasPrefix(md.CoverURL, srv.URL) {
+		t.Errorf("LookupMetadata(%s).CoverURL = %q, want the stub's cover", hobbit.ISBN13, md.CoverURL)
+	}
+	if q := srv.Queries(); len(q) != 1 || q[0] != "isbn:"+hobbit.ISBN13 {
+		t.Errorf("stub was queried for %q, want the ISBN alone", q)
+	}
+}
+
+func TestLookupMetadataNotFound(t *testing.T) {
+	useMetadataServer(t, metadatatest.NewServer(hobbit))
+	_, err := bookshelf.LookupMetadata(context.Background(), "9780441172719")
+	if !errors.Is(err, bookshelf.ErrNotFound) {
+		t.Errorf("LookupMetadata of an unknown ISBN = %v, want ErrNotFound", err)
+	}
+}
+
+func TestLookupMetadataProviderError(t *testing.T) {
+	srv := metadatatest.NewServer(hobbit)
+	useMetadataServer(t, srv)
+	srv.Fail(http.StatusServiceUnavailable)
+	_, err := bookshelf.LookupMetadata(context.Background(), hobbit.ISBN13)
+	if err == nil || errors.Is(err, bookshelf.ErrNotFound) || !strings.Contains(err.Error(), "503") {
+		t.Errorf("LookupMetadata from a provider answering 503 = %v, want its status", err)
+	}
+
+	srv.Fail(0)
+	if _, err := bookshelf.LookupMetadata(context.Background(), hobbit.ISBN13); err != nil {
+		t.Errorf("LookupMetadata once the provider recovered: %v", err)
+	}
+}
+
+func TestLookupMetadataMalformed(t *testing.T) {
+	srv := metadatatest.NewServer(hobbit)
+	useMetadataServer(t, srv)
+	srv.Malform(true)
+	_, err := bookshelf.LookupMetadata(context.Background(), hobbit.ISBN13)
+	if err == nil || errors.Is(err, bookshelf.ErrNotFound) || !strings.Contains(err.Error(), "decode") {
+		t.Errorf("LookupMetadata from a provider answering malformed JSON = %v, want a decoding error", err)
+	}
+}
@@ -0,0 +1,188 @@
+// Package metadatatest serves a stub of the Google Books volumes endpoint,
+// so what looks books up, such as the add-by-ISBN flow and the worker, can
+// be tested without the network.
+package metadatatest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// VolumesPath is the path of the stub volumes endpoint.
+const VolumesPath = "/books/v1/volumes"
+
+// coversPath is where the stub serves the covers of its volumes, by
+// ISBN-13.
+const coversPath = "/covers/"
+
+// Volume is a book the stub knows.
+type Volume struct {
+	ISBN13        string
+	Title         string
+	Authors       []string
+	Categories    []string
+	Description   string
+	PublishedDate string
+
+	// Cover, if set, is served as the volume's cover image, with
+	// CoverType as its content type, "image/jpeg" if empty.
+	Cover     []byte
+	CoverType string
+}
+
+// Server is a stub volumes endpoint. It answers "isbn:", "intitle:" and
+// "inauthor:" queries, the last two by a case-insensitive substring
+// match, and links each volume's cover to an image it serves itself.
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	volumes   []Volume
+	queries   []string
+	status    int  // answered instead of the volumes, if set
+	malformed bool // whether to answer with a body that is not JSON
+}
+
+// NewServer starts a stub that knows volumes. The caller should Close it
+// when done. It listens on a loopback address, so tests that copy its
+// covers need bookshelf.AllowPrivateCovers set.
+func NewServer(volumes ...Volume) *Server {
+	s := &Server{volumes: volumes}
+	mux := http.NewServeMux()
+	mux.HandleFunc(VolumesPath, s.serveVolumes)
+	mux.HandleFunc(coversPath, s.serveCover)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// VolumesURL is the URL of the stub volumes endpoint, to be set as
+// bookshelf.MetadataURL or passed to bookshelf.NewGoogleBooks.
+func (s *Server) VolumesURL() string {
+	return s.URL + VolumesPath
+}
+
+// Provider returns a MetadataProvider that looks books up in the stub.
+func (s *Server) Provider() bookshelf.MetadataProvider {
+	return bookshelf.NewGoogleBooks(s.VolumesURL(), "")
+}
+
+// Add makes the stub know v too.
+func (s *Server) Add(v Volume) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.volumes = append(s.volumes, v)
+}
+
+// Fail makes the stub answer volume queries with status, such as 503 for
+// a provider that is down, until it is called again with 0.
+func (s *Server) Fail(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// Malform makes the stub answer volume queries with a body that is not
+// JSON, until it is called again with false.
+func (s *Server) Malform(malformed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.malformed = malformed
+}
+
+// Queries returns the q parameters of the requests served so far.
+func (s *Server) Queries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+// match reports whether v answers the query q.
+func match(v Volume, q string) bool {
+	contains := func(s, sub string) bool {
+		return sub != "" && strings.Contains(strings.ToLower(s), strings.ToLower(sub))
+	}
+	switch {
+	case strings.HasPrefix(q, "isbn:"):
+		return v.ISBN13 == strings.TrimPrefix(q, "isbn:")
+	case strings.HasPrefix(q, "intitle:"):
+		return contains(v.Title, strings.TrimPrefix(q, "intitle:"))
+	case strings.HasPrefix(q, "inauthor:"):
+		for _, a := range v.Authors {
+			if contains(a, strings.TrimPrefix(q, "inauthor:")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type volumeInfo struct {
+	Title         string            `json:"title"`
+	Authors       []string          `json:"authors,omitempty"`
+	Categories    []string          `json:"categories,omitempty"`
+	Description   string            `json:"description,omitempty"`
+	PublishedDate string            `json:"publishedDate,omitempty"`
+	ImageLinks    map[string]string `json:"imageLinks,omitempty"`
+}
+
+type volume struct {
+	VolumeInfo volumeInfo `json:"volumeInfo"`
+}
+
+func (s *Server) serveVolumes(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	s.mu.Lock()
+	s.queries = append(s.queries, q)
+	status, malformed := s.status, s.malformed
+	var items []volume
+	for _, v := range s.volumes {
+		if !match(v, q) {
+			continue
+		}
+		info := volumeInfo{
+			Title:         v.Title,
+			Authors:       v.Authors,
+			Categories:    v.Categories,
+			Description:   v.Description,
+			PublishedDate: v.PublishedDate,
+		}
+		if v.Cover != nil {
+			info.ImageLinks = map[string]string{"thumbnail": s.URL + coversPath + v.ISBN13}
+		}
+		items = append(items, volume{VolumeInfo: info})
+	}
+	s.mu.Unlock()
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if malformed {
+		w.Write([]byte(`{"totalItems": 1, "items": [{"volumeInfo": `))
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"totalItems": len(items), "items": items})
+}
+
+func (s *Server) serveCover(w http.ResponseWriter, r *http.Request) {
+	isbn := strings.TrimPrefix(r.URL.Path, coversPath)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.volumes {
+		if v.ISBN13 == isbn && v.Cover != nil {
+			contentType := v.CoverType
+			if contentType == "" {
+				contentType = "image/jpeg"
+			}
+			w.Header().Set("Content-Type", contentType)
+			w.Write(v.Cover)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
@@ -0,0 +1,100 @@
+package bookshelf
+
+import (
+	"strings"
+	"unicode"
+)
+
+// foldedLetters maps lower case Latin letters with diacritics to the
+// letters they are written as without them.
+var foldedLetters = func() map[rune]string {
+	m := make(map[rune]string)
+	for letters, plain := range map[string]string{
+		"àáâãäåāăą": "a", "çćĉċč": "c", "ďđ": "d", "èéêëēĕėęě": "e",
+		"ĝğġģ": "g", "ĥħ": "h", "ìíîïĩīĭįı": "i", "ĵ": "j", "ķ": "k",
+		"ĺļľŀł": "l", "ñńņňŉ": "n", "òóôõöøōŏő": "o", "ŕŗř": "r",
+		"śŝşšș": "s", "ţťŧț": "t", "ùúûüũūŭůűų": "u", "ŵ": "w", "ýÿŷ": "y",
+		"źżž": "z", "ß": "ss", "æ": "ae", "œ": "oe", "þ": "th",
+	} {
+		for _, r := range letters {
+			m[r] = plain
+		}
+	}
+	return m
+}()
+
+// normalizeText lower-cases s, removes diacritics, turns punctuation into
+// spaces and collapses runs of spaces, so values that differ only in case,
+// accents, punctuation or spacing compare equal. Periods are dropped
+// rather than spaced out, so "J.R.R." reads as "jrr".
+func normalizeText(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case r == '.' || r == '\'' || r == '’':
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			space = false
+			if plain, ok := foldedLetters[r]; ok {
+				b.WriteString(plain)
+			} else {
+				b.WriteRune(r)
+			}
+		default:
+			space = true
+		}
+	}
+	return b.String()
+}
+
+// NormalizeTitle reduces a title to a form in which the same book's title
+// compares equal however a site wrote it: without case, accents,
+// punctuation, a leading article, even when sorted to the end as in
+// "Hobbit, The", or a trailing series note such as "(Discworld, #1)".
+func NormalizeTitle(title string) string {
+	title = strings.TrimSpace(title)
+	if i := strings.LastIndex(title, "("); i > 0 && strings.HasSuffix(title, ")") {
+		title = title[:i]
+	}
+	t := normalizeText(title)
+	for _, article := range []string{"the", "a", "an"} {
+		if strings.HasPrefix(t, article+" ") {
+			return strings.TrimPrefix(t, article+" ")
+		}
+		if strings.HasSuffix(t, " "+article) {
+			return strings.TrimSuffix(t, " "+article)
+		}
+	}
+	return t
+}
+
+// NormalizeAuthor reduces an author's name to a comparable form, turning
+// "Pratchett, Terry" into the same form as "Terry Pratchett", and "J. R. R.
+// Tolkien" into the same form as "J.R.R. Tolkien".
+func NormalizeAuthor(author string) string {
+	if parts := strings.Split(author, ","); len(parts) == 2 {
+		author = parts[1] + " " + parts[0]
+	}
+	var words []string
+	initials := false
+	for _, w := range strings.Fields(normalizeText(author)) {
+		single := len([]rune(w)) == 1
+		if single && initials {
+			words[len(words)-1] += w
+		} else {
+			words = append(words, w)
+		}
+		initials = single
+	}
+	return strings.Join(words, " ")
+}
+
+// TitleAuthorKey identifies a book by its normalized title and author, for
+// finding the same book entered twice.
+func TitleAuthorKey(title, author string) string {
+	return NormalizeTitle(title) + "|" + NormalizeAuthor(author)
+}
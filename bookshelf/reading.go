@@ -0,0 +1,183 @@
+package bookshelf
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Reading statuses. Every book on a user's shelves has exactly one status,
+// which is also the shelf it is listed on; custom shelves come on top.
+const (
+	StatusWantToRead = "want-to-read"
+	StatusReading    = "reading"
+	StatusRead       = "read"
+)
+
+// Statuses lists the reading statuses in the order a book goes through
+// them.
+var Statuses = []string{StatusWantToRead, StatusReading, StatusRead}
+
+// Reading is what a user records about a book they read or mean to read.
+// Readings are personal, so they are kept apart from the catalogue: they
+// are not part of a Book, and changing them is not recorded in its
+// history.
+type Reading struct {
+	// UserID is the profile ID of the reader.
+	UserID string
+	BookID int64
+
+	Status string
+
+	// Shelves are the user's custom shelves holding the book, stored like
+	// tags: lower case and sorted.
+	Shelves []string
+
+	// StartedAt and FinishedAt are dates, kept as midnight UTC. Either may
+	// be zero when the reader did not say.
+	StartedAt  time.Time
+	FinishedAt time.Time
+
+	// Progress is how far through the book the reader is, in percent.
+	Progress int
+
+	// UpdatedAt is set by the database on every save.
+	UpdatedAt time.Time
+
+	// Book is set by ListReadings.
+	Book *Book
+}
+
+// ShelfCount is how many books a user has on a shelf.
+type ShelfCount struct {
+	Shelf string
+	Count int
+}
+
+// isStatus reports whether s is one of Statuses.
+func isStatus(s string) bool {
+	for _, status := range Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseDate reads a date written as 2006-01-02, as date inputs send it. An
+// empty string is the zero time.
+func ParseDate(s string) (time.Time, error) {
+	if strings.TrimSpace(s) == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse("2006-01-02", strings.TrimSpace(s))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q: want YYYY-MM-DD: %w", s, ErrInvalid)
+	}
+	return t, nil
+}
+
+// day truncates t to its date in UTC.
+func day(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// normalize checks a reading before it is saved and puts its shelves and
+// dates in the form they are stored. A book marked read is finished, so
+// its progress is 100.
+func (r *Reading) normalize() error {
+	if r.UserID == "" || r.BookID == 0 {
+		return fmt.Errorf("reading without a user or book: %w", ErrInvalid)
+	}
+	if r.Status == "" {
+		r.Status = StatusWantToRead
+	}
+	if !isStatus(r.Status) {
+		return fmt.Errorf("unknown reading status %q: %w", r.Status, ErrInvalid)
+	}
+	var shelves []string
+	for _, s := range sortedSet(r.Shelves) {
+		if len(s) > maxTagLength {
+			return fmt.Errorf("shelf %q is longer than %d characters: %w", s, maxTagLength, ErrInvalid)
+		}
+		if !isStatus(s) {
+			shelves = append(shelves, s)
+		}
+	}
+	r.Shelves = shelves
+	if r.Progress < 0 || r.Progress > 100 {
+		return fmt.Errorf("progress %d is not a percentage: %w", r.Progress, ErrInvalid)
+	}
+	if r.Status == StatusRead {
+		r.Progress = 100
+	}
+	r.StartedAt, r.FinishedAt = day(r.StartedAt), day(r.FinishedAt)
+	if !r.StartedAt.IsZero() && !r.FinishedAt.IsZero() && r.FinishedAt.Before(r.StartedAt) {
+		return fmt.Errorf("finished on %s before starting on %s: %w",
+			r.FinishedAt.Format("2006-01-02"), r.StartedAt.Format("2006-01-02"), ErrInvalid)
+	}
+	return nil
+}
+
+// OnShelf reports whether the reading is listed on shelf, which is either
+// a status or a custom shelf.
+func (r *Reading) OnShelf(shelf string) bool {
+	shelf = NormalizeTag(shelf)
+	if shelf == r.Status {
+		return true
+	}
+	for _, s := range r.Shelves {
+		if s == shelf {
+			return true
+		}
+	}
+	return false
+}
+
+// filterReadings keeps the readings on shelf, or all if shelf is empty,
+// and sorts them most recently updated first.
+func filterReadings(readings []*Reading, shelf string) []*Reading {
+	var kept []*Reading
+	for _, r := range readings {
+		if shelf == "" || r.OnShelf(shelf) {
+			kept = append(kept, r)
+		}
+	}
+	sort.SliceStable(kept, func(i, j int) bool {
+		if !kept[i].UpdatedAt.Equal(kept[j].UpdatedAt) {
+			return kept[i].UpdatedAt.After(kept[j].UpdatedAt)
+		}
+		return kept[i].BookID > kept[j].BookID
+	})
+	return kept
+}
+
+// countShelves counts readings on each status, listing every status even
+// when empty, then on each custom shelf by name.
+func countShelves(readings []*Reading) []ShelfCount {
+	counts := make(map[string]int)
+	for _, r := range readings {
+		counts[r.Status]++
+		for _, s := range r.Shelves {
+			counts[s]++
+		}
+	}
+	var shelves []ShelfCount
+	for _, s := range Statuses {
+		shelves = append(shelves, ShelfCount{Shelf: s, Count: counts[s]})
+		delete(counts, s)
+	}
+	var custom []string
+	for s := range counts {
+		custom = append(custom, s)
+	}
+	for _, s := range sortedSet(custom) {
+		shelves = append(shelves, ShelfCount{Shelf: s, Count: counts[s]})
+	}
+	return shelves
+}
@@ -0,0 +1,112 @@
+package bookshelf
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadingNormalize(t *testing.T) {
+	jan := func(d, hour int) time.Time { return time.Date(2021, 1, d, hour, 0, 0, 0, time.UTC) }
+	for _, c := range []struct {
+		name    string
+		in      Reading
+		want    Reading
+		wantErr bool
+	}{
+		{"default status",
+			Reading{UserID: "alice", BookID: 1},
+			Reading{UserID: "alice", BookID: 1, Status: StatusWantToRead}, false},
+		{"shelves stored like tags",
+			Reading{UserID: "alice", BookID: 1, Status: StatusReading, Shelves: []string{"Holiday", "book  club", "holiday", "Read"}},
+			Reading{UserID: "alice", BookID: 1, Status: StatusReading, Shelves: []string{"book club", "holiday"}}, false},
+		{"read is finished",
+			Reading{UserID: "alice", BookID: 1, Status: StatusRead, Progress: 40},
+			Reading{UserID: "alice", BookID: 1, Status: StatusRead, Progress: 100}, false},
+		{"dates kept as days",
+			Reading{UserID: "alice", BookID: 1, Status: StatusRead, StartedAt: jan(2, 23), FinishedAt: jan(2, 1)},
+			Reading{UserID: "alice", BookID: 1, Status: StatusRead, Progress: 100, StartedAt: jan(2, 0), FinishedAt: jan(2, 0)}, false},
+		{"no user", Reading{BookID: 1}, Reading{}, true},
+		{"no book", Reading{UserID: "alice"}, Reading{}, true},
+		{"unknown status", Reading{UserID: "alice", BookID: 1, Status: "abandoned"}, Reading{}, true},
+		{"progress over 100", Reading{UserID: "alice", BookID: 1, Progress: 101}, Reading{}, true},
+		{"negative progress", Reading{UserID: "alice", BookID: 1, Progress: -1}, Reading{}, true},
+		{"finished before started", Reading{UserID: "alice", BookID: 1, StartedAt: jan(3, 0), FinishedAt: jan(2, 0)}, Reading{}, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			r := c.in
+			err := r.normalize()
+			if c.wantErr {
+				if !errors.Is(err, ErrInvalid) {
+					t.Errorf("normalize = %v, want ErrInvalid", err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(r, c.want) {
+				t.Errorf("normalize = %v, leaving %+v; want %+v", err, r, c.want)
+			}
+		})
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want time.Time
+		ok   bool
+	}{
+		{"", time.Time{}, true},
+		{"  ", time.Time{}, true},
+		{"2021-01-02", time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC), true},
+		{" 2021-01-02 ", time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC), true},
+		{"2021/01/02", time.Time{}, false},
+		{"2021-02-30", time.Time{}, false},
+	} {
+		got, err := ParseDate(c.in)
+		if c.ok != (err == nil) || !got.Equal(c.want) {
+			t.Errorf("ParseDate(%q) = %v, %v; want %v", c.in, got, err, c.want)
+		}
+		if err != nil && !errors.Is(err, ErrInvalid) {
+			t.Errorf("ParseDate(%q) = %v, want ErrInvalid", c.in, err)
+		}
+	}
+}
+
+func TestShelves(t *testing.T) {
+	at := func(h int) time.Time { return time.Date(2021, 1, 1, h, 0, 0, 0, time.UTC) }
+	readings := []*Reading{
+		{BookID: 1, Status: StatusRead, Shelves: []string{"favorites"}, UpdatedAt: at(1)},
+		{BookID: 2, Status: StatusReading, Shelves: []string{"book club", "favorites"}, UpdatedAt: at(3)},
+		{BookID: 3, Status: StatusRead, UpdatedAt: at(3)},
+		{BookID: 4, Status: StatusRead, UpdatedAt: at(2)},
+	}
+	for _, c := range []struct {
+		shelf string
+		want  []int64
+	}{
+		{"", []int64{3, 2, 4, 1}},
+		{StatusRead, []int64{3, 4, 1}},
+		{StatusReading, []int64{2}},
+		{StatusWantToRead, nil},
+		{"Favorites", []int64{2, 1}},
+		{"book  club", []int64{2}},
+		{"holiday", nil},
+	} {
+		var got []int64
+		for _, r := range filterReadings(readings, c.shelf) {
+			got = append(got, r.BookID)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("filterReadings(%q) listed books %v, want %v", c.shelf, got, c.want)
+		}
+	}
+
+	want := []ShelfCount{
+		{StatusWantToRead, 0}, {StatusReading, 1}, {StatusRead, 3},
+		{"book club", 1}, {"favorites", 2},
+	}
+	if got := countShelves(readings); !reflect.DeepEqual(got, want) {
+		t.Errorf("countShelves = %v, want %v", got, want)
+	}
+}
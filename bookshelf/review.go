@@ -0,0 +1,123 @@
+package bookshelf
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The range of a review's rating, in stars.
+const (
+	MinRating = 1
+	MaxRating = 5
+)
+
+// maxReviewLength bounds the text of a review, in characters.
+const maxReviewLength = 10000
+
+// Review is a user's rating of a book, with what they thought of it. A user
+// has at most one review of a book. Unlike readings, reviews are public,
+// and their ratings add up to the book's RatingCount and RatingSum.
+type Review struct {
+	BookID int64
+
+	// UserID is the profile ID of the reviewer, and UserName their name
+	// when they last saved the review.
+	UserID   string
+	UserName string
+
+	// Rating is from MinRating to MaxRating stars.
+	Rating int
+
+	// Text may be empty, for a rating on its own.
+	Text string
+
+	// CreatedAt is set when the review is first saved and UpdatedAt on
+	// every save.
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// Book is set by ListReviews.
+	Book *Book
+}
+
+// ReviewQuery selects reviews for ListReviews. Zero fields select every
+// review.
+type ReviewQuery struct {
+	BookID int64
+	UserID string
+
+	// Limit, if positive, keeps only the most recently updated reviews.
+	Limit int
+}
+
+// normalize checks a review before it is saved and trims its text.
+func (r *Review) normalize() error {
+	if r.UserID == "" || r.BookID == 0 {
+		return fmt.Errorf("review without a user or book: %w", ErrInvalid)
+	}
+	if r.Rating < MinRating || r.Rating > MaxRating {
+		return fmt.Errorf("rating %d is not from %d to %d: %w", r.Rating, MinRating, MaxRating, ErrInvalid)
+	}
+	r.Text = strings.TrimSpace(r.Text)
+	if utf8.RuneCountInString(r.Text) > maxReviewLength {
+		return fmt.Errorf("review is longer than %d characters: %w", maxReviewLength, ErrInvalid)
+	}
+	return nil
+}
+
+// ratingDelta is how saving r over old, which is nil for a new review,
+// changes the RatingCount and RatingSum of the book. A nil r deletes old.
+func ratingDelta(old, r *Review) (count, sum int) {
+	if old != nil {
+		count, sum = -1, -old.Rating
+	}
+	if r != nil {
+		count, sum = count+1, sum+r.Rating
+	}
+	return count, sum
+}
+
+// sortReviews orders reviews most recently updated first and applies the
+// limit of q.
+func sortReviews(reviews []*Review, q ReviewQuery) []*Review {
+	sort.SliceStable(reviews, func(i, j int) bool {
+		if !reviews[i].UpdatedAt.Equal(reviews[j].UpdatedAt) {
+			return reviews[i].UpdatedAt.After(reviews[j].UpdatedAt)
+		}
+		if reviews[i].BookID != reviews[j].BookID {
+			return reviews[i].BookID > reviews[j].BookID
+		}
+		return reviews[i].UserID < reviews[j].UserID
+	})
+	if q.Limit > 0 && len(reviews) > q.Limit {
+		reviews = reviews[:q.Limit]
+	}
+	return reviews
+}
+
+// AverageRating is the mean rating of the book's reviews, or 0 if it has
+// none.
+func (b *Book) AverageRating() float64 {
+	if b.RatingCount == 0 {
+		return 0
+	}
+	return float64(b.RatingSum) / float64(b.RatingCount)
+}
+
+// sortByRating orders books by average rating, highest first, then by the
+// number of ratings and by title. Books without ratings come last.
+func sortByRating(books []*Book) {
+	sort.SliceStable(books, func(i, j int) bool {
+		ai, aj := books[i].AverageRating(), books[j].AverageRating()
+		if ai != aj {
+			return ai > aj
+		}
+		if books[i].RatingCount != books[j].RatingCount {
+			return books[i].RatingCount > books[j].RatingCount
+		}
+		return strings.ToLower(books[i].Title) < strings.ToLower(books[j].Title)
+	})
+}
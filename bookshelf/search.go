@@ -0,0 +1,124 @@
+package bookshelf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Bounds on SearchQuery.Size.
+const (
+	DefaultSearchSize = 20
+	MaxSearchSize     = 100
+)
+
+// SearchQuery is a full-text search of the catalogue, which the worker
+// answers from its index.
+type SearchQuery struct {
+	// Text is matched against the title, author, description, tags and
+	// genres of books. Words match their other forms, such as "dragons"
+	// for "dragon", and tolerate a typo in words of four letters or more;
+	// books matching more of them rank higher. "Quoted phrases" must all
+	// match, word for word.
+	Text string
+
+	// Tag and Genre, if set, keep only the books that have them.
+	Tag   string
+	Genre string
+
+	// From and Size page through the hits, best first.
+	From int
+	Size int
+}
+
+// SearchHit is a book a SearchQuery matched. Fragments holds, by field,
+// snippets of the book around the matches, as HTML with the matched words
+// in <mark> tags.
+type SearchHit struct {
+	BookID    int64               `json:"bookId"`
+	Score     float64             `json:"score"`
+	Title     string              `json:"title"`
+	Author    string              `json:"author"`
+	Fragments map[string][]string `json:"fragments,omitempty"`
+}
+
+// SearchResults holds a page of the hits of a SearchQuery, with the number
+// of books matched in all and, as facets, how many of them have each of
+// the most common tags and genres.
+type SearchResults struct {
+	Total  int         `json:"total"`
+	Hits   []SearchHit `json:"hits"`
+	Tags   []TagCount  `json:"tags,omitempty"`
+	Genres []TagCount  `json:"genres,omitempty"`
+}
+
+// ParseSearchQuery reads a SearchQuery from the q, tag, genre, from and
+// size parameters. The size defaults to DefaultSearchSize and may not be
+// more than MaxSearchSize.
+func ParseSearchQuery(v url.Values) (SearchQuery, error) {
+	q := SearchQuery{Text: v.Get("q"), Tag: v.Get("tag"), Genre: v.Get("genre"), Size: DefaultSearchSize}
+	for _, p := range []struct {
+		name string
+		n    *int
+	}{{"from", &q.From}, {"size", &q.Size}} {
+		if s := v.Get(p.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return q, fmt.Errorf("search: invalid %s %q: %w", p.name, s, ErrInvalid)
+			}
+			*p.n = n
+		}
+	}
+	if q.Size == 0 || q.Size > MaxSearchSize {
+		return q, fmt.Errorf("search: size must be from 1 to %d: %w", MaxSearchSize, ErrInvalid)
+	}
+	return q, nil
+}
+
+// Values encodes q as the parameters ParseSearchQuery reads.
+func (q SearchQuery) Values() url.Values {
+	v := url.Values{"q": {q.Text}, "from": {strconv.Itoa(q.From)}, "size": {strconv.Itoa(q.Size)}}
+	if q.Tag != "" {
+		v.Set("tag", q.Tag)
+	}
+	if q.Genre != "" {
+		v.Set("genre", q.Genre)
+	}
+	return v
+}
+
+// searchClient bounds how long a search can hold up a page.
+var searchClient = &http.Client{Timeout: 10 * time.Second}
+
+// Search runs q against the worker's index at SearchURL. A query the
+// worker rejects reports ErrInvalid.
+func Search(ctx context.Context, q SearchQuery) (*SearchResults, error) {
+	if SearchURL == "" {
+		return nil, fmt.Errorf("search: SEARCH_URL is not configured")
+	}
+	req, err := http.NewRequest("GET", SearchURL+"?"+q.Values().Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := searchClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("search: could not reach %s: %v", SearchURL, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest:
+		return nil, fmt.Errorf("search: query rejected: %w", ErrInvalid)
+	default:
+		return nil, fmt.Errorf("search: %s replied %s", SearchURL, resp.Status)
+	}
+	var results SearchResults
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, fmt.Errorf("search: could not decode results: %v", err)
+	}
+	return &results, nil
+}
@@ -0,0 +1,42 @@
+package bookshelf
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	for _, c := range []struct {
+		query string
+		want  SearchQuery
+		ok    bool
+	}{
+		{"", SearchQuery{Size: DefaultSearchSize}, true},
+		{"q=dragon&tag=classic&genre=fantasy", SearchQuery{Text: "dragon", Tag: "classic", Genre: "fantasy", Size: DefaultSearchSize}, true},
+		{"q=%22the+hobbit%22&from=40&size=20", SearchQuery{Text: `"the hobbit"`, From: 40, Size: 20}, true},
+		{"size=100", SearchQuery{Size: MaxSearchSize}, true},
+		{"size=101", SearchQuery{}, false},
+		{"size=0", SearchQuery{}, false},
+		{"from=-1", SearchQuery{}, false},
+		{"from=next", SearchQuery{}, false},
+	} {
+		v, err := url.ParseQuery(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ParseSearchQuery(v)
+		if !c.ok {
+			if !errors.Is(err, ErrInvalid) {
+				t.Errorf("ParseSearchQuery(%q) = %+v, %v; want ErrInvalid", c.query, got, err)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("ParseSearchQuery(%q) = %+v, %v; want %+v", c.query, got, err, c.want)
+		}
+		if again, err := ParseSearchQuery(got.Values()); err != nil || again != got {
+			t.Errorf("ParseSearchQuery(%q.Values()) = %+v, %v; want it back", c.query, again, err)
+		}
+	}
+}
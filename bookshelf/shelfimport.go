@@ -0,0 +1,417 @@
+package bookshelf
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of reading site exports read by ImportShelfExport.
+const (
+	FormatGoodreads    = "goodreads"
+	FormatLibraryThing = "librarything"
+)
+
+// MaxShelfExportSize bounds the exports accepted for import. Exports are
+// imported inline, and a library of ten thousand books exports to a few
+// megabytes.
+const MaxShelfExportSize = 8 << 20
+
+// maxShelfResults bounds the entries listed in a ShelfImportReport; the
+// counts cover every row.
+const maxShelfResults = 1000
+
+// ShelfEntry is a book as a reading site exports it, along with what the
+// reader recorded about it.
+type ShelfEntry struct {
+	// Row counts records, the header being row 1.
+	Row int `json:"row"`
+
+	Title  string `json:"title"`
+	Author string `json:"author"`
+
+	// ISBN holds the ISBN-13, converted from the ISBN-10 when that is all
+	// the file has. An ISBN that fails validation is kept as the file gave
+	// it, but not stored or matched on.
+	ISBN string `json:"isbn,omitempty"`
+
+	Shelves  []string  `json:"shelves,omitempty"`
+	Rating   int       `json:"rating,omitempty"` // 1 to 5, 0 if unrated
+	DateRead time.Time `json:"dateRead,omitempty"`
+}
+
+// Outcomes of an entry, recorded in ShelfImportResult.Outcome.
+const (
+	ShelfCreated = "created"
+	ShelfMerged  = "merged"
+	ShelfSkipped = "skipped"
+)
+
+// ShelfImportResult is what happened to one entry of an export.
+type ShelfImportResult struct {
+	ShelfEntry
+	Outcome string `json:"outcome"`
+
+	// BookID is the book created, or the existing book the entry was
+	// merged into.
+	BookID int64 `json:"bookId,omitempty"`
+
+	// Reason explains a merge or a skip.
+	Reason string `json:"reason,omitempty"`
+}
+
+// ShelfImportReport is the outcome of ImportShelfExport.
+type ShelfImportReport struct {
+	Format  string `json:"format"`
+	DryRun  bool   `json:"dryRun"`
+	Rows    int    `json:"rows"`
+	Created int    `json:"created"`
+	Merged  int    `json:"merged"`
+	Skipped int    `json:"skipped"`
+
+	// Shelved counts the entries put on the user's shelves.
+	Shelved int `json:"shelved"`
+
+	Results []ShelfImportResult `json:"results"`
+
+	// Error, if set, is why the import stopped before the end of the file.
+	Error string `json:"error,omitempty"`
+}
+
+// shelfColumns lists, for each value read from an export, the headers it
+// may appear under, in order of preference. Headers are compared ignoring
+// case.
+var shelfColumns = map[string][]string{
+	"title":    {"title"},
+	"author":   {"author", "author (first, last)", "primary author", "author (last, first)"},
+	"isbn13":   {"isbn13"},
+	"isbn":     {"isbn", "isbns"},
+	"rating":   {"my rating", "rating"},
+	"dateRead": {"date read"},
+	"shelves":  {"bookshelves", "tags", "collections"},
+	"shelf":    {"exclusive shelf"},
+}
+
+// detectShelfFormat tells a Goodreads export from a LibraryThing one by
+// columns only one of them has.
+func detectShelfFormat(header []string) (string, error) {
+	has := func(name string) bool {
+		for _, h := range header {
+			if strings.EqualFold(strings.TrimSpace(h), name) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has("exclusive shelf") || has("bookshelves"):
+		return FormatGoodreads, nil
+	case has("primary author") || has("collections") || has("author (first, last)"):
+		return FormatLibraryThing, nil
+	}
+	return "", fmt.Errorf("shelves: not a Goodreads or LibraryThing export: %w", ErrInvalid)
+}
+
+// cleanISBN strips the punctuation sites wrap ISBNs in, such as Goodreads'
+// ="0439023483" spreadsheet quoting, and keeps the first of a list.
+func cleanISBN(s string) string {
+	s = strings.NewReplacer("=", "", "\"", "", "[", "", "]", "").Replace(s)
+	if i := strings.IndexAny(s, ",; "); i >= 0 {
+		s = s[:i]
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if r >= '0' && r <= '9' || r == 'X' || r == 'x' {
+			b.WriteRune(r)
+		}
+	}
+	return strings.ToUpper(b.String())
+}
+
+// parseShelfDate reads the date formats the sites export.
+func parseShelfDate(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{"2006/01/02", "2006-01-02", "Jan 2, 2006", "2006"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// splitShelves splits a list of shelves or tags and drops empty ones.
+func splitShelves(s string) []string {
+	var shelves []string
+	for _, shelf := range strings.Split(s, ",") {
+		if shelf = strings.TrimSpace(shelf); shelf != "" {
+			shelves = append(shelves, shelf)
+		}
+	}
+	return shelves
+}
+
+// firstLast turns LibraryThing's "Pratchett, Terry" into "Terry Pratchett".
+func firstLast(name string) string {
+	parts := strings.Split(name, ",")
+	if len(parts) != 2 {
+		return name
+	}
+	return strings.TrimSpace(parts[1]) + " " + strings.TrimSpace(parts[0])
+}
+
+// ReadShelfExport reads the entries of a Goodreads CSV or LibraryThing TSV
+// export, telling the two apart by their headers. Rows without a title
+// are returned with an empty Title for the caller to report.
+func ReadShelfExport(r io.Reader) (string, []*ShelfEntry, error) {
+	br := bufio.NewReader(r)
+	first, err := br.Peek(4096)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", nil, fmt.Errorf("shelves: could not read export: %v", err)
+	}
+	firstLine := string(first)
+	if i := strings.IndexByte(firstLine, '\n'); i >= 0 {
+		firstLine = firstLine[:i]
+	}
+
+	cr := csv.NewReader(br)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	if strings.Contains(firstLine, "\t") {
+		cr.Comma = '\t'
+	}
+	header, err := cr.Read()
+	if err == io.EOF {
+		return "", nil, fmt.Errorf("shelves: export is empty: %w", ErrInvalid)
+	} else if err != nil {
+		return "", nil, fmt.Errorf("shelves: could not read header: %v: %w", err, ErrInvalid)
+	}
+	format, err := detectShelfFormat(header)
+	if err != nil {
+		return "", nil, err
+	}
+
+	columns := make(map[string]int)
+	for value, names := range shelfColumns {
+	names:
+		for _, name := range names {
+			for i, h := range header {
+				if strings.EqualFold(strings.TrimSpace(h), name) {
+					columns[value] = i
+					break names
+				}
+			}
+		}
+	}
+	get := func(record []string, value string) string {
+		if i, ok := columns[value]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var entries []*ShelfEntry
+	for row := 2; ; row++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return format, entries, fmt.Errorf("shelves: row %d: %v: %w", row, err, ErrInvalid)
+		}
+		e := &ShelfEntry{
+			Row:      row,
+			Title:    get(record, "title"),
+			Author:   get(record, "author"),
+			ISBN:     cleanISBN(get(record, "isbn13")),
+			DateRead: parseShelfDate(get(record, "dateRead")),
+			Shelves:  splitShelves(get(record, "shelves")),
+		}
+		if e.ISBN == "" {
+			e.ISBN = cleanISBN(get(record, "isbn"))
+		}
+		if _, isbn13, err := NormalizeISBN(e.ISBN); err == nil {
+			e.ISBN = isbn13
+		}
+		if format == FormatLibraryThing {
+			e.Author = firstLast(e.Author)
+		}
+		if shelf := get(record, "shelf"); shelf != "" {
+			e.Shelves = append([]string{shelf}, e.Shelves...)
+		}
+		if rating, err := strconv.ParseFloat(get(record, "rating"), 64); err == nil && rating > 0 {
+			// LibraryThing allows half stars; keep whole ones.
+			e.Rating = int(rating + 0.5)
+			if e.Rating > 5 {
+				e.Rating = 5
+			}
+		}
+		entries = append(entries, e)
+	}
+	return format, entries, nil
+}
+
+// ShelfImportOptions controls ImportShelfExport.
+type ShelfImportOptions struct {
+	// DryRun works out what would happen without changing any books.
+	DryRun bool
+
+	// Actor is recorded as having added or updated the books.
+	Actor Actor
+
+	// UserID, if set, is the user whose shelves the entries are put on,
+	// replacing what the user recorded about the same books before.
+	UserID string
+}
+
+// shelfStatuses maps the exclusive shelves of Goodreads and the
+// collections of LibraryThing, as normalized by NormalizeTag, to reading
+// statuses.
+var shelfStatuses = map[string]string{
+	"to-read":           StatusWantToRead,
+	"to read":           StatusWantToRead,
+	"wishlist":          StatusWantToRead,
+	"currently-reading": StatusReading,
+	"currently reading": StatusReading,
+	"read":              StatusRead,
+	"read but unowned":  StatusRead,
+}
+
+// entryReading is the reading of the book with bookID that e records. The
+// first shelf naming a status sets it; the others become custom shelves,
+// except LibraryThing's "your library", which every owned book is in. An
+// entry with a read date and no status was read.
+func entryReading(e *ShelfEntry, userID string, bookID int64) *Reading {
+	r := &Reading{UserID: userID, BookID: bookID, FinishedAt: e.DateRead}
+	for _, shelf := range e.Shelves {
+		shelf = NormalizeTag(shelf)
+		if status, ok := shelfStatuses[shelf]; ok {
+			if r.Status == "" {
+				r.Status = status
+			}
+		} else if shelf != "your library" {
+			r.Shelves = append(r.Shelves, shelf)
+		}
+	}
+	if r.Status == "" && !e.DateRead.IsZero() {
+		r.Status = StatusRead
+	}
+	return r
+}
+
+// ImportShelfExport adds the books of a Goodreads or LibraryThing export to
+// db. An entry whose ISBN, or normalized title and author, matches a book
+// already in the library, or an earlier entry of the same file, is merged
+// into that book rather than added again; entries without a title are
+// skipped. With a UserID, each entry imported or merged is put on that
+// user's shelves, its status and custom shelves taken from the shelves the
+// file gave it. The report says what happened to each entry, with the
+// shelves, rating and read date the file gave it.
+func ImportShelfExport(ctx context.Context, db BookDatabase, r io.Reader, opts ShelfImportOptions) (*ShelfImportReport, error) {
+	format, entries, err := ReadShelfExport(r)
+	if format == "" {
+		return nil, err
+	}
+	report := &ShelfImportReport{Format: format, DryRun: opts.DryRun}
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	existing, err := ReadPrimary(db).ListBooks()
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]int64)
+	byISBN := make(map[string]int64)
+	for _, b := range existing {
+		byKey[TitleAuthorKey(b.Title, b.Author)] = b.ID
+		if b.ISBN13 != "" {
+			byISBN[b.ISBN13] = b.ID
+		}
+	}
+	// IDs handed out in a dry run are negative so they match later rows
+	// but are not mistaken for real books.
+	var dryRunID int64
+
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			report.Error = err.Error()
+			return report, err
+		}
+		report.Rows++
+		result := ShelfImportResult{ShelfEntry: *e}
+		key := TitleAuthorKey(e.Title, e.Author)
+
+		switch id, ok := byISBN[e.ISBN]; {
+		case strings.TrimSpace(e.Title) == "":
+			result.Outcome, result.Reason = ShelfSkipped, "no title"
+		case ok:
+			result.Outcome, result.BookID, result.Reason = ShelfMerged, id, "same ISBN"
+		case byKey[key] != 0:
+			result.Outcome, result.BookID, result.Reason = ShelfMerged, byKey[key], "same title and author"
+		default:
+			b := &Book{Title: e.Title, Author: e.Author}
+			if ValidISBN13(e.ISBN) {
+				b.ISBN13 = e.ISBN
+			}
+			if err := validateBook(b); err != nil {
+				result.Outcome, result.Reason = ShelfSkipped, err.Error()
+				break
+			}
+			if opts.DryRun {
+				dryRunID--
+				result.Outcome, result.BookID = ShelfCreated, dryRunID
+			} else {
+				id, err := db.AddBook(b, opts.Actor)
+				if errors.Is(err, ErrConflict) || errors.Is(err, ErrInvalid) {
+					result.Outcome, result.Reason = ShelfSkipped, err.Error()
+					break
+				} else if err != nil {
+					report.Error = fmt.Sprintf("row %d: %v", e.Row, err)
+					return report, err
+				}
+				result.Outcome, result.BookID = ShelfCreated, id
+				if err := RequestEnrichment(ctx, id); err != nil {
+					log.Printf("[ID %d] could not request enrichment: %v", id, err)
+				}
+				if err := PublishBookEvent(ctx, BookCreated, id); err != nil {
+					log.Printf("[ID %d] could not publish create event: %v", id, err)
+				}
+			}
+			byKey[key] = result.BookID
+		}
+		if result.BookID != 0 && ValidISBN13(e.ISBN) {
+			byISBN[e.ISBN] = result.BookID
+		}
+		if opts.UserID != "" && result.BookID != 0 {
+			if opts.DryRun {
+				report.Shelved++
+			} else if err := db.SaveReading(entryReading(e, opts.UserID, result.BookID)); err == nil {
+				report.Shelved++
+			} else if errors.Is(err, ErrInvalid) || errors.Is(err, ErrNotFound) {
+				result.Reason = strings.TrimPrefix(result.Reason+"; not shelved: "+err.Error(), "; ")
+			} else {
+				report.Error = fmt.Sprintf("row %d: %v", e.Row, err)
+				return report, err
+			}
+		}
+
+		switch result.Outcome {
+		case ShelfCreated:
+			report.Created++
+		case ShelfMerged:
+			report.Merged++
+		case ShelfSkipped:
+			report.Skipped++
+		}
+		if len(report.Results) < maxShelfResults {
+			report.Results = append(report.Results, result)
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,193 @@
+package bookshelf
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// goodreadsExport is a Goodreads export cut down to the columns read, with
+// Goodreads' spreadsheet quoting of ISBNs.
+const goodreadsExport = `Book Id,Title,Author,Author l-f,ISBN,ISBN13,My Rating,Date Read,Bookshelves,Exclusive Shelf
+1,The Hobbit,J.R.R. Tolkien,"Tolkien, J.R.R.","=""0261103342""","=""9780261103344""",5,2020/03/14,"favorites, classics",read
+2,Mort (Discworld #4),Terry Pratchett,"Pratchett, Terry","=""""","=""""",0,,,to-read
+3,,Nobody,,,,3,,,read
+4,Hobbit,J. R. R. Tolkien,,,,4,,,currently-reading
+`
+
+// libraryThingExport is a LibraryThing TSV export cut down likewise.
+const libraryThingExport = "Book Id\tTitle\tPrimary Author\tISBNs\tRating\tCollections\tDate Read\n" +
+	"10\tGuards! Guards!\tPratchett, Terry\t[0575046066, 9780575046061]\t3.5\tYour library, Read but unowned\t\n" +
+	"11\tDune\tHerbert, Frank\t\t\tWishlist\t2019\n"
+
+func TestReadShelfExport(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		in     string
+		format string
+		want   []*ShelfEntry
+	}{
+		{"goodreads", goodreadsExport, FormatGoodreads, []*ShelfEntry{
+			{Row: 2, Title: "The Hobbit", Author: "J.R.R. Tolkien", ISBN: "9780261103344", Shelves: []string{"read", "favorites", "classics"}, Rating: 5, DateRead: time.Date(2020, 3, 14, 0, 0, 0, 0, time.UTC)},
+			{Row: 3, Title: "Mort (Discworld #4)", Author: "Terry Pratchett", Shelves: []string{"to-read"}},
+			{Row: 4, Author: "Nobody", Shelves: []string{"read"}, Rating: 3},
+			{Row: 5, Title: "Hobbit", Author: "J. R. R. Tolkien", Shelves: []string{"currently-reading"}, Rating: 4},
+		}},
+		{"librarything", libraryThingExport, FormatLibraryThing, []*ShelfEntry{
+			{Row: 2, Title: "Guards! Guards!", Author: "Terry Pratchett", ISBN: "9780575046061", Shelves: []string{"Your library", "Read but unowned"}, Rating: 4},
+			{Row: 3, Title: "Dune", Author: "Frank Herbert", Shelves: []string{"Wishlist"}, DateRead: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)},
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			format, entries, err := ReadShelfExport(strings.NewReader(c.in))
+			if err != nil || format != c.format {
+				t.Fatalf("ReadShelfExport = %q, %v; want %q", format, err, c.format)
+			}
+			if len(entries) != len(c.want) {
+				t.Fatalf("ReadShelfExport read %d entries, want %d", len(entries), len(c.want))
+			}
+			for i, e := range entries {
+				if !reflect.DeepEqual(e, c.want[i]) {
+					t.Errorf("entry %d = %+v, want %+v", i, e, c.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDetectShelfFormat(t *testing.T) {
+	for _, c := range []struct {
+		header []string
+		want   string
+	}{
+		{[]string{"Title", "Author", "Exclusive Shelf"}, FormatGoodreads},
+		{[]string{"Title", " bookshelves "}, FormatGoodreads},
+		{[]string{"Title", "Primary Author"}, FormatLibraryThing},
+		{[]string{"TITLE", "AUTHOR (FIRST, LAST)"}, FormatLibraryThing},
+		{[]string{"Title", "Collections"}, FormatLibraryThing},
+		{[]string{"title", "author", "isbn"}, ""},
+	} {
+		got, err := detectShelfFormat(c.header)
+		if got != c.want || (c.want == "") != errors.Is(err, ErrInvalid) {
+			t.Errorf("detectShelfFormat(%q) = %q, %v; want %q", c.header, got, err, c.want)
+		}
+	}
+}
+
+func TestTitleAuthorKey(t *testing.T) {
+	for _, c := range []struct {
+		title, author string
+		want          string
+	}{
+		{"The Hobbit", "J.R.R. Tolkien", "hobbit|jrr tolkien"},
+		{"Hobbit, The", "Tolkien, J. R. R.", "hobbit|jrr tolkien"},
+		{"Mort (Discworld, #4)", "Terry Pratchett", "mort|terry pratchett"},
+		{"  Guards!  Guards! ", "PRATCHETT, TERRY", "guards guards|terry pratchett"},
+		{"Les Misérables", "Victor Hugo", "les miserables|victor hugo"},
+		{"An Ode", "", "ode|"},
+		{"Theory of Everything", "", "theory of everything|"},
+	} {
+		if got := TitleAuthorKey(c.title, c.author); got != c.want {
+			t.Errorf("TitleAuthorKey(%q, %q) = %q, want %q", c.title, c.author, got, c.want)
+		}
+	}
+}
+
+func TestEntryReading(t *testing.T) {
+	read := time.Date(2020, 3, 14, 0, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		shelves  []string
+		dateRead time.Time
+		status   string
+		custom   []string
+	}{
+		{[]string{"read", "favorites"}, read, StatusRead, []string{"favorites"}},
+		{[]string{"to-read"}, time.Time{}, StatusWantToRead, nil},
+		{[]string{"Currently-Reading", "Read"}, time.Time{}, StatusReading, nil},
+		{[]string{"Your library", "Wishlist"}, time.Time{}, StatusWantToRead, nil},
+		{[]string{"Your library", "Read but unowned"}, time.Time{}, StatusRead, nil},
+		{[]string{"sci-fi"}, read, StatusRead, []string{"sci-fi"}},
+		{nil, time.Time{}, "", nil},
+	} {
+		e := &ShelfEntry{Shelves: c.shelves, DateRead: c.dateRead}
+		r := entryReading(e, "alice", 7)
+		if r.UserID != "alice" || r.BookID != 7 || r.Status != c.status || !reflect.DeepEqual(r.Shelves, c.custom) || !r.FinishedAt.Equal(c.dateRead) {
+			t.Errorf("entryReading(%q, %v) = %+v, want status %q and shelves %q", c.shelves, c.dateRead, r, c.status, c.custom)
+		}
+	}
+}
+
+func TestImportShelfExport(t *testing.T) {
+	ctx := context.Background()
+	db := newEmptySQLiteDB(t)
+	defer db.Close()
+	guardsID, err := db.AddBook(&Book{Title: "Guards! Guards!", Author: "Terry Pratchett", ISBN13: "9780575046061"}, testActor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A dry run reports what would happen without changing anything.
+	report, err := ImportShelfExport(ctx, db, strings.NewReader(goodreadsExport), ShelfImportOptions{DryRun: true, UserID: "alice"})
+	if err != nil || report.Created != 2 || report.Merged != 1 || report.Skipped != 1 || report.Shelved != 3 {
+		t.Fatalf("dry run: ImportShelfExport = %+v, %v; want 2 created, 1 merged, 1 skipped, 3 shelved", report, err)
+	}
+	if books, err := db.ListBooks(); err != nil || len(books) != 1 {
+		t.Fatalf("ListBooks after a dry run = %v, %v; want the one book", books, err)
+	}
+
+	report, err = ImportShelfExport(ctx, db, strings.NewReader(goodreadsExport), ShelfImportOptions{Actor: testActor, UserID: "alice"})
+	if err != nil || report.Format != FormatGoodreads || report.Rows != 4 {
+		t.Fatalf("ImportShelfExport = %+v, %v", report, err)
+	}
+	for i, want := range []struct {
+		outcome, reason string
+	}{
+		{ShelfCreated, ""},
+		{ShelfCreated, ""},
+		{ShelfSkipped, "no title"},
+		{ShelfMerged, "same title and author"},
+	} {
+		if r := report.Results[i]; r.Outcome != want.outcome || r.Reason != want.reason {
+			t.Errorf("row %d: %s (%s), want %s (%s)", r.Row, r.Outcome, r.Reason, want.outcome, want.reason)
+		}
+	}
+	hobbitID := report.Results[0].BookID
+	if report.Results[3].BookID != hobbitID {
+		t.Errorf("Hobbit was merged into book %d, want %d", report.Results[3].BookID, hobbitID)
+	}
+	if b, err := db.GetBook(hobbitID); err != nil || b.ISBN13 != "9780261103344" || b.ISBN10 != "0261103342" {
+		t.Errorf("GetBook(%d) = %v, %v; want the ISBNs stored", hobbitID, b, err)
+	}
+	// The merged row comes later, so its shelf replaces the first one's.
+	if r, err := db.GetReading("alice", hobbitID); err != nil || r.Status != StatusReading {
+		t.Errorf("GetReading(alice, %d) = %+v, %v; want it being read", hobbitID, r, err)
+	}
+
+	// LibraryThing matches the existing book by ISBN.
+	report, err = ImportShelfExport(ctx, db, strings.NewReader(libraryThingExport), ShelfImportOptions{Actor: testActor, UserID: "bob"})
+	if err != nil || report.Format != FormatLibraryThing || report.Created != 1 || report.Merged != 1 {
+		t.Fatalf("ImportShelfExport = %+v, %v; want 1 created and 1 merged", report, err)
+	}
+	if r := report.Results[0]; r.BookID != guardsID || r.Reason != "same ISBN" {
+		t.Errorf("Guards! Guards! = %+v, want it merged into book %d by ISBN", r, guardsID)
+	}
+	if r, err := db.GetReading("bob", guardsID); err != nil || r.Status != StatusRead || len(r.Shelves) != 0 {
+		t.Errorf("GetReading(bob, %d) = %+v, %v; want it read and on no custom shelf", guardsID, r, err)
+	}
+	if books, err := db.ListBooks(); err != nil || len(books) != 4 {
+		t.Errorf("ListBooks = %v, %v; want 4 books", books, err)
+	}
+}
+
+func TestImportShelfExportInvalid(t *testing.T) {
+	db := newEmptySQLiteDB(t)
+	defer db.Close()
+	for _, in := range []string{"", "title,author\nEmma,Jane Austen\n"} {
+		if _, err := ImportShelfExport(context.Background(), db, strings.NewReader(in), ShelfImportOptions{}); !errors.Is(err, ErrInvalid) {
+			t.Errorf("ImportShelfExport(%q) = %v, want ErrInvalid", in, err)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package bookshelf
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of Suggestion.
+const (
+	SuggestTitle  = "title"
+	SuggestAuthor = "author"
+)
+
+// Suggestion is a title or author name offered as a book form is typed in.
+type Suggestion struct {
+	Kind string
+
+	// Text is the title or name as a book spells it. Different spellings
+	// of the same title or name are separate suggestions.
+	Text string
+
+	// Count is the number of books with Text, or 0 for a suggestion from
+	// Google Books.
+	Count int
+}
+
+// suggestEntry identifies a suggestion in a Suggester.
+type suggestEntry struct {
+	kind, text string
+}
+
+// trieNode is a node of a Suggester's trie. Entries counts the books with
+// each title or name whose key ends at the node.
+type trieNode struct {
+	children map[rune]*trieNode
+	entries  map[suggestEntry]int
+}
+
+// Suggester suggests the titles and authors of the books in the catalogue
+// that start with what has been typed. It keeps them in a trie keyed by
+// their normalized text from each word on, so "rings" finds "The Lord of
+// the Rings" as well as "lord" does. It is safe for concurrent use.
+type Suggester struct {
+	mu    sync.RWMutex
+	root  *trieNode
+	books map[int64][]suggestEntry
+}
+
+// NewSuggester returns an empty Suggester.
+func NewSuggester() *Suggester {
+	return &Suggester{root: &trieNode{}, books: make(map[int64][]suggestEntry)}
+}
+
+// bookEntries lists the title and authors b is suggested under. Lists
+// that leave Contributors nil have them parsed from the author string.
+func bookEntries(b *Book) []suggestEntry {
+	var entries []suggestEntry
+	if title := strings.TrimSpace(b.Title); title != "" {
+		entries = append(entries, suggestEntry{SuggestTitle, title})
+	}
+	contributors := b.Contributors
+	if contributors == nil {
+		contributors = ParseContributors(b.Author)
+	}
+	for _, c := range contributors {
+		entries = append(entries, suggestEntry{SuggestAuthor, c.Name})
+	}
+	return entries
+}
+
+// suggestKeys are the keys e is stored under: its normalized text from
+// each word on.
+func suggestKeys(e suggestEntry) []string {
+	words := strings.Fields(normalizeText(e.text))
+	keys := make([]string, len(words))
+	for i := range words {
+		keys[i] = strings.Join(words[i:], " ")
+	}
+	return keys
+}
+
+// add changes the count of e by delta under each of its keys, dropping it
+// from the nodes where it reaches 0.
+func (s *Suggester) add(e suggestEntry, delta int) {
+keys:
+	for _, key := range suggestKeys(e) {
+		n := s.root
+		for _, r := range key {
+			child := n.children[r]
+			if child == nil {
+				if delta < 0 {
+					continue keys
+				}
+				if n.children == nil {
+					n.children = make(map[rune]*trieNode)
+				}
+				child = &trieNode{}
+				n.children[r] = child
+			}
+			n = child
+		}
+		if n.entries == nil {
+			n.entries = make(map[suggestEntry]int)
+		}
+		if n.entries[e] += delta; n.entries[e] <= 0 {
+			delete(n.entries, e)
+		}
+	}
+}
+
+// update replaces the entries of the book with id with entries, which are
+// nil for a book that is gone. The caller holds s.mu.
+func (s *Suggester) update(id int64, entries []suggestEntry) {
+	for _, e := range s.books[id] {
+		s.add(e, -1)
+	}
+	for _, e := range entries {
+		s.add(e, 1)
+	}
+	if entries == nil {
+		delete(s.books, id)
+	} else {
+		s.books[id] = entries
+	}
+}
+
+// Load replaces the books s suggests from with books.
+func (s *Suggester) Load(books []*Book) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.root = &trieNode{}
+	s.books = make(map[int64][]suggestEntry)
+	for _, b := range books {
+		s.update(b.ID, bookEntries(b))
+	}
+}
+
+// Update adds b to the books s suggests from, replacing what it had for a
+// book with the same ID.
+func (s *Suggester) Update(b *Book) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.update(b.ID, bookEntries(b))
+}
+
+// Remove drops the book with id from the books s suggests from.
+func (s *Suggester) Remove(id int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.update(id, nil)
+}
+
+// Suggest returns up to limit titles and authors of kind, or of both kinds
+// if kind is empty, with a word starting with prefix. Those on the most
+// books come first, then the shortest.
+func (s *Suggester) Suggest(prefix, kind string, limit int) []Suggestion {
+	key := normalizeText(prefix)
+	if key == "" {
+		return nil
+	}
+	s.mu.RLock()
+	n := s.root
+	for _, r := range key {
+		if n = n.children[r]; n == nil {
+			s.mu.RUnlock()
+			return nil
+		}
+	}
+	// An entry with two words starting with the prefix is found twice,
+	// with the same count.
+	found := make(map[suggestEntry]int)
+	var walk func(n *trieNode)
+	walk = func(n *trieNode) {
+		for e, count := range n.entries {
+			if kind == "" || e.kind == kind {
+				found[e] = count
+			}
+		}
+		for _, child := range n.children {
+			walk(child)
+		}
+	}
+	walk(n)
+	s.mu.RUnlock()
+
+	suggestions := make([]Suggestion, 0, len(found))
+	for e, count := range found {
+		suggestions = append(suggestions, Suggestion{Kind: e.kind, Text: e.text, Count: count})
+	}
+	sortSuggestions(suggestions)
+	if limit > 0 && len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	return suggestions
+}
+
+// sortSuggestions orders suggestions by count, highest first, then
+// shortest first, then alphabetically.
+func sortSuggestions(suggestions []Suggestion) {
+	sort.Slice(suggestions, func(i, j int) bool {
+		a, b := suggestions[i], suggestions[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if len(a.Text) != len(b.Text) {
+			return len(a.Text) < len(b.Text)
+		}
+		if a.Text != b.Text {
+			return a.Text < b.Text
+		}
+		return a.Kind < b.Kind
+	})
+}
+
+// externalSuggestionTTL is how long the Google Books suggestions for a
+// prefix are reused, and maxExternalSuggestions how many prefixes are
+// kept.
+const (
+	externalSuggestionTTL  = 10 * time.Minute
+	maxExternalSuggestions = 1000
+)
+
+// externalSuggestions caches the Google Books suggestions of recent
+// prefixes, since every keystroke of every user asks for them.
+var externalSuggestions = struct {
+	sync.Mutex
+	m map[string]cachedSuggestions
+}{m: make(map[string]cachedSuggestions)}
+
+type cachedSuggestions struct {
+	suggestions []Suggestion
+	expires     time.Time
+}
+
+// SuggestExternal returns up to limit titles, or author names if kind is
+// SuggestAuthor, of books on Google Books with a word starting with
+// prefix.
+func SuggestExternal(ctx context.Context, prefix, kind string, limit int) ([]Suggestion, error) {
+	key := normalizeText(prefix)
+	if key == "" {
+		return nil, nil
+	}
+	if kind != SuggestAuthor {
+		kind = SuggestTitle
+	}
+	cacheKey := kind + "|" + key
+	externalSuggestions.Lock()
+	c, ok := externalSuggestions.m[cacheKey]
+	externalSuggestions.Unlock()
+	if !ok || time.Now().After(c.expires) {
+		volumes, err := SearchMetadata(ctx, kind, prefix, maxSearchMetadata)
+		if err != nil {
+			return nil, err
+		}
+		c = cachedSuggestions{suggestions: volumeSuggestions(volumes, key, kind), expires: time.Now().Add(externalSuggestionTTL)}
+		externalSuggestions.Lock()
+		if len(externalSuggestions.m) >= maxExternalSuggestions {
+			externalSuggestions.m = make(map[string]cachedSuggestions)
+		}
+		externalSuggestions.m[cacheKey] = c
+		externalSuggestions.Unlock()
+	}
+	suggestions := c.suggestions
+	if limit > 0 && len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	return suggestions, nil
+}
+
+// volumeSuggestions picks the distinct titles or authors of volumes with a
+// word starting with the normalized prefix key, in the order Google Books
+// ranked them.
+func volumeSuggestions(volumes []*Metadata, key, kind string) []Suggestion {
+	var suggestions []Suggestion
+	seen := make(map[string]bool)
+	for _, v := range volumes {
+		texts := []string{v.Title}
+		if kind == SuggestAuthor {
+			texts = v.Authors
+		}
+		for _, text := range texts {
+			text = strings.TrimSpace(text)
+			matches := false
+			for _, k := range suggestKeys(suggestEntry{kind, text}) {
+				matches = matches || strings.HasPrefix(k, key)
+			}
+			if !matches || seen[text] {
+				continue
+			}
+			seen[text] = true
+			suggestions = append(suggestions, Suggestion{Kind: kind, Text: text})
+		}
+	}
+	return suggestions
+}
@@ -0,0 +1,130 @@
+package bookshelf
+
+import (
+	"reflect"
+	"testing"
+)
+
+// suggestBooks are loaded by the Suggester tests.
+var suggestBooks = []*Book{
+	{ID: 1, Title: "The Lord of the Rings", Author: "J.R.R. Tolkien"},
+	{ID: 2, Title: "The Hobbit", Author: "J.R.R. Tolkien"},
+	{ID: 3, Title: "Lords and Ladies", Author: "Terry Pratchett"},
+	{ID: 4, Title: "Mort", Author: "Terry Pratchett"},
+	{ID: 5, Title: "The Hobbit"},
+	{ID: 6, Title: "Dune", Author: "Frank Herbert"},
+	{ID: 7, Title: "Children of Dune", Author: "Frank Herbert"},
+	{ID: 8, Title: "Dune Messiah", Author: "Frank Herbert"},
+}
+
+func TestSuggest(t *testing.T) {
+	s := NewSuggester()
+	s.Load(suggestBooks)
+	for _, c := range []struct {
+		prefix, kind string
+		limit        int
+		want         []Suggestion
+	}{
+		{"lord", "", 0, []Suggestion{
+			{SuggestTitle, "Lords and Ladies", 1},
+			{SuggestTitle, "The Lord of the Rings", 1},
+		}},
+		{"rings", "", 0, []Suggestion{{SuggestTitle, "The Lord of the Rings", 1}}},
+		{"dune", SuggestTitle, 0, []Suggestion{
+			{SuggestTitle, "Dune", 1},
+			{SuggestTitle, "Dune Messiah", 1},
+			{SuggestTitle, "Children of Dune", 1},
+		}},
+		{"t", SuggestAuthor, 0, []Suggestion{
+			{SuggestAuthor, "J.R.R. Tolkien", 2},
+			{SuggestAuthor, "Terry Pratchett", 2},
+		}},
+		{"the", SuggestTitle, 0, []Suggestion{
+			{SuggestTitle, "The Hobbit", 2},
+			{SuggestTitle, "The Lord of the Rings", 1},
+		}},
+		{"the", SuggestTitle, 1, []Suggestion{{SuggestTitle, "The Hobbit", 2}}},
+		{"herb", "", 0, []Suggestion{{SuggestAuthor, "Frank Herbert", 3}}},
+		{"jrr", "", 0, []Suggestion{{SuggestAuthor, "J.R.R. Tolkien", 2}}},
+		{"LÖRDS a", "", 0, []Suggestion{{SuggestTitle, "Lords and Ladies", 1}}},
+		{"mort", SuggestAuthor, 0, nil},
+		{"zeppelin", "", 0, nil},
+		{" ", "", 0, nil},
+	} {
+		got := s.Suggest(c.prefix, c.kind, c.limit)
+		if len(got) == 0 && len(c.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Suggest(%q, %q, %d) = %v, want %v", c.prefix, c.kind, c.limit, got, c.want)
+		}
+	}
+}
+
+func TestSuggesterUpdate(t *testing.T) {
+	s := NewSuggester()
+	s.Load(suggestBooks)
+	for _, c := range []struct {
+		name   string
+		change func()
+		prefix string
+		want   []Suggestion
+	}{
+		{"author changed", func() { s.Update(&Book{ID: 2, Title: "The Hobbit", Author: "Christopher Tolkien"}) }, "tolk", []Suggestion{
+			{SuggestAuthor, "J.R.R. Tolkien", 1},
+			{SuggestAuthor, "Christopher Tolkien", 1},
+		}},
+		{"title changed", func() { s.Update(&Book{ID: 5, Title: "There and Back Again"}) }, "the", []Suggestion{
+			{SuggestTitle, "The Hobbit", 1},
+			{SuggestTitle, "There and Back Again", 1},
+			{SuggestTitle, "The Lord of the Rings", 1},
+		}},
+		{"book added", func() { s.Update(&Book{ID: 9, Title: "Small Gods", Author: "Terry Pratchett"}) }, "pratch", []Suggestion{
+			{SuggestAuthor, "Terry Pratchett", 3},
+		}},
+		{"book removed", func() { s.Remove(1) }, "tolk", []Suggestion{
+			{SuggestAuthor, "Christopher Tolkien", 1},
+		}},
+		{"unknown book removed", func() { s.Remove(100) }, "herb", []Suggestion{
+			{SuggestAuthor, "Frank Herbert", 3},
+		}},
+		{"reloaded", func() { s.Load(suggestBooks[:1]) }, "t", []Suggestion{
+			{SuggestAuthor, "J.R.R. Tolkien", 1},
+			{SuggestTitle, "The Lord of the Rings", 1},
+		}},
+	} {
+		c.change()
+		if got := s.Suggest(c.prefix, "", 0); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: Suggest(%q) = %v, want %v", c.name, c.prefix, got, c.want)
+		}
+	}
+}
+
+func TestVolumeSuggestions(t *testing.T) {
+	volumes := []*Metadata{
+		{Title: "Dune Messiah", Authors: []string{"Frank Herbert"}},
+		{Title: "Dune", Authors: []string{"Frank Herbert", "Brian Herbert"}},
+		{Title: " Dune ", Authors: []string{"Kevin J. Anderson"}},
+		{Title: "Children of Dune"},
+		{Title: "Duma Key", Authors: []string{"Stephen King"}},
+	}
+	for _, c := range []struct {
+		key, kind string
+		want      []Suggestion
+	}{
+		{"dune", SuggestTitle, []Suggestion{
+			{SuggestTitle, "Dune Messiah", 0},
+			{SuggestTitle, "Dune", 0},
+			{SuggestTitle, "Children of Dune", 0},
+		}},
+		{"herb", SuggestAuthor, []Suggestion{
+			{SuggestAuthor, "Frank Herbert", 0},
+			{SuggestAuthor, "Brian Herbert", 0},
+		}},
+		{"king", SuggestTitle, nil},
+	} {
+		if got := volumeSuggestions(volumes, c.key, c.kind); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("volumeSuggestions(%q, %q) = %v, want %v", c.key, c.kind, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package bookshelf
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Genres is the controlled list of genres a book can be filed under, unlike
+// tags, which are whatever users make up.
+var Genres = []string{
+	"art", "biography", "business", "children", "comics", "cooking", "fantasy",
+	"fiction", "history", "horror", "humor", "mystery", "philosophy", "poetry",
+	"politics", "reference", "religion", "romance", "science", "science fiction",
+	"self-help", "thriller", "travel", "young adult",
+}
+
+// maxTagLength is the longest tag the book_tags table holds.
+const maxTagLength = 64
+
+// TagCount is how many books outside the trash have a tag or genre.
+type TagCount struct {
+	Tag   string
+	Count int
+}
+
+// TagCloud counts the books with each tag and each genre, ordered by tag.
+type TagCloud struct {
+	Tags   []TagCount
+	Genres []TagCount
+}
+
+// BookFilter selects books for FilterBooks. Empty fields select every book.
+type BookFilter struct {
+	// Query matches the title or author anywhere, ignoring case, like
+	// SearchBooks.
+	Query string
+
+	Tag   string
+	Genre string
+
+	// Sort orders the books by title, or as SortRating, SortNewest or
+	// SortUpdated say.
+	Sort string
+}
+
+// SortRating sorts books by average rating, as by Book.AverageRating. Books
+// with the same average are ordered by their number of ratings, then by
+// title, and unrated books come last.
+const SortRating = "rating"
+
+// SortNewest sorts books by CreatedAt and SortUpdated by UpdatedAt, most
+// recent first. Books added at the same time come newest ID first, and
+// books without the time last.
+const (
+	SortNewest  = "newest"
+	SortUpdated = "updated"
+)
+
+// SortRecent orders books as FilterBooks does for order, SortNewest or
+// SortUpdated, for lists it cannot sort.
+func SortRecent(books []*Book, order string) {
+	at := func(b *Book) time.Time { return b.UpdatedAt }
+	if order == SortNewest {
+		at = func(b *Book) time.Time { return b.CreatedAt }
+	}
+	sort.SliceStable(books, func(i, j int) bool {
+		ti, tj := at(books[i]), at(books[j])
+		if ti.IsZero() != tj.IsZero() {
+			return tj.IsZero()
+		}
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return books[i].ID > books[j].ID
+	})
+}
+
+// NormalizeTag returns a tag in the form it is stored: lower case, with
+// runs of spaces collapsed. Commas are what separate tags, so they become
+// spaces too.
+func NormalizeTag(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(strings.ReplaceAll(s, ",", " "))), " ")
+}
+
+// ParseTags splits a comma separated list of tags.
+func ParseTags(s string) []string {
+	var tags []string
+	for _, t := range strings.Split(s, ",") {
+		if t = NormalizeTag(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// FormatTags joins tags the way ParseTags splits them.
+func FormatTags(tags []string) string {
+	return strings.Join(tags, ", ")
+}
+
+// isGenre reports whether g is one of Genres.
+func isGenre(g string) bool {
+	for _, genre := range Genres {
+		if g == genre {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedSet normalizes tags, drops the empty and repeated ones and sorts
+// the rest.
+func sortedSet(tags []string) []string {
+	seen := make(map[string]bool)
+	var set []string
+	for _, t := range tags {
+		if t = NormalizeTag(t); t != "" && !seen[t] {
+			seen[t] = true
+			set = append(set, t)
+		}
+	}
+	sort.Strings(set)
+	return set
+}
+
+// normalizeTags puts the tags and genres of b in the form they are stored,
+// so that a book's history does not record a change of order or case.
+// Genres outside the controlled list are ErrInvalid.
+func (b *Book) normalizeTags() error {
+	b.Tags = sortedSet(b.Tags)
+	for _, t := range b.Tags {
+		if len(t) > maxTagLength {
+			return fmt.Errorf("tag %q is longer than %d characters: %w", t, maxTagLength, ErrInvalid)
+		}
+	}
+	b.Genres = sortedSet(b.Genres)
+	for _, g := range b.Genres {
+		if !isGenre(g) {
+			return fmt.Errorf("unknown genre %q: %w", g, ErrInvalid)
+		}
+	}
+	return nil
+}
+
+// categoryGenres maps the subject categories of book metadata, such as
+// the BISAC headings Google Books uses, to genres. Categories that are
+// already the name of a genre need no entry. Keys are normalized by
+// NormalizeTag.
+var categoryGenres = map[string]string{
+	"biography & autobiography":   "biography",
+	"business & economics":        "business",
+	"comics & graphic novels":     "comics",
+	"juvenile fiction":            "children",
+	"juvenile nonfiction":         "children",
+	"young adult fiction":         "young adult",
+	"young adult nonfiction":      "young adult",
+	"mystery & detective":         "mystery",
+	"thrillers":                   "thriller",
+	"political science":           "politics",
+	"body mind & spirit":          "self-help",
+	"language arts & disciplines": "reference",
+	"study aids":                  "reference",
+}
+
+// ClassifyCategories sorts the subject categories of book metadata into
+// the genres they name and tags for the rest. A category may be a path,
+// like "Fiction / Fantasy / Epic", whose every part is considered.
+func ClassifyCategories(categories []string) (genres, tags []string) {
+	for _, c := range categories {
+		matched := false
+		for _, part := range strings.Split(c, "/") {
+			part = NormalizeTag(part)
+			if g, ok := categoryGenres[part]; ok {
+				genres, matched = append(genres, g), true
+			} else if isGenre(part) {
+				genres, matched = append(genres, part), true
+			}
+		}
+		if !matched {
+			if t := NormalizeTag(strings.ReplaceAll(c, "/", " ")); t != "" && len(t) <= maxTagLength {
+				tags = append(tags, t)
+			}
+		}
+	}
+	return sortedSet(genres), sortedSet(tags)
+}
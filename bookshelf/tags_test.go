@@ -0,0 +1,110 @@
+package bookshelf
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTags(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"Classic", []string{"classic"}},
+		{" To  Read ,gift", []string{"to read", "gift"}},
+		{"a,, ,b,", []string{"a", "b"}},
+		{"Sci\tFi", []string{"sci fi"}},
+	} {
+		got := ParseTags(c.in)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ParseTags(%q) = %q, want %q", c.in, got, c.want)
+		}
+		if again := ParseTags(FormatTags(got)); !reflect.DeepEqual(again, got) {
+			t.Errorf("ParseTags(FormatTags(%q)) = %q, want them back", got, again)
+		}
+	}
+}
+
+func TestBookNormalizeTags(t *testing.T) {
+	for _, c := range []struct {
+		name                 string
+		tags, genres         []string
+		wantTags, wantGenres []string
+		wantErr              bool
+	}{
+		{"empty", nil, nil, nil, nil, false},
+		{"sorted and deduplicated", []string{"Gift", "classic", "gift ", ""}, []string{"Science  Fiction", "fantasy", "fantasy"},
+			[]string{"classic", "gift"}, []string{"fantasy", "science fiction"}, false},
+		{"comma in a tag", []string{"one,two"}, nil, []string{"one two"}, nil, false},
+		{"tag too long", []string{strings.Repeat("x", maxTagLength+1)}, nil, nil, nil, true},
+		{"longest tag", []string{strings.Repeat("x", maxTagLength)}, nil, []string{strings.Repeat("x", maxTagLength)}, nil, false},
+		{"unknown genre", nil, []string{"fantasy", "gossip"}, nil, nil, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			b := &Book{Tags: c.tags, Genres: c.genres}
+			err := b.normalizeTags()
+			if c.wantErr {
+				if !errors.Is(err, ErrInvalid) {
+					t.Errorf("normalizeTags = %v, want ErrInvalid", err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(b.Tags, c.wantTags) || !reflect.DeepEqual(b.Genres, c.wantGenres) {
+				t.Errorf("normalizeTags = %v, leaving %q and %q; want %q and %q", err, b.Tags, b.Genres, c.wantTags, c.wantGenres)
+			}
+		})
+	}
+}
+
+func TestClassifyCategories(t *testing.T) {
+	for _, c := range []struct {
+		categories   []string
+		genres, tags []string
+	}{
+		{nil, nil, nil},
+		{[]string{"Fiction"}, []string{"fiction"}, nil},
+		{[]string{"Fiction / Fantasy / Epic"}, []string{"fantasy", "fiction"}, nil},
+		{[]string{"Biography & Autobiography"}, []string{"biography"}, nil},
+		{[]string{"Juvenile Fiction / Animals"}, []string{"children"}, nil},
+		{[]string{"Dragons", "Fiction"}, []string{"fiction"}, []string{"dragons"}},
+		{[]string{"Games & Activities / Puzzles"}, nil, []string{"games & activities puzzles"}},
+		{[]string{"Thrillers", "Thriller", "Mystery & Detective"}, []string{"mystery", "thriller"}, nil},
+		{[]string{strings.Repeat("x", maxTagLength+1), " / "}, nil, nil},
+	} {
+		genres, tags := ClassifyCategories(c.categories)
+		if !reflect.DeepEqual(genres, c.genres) || !reflect.DeepEqual(tags, c.tags) {
+			t.Errorf("ClassifyCategories(%q) = %q, %q; want %q, %q", c.categories, genres, tags, c.genres, c.tags)
+		}
+	}
+}
+
+func TestSortRecent(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC) }
+	books := []*Book{
+		{ID: 1, CreatedAt: day(1), UpdatedAt: day(9)},
+		{ID: 2},
+		{ID: 3, CreatedAt: day(3), UpdatedAt: day(3)},
+		{ID: 4, CreatedAt: day(3), UpdatedAt: day(5)},
+	}
+	for _, c := range []struct {
+		order string
+		want  []int64
+	}{
+		{SortNewest, []int64{4, 3, 1, 2}},
+		{SortUpdated, []int64{1, 4, 3, 2}},
+	} {
+		sorted := append([]*Book(nil), books...)
+		SortRecent(sorted, c.order)
+		var got []int64
+		for _, b := range sorted {
+			got = append(got, b.ID)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("SortRecent(%s) ordered %v, want %v", c.order, got, c.want)
+		}
+	}
+}
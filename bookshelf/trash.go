@@ -0,0 +1,56 @@
+package bookshelf
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// DefaultTrashRetention is used when TrashRetention is not set.
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// TrashRetentionPeriod returns how long deleted books are kept, parsed from
+// TrashRetention.
+func TrashRetentionPeriod() (time.Duration, error) {
+	if TrashRetention == "" {
+		return DefaultTrashRetention, nil
+	}
+	d, err := time.ParseDuration(TrashRetention)
+	if err != nil {
+		return 0, fmt.Errorf("invalid TRASH_RETENTION %q: %v", TrashRetention, err)
+	}
+	return d, nil
+}
+
+// DeleteCover removes a cover uploaded to StorageBucket. Covers hosted
+// anywhere else, and books without one, are left alone.
+func DeleteCover(ctx context.Context, imageURL string) error {
+	prefix := fmt.Sprintf("https://storage.googleapis.com/%s/", StorageBucketName)
+	if StorageBucket == nil || !strings.HasPrefix(imageURL, prefix) {
+		return nil
+	}
+	err := StorageBucket.Object(strings.TrimPrefix(imageURL, prefix)).Delete(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+	return err
+}
+
+// PurgeTrash permanently removes the books deleted more than retention ago,
+// along with their covers, and returns how many were removed.
+func PurgeTrash(ctx context.Context, retention time.Duration) (int, error) {
+	books, err := DB.PurgeDeletedBooks(time.Now().Add(-retention), WorkerActor)
+	for _, b := range books {
+		if err := DeleteCover(ctx, b.ImageURL); err != nil {
+			log.Printf("[ID %d] could not delete cover %s: %v", b.ID, b.ImageURL, err)
+		}
+		if err := PublishBookEvent(ctx, BookPurged, b.ID); err != nil {
+			log.Printf("[ID %d] could not publish purge event: %v", b.ID, err)
+		}
+	}
+	return len(books), err
+}
@@ -0,0 +1,486 @@
+package bookshelf
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/gofrs/uuid"
+)
+
+// WebhookTest is the type of the event sent to try a webhook out. It goes
+// to every webhook whatever its events, is attempted once, and does not
+// count against the webhook if it fails.
+const WebhookTest = "webhook.test"
+
+// WebhookEvents are the types of BookEvent a webhook can subscribe to.
+var WebhookEvents = []string{BookCreated, BookUpdated, BookDeleted, BookRestored, BookPurged, BookReviewed, LoanOverdue}
+
+// States of a WebhookDelivery.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// MaxWebhookFailures is how many deliveries to a webhook may fail in a row,
+// each after every retry, before the webhook is disabled.
+const MaxWebhookFailures = 5
+
+// maxWebhookAttempts is how many times a delivery is attempted before it
+// fails. The first retry waits webhookBackoff and each one after twice as
+// long as the last, up to maxWebhookBackoff, so a delivery is given about
+// an hour.
+const (
+	maxWebhookAttempts = 8
+	webhookBackoff     = 30 * time.Second
+	maxWebhookBackoff  = time.Hour
+)
+
+// webhookLease is how long a worker that claimed a delivery has to attempt
+// it before another worker may.
+const webhookLease = 2 * time.Minute
+
+// webhookTimeout bounds an attempt at a delivery.
+const webhookTimeout = 10 * time.Second
+
+// Limits on what a webhook and its deliveries keep, in bytes.
+const (
+	maxWebhookURLLength = 2048
+	minWebhookSecret    = 16
+	maxWebhookSecret    = 255
+	maxWebhookError     = 500
+)
+
+// WebhookDeliveryRetention is how long finished deliveries are kept in the
+// delivery log.
+const WebhookDeliveryRetention = 30 * 24 * time.Hour
+
+// WebhookTolerance is how far from now the timestamp of a delivery may be
+// for VerifyWebhook to accept it.
+const WebhookTolerance = 5 * time.Minute
+
+// Headers sent with every delivery. The signature is that of SignWebhook.
+const (
+	WebhookEventHeader     = "X-Bookshelf-Event"
+	WebhookDeliveryHeader  = "X-Bookshelf-Delivery"
+	WebhookTimestampHeader = "X-Bookshelf-Timestamp"
+	WebhookSignatureHeader = "X-Bookshelf-Signature"
+)
+
+// AllowPrivateWebhooks lets webhooks be delivered to loopback and private
+// addresses, which are otherwise refused as CopyCover refuses them. It is
+// set by WebhookAllowPrivate, and by tests against local receivers such as
+// a webhooktest receiver.
+var AllowPrivateWebhooks = WebhookAllowPrivate == "true"
+
+// Webhook is a URL a user registered to be told of changes to books. Each
+// event it subscribes to is POSTed to it as a WebhookPayload, signed with
+// its secret.
+type Webhook struct {
+	ID int64
+
+	// OwnerID is the profile ID of the user who registered the webhook,
+	// and OwnerName their name when they did.
+	OwnerID   string
+	OwnerName string
+
+	URL string
+
+	// Events are the types of event, from WebhookEvents, the webhook is
+	// sent. Empty means every type.
+	Events []string
+
+	// Secret signs the deliveries, so the receiver can tell they are ours.
+	Secret string
+
+	// Active is cleared by the owner to pause the webhook, or when
+	// MaxWebhookFailures deliveries in a row failed, which also sets
+	// DisabledAt. Failures counts those deliveries.
+	Active     bool
+	Failures   int
+	DisabledAt time.Time
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Wants reports whether w is sent events of eventType.
+func (w *Webhook) Wants(eventType string) bool {
+	if eventType == WebhookTest || len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// NewWebhookSecret returns a random secret for a webhook.
+func NewWebhookSecret() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("webhook: could not make a secret: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// normalize checks a webhook before it is saved, sorting its events and
+// making up a secret if it has none.
+func (w *Webhook) normalize() error {
+	if w.OwnerID == "" {
+		return fmt.Errorf("webhook without an owner: %w", ErrInvalid)
+	}
+	w.URL = strings.TrimSpace(w.URL)
+	if len(w.URL) > maxWebhookURLLength {
+		return fmt.Errorf("webhook URL is longer than %d bytes: %w", maxWebhookURLLength, ErrInvalid)
+	}
+	u, err := url.Parse(w.URL)
+	if err == nil {
+		err = checkWebURL(u)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid webhook URL %q: %v: %w", w.URL, err, ErrInvalid)
+	}
+	seen := make(map[string]bool, len(w.Events))
+	var events []string
+	for _, e := range w.Events {
+		e = strings.TrimSpace(e)
+		if e == "" || seen[e] {
+			continue
+		}
+		known := false
+		for _, k := range WebhookEvents {
+			known = known || e == k
+		}
+		if !known {
+			return fmt.Errorf("unknown webhook event %q: %w", e, ErrInvalid)
+		}
+		seen[e] = true
+		events = append(events, e)
+	}
+	sort.Strings(events)
+	w.Events = events
+	if w.Secret == "" {
+		w.Secret = NewWebhookSecret()
+	}
+	if len(w.Secret) < minWebhookSecret || len(w.Secret) > maxWebhookSecret {
+		return fmt.Errorf("webhook secret is not %d to %d bytes: %w", minWebhookSecret, maxWebhookSecret, ErrInvalid)
+	}
+	return nil
+}
+
+// count counts the outcome of the last attempt at d against w, as
+// RecordWebhookAttempt does, at t.
+func (w *Webhook) count(d *WebhookDelivery, t time.Time) {
+	if d.Event == WebhookTest || !w.Active {
+		return
+	}
+	switch d.Status {
+	case DeliveryDelivered:
+		w.Failures = 0
+	case DeliveryFailed:
+		w.Failures++
+		if w.Failures >= MaxWebhookFailures {
+			w.Active, w.DisabledAt = false, t
+		}
+	}
+}
+
+// WebhookDelivery is an event sent, or to be sent, to a webhook, with how
+// its attempts went. It is retried with backoff while it is pending.
+type WebhookDelivery struct {
+	ID        int64
+	WebhookID int64
+
+	// Event is the type of the event and BookID its book, which is 0 for
+	// a WebhookTest. Payload is the body sent, the same on every attempt.
+	Event   string
+	BookID  int64
+	Payload string
+
+	// Status is DeliveryPending until the delivery succeeds or runs out of
+	// attempts.
+	Status   string
+	Attempts int
+
+	// ResponseCode and Error describe the last attempt. ResponseCode is 0
+	// if no response came.
+	ResponseCode int
+	Error        string
+
+	CreatedAt     time.Time
+	LastAttemptAt time.Time
+
+	// NextAttemptAt is when a pending delivery is due.
+	NextAttemptAt time.Time
+}
+
+// DeliveryQuery selects deliveries for ListWebhookDeliveries. Zero fields
+// select every delivery.
+type DeliveryQuery struct {
+	WebhookID int64
+
+	// DueBy, if set, keeps only the pending deliveries due by then.
+	DueBy time.Time
+
+	// Limit, if positive, keeps only the most recent deliveries.
+	Limit int
+}
+
+// matches reports whether q selects d, for backends that filter in memory.
+func (q DeliveryQuery) matches(d *WebhookDelivery) bool {
+	return (q.WebhookID == 0 || d.WebhookID == q.WebhookID) &&
+		(q.DueBy.IsZero() || d.Status == DeliveryPending && !d.NextAttemptAt.After(q.DueBy))
+}
+
+// sortDeliveries orders deliveries most recent first and applies the limit
+// of q.
+func sortDeliveries(deliveries []*WebhookDelivery, q DeliveryQuery) []*WebhookDelivery {
+	sort.SliceStable(deliveries, func(i, j int) bool { return deliveries[i].ID > deliveries[j].ID })
+	if q.Limit > 0 && len(deliveries) > q.Limit {
+		deliveries = deliveries[:q.Limit]
+	}
+	return deliveries
+}
+
+// webhookRetryDelay is how long to wait before the next attempt at a
+// delivery after its attempts so far failed.
+func webhookRetryDelay(attempts int) time.Duration {
+	if attempts > 8 {
+		return maxWebhookBackoff
+	}
+	if d := webhookBackoff << uint(attempts-1); d < maxWebhookBackoff {
+		return d
+	}
+	return maxWebhookBackoff
+}
+
+// fail records that the attempt at d made at t failed with err, after a
+// response with code if it is not 0, and schedules the next one unless d is
+// out of attempts.
+func (d *WebhookDelivery) fail(t time.Time, code int, err error) {
+	d.ResponseCode, d.Error = code, err.Error()
+	if len(d.Error) > maxWebhookError {
+		d.Error = d.Error[:maxWebhookError]
+	}
+	if d.Event == WebhookTest || d.Attempts >= maxWebhookAttempts {
+		d.Status, d.NextAttemptAt = DeliveryFailed, time.Time{}
+		return
+	}
+	d.NextAttemptAt = t.Add(webhookRetryDelay(d.Attempts))
+}
+
+// WebhookPayload is the JSON body of a delivery. ID is the same on every
+// attempt, and for every delivery of an event redelivered by Pub/Sub, so
+// receivers can tell a retry from a new event.
+type WebhookPayload struct {
+	ID string `json:"id"`
+	BookEvent
+}
+
+// webhookPayloadSpace is the namespace of the name-based IDs of the
+// payloads of events that came from Pub/Sub.
+var webhookPayloadSpace = uuid.Must(uuid.FromString("6f0c2b1e-5d3a-4c8e-9b7f-2a4d6e8c0b13"))
+
+// webhookPayloadID returns the ID of the payload of e to w: made from the
+// message ID and the webhook, when e came from Pub/Sub, and random
+// otherwise.
+func webhookPayloadID(w *Webhook, e BookEvent) string {
+	if e.MessageID == "" {
+		return uuid.Must(uuid.NewV4()).String()
+	}
+	return uuid.NewV5(webhookPayloadSpace, fmt.Sprintf("%s/%d", e.MessageID, w.ID)).String()
+}
+
+// queueWebhook queues a delivery of e to w.
+func queueWebhook(w *Webhook, e BookEvent) (*WebhookDelivery, error) {
+	payload, err := json.Marshal(WebhookPayload{ID: webhookPayloadID(w, e), BookEvent: e})
+	if err != nil {
+		return nil, err
+	}
+	d := &WebhookDelivery{WebhookID: w.ID, Event: e.Type, BookID: e.BookID, Payload: string(payload)}
+	if err := DB.QueueWebhookDelivery(d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// QueueWebhookEvent queues a delivery of e to every active webhook that
+// wants it, and returns them.
+func QueueWebhookEvent(e BookEvent) ([]*WebhookDelivery, error) {
+	if e.Time.IsZero() {
+		e.Time = now()
+	}
+	hooks, err := DB.ListWebhooks("")
+	if err != nil {
+		return nil, err
+	}
+	var deliveries []*WebhookDelivery
+	for _, w := range hooks {
+		if !w.Active || !w.Wants(e.Type) {
+			continue
+		}
+		d, err := queueWebhook(w, e)
+		if err != nil {
+			return deliveries, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+// SendTestWebhook queues a WebhookTest event to w for the worker to
+// deliver.
+func SendTestWebhook(w *Webhook) (*WebhookDelivery, error) {
+	return queueWebhook(w, BookEvent{Type: WebhookTest, Time: now()})
+}
+
+// SignWebhook returns the signature of a delivery of body made at
+// timestamp, in seconds since the Unix epoch: "sha256=" followed by the
+// hex HMAC-SHA256, keyed with secret, of the timestamp, a dot and the
+// body. Signing the timestamp keeps a delivery from being replayed later.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks the signature of a delivery received with header
+// and body, as receivers should, refusing timestamps further than
+// WebhookTolerance from now.
+func VerifyWebhook(secret string, header http.Header, body []byte) error {
+	timestamp, err := strconv.ParseInt(header.Get(WebhookTimestampHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("webhook: invalid timestamp %q", header.Get(WebhookTimestampHeader))
+	}
+	if d := time.Since(time.Unix(timestamp, 0)); d > WebhookTolerance || d < -WebhookTolerance {
+		return fmt.Errorf("webhook: timestamp %d is too far from now", timestamp)
+	}
+	if !hmac.Equal([]byte(header.Get(WebhookSignatureHeader)), []byte(SignWebhook(secret, timestamp, body))) {
+		return errors.New("webhook: signature does not match")
+	}
+	return nil
+}
+
+// webhookClient sends deliveries. Like coverClient it ignores proxy
+// settings and only reaches public addresses, unless AllowPrivateWebhooks
+// is set. Redirects are not followed: a receiver that moved should have
+// its webhook updated.
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: publicAddrControl(&AllowPrivateWebhooks),
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     time.Minute,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// sendWebhook makes one attempt at d to w, returning the status code of
+// the response, if there was one. Any status but 2xx is an error.
+func sendWebhook(ctx context.Context, w *Webhook, d *WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", w.URL, strings.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Bookshelf-Webhooks")
+	req.Header.Set(WebhookEventHeader, d.Event)
+	req.Header.Set(WebhookDeliveryHeader, strconv.FormatInt(d.ID, 10))
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(w.Secret, timestamp, []byte(d.Payload)))
+	resp, err := webhookClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// DeliverWebhook attempts a pending delivery, as ListWebhookDeliveries
+// returned it, and records how that went in d and the database. The
+// delivery is claimed first, so of concurrent workers only one attempts
+// it and the others get ErrNotFound. A delivery to a webhook disabled
+// since it was queued fails without being sent.
+func DeliverWebhook(ctx context.Context, d *WebhookDelivery) error {
+	t := now()
+	if err := DB.ClaimWebhookDelivery(d.ID, d.NextAttemptAt, t.Add(webhookLease)); err != nil {
+		return err
+	}
+	w, err := DB.GetWebhook(d.WebhookID)
+	if err != nil {
+		return err
+	}
+	if !w.Active {
+		d.Status, d.Error, d.NextAttemptAt = DeliveryFailed, "the webhook is disabled", time.Time{}
+	} else {
+		d.Attempts++
+		d.LastAttemptAt = t
+		if code, err := sendWebhook(ctx, w, d); err != nil {
+			d.fail(t, code, err)
+		} else {
+			d.Status, d.ResponseCode, d.Error, d.NextAttemptAt = DeliveryDelivered, code, "", time.Time{}
+		}
+	}
+	active := w.Active
+	if w, err = DB.RecordWebhookAttempt(d); err != nil {
+		return err
+	}
+	if active && !w.Active {
+		log.Printf("[webhook %d] disabled after %d failed deliveries", w.ID, w.Failures)
+	}
+	return nil
+}
+
+// DeliverDueWebhooks attempts the pending deliveries that are due, and
+// returns how many of them were delivered.
+func DeliverDueWebhooks(ctx context.Context) (int, error) {
+	deliveries, err := DB.ListWebhookDeliveries(DeliveryQuery{DueBy: now()})
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, d := range deliveries {
+		if err := DeliverWebhook(ctx, d); err != nil {
+			// Another worker claimed it, or it could not be recorded and
+			// is attempted again once its claim runs out.
+			log.Printf("[webhook %d] could not deliver %d: %v", d.WebhookID, d.ID, err)
+			continue
+		}
+		if d.Status == DeliveryDelivered {
+			n++
+		}
+	}
+	return n, nil
+}
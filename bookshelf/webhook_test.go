@@ -0,0 +1,212 @@
+package bookshelf_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+	"github.com/tony-yang/google-cloud-stack/bookshelf/webhooktest"
+)
+
+// useWebhookReceiver stores books in a fresh in-memory SQLite database and
+// lets webhooks reach a new receiver for the rest of the test.
+func useWebhookReceiver(t *testing.T) *webhooktest.Receiver {
+	savedDB, savedBackend, savedPath, savedPrivate := bookshelf.DB, bookshelf.DBBackend, bookshelf.SQLitePath, bookshelf.AllowPrivateWebhooks
+	bookshelf.DBBackend, bookshelf.SQLitePath, bookshelf.AllowPrivateWebhooks = "sqlite", ":memory:", true
+	if err := bookshelf.ConfigureDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	rc := webhooktest.NewReceiver()
+	t.Cleanup(func() {
+		rc.Close()
+		bookshelf.DB.Close()
+		bookshelf.DB, bookshelf.DBBackend, bookshelf.SQLitePath, bookshelf.AllowPrivateWebhooks = savedDB, savedBackend, savedPath, savedPrivate
+	})
+	return rc
+}
+
+// queueEvent registers a webhook to rc and queues an event to it.
+func queueEvent(t *testing.T, rc *webhooktest.Receiver) (*bookshelf.Webhook, *bookshelf.WebhookDelivery) {
+	w := rc.Webhook("alice")
+	if err := bookshelf.DB.AddWebhook(w); err != nil {
+		t.Fatalf("AddWebhook: %v", err)
+	}
+	deliveries, err := bookshelf.QueueWebhookEvent(bookshelf.BookEvent{Type: bookshelf.BookCreated, BookID: 7})
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("QueueWebhookEvent = %v, %v; want one delivery", deliveries, err)
+	}
+	return w, deliveries[0]
+}
+
+// getDelivery reads delivery id of w back from the database.
+func getDelivery(t *testing.T, w *bookshelf.Webhook, id int64) *bookshelf.WebhookDelivery {
+	deliveries, err := bookshelf.DB.ListWebhookDeliveries(bookshelf.DeliveryQuery{WebhookID: w.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range deliveries {
+		if d.ID == id {
+			return d
+		}
+	}
+	t.Fatalf("delivery %d is missing", id)
+	return nil
+}
+
+func TestWebhookSignature(t *testing.T) {
+	rc := useWebhookReceiver(t)
+	_, d := queueEvent(t, rc)
+	if err := bookshelf.DeliverWebhook(context.Background(), d); err != nil {
+		t.Fatalf("DeliverWebhook: %v", err)
+	}
+	got := rc.Deliveries()
+	if len(got) != 1 {
+		t.Fatalf("the receiver got %d deliveries, want 1", len(got))
+	}
+	r := got[0]
+	if !r.Verified {
+		t.Errorf("the signature %q does not verify", r.Header.Get(bookshelf.WebhookSignatureHeader))
+	}
+	if r.Header.Get(bookshelf.WebhookEventHeader) != bookshelf.BookCreated ||
+		r.Header.Get(bookshelf.WebhookDeliveryHeader) != strconv.FormatInt(d.ID, 10) {
+		t.Errorf("delivered with headers %v, want the event and delivery ID", r.Header)
+	}
+	if r.Payload.Type != bookshelf.BookCreated || r.Payload.BookID != 7 || r.Payload.ID == "" {
+		t.Errorf("delivered %+v, want the event with an ID", r.Payload)
+	}
+
+	timestamp, _ := strconv.ParseInt(r.Header.Get(bookshelf.WebhookTimestampHeader), 10, 64)
+	if want := bookshelf.SignWebhook(rc.Secret, timestamp, r.Body); r.Header.Get(bookshelf.WebhookSignatureHeader) != want {
+		t.Errorf("signature %q, want %q", r.Header.Get(bookshelf.WebhookSignatureHeader), want)
+	}
+	if err := bookshelf.VerifyWebhook("not the secret at all", r.Header, r.Body); err == nil {
+		t.Error("VerifyWebhook accepted the wrong secret")
+	}
+	if err := bookshelf.VerifyWebhook(rc.Secret, r.Header, append(r.Body, ' ')); err == nil {
+		t.Error("VerifyWebhook accepted a changed body")
+	}
+	old := r.Header.Clone()
+	stale := time.Now().Add(-2 * bookshelf.WebhookTolerance).Unix()
+	old.Set(bookshelf.WebhookTimestampHeader, strconv.FormatInt(stale, 10))
+	old.Set(bookshelf.WebhookSignatureHeader, bookshelf.SignWebhook(rc.Secret, stale, r.Body))
+	if err := bookshelf.VerifyWebhook(rc.Secret, old, r.Body); err == nil {
+		t.Error("VerifyWebhook accepted a replayed delivery")
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	rc := useWebhookReceiver(t)
+	rc.Fail(100, http.StatusServiceUnavailable)
+	w, d := queueEvent(t, rc)
+	ctx := context.Background()
+
+	for i, wait := range []time.Duration{
+		30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute,
+		8 * time.Minute, 16 * time.Minute, 32 * time.Minute,
+	} {
+		if err := bookshelf.DeliverWebhook(ctx, d); err != nil {
+			t.Fatalf("attempt %d: DeliverWebhook: %v", i+1, err)
+		}
+		d = getDelivery(t, w, d.ID)
+		if d.Status != bookshelf.DeliveryPending || d.Attempts != i+1 || d.ResponseCode != http.StatusServiceUnavailable {
+			t.Fatalf("after attempt %d: %+v, want it pending after %d attempts", i+1, d, i+1)
+		}
+		if got := d.NextAttemptAt.Sub(d.LastAttemptAt); got != wait {
+			t.Errorf("after attempt %d the next one is due in %v, want %v", i+1, got, wait)
+		}
+	}
+	if err := bookshelf.DeliverWebhook(ctx, d); err != nil {
+		t.Fatalf("last attempt: DeliverWebhook: %v", err)
+	}
+	if d = getDelivery(t, w, d.ID); d.Status != bookshelf.DeliveryFailed || d.Attempts != 8 || !d.NextAttemptAt.IsZero() {
+		t.Errorf("after the last attempt: %+v, want it failed after 8 attempts", d)
+	}
+	if got := len(rc.Deliveries()); got != 8 {
+		t.Errorf("the receiver got %d attempts, want 8", got)
+	}
+	if w, err := bookshelf.DB.GetWebhook(w.ID); err != nil || w.Failures != 1 || !w.Active {
+		t.Errorf("GetWebhook = %+v, %v; want one failure counted", w, err)
+	}
+}
+
+func TestWebhookClaim(t *testing.T) {
+	rc := useWebhookReceiver(t)
+	w, d := queueEvent(t, rc)
+	ctx := context.Background()
+
+	// A second worker holds the delivery as it listed it too.
+	other := *d
+	if err := bookshelf.DeliverWebhook(ctx, d); err != nil {
+		t.Fatalf("DeliverWebhook: %v", err)
+	}
+	if err := bookshelf.DeliverWebhook(ctx, &other); !errors.Is(err, bookshelf.ErrNotFound) {
+		t.Errorf("DeliverWebhook of a claimed delivery = %v, want ErrNotFound", err)
+	}
+	if got := getDelivery(t, w, d.ID); got.Status != bookshelf.DeliveryDelivered || got.Attempts != 1 || got.ResponseCode != http.StatusNoContent {
+		t.Errorf("after delivering: %+v, want it delivered in one attempt", got)
+	}
+
+	// Once acknowledged, it is no longer due.
+	if n, err := bookshelf.DeliverDueWebhooks(ctx); err != nil || n != 0 {
+		t.Errorf("DeliverDueWebhooks = %d, %v; want nothing left to deliver", n, err)
+	}
+	if got := len(rc.Deliveries()); got != 1 {
+		t.Errorf("the receiver got %d deliveries, want 1", got)
+	}
+
+	// A queued delivery is claimed and sent by DeliverDueWebhooks.
+	deliveries, err := bookshelf.QueueWebhookEvent(bookshelf.BookEvent{Type: bookshelf.BookUpdated, BookID: 7})
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("QueueWebhookEvent = %v, %v; want one delivery", deliveries, err)
+	}
+	if n, err := bookshelf.DeliverDueWebhooks(ctx); err != nil || n != 1 {
+		t.Errorf("DeliverDueWebhooks = %d, %v; want 1 delivered", n, err)
+	}
+	if got := getDelivery(t, w, deliveries[0].ID); got.Status != bookshelf.DeliveryDelivered {
+		t.Errorf("after DeliverDueWebhooks: %+v, want it delivered", got)
+	}
+}
+
+func TestWebhookRedeliveredEvent(t *testing.T) {
+	rc := useWebhookReceiver(t)
+	a, b := rc.Webhook("alice"), rc.Webhook("bob")
+	for _, w := range []*bookshelf.Webhook{a, b} {
+		if err := bookshelf.DB.AddWebhook(w); err != nil {
+			t.Fatalf("AddWebhook: %v", err)
+		}
+	}
+	ctx := context.Background()
+	ids := map[int64][]string{}
+	// The second event is Pub/Sub redelivering the first, the third a new
+	// message.
+	for _, msg := range []string{"m1", "m1", "m2"} {
+		e := bookshelf.BookEvent{Type: bookshelf.BookUpdated, BookID: 7, MessageID: msg}
+		deliveries, err := bookshelf.QueueWebhookEvent(e)
+		if err != nil || len(deliveries) != 2 {
+			t.Fatalf("QueueWebhookEvent(%s) = %v, %v; want two deliveries", msg, deliveries, err)
+		}
+		for _, d := range deliveries {
+			if err := bookshelf.DeliverWebhook(ctx, d); err != nil {
+				t.Fatalf("DeliverWebhook: %v", err)
+			}
+			got := rc.Deliveries()
+			ids[d.WebhookID] = append(ids[d.WebhookID], got[len(got)-1].Payload.ID)
+		}
+	}
+	for _, w := range []*bookshelf.Webhook{a, b} {
+		got := ids[w.ID]
+		if got[0] == "" || got[0] != got[1] {
+			t.Errorf("webhook %d was sent the redelivered event as %q and %q, want the same ID", w.ID, got[0], got[1])
+		}
+		if got[2] == got[0] {
+			t.Errorf("webhook %d was sent a new event as %q, the ID of an earlier one", w.ID, got[2])
+		}
+	}
+	if ids[a.ID][0] == ids[b.ID][0] {
+		t.Errorf("both webhooks were sent the event as %q, want an ID for each", ids[a.ID][0])
+	}
+}
@@ -0,0 +1,110 @@
+// Package webhooktest serves a local receiver of webhook deliveries, so
+// what delivers them, such as the worker and the "send test event" button,
+// can be tested without the network.
+package webhooktest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// Delivery is a request the receiver was sent.
+type Delivery struct {
+	Header  http.Header
+	Body    []byte
+	Payload bookshelf.WebhookPayload
+
+	// Verified reports whether the signature of the delivery matched the
+	// receiver's secret, and Status is what the receiver answered.
+	Verified bool
+	Status   int
+}
+
+// Receiver records the deliveries POSTed to it, checking their signatures
+// with its secret. It answers 204 unless told to fail.
+type Receiver struct {
+	*httptest.Server
+
+	// Secret is the secret webhooks delivering to the receiver are
+	// registered with.
+	Secret string
+
+	mu         sync.Mutex
+	deliveries []Delivery
+	failures   int
+	failStatus int
+	received   chan struct{}
+}
+
+// NewReceiver starts a receiver with a new secret. The caller should Close
+// it when done. It listens on a loopback address, so tests delivering to
+// it need bookshelf.AllowPrivateWebhooks set.
+func NewReceiver() *Receiver {
+	rc := &Receiver{Secret: bookshelf.NewWebhookSecret(), received: make(chan struct{}, 100)}
+	rc.Server = httptest.NewServer(http.HandlerFunc(rc.serve))
+	return rc
+}
+
+// Webhook returns a webhook of ownerID that delivers events of the given
+// types, or every type if none are given, to the receiver.
+func (rc *Receiver) Webhook(ownerID string, events ...string) *bookshelf.Webhook {
+	return &bookshelf.Webhook{OwnerID: ownerID, URL: rc.URL, Events: events, Secret: rc.Secret, Active: true}
+}
+
+// Fail makes the receiver answer the next n deliveries with status.
+func (rc *Receiver) Fail(n, status int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.failures, rc.failStatus = n, status
+}
+
+// Deliveries returns the deliveries received so far, oldest first.
+func (rc *Receiver) Deliveries() []Delivery {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]Delivery(nil), rc.deliveries...)
+}
+
+// Received is sent a value for each delivery received, for tests waiting
+// on a worker.
+func (rc *Receiver) Received() <-chan struct{} {
+	return rc.received
+}
+
+func (rc *Receiver) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "deliveries are POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	d := Delivery{
+		Header:   r.Header.Clone(),
+		Body:     body,
+		Verified: bookshelf.VerifyWebhook(rc.Secret, r.Header, body) == nil,
+		Status:   http.StatusNoContent,
+	}
+	json.Unmarshal(body, &d.Payload)
+
+	rc.mu.Lock()
+	if rc.failures > 0 {
+		rc.failures--
+		d.Status = rc.failStatus
+	}
+	rc.deliveries = append(rc.deliveries, d)
+	rc.mu.Unlock()
+
+	w.WriteHeader(d.Status)
+	select {
+	case rc.received <- struct{}{}:
+	default:
+	}
+}
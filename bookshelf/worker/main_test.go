@@ -0,0 +1,22 @@
+package main
+
+import (
+	"log"
+	"os"
+	"testing"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// TestMain runs the tests against an in-memory SQLite database, without
+// the other services.
+func TestMain(m *testing.M) {
+	bookshelf.DBBackend = "sqlite"
+	bookshelf.SQLitePath = ":memory:"
+	if err := bookshelf.ConfigureDatabase(); err != nil {
+		log.Fatal(err)
+	}
+	code := m.Run()
+	bookshelf.DB.Close()
+	os.Exit(code)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/analysis/lang/en"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/highlight/highlighter/html"
+	"github.com/blevesearch/bleve/search/query"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// defaultSearchIndexPath is where the index is kept without
+// SEARCH_INDEX_PATH.
+const defaultSearchIndexPath = "bookshelf.bleve"
+
+// searchBatchSize is how many books a rebuild indexes at a time.
+const searchBatchSize = 500
+
+// searchFacetSize is how many of the most common tags and genres a search
+// counts.
+const searchFacetSize = 10
+
+// minFuzzyLength is the shortest word, in characters, a search matches
+// with a typo. Shorter words would match too many others.
+const minFuzzyLength = 4
+
+// searchFields are the fields a search matches words in, with how much a
+// match in each adds to a book's score.
+var searchFields = []struct {
+	name  string
+	boost float64
+}{
+	{"title", 3},
+	{"author", 2},
+	{"tags", 1.5},
+	{"genres", 1.5},
+	{"description", 1},
+}
+
+// highlightFields are the stored fields search hits carry fragments of.
+var highlightFields = []string{"title", "author", "description"}
+
+// searchIndex is the full-text index of the books outside the trash.
+var searchIndex bleve.Index
+
+// searchMapping analyzes the title, author and description as English,
+// which stems words and drops stop words, and stores them with their term
+// positions for highlighting. Tags and genres are kept whole, so they can
+// be counted as facets and matched as quoted phrases.
+func searchMapping() mapping.IndexMapping {
+	doc := bleve.NewDocumentMapping()
+	for _, name := range highlightFields {
+		f := bleve.NewTextFieldMapping()
+		f.Analyzer = en.AnalyzerName
+		f.Store = true
+		f.IncludeTermVectors = true
+		doc.AddFieldMappingsAt(name, f)
+	}
+	for _, name := range []string{"tags", "genres"} {
+		f := bleve.NewTextFieldMapping()
+		f.Analyzer = keyword.Name
+		doc.AddFieldMappingsAt(name, f)
+	}
+	m := bleve.NewIndexMapping()
+	m.DefaultMapping = doc
+	m.DefaultAnalyzer = en.AnalyzerName
+	return m
+}
+
+// openSearchIndex opens the index at path, creating an empty one if there
+// is none yet, and reports whether it did.
+func openSearchIndex(path string) (idx bleve.Index, created bool, err error) {
+	idx, err = bleve.Open(path)
+	if err == bleve.ErrorIndexPathDoesNotExist {
+		idx, err = bleve.New(path, searchMapping())
+		return idx, true, err
+	}
+	return idx, false, err
+}
+
+// searchDocument is what the index holds for a book.
+func searchDocument(b *bookshelf.Book) map[string]interface{} {
+	return map[string]interface{}{
+		"title":       b.Title,
+		"author":      b.Author,
+		"description": b.Description,
+		"tags":        b.Tags,
+		"genres":      b.Genres,
+	}
+}
+
+func searchID(bookID int64) string {
+	return strconv.FormatInt(bookID, 10)
+}
+
+// rebuildSearchIndex indexes every book outside the trash in idx, which
+// should be empty.
+func rebuildSearchIndex(idx bleve.Index) error {
+	books, err := bookshelf.DB.FilterBooks(bookshelf.BookFilter{})
+	if err != nil {
+		return err
+	}
+	batch := idx.NewBatch()
+	for _, b := range books {
+		if err := batch.Index(searchID(b.ID), searchDocument(b)); err != nil {
+			return err
+		}
+		if batch.Size() >= searchBatchSize {
+			if err := idx.Batch(batch); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := idx.Batch(batch); err != nil {
+		return err
+	}
+	log.Printf("indexed %d books for search", len(books))
+	return nil
+}
+
+// setUpSearch opens the index at SearchIndexPath, first removing it if
+// reindex is set, and fills it from the database if it was just created.
+func setUpSearch(reindex bool) error {
+	path := bookshelf.SearchIndexPath
+	if path == "" {
+		path = defaultSearchIndexPath
+	}
+	if reindex {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	idx, created, err := openSearchIndex(path)
+	if err != nil {
+		return err
+	}
+	if created {
+		if err := rebuildSearchIndex(idx); err != nil {
+			idx.Close()
+			os.RemoveAll(path)
+			return err
+		}
+	}
+	searchIndex = idx
+	return nil
+}
+
+// indexBookEvents keeps the index up to date as books change. Books that
+// are gone or in the trash are removed from it. Each worker keeps its own
+// index, so it needs its own subscription, which expires a day after the
+// worker goes away.
+func indexBookEvents() {
+	host, err := os.Hostname()
+	if err != nil {
+		log.Printf("could not subscribe to book events: %v", err)
+		return
+	}
+	subID := "book-events-search-" + host
+	err = bookshelf.SubscribeBookEvents(context.Background(), subID, 24*time.Hour,
+		func(ctx context.Context, e bookshelf.BookEvent) error {
+			if e.Type == bookshelf.LoanOverdue {
+				return nil
+			}
+			// A replica may not have the change yet.
+			book, err := bookshelf.ReadPrimary(bookshelf.DB).GetBook(e.BookID)
+			if errors.Is(err, bookshelf.ErrNotFound) {
+				return searchIndex.Delete(searchID(e.BookID))
+			} else if err != nil {
+				return err
+			}
+			return searchIndex.Index(searchID(book.ID), searchDocument(book))
+		})
+	log.Printf("book event subscription %s stopped: %v", subID, err)
+}
+
+// splitQuery splits the text of a search into its quoted phrases and the
+// words outside them. An unclosed quote runs to the end of the text.
+func splitQuery(text string) (phrases, words []string) {
+	for i, part := range strings.Split(text, `"`) {
+		if i%2 == 0 {
+			words = append(words, strings.Fields(part)...)
+		} else if p := strings.TrimSpace(part); p != "" {
+			phrases = append(phrases, p)
+		}
+	}
+	return phrases, words
+}
+
+// wordQuery matches a word in any of the searchFields, and, if it is long
+// enough, with a typo at a lower score.
+func wordQuery(word string) query.Query {
+	var qs []query.Query
+	for _, f := range searchFields {
+		q := bleve.NewMatchQuery(word)
+		q.SetField(f.name)
+		q.SetBoost(f.boost)
+		qs = append(qs, q)
+		if utf8.RuneCountInString(word) >= minFuzzyLength {
+			fq := bleve.NewMatchQuery(word)
+			fq.SetField(f.name)
+			fq.SetBoost(f.boost / 2)
+			fq.SetFuzziness(1)
+			qs = append(qs, fq)
+		}
+	}
+	return bleve.NewDisjunctionQuery(qs...)
+}
+
+// phraseQuery matches a phrase in any of the searchFields.
+func phraseQuery(phrase string) query.Query {
+	var qs []query.Query
+	for _, f := range searchFields {
+		q := bleve.NewMatchPhraseQuery(phrase)
+		q.SetField(f.name)
+		q.SetBoost(f.boost)
+		qs = append(qs, q)
+	}
+	return bleve.NewDisjunctionQuery(qs...)
+}
+
+// searchRequest turns q into a request for the index. Books must match
+// every phrase, tag and genre of q, and at least one of its words if it
+// has no phrases; the more words they match, the higher they rank.
+func searchRequest(q bookshelf.SearchQuery) *bleve.SearchRequest {
+	phrases, words := splitQuery(strings.ToLower(q.Text))
+	var must, should []query.Query
+	for _, p := range phrases {
+		must = append(must, phraseQuery(p))
+	}
+	for _, w := range words {
+		should = append(should, wordQuery(w))
+	}
+	for _, t := range []struct{ field, tag string }{{"tags", q.Tag}, {"genres", q.Genre}} {
+		if tag := bookshelf.NormalizeTag(t.tag); tag != "" {
+			tq := bleve.NewTermQuery(tag)
+			tq.SetField(t.field)
+			must = append(must, tq)
+		}
+	}
+	var bq query.Query = bleve.NewMatchAllQuery()
+	if len(must) > 0 || len(should) > 0 {
+		b := bleve.NewBooleanQuery()
+		b.AddMust(must...)
+		b.AddShould(should...)
+		// Alongside a tag or genre, words would otherwise only add to
+		// the score.
+		if len(phrases) == 0 && len(should) > 0 {
+			b.SetMinShould(1)
+		}
+		bq = b
+	}
+
+	req := bleve.NewSearchRequestOptions(bq, q.Size, q.From, false)
+	req.Fields = []string{"title", "author"}
+	req.Highlight = bleve.NewHighlightWithStyle(html.Name)
+	for _, f := range highlightFields {
+		req.Highlight.AddField(f)
+	}
+	req.AddFacet("tags", bleve.NewFacetRequest("tags", searchFacetSize))
+	req.AddFacet("genres", bleve.NewFacetRequest("genres", searchFacetSize))
+	return req
+}
+
+// facetCounts lists the terms of a facet with their counts.
+func facetCounts(f *search.FacetResult) []bookshelf.TagCount {
+	if f == nil {
+		return nil
+	}
+	counts := make([]bookshelf.TagCount, len(f.Terms))
+	for i, t := range f.Terms {
+		counts[i] = bookshelf.TagCount{Tag: t.Term, Count: t.Count}
+	}
+	return counts
+}
+
+// runSearch answers q from the index.
+func runSearch(q bookshelf.SearchQuery) (*bookshelf.SearchResults, error) {
+	res, err := searchIndex.Search(searchRequest(q))
+	if err != nil {
+		return nil, err
+	}
+	results := &bookshelf.SearchResults{
+		Total:  int(res.Total),
+		Hits:   []bookshelf.SearchHit{},
+		Tags:   facetCounts(res.Facets["tags"]),
+		Genres: facetCounts(res.Facets["genres"]),
+	}
+	for _, h := range res.Hits {
+		id, err := strconv.ParseInt(h.ID, 10, 64)
+		if err != nil {
+			continue
+		}
+		title, _ := h.Fields["title"].(string)
+		author, _ := h.Fields["author"].(string)
+		results.Hits = append(results.Hits, bookshelf.SearchHit{
+			BookID:    id,
+			Score:     h.Score,
+			Title:     title,
+			Author:    author,
+			Fragments: h.Fragments,
+		})
+	}
+	return results, nil
+}
+
+// searchHandler answers the searches the app sends, as SearchResults in
+// JSON.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := bookshelf.ParseSearchQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	results, err := runSearch(q)
+	if err != nil {
+		log.Printf("could not search for %q: %v", q.Text, err)
+		http.Error(w, "search failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		log.Printf("could not encode search results: %v", err)
+	}
+}
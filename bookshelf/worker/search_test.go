@@ -0,0 +1,147 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// searchBooks are indexed by useSearchIndex.
+var searchBooks = []*bookshelf.Book{
+	{ID: 1, Title: "The Hobbit", Author: "J. R. R. Tolkien", Description: "A hobbit is swept into a quest to take back a treasure guarded by a dragon.", Tags: []string{"classic"}, Genres: []string{"fantasy"}},
+	{ID: 2, Title: "Dragons of Autumn Twilight", Author: "Margaret Weis", Genres: []string{"fantasy"}},
+	{ID: 3, Title: "The Hobbit Companion", Author: "David Day", Description: "A guide to the world of Bilbo Baggins."},
+	{ID: 4, Title: "Dune", Author: "Frank Herbert", Description: "Politics and prophecy on a desert planet.", Tags: []string{"classic"}, Genres: []string{"science fiction"}},
+	{ID: 5, Title: "Cooking for Hobbits", Author: "Tolkien Fan", Tags: []string{"recipes"}, Genres: []string{"cooking"}},
+}
+
+// useSearchIndex searches an in-memory index of searchBooks for the rest
+// of the test.
+func useSearchIndex(t *testing.T) {
+	idx, err := bleve.NewMemOnly(searchMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range searchBooks {
+		if err := idx.Index(searchID(b.ID), searchDocument(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved := searchIndex
+	searchIndex = idx
+	t.Cleanup(func() {
+		searchIndex = saved
+		idx.Close()
+	})
+}
+
+func TestSplitQuery(t *testing.T) {
+	for _, c := range []struct {
+		text           string
+		phrases, words []string
+	}{
+		{"", nil, nil},
+		{"hobbit  dragon", nil, []string{"hobbit", "dragon"}},
+		{`"the hobbit" dragon`, []string{"the hobbit"}, []string{"dragon"}},
+		{`dragon "bilbo baggins" tolkien "lonely mountain"`, []string{"bilbo baggins", "lonely mountain"}, []string{"dragon", "tolkien"}},
+		{`"" dune`, nil, []string{"dune"}},
+		{`dune "desert planet`, []string{"desert planet"}, []string{"dune"}},
+	} {
+		phrases, words := splitQuery(c.text)
+		if !reflect.DeepEqual(phrases, c.phrases) || !reflect.DeepEqual(words, c.words) {
+			t.Errorf("splitQuery(%q) = %q, %q; want %q, %q", c.text, phrases, words, c.phrases, c.words)
+		}
+	}
+}
+
+func TestRunSearch(t *testing.T) {
+	useSearchIndex(t)
+	for _, c := range []struct {
+		name string
+		q    bookshelf.SearchQuery
+		want []int64
+	}{
+		{"everything", bookshelf.SearchQuery{}, []int64{1, 2, 3, 4, 5}},
+		{"title ranks above description", bookshelf.SearchQuery{Text: "dragon"}, []int64{2, 1}},
+		{"stemmed", bookshelf.SearchQuery{Text: "hobbits"}, []int64{1, 3, 5}},
+		{"typo", bookshelf.SearchQuery{Text: "herbrt"}, []int64{4}},
+		{"no typo in short words", bookshelf.SearchQuery{Text: "dun"}, nil},
+		{"more words rank higher", bookshelf.SearchQuery{Text: "hobbit companion"}, []int64{3, 1, 5}},
+		{"phrase", bookshelf.SearchQuery{Text: `"bilbo baggins"`}, []int64{3}},
+		{"phrase word for word", bookshelf.SearchQuery{Text: `"baggins bilbo"`}, nil},
+		{"phrase and word", bookshelf.SearchQuery{Text: `"hobbit companion" tolkien`}, []int64{3}},
+		{"tag", bookshelf.SearchQuery{Tag: "Classic"}, []int64{1, 4}},
+		{"genre and word", bookshelf.SearchQuery{Text: "tolkien", Genre: "fantasy"}, []int64{1}},
+		{"genre and words", bookshelf.SearchQuery{Text: "dragon twilight", Genre: "Fantasy"}, []int64{2, 1}},
+		{"tag as a phrase", bookshelf.SearchQuery{Text: `"science fiction"`}, []int64{4}},
+		{"no match", bookshelf.SearchQuery{Text: "zeppelin"}, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			c.q.Size = bookshelf.DefaultSearchSize
+			results, err := runSearch(c.q)
+			if err != nil {
+				t.Fatalf("runSearch: %v", err)
+			}
+			var got []int64
+			for _, h := range results.Hits {
+				got = append(got, h.BookID)
+			}
+			if c.q.Text == "" {
+				// Without words to score, the order is the index's.
+				got = sortedIDs(got)
+			}
+			if !reflect.DeepEqual(got, c.want) || results.Total != len(c.want) {
+				t.Errorf("runSearch(%+v) = %d hits %v, want %v", c.q, results.Total, got, c.want)
+			}
+		})
+	}
+}
+
+func TestRunSearchPagesAndFacets(t *testing.T) {
+	useSearchIndex(t)
+	all, err := runSearch(bookshelf.SearchQuery{Text: "hobbit", Size: bookshelf.DefaultSearchSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := runSearch(bookshelf.SearchQuery{Text: "hobbit", From: 1, Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != all.Total || len(page.Hits) != 1 || page.Hits[0].BookID != all.Hits[1].BookID {
+		t.Errorf("the second page of one = %+v, want the second of %+v", page, all.Hits)
+	}
+
+	wantGenres := []bookshelf.TagCount{{Tag: "cooking", Count: 1}, {Tag: "fantasy", Count: 1}}
+	wantTags := []bookshelf.TagCount{{Tag: "classic", Count: 1}, {Tag: "recipes", Count: 1}}
+	if !reflect.DeepEqual(sortedCounts(all.Genres), wantGenres) || !reflect.DeepEqual(sortedCounts(all.Tags), wantTags) {
+		t.Errorf("facets %v and %v, want %v and %v", all.Tags, all.Genres, wantTags, wantGenres)
+	}
+
+	hit := all.Hits[0]
+	if hit.BookID != 1 || hit.Title != "The Hobbit" || hit.Author != "J. R. R. Tolkien" {
+		t.Fatalf("the first hit is %+v, want The Hobbit with its title and author", hit)
+	}
+	for _, field := range []string{"title", "description"} {
+		if f := hit.Fragments[field]; len(f) == 0 || !strings.Contains(strings.ToLower(f[0]), "<mark>hobbit</mark>") {
+			t.Errorf("the %s fragments %q do not mark the match", field, f)
+		}
+	}
+}
+
+// sortedIDs sorts ids and returns them.
+func sortedIDs(ids []int64) []int64 {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// sortedCounts orders facet counts by tag, as facets with the same count
+// come in no set order.
+func sortedCounts(counts []bookshelf.TagCount) []bookshelf.TagCount {
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Tag < counts[j].Tag })
+	return counts
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// webhookSubName is the subscription to book events the workers share to
+// queue webhook deliveries, so each event is queued once.
+const webhookSubName = "webhook-worker-sub"
+
+// webhookPollInterval is how often deliveries due for a retry, and test
+// events queued by the app, are attempted.
+const webhookPollInterval = 15 * time.Second
+
+// webhookPruneInterval is how often deliveries older than
+// bookshelf.WebhookDeliveryRetention are removed from the delivery log.
+const webhookPruneInterval = time.Hour
+
+// queueWebhookEvents queues a delivery of each book event to the webhooks
+// that want it and attempts them straight away. Those that fail are
+// retried by deliverWebhooks.
+func queueWebhookEvents() {
+	err := bookshelf.SubscribeBookEvents(context.Background(), webhookSubName, 0,
+		func(ctx context.Context, e bookshelf.BookEvent) error {
+			deliveries, err := bookshelf.QueueWebhookEvent(e)
+			if len(deliveries) > 0 {
+				go func() {
+					for _, d := range deliveries {
+						if err := bookshelf.DeliverWebhook(context.Background(), d); err != nil {
+							log.Printf("[webhook %d] could not deliver %d: %v", d.WebhookID, d.ID, err)
+						}
+					}
+				}()
+			}
+			// Events are redelivered if queueing fails part way, so some
+			// webhooks may be sent an event twice. The payload ID comes
+			// from the message ID, so both carry the same one.
+			return err
+		})
+	log.Printf("book event subscription %s stopped: %v", webhookSubName, err)
+}
+
+// deliverWebhooks attempts the deliveries that are due every
+// webhookPollInterval.
+func deliverWebhooks() {
+	ctx := context.Background()
+	for {
+		n, err := bookshelf.DeliverDueWebhooks(ctx)
+		if err != nil {
+			log.Printf("could not deliver webhooks: %v", err)
+		}
+		if n > 0 {
+			log.Printf("delivered %d webhook events", n)
+		}
+		time.Sleep(webhookPollInterval)
+	}
+}
+
+// pruneWebhookDeliveries removes old deliveries from the delivery log
+// every webhookPruneInterval.
+func pruneWebhookDeliveries() {
+	for {
+		n, err := bookshelf.DB.PurgeWebhookDeliveries(time.Now().Add(-bookshelf.WebhookDeliveryRetention))
+		if err != nil {
+			log.Printf("could not prune webhook deliveries: %v", err)
+		}
+		if n > 0 {
+			log.Printf("pruned %d webhook deliveries older than %v", n, bookshelf.WebhookDeliveryRetention)
+		}
+		time.Sleep(webhookPruneInterval)
+	}
+}
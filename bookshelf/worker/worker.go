@@ -4,11 +4,14 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"sync"
+	"time"
 
 	"cloud.google.com/go/pubsub"
 
@@ -21,17 +24,93 @@ var (
 	subscription *pubsub.Subscription
 )
 
-const subName = "book-worker-sub"
+const (
+	subName       = "book-worker-sub"
+	importSubName = "import-worker-sub"
+)
+
+// trashPurgeInterval is how often books past the trash retention period are
+// purged.
+const trashPurgeInterval = time.Hour
+
+// overdueCheckInterval is how often open loans are checked against their
+// due dates.
+const overdueCheckInterval = time.Hour
 
-// update retrieves book info and updates the database with details.
-// This is a mocked function to simulate actual service call for demo only.
-func update(bookID int64) error {
-	book, err := bookshelf.DB.GetBook(bookID)
+// update retrieves book info and updates the database with details. For
+// now these are its description, published date and cover from the
+// metadata provider and the genres and tags its categories suggest, each
+// filled in only where the book has none, so the worker never overrides a
+// user's choice. Books without an ISBN cannot be looked up. The book is
+// read from the primary, where a book just added is sure to be found.
+// update reports whether it saved the book, which it only does when it
+// filled something in.
+func update(ctx context.Context, bookID int64) (bool, error) {
+	db := bookshelf.ReadPrimary(bookshelf.DB)
+	book, err := db.GetBook(bookID)
 	if err != nil {
-		return err
+		return false, err
+	}
+	if book.ISBN13 == "" || len(book.Genres) > 0 && len(book.Tags) > 0 &&
+		book.Description != "" && book.PublishedDate != "" && book.ImageURL != "" {
+		return false, nil
+	}
+	md, err := bookshelf.LookupMetadata(ctx, book.ISBN13)
+	if errors.Is(err, bookshelf.ErrNotFound) {
+		log.Printf("[ID %d] no metadata: %v", bookID, err)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	var imageURL string
+	if book.ImageURL == "" && md.CoverURL != "" {
+		if imageURL, err = bookshelf.CopyCover(ctx, md.CoverURL); err != nil {
+			log.Printf("[ID %d] could not copy cover: %v", bookID, err)
+		}
+	}
+	// The lookup and copying the cover take a while, so read the book again
+	// rather than undo what a user saved meanwhile.
+	isbn13 := book.ISBN13
+	if book, err = db.GetBook(bookID); err != nil {
+		bookshelf.DeleteCover(ctx, imageURL)
+		return false, err
+	}
+	if book.ISBN13 != isbn13 {
+		log.Printf("[ID %d] ISBN changed from %s during lookup", bookID, isbn13)
+		bookshelf.DeleteCover(ctx, imageURL)
+		return false, nil
 	}
-	book.Title = "Updated " + book.Title
-	return bookshelf.DB.UpdateBook(book)
+	filled := false
+	if imageURL != "" {
+		if book.ImageURL == "" {
+			book.ImageURL, filled = imageURL, true
+		} else if err := bookshelf.DeleteCover(ctx, imageURL); err != nil {
+			log.Printf("[ID %d] could not delete unused cover %s: %v", bookID, imageURL, err)
+		}
+	}
+	genres, tags := bookshelf.ClassifyCategories(md.Categories)
+	if len(book.Genres) == 0 && len(genres) > 0 {
+		book.Genres, filled = genres, true
+	}
+	if len(book.Tags) == 0 && len(tags) > 0 {
+		book.Tags, filled = tags, true
+	}
+	if book.Description == "" && md.Description != "" {
+		book.Description, filled = md.Description, true
+	}
+	if book.PublishedDate == "" && md.PublishedDate != "" {
+		book.PublishedDate, filled = md.PublishedDate, true
+	}
+	if !filled {
+		return false, nil
+	}
+	if err := bookshelf.DB.UpdateBook(book, bookshelf.WorkerActor); err != nil {
+		if book.ImageURL == imageURL {
+			bookshelf.DeleteCover(ctx, imageURL)
+		}
+		return false, err
+	}
+	return true, nil
 }
 
 func subscribe() {
@@ -44,11 +123,24 @@ func subscribe() {
 			return
 		}
 		log.Printf("[ID %d] Processing.", id)
-		if err := update(id); err != nil {
+		updated, err := update(ctx, id)
+		if err != nil {
+			// A missing book or a rejected update will fail the same way
+			// on every retry, so drop the message instead of redelivering.
+			if errors.Is(err, bookshelf.ErrNotFound) || errors.Is(err, bookshelf.ErrInvalid) {
+				log.Printf("[ID %d] dropping update: %v", id, err)
+				msg.Ack()
+				return
+			}
 			log.Printf("[ID %d] could not update: %v", id, err)
 			msg.Nack()
 			return
 		}
+		if updated {
+			if err := bookshelf.PublishBookEvent(ctx, bookshelf.BookUpdated, id); err != nil {
+				log.Printf("[ID %d] could not publish update event: %v", id, err)
+			}
+		}
 		countMu.Lock()
 		count++
 		countMu.Unlock()
@@ -60,8 +152,92 @@ func subscribe() {
 	}
 }
 
+// subscribeImports runs the CSV imports queued by the app. An import is not
+// retried once it has started, since that would add its books twice; its
+// report says how far it got.
+func subscribeImports(sub *pubsub.Subscription) {
+	ctx := context.Background()
+	err := sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		var job bookshelf.ImportJob
+		if err := json.Unmarshal(msg.Data, &job); err != nil {
+			log.Printf("could not decode import job: %#v", msg)
+			msg.Ack()
+			return
+		}
+		log.Printf("[import %s] Processing.", job.ID)
+		report, err := bookshelf.RunImportJob(ctx, job)
+		if report == nil {
+			// The file could not be read, so nothing was imported yet.
+			log.Printf("[import %s] could not start: %v", job.ID, err)
+			msg.Nack()
+			return
+		}
+		if err != nil {
+			log.Printf("[import %s] stopped: %v", job.ID, err)
+		}
+		log.Printf("[import %s] read %d rows, added %d, %d failed", job.ID, report.Rows, report.Added, report.Failed)
+		msg.Ack()
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// ensureSubscription returns the named subscription to topic, creating it
+// if it doesn't exist yet.
+func ensureSubscription(ctx context.Context, name string, topic *pubsub.Topic) (*pubsub.Subscription, error) {
+	sub := bookshelf.PubsubClient.Subscription(name)
+	exists, err := sub.Exists(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error checking for subscription %s: %v", name, err)
+	}
+	if !exists {
+		if _, err = bookshelf.PubsubClient.CreateSubscription(ctx, name, pubsub.SubscriptionConfig{Topic: topic}); err != nil {
+			return nil, fmt.Errorf("failed to create subscription %s: %v", name, err)
+		}
+	}
+	return sub, nil
+}
+
+// purgeTrash permanently removes books that have been in the trash for
+// longer than retention, along with their covers, every trashPurgeInterval.
+func purgeTrash(retention time.Duration) {
+	ctx := context.Background()
+	for {
+		n, err := bookshelf.PurgeTrash(ctx, retention)
+		if err != nil {
+			log.Printf("could not purge trash: %v", err)
+		}
+		if n > 0 {
+			log.Printf("purged %d books deleted more than %v ago", n, retention)
+		}
+		time.Sleep(trashPurgeInterval)
+	}
+}
+
+// markOverdue flags the loans past their due date every
+// overdueCheckInterval.
+func markOverdue() {
+	ctx := context.Background()
+	for {
+		n, err := bookshelf.MarkOverdueLoans(ctx)
+		if err != nil {
+			log.Printf("could not check for overdue loans: %v", err)
+		}
+		if n > 0 {
+			log.Printf("marked %d loans overdue", n)
+		}
+		time.Sleep(overdueCheckInterval)
+	}
+}
+
 func main() {
+	reindex := flag.Bool("reindex", false, "rebuild the search index from the database before starting")
+	flag.Parse()
 	ctx := context.Background()
+	if err := bookshelf.Configure(); err != nil {
+		log.Fatal(err)
+	}
 	if bookshelf.PubsubClient == nil {
 		log.Fatal("Configure the Pub/Sub client")
 	}
@@ -78,20 +254,33 @@ func main() {
 		}
 	}
 
-	// Create topic subscription if it doesn't yet exist
-	subscription = bookshelf.PubsubClient.Subscription(subName)
-	exists, err = subscription.Exists(ctx)
+	// Create topic subscriptions if they don't yet exist
+	subscription, err = ensureSubscription(ctx, subName, topic)
 	if err != nil {
-		log.Fatalf("Error checking for subscription: %v", err)
+		log.Fatal(err)
 	}
-	if !exists {
-		if _, err = bookshelf.PubsubClient.CreateSubscription(ctx, subName, pubsub.SubscriptionConfig{Topic: topic}); err != nil {
-			log.Fatalf("Failed to create subscription: %v", err)
-		}
+	importSub, err := ensureSubscription(ctx, importSubName, bookshelf.PubsubClient.Topic(bookshelf.PubsubImportTopicID))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	retention, err := bookshelf.TrashRetentionPeriod()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := setUpSearch(*reindex); err != nil {
+		log.Fatalf("Could not set up the search index: %v", err)
 	}
 
-	// Start worker goroutine
+	// Start worker goroutines
 	go subscribe()
+	go subscribeImports(importSub)
+	go purgeTrash(retention)
+	go markOverdue()
+	go indexBookEvents()
+	go queueWebhookEvents()
+	go deliverWebhooks()
+	go pruneWebhookDeliveries()
 
 	// Publish a count of processed request to the server homepage
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -99,6 +288,7 @@ func main() {
 		defer countMu.Unlock()
 		fmt.Fprintf(w, "This worker has processed %d books.", count)
 	})
+	http.HandleFunc("/search", searchHandler)
 
 	port := "8080"
 	if p := os.Getenv("PORT"); p != "" {
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tony-yang/google-cloud-stack/bookshelf"
+)
+
+// editingProvider knows every book as md, and runs edit during each
+// lookup, as a user saving the book while the worker waits.
+type editingProvider struct {
+	md   bookshelf.Metadata
+	edit func()
+}
+
+func (p *editingProvider) Lookup(ctx context.Context, isbn13 string) (*bookshelf.Metadata, error) {
+	p.edit()
+	md := p.md
+	return &md, nil
+}
+
+func (p *editingProvider) Search(ctx context.Context, kind, query string, limit int) ([]*bookshelf.Metadata, error) {
+	return nil, nil
+}
+
+// useProvider looks books up with p for the rest of the test.
+func useProvider(t *testing.T, p bookshelf.MetadataProvider) {
+	saved := bookshelf.MetadataSource
+	bookshelf.MetadataSource = p
+	t.Cleanup(func() { bookshelf.MetadataSource = saved })
+}
+
+func TestUpdateKeepsEditsMadeDuringLookup(t *testing.T) {
+	by := bookshelf.Actor{ID: "alice", Name: "Alice", Source: bookshelf.SourceHTML}
+	id, err := bookshelf.DB.AddBook(&bookshelf.Book{Title: "dune", ISBN13: "9780441172719"}, by)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useProvider(t, &editingProvider{
+		md: bookshelf.Metadata{Title: "Dune", Description: "Arrakis.", PublishedDate: "1965"},
+		edit: func() {
+			b := &bookshelf.Book{ID: id, Title: "Dune", PublishedDate: "1965-08-01", ISBN13: "9780441172719"}
+			if err := bookshelf.DB.UpdateBook(b, by); err != nil {
+				t.Fatal(err)
+			}
+		},
+	})
+
+	if updated, err := update(context.Background(), id); err != nil || !updated {
+		t.Fatalf("update(%d) = %v, %v; want the book updated", id, updated, err)
+	}
+	b, err := bookshelf.DB.GetBook(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Title != "Dune" || b.PublishedDate != "1965-08-01" {
+		t.Errorf("update(%d) saved %+v, want the user's title and date kept", id, b)
+	}
+	if b.Description != "Arrakis." {
+		t.Errorf("update(%d) saved description %q, want the provider's", id, b.Description)
+	}
+}
+
+func TestUpdateDropsLookupOfChangedISBN(t *testing.T) {
+	by := bookshelf.Actor{ID: "alice", Name: "Alice", Source: bookshelf.SourceHTML}
+	id, err := bookshelf.DB.AddBook(&bookshelf.Book{Title: "The Hobbit", ISBN13: "9780261103344"}, by)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useProvider(t, &editingProvider{
+		md: bookshelf.Metadata{Title: "The Hobbit", Description: "Of the 1937 edition."},
+		edit: func() {
+			b := &bookshelf.Book{ID: id, Title: "The Hobbit", ISBN13: "9780547928227"}
+			if err := bookshelf.DB.UpdateBook(b, by); err != nil {
+				t.Fatal(err)
+			}
+		},
+	})
+
+	if updated, err := update(context.Background(), id); err != nil || updated {
+		t.Fatalf("update(%d) = %v, %v; want nothing updated", id, updated, err)
+	}
+	if b, err := bookshelf.DB.GetBook(id); err != nil || b.Description != "" {
+		t.Errorf("update(%d) = %v, %v, want the lookup of the old ISBN dropped", id, b, err)
+	}
+}
+
+func TestUpdateReportsWhetherItSaved(t *testing.T) {
+	by := bookshelf.Actor{ID: "alice", Name: "Alice", Source: bookshelf.SourceHTML}
+	useProvider(t, &editingProvider{
+		md:   bookshelf.Metadata{Title: "Emma", Description: "Of Highbury."},
+		edit: func() {},
+	})
+	for _, c := range []struct {
+		name string
+		book *bookshelf.Book
+		want bool
+	}{
+		{"no ISBN", &bookshelf.Book{Title: "Persuasion"}, false},
+		{"nothing to fill", &bookshelf.Book{Title: "Emma", ISBN13: "9780141439587", Description: "Mine."}, false},
+		{"description filled", &bookshelf.Book{Title: "Emma", ISBN13: "9780141439587"}, true},
+	} {
+		id, err := bookshelf.DB.AddBook(c.book, by)
+		if err != nil {
+			t.Fatalf("%s: AddBook: %v", c.name, err)
+		}
+		if updated, err := update(context.Background(), id); err != nil || updated != c.want {
+			t.Errorf("%s: update(%d) = %v, %v; want %v", c.name, id, updated, err, c.want)
+		}
+		bookshelf.DB.DeleteBook(id, by)
+		bookshelf.DB.PurgeBook(id, by)
+	}
+}